@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// API key errors
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid, expired or revoked api key")
+	ErrInvalidScope   = errors.New("invalid api key scope")
+)
+
+// APIKeyPrefix can/should be set by applications using auth.
+// Every key starts with it so keys are easy to recognize, i.e. by secret scanners.
+var APIKeyPrefix = "ak_"
+
+// APIKeyScopes can/should be set by applications using auth.
+// When it is not empty only these scopes can be given to a key; otherwise any scope without commas or spaces can.
+var APIKeyScopes []string
+
+// apiKeyLastUsedInterval is how stale LastUsedAt can get before a request updates it
+const apiKeyLastUsedInterval = time.Minute
+
+// Scopes are what an API key may be used for. The application decides what each scope allows.
+type Scopes []string
+
+// Value implements driver.Valuer
+func (s Scopes) Value() (driver.Value, error) {
+	return strings.Join(s, ","), nil
+}
+
+// Scan implements sql.Scanner
+func (s *Scopes) Scan(src interface{}) error {
+	var str string
+	switch v := src.(type) {
+	case []byte:
+		str = string(v)
+	case string:
+		str = v
+	case nil:
+	default:
+		return errors.New("auth: cannot scan scopes")
+	}
+	*s = Scopes{}
+	for _, v := range strings.Split(str, ",") {
+		if len(v) > 0 {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+// Has reports whether scope is in s
+func (s Scopes) Has(scope string) bool {
+	for _, v := range s {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey lets CLI tools and other programs act as a user without logging in.
+// The key itself is only returned by CreateAPIKey; it is stored as the SHA-256 hash of its secret part.
+type APIKey struct {
+	ID     uuid.UUID `db:"id" json:"id"`
+	UserID uuid.UUID `db:"user_id" json:"user_id"`
+	Name   string    `db:"name" json:"name"`
+	// Prefix is the start of the key, up to its secret. It identifies the key in lists.
+	Prefix string `db:"prefix" json:"prefix"`
+	Hash   string `db:"hash" json:"-"`
+	Scopes Scopes `db:"scopes" json:"scopes"`
+	// ExpiresAt is the zero time for a key that doesn't expire
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+	// LastUsedAt is updated at most once a minute; it is the zero time for a key that hasn't been used
+	LastUsedAt time.Time `db:"last_used_at" json:"last_used_at"`
+	IsRevoked  bool      `db:"is_revoked" json:"is_revoked"`
+	RevokedAt  time.Time `db:"revoked_at" json:"revoked_at"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+// IsExpired reports whether k had expired at t
+func (k APIKey) IsExpired(t time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !k.ExpiresAt.After(t)
+}
+
+func (s *authService) CreateAPIKey(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt time.Time) (APIKey, string, error) {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	if u.IsDeleted {
+		return APIKey{}, "", ErrUserDeleted
+	}
+	if !u.IsActive {
+		return APIKey{}, "", ErrUserInactive
+	}
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return APIKey{}, "", ErrInvalidName
+	}
+	checked, err := checkScopes(scopes)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	// the key is APIKeyPrefix, a random ID to look it up by, "_" and the secret
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return APIKey{}, "", err
+	}
+	if _, err = rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	t := time.Now()
+	k := APIKey{
+		ID:        uuid.NewV4(),
+		UserID:    u.ID,
+		Name:      name,
+		Prefix:    APIKeyPrefix + hex.EncodeToString(id),
+		Hash:      hashAPIKeySecret(encoded),
+		Scopes:    checked,
+		ExpiresAt: expiresAt,
+		CreatedAt: t,
+	}
+	_, err = s.db.NamedExecContext(ctx, `INSERT INTO api_key (id, user_id, name, prefix, hash, scopes, expires_at, last_used_at, is_revoked, revoked_at, created_at)
+	VALUES (:id, :user_id, :name, :prefix, :hash, :scopes, :expires_at, :last_used_at, :is_revoked, :revoked_at, :created_at)`, &k)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	s.audit(ctx, AuditAPIKeyCreated, u.ID, AuditDetails{"key": k.ID.String(), "name": k.Name, "scopes": strings.Join(k.Scopes, ",")})
+
+	return k, k.Prefix + "_" + encoded, nil
+}
+
+func (s *authService) ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]APIKey, error) {
+	if userID == uuid.Nil {
+		return nil, ErrInvalidID
+	}
+
+	keys := []APIKey{}
+	err := s.db.SelectContext(ctx, &keys, "SELECT * FROM api_key WHERE user_id=$1 AND is_revoked=$2 ORDER BY created_at DESC", userID, false)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *authService) RevokeAPIKey(ctx context.Context, userID, id uuid.UUID) error {
+	if userID == uuid.Nil || id == uuid.Nil {
+		return ErrInvalidID
+	}
+
+	res, err := s.db.ExecContext(ctx, "UPDATE api_key SET is_revoked=$1, revoked_at=$2 WHERE id=$3 AND user_id=$4 AND is_revoked=$5",
+		true, time.Now(), id, userID, false)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	s.audit(ctx, AuditAPIKeyRevoked, userID, AuditDetails{"key": id.String()})
+	return nil
+}
+
+func (s *authService) AuthenticateAPIKey(ctx context.Context, key string) (User, APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return User{}, APIKey{}, ErrInvalidAPIKey
+	}
+	i := strings.Index(key[len(APIKeyPrefix):], "_")
+	if i <= 0 {
+		return User{}, APIKey{}, ErrInvalidAPIKey
+	}
+	prefix, secret := key[:len(APIKeyPrefix)+i], key[len(APIKeyPrefix)+i+1:]
+
+	k := APIKey{}
+	err := s.db.GetContext(ctx, &k, "SELECT * FROM api_key WHERE prefix=$1", prefix)
+	if err == sql.ErrNoRows {
+		return User{}, APIKey{}, ErrInvalidAPIKey
+	} else if err != nil {
+		return User{}, APIKey{}, err
+	}
+	t := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(k.Hash)) != 1 || k.IsRevoked || k.IsExpired(t) {
+		return User{}, APIKey{}, ErrInvalidAPIKey
+	}
+
+	// keys stop working while their user is deactivated or deleted
+	u, err := s.GetUser(ctx, k.UserID)
+	if err == ErrUserNotFound {
+		return User{}, APIKey{}, ErrInvalidAPIKey
+	} else if err != nil {
+		return User{}, APIKey{}, err
+	}
+	if u.IsDeleted {
+		return User{}, APIKey{}, ErrUserDeleted
+	}
+	if !u.IsActive {
+		return User{}, APIKey{}, ErrUserInactive
+	}
+
+	if t.Sub(k.LastUsedAt) >= apiKeyLastUsedInterval {
+		k.LastUsedAt = t
+		_, err = s.db.ExecContext(ctx, "UPDATE api_key SET last_used_at=$1 WHERE id=$2", t, k.ID)
+		if err != nil {
+			logCtx(ctx, LevelWarn, "Error recording api key use", Fields{"key_id": k.ID, "error": err})
+		}
+	}
+	return u, k, nil
+}
+
+// hashAPIKeySecret hashes the secret part of a key for storage.
+// The secret is random so a fast hash is as good as a password hash and keeps each request cheap.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkScopes removes duplicate scopes and returns ErrInvalidScope for one that can't be given to a key
+func checkScopes(scopes []string) (Scopes, error) {
+	checked := Scopes{}
+	for _, scope := range scopes {
+		if len(scope) == 0 || strings.ContainsAny(scope, ", \t\r\n") {
+			return nil, ErrInvalidScope
+		}
+		if len(APIKeyScopes) > 0 && !Scopes(APIKeyScopes).Has(scope) {
+			return nil, ErrInvalidScope
+		}
+		if !checked.Has(scope) {
+			checked = append(checked, scope)
+		}
+	}
+	return checked, nil
+}
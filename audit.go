@@ -0,0 +1,319 @@
+package auth
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Audit event types
+const (
+	AuditLoginSucceeded         = "login.succeeded"
+	AuditLoginFailed            = "login.failed"
+	AuditLoginReported          = "login.reported"
+	AuditLogout                 = "logout"
+	AuditPasswordResetRequested = "password_reset.requested"
+	AuditPasswordResetCompleted = "password_reset.completed"
+	AuditUserCreated            = "user.created"
+	AuditUserUpdated            = "user.updated"
+	AuditUserDeleted            = "user.deleted"
+	AuditUserRestored           = "user.restored"
+	AuditUserPurged             = "user.purged"
+	AuditRoleChanged            = "user.role_changed"
+	AuditSessionsRevoked        = "user.sessions_revoked"
+	AuditEmailChanged           = "user.email_changed"
+	AuditProviderLinked         = "provider.linked"
+	AuditPasskeyAdded           = "passkey.added"
+	AuditPasskeyRemoved         = "passkey.removed"
+	AuditDataExported           = "data.exported"
+	AuditOrgCreated             = "org.created"
+	AuditOrgUpdated             = "org.updated"
+	AuditOrgDeleted             = "org.deleted"
+	AuditOrgMemberAdded         = "org.member_added"
+	AuditOrgMemberRoleChanged   = "org.member_role_changed"
+	AuditOrgMemberRemoved       = "org.member_removed"
+	AuditOrgInviteSent          = "org.invite_sent"
+	AuditOrgInviteRevoked       = "org.invite_revoked"
+	AuditUserInvited            = "user.invited"
+	AuditUserInviteRevoked      = "user.invite_revoked"
+	AuditAPIKeyCreated          = "api_key.created"
+	AuditAPIKeyRevoked          = "api_key.revoked"
+)
+
+// AuditListLimit and AuditListMaxLimit can be set by applications using auth.
+// AuditListLimit is the page size used when AuditQuery.Limit is zero; larger limits are capped at AuditListMaxLimit.
+var (
+	AuditListLimit    = 100
+	AuditListMaxLimit = 1000
+)
+
+// AuditEvent records something that happened to a user's account.
+// ActorID is who did it and TargetID who it was done to; they are the same when
+// users act on their own account and ActorID is uuid.Nil when nobody is logged in
+// or the application acted on its own (i.e. the RetentionJob).
+type AuditEvent struct {
+	ID        uuid.UUID    `json:"id"`
+	Type      string       `db:"type" json:"type"`
+	ActorID   uuid.UUID    `db:"actor_id" json:"actor_id"`
+	TargetID  uuid.UUID    `db:"target_id" json:"target_id"`
+	IP        string       `db:"ip" json:"ip"`
+	UserAgent string       `db:"user_agent" json:"user_agent"`
+	Details   AuditDetails `db:"details" json:"details"`
+	CreatedAt time.Time    `db:"created_at" json:"created_at"`
+}
+
+// AuditDetails holds event specific values, i.e. the login method. It is stored as JSON.
+type AuditDetails map[string]string
+
+// Value implements driver.Valuer
+func (d AuditDetails) Value() (driver.Value, error) {
+	if d == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(d)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner
+func (d *AuditDetails) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	case nil:
+		*d = nil
+		return nil
+	default:
+		return errors.New("auth: cannot scan audit details")
+	}
+	return json.Unmarshal(b, d)
+}
+
+// AuditInfo describes the request that caused the audit events a Service records. See WithAuditInfo.
+type AuditInfo struct {
+	// ActorID is the logged in user, uuid.Nil if there is none
+	ActorID   uuid.UUID
+	IP        string
+	UserAgent string
+}
+
+// AuditQuery selects the events returned by ListAuditEvents.
+// Events are listed newest first; the zero value lists every event.
+type AuditQuery struct {
+	// Types matches events of any of the given types
+	Types []string
+
+	// ActorID and TargetID match the actor and target when not uuid.Nil
+	ActorID  uuid.UUID
+	TargetID uuid.UUID
+
+	IP string
+
+	// Since (inclusive) and Until (exclusive) limit when the event happened when not zero
+	Since time.Time
+	Until time.Time
+
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// AuditList is a page of audit events
+type AuditList struct {
+	Events []AuditEvent `json:"events"`
+
+	// NextCursor fetches the following page; it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// auditCursor is the position after the last event of a page
+type auditCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        uuid.UUID `json:"id"`
+}
+
+func (s *authService) WithAuditInfo(info AuditInfo) Service {
+	c := *s
+	c.auditInfo = info
+	return &c
+}
+
+func (s *authService) RecordAuditEvent(ctx context.Context, e AuditEvent) error {
+	if len(e.Type) == 0 {
+		return errors.New("audit event type is required")
+	}
+	e.ID = uuid.NewV4()
+	if e.ActorID == uuid.Nil {
+		e.ActorID = s.auditInfo.ActorID
+	}
+	if len(e.IP) == 0 {
+		e.IP = s.auditInfo.IP
+	}
+	if len(e.UserAgent) == 0 {
+		e.UserAgent = s.auditInfo.UserAgent
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+
+	_, err := s.db.NamedExecContext(ctx, `INSERT INTO audit_event
+	(id, type, actor_id, target_id, ip, user_agent, details, created_at)
+	VALUES (:id, :type, :actor_id, :target_id, :ip, :user_agent, :details, :created_at)`, &e)
+	if err != nil {
+		return err
+	}
+
+	// a failing sink must not keep the event from the others
+	for _, sink := range AuditSinks {
+		err := sink.WriteAuditEvent(e)
+		if err != nil {
+			logCtx(ctx, LevelError, "Error writing audit event to sink", Fields{"event_id": e.ID, "error": err})
+		}
+	}
+	return nil
+}
+
+// audit records an event about target on behalf of the current actor.
+// The operation it describes has already happened, so failures are logged rather than returned.
+func (s *authService) audit(ctx context.Context, typ string, target uuid.UUID, details AuditDetails) {
+	s.auditAs(ctx, typ, s.auditInfo.ActorID, target, details)
+}
+
+// auditAs is audit with an explicit actor, i.e. the user who just logged in
+func (s *authService) auditAs(ctx context.Context, typ string, actor, target uuid.UUID, details AuditDetails) {
+	err := s.RecordAuditEvent(detach(ctx), AuditEvent{Type: typ, ActorID: actor, TargetID: target, Details: details})
+	if err != nil {
+		logCtx(ctx, LevelError, "Error recording audit event", Fields{"event_type": typ, "target_id": target, "error": err})
+	}
+}
+
+// loginFailed records a failed login. target is uuid.Nil when no user matched.
+func (s *authService) loginFailed(ctx context.Context, method string, target uuid.UUID, email string, err error) {
+	result := "failure"
+	switch err {
+	case ErrUserInactive:
+		result = "locked"
+		incMetric(MetricLockouts, Labels{"reason": "inactive"})
+	case ErrUserDeleted:
+		result = "locked"
+		incMetric(MetricLockouts, Labels{"reason": "deleted"})
+	}
+	incMetric(MetricLogins, Labels{"method": method, "result": result})
+
+	details := AuditDetails{"method": method, "reason": err.Error()}
+	if len(email) > 0 {
+		details["email"] = email
+	}
+	s.audit(ctx, AuditLoginFailed, target, details)
+}
+
+// userChanges lists the fields UpdateUser changed
+func userChanges(old, u User) []string {
+	changed := []string{}
+	if old.Email != u.Email {
+		changed = append(changed, "email")
+	}
+	if old.Password != u.Password {
+		changed = append(changed, "password")
+	}
+	if old.FirstName != u.FirstName {
+		changed = append(changed, "firstname")
+	}
+	if old.LastName != u.LastName {
+		changed = append(changed, "lastname")
+	}
+	if old.IsActive != u.IsActive {
+		changed = append(changed, "is_active")
+	}
+	if old.IsSuperuser != u.IsSuperuser {
+		changed = append(changed, "is_superuser")
+	}
+	if old.AvatarURL != u.AvatarURL {
+		changed = append(changed, "avatar_url")
+	}
+	if old.Locale != u.Locale {
+		changed = append(changed, "locale")
+	}
+	return changed
+}
+
+func (s *authService) ListAuditEvents(ctx context.Context, q AuditQuery) (AuditList, error) {
+	if q.Limit <= 0 {
+		q.Limit = AuditListLimit
+	}
+	if q.Limit > AuditListMaxLimit {
+		q.Limit = AuditListMaxLimit
+	}
+
+	var conds []string
+	var args []interface{}
+	if len(q.Types) > 0 {
+		conds = append(conds, "type IN (?"+strings.Repeat(", ?", len(q.Types)-1)+")")
+		for _, t := range q.Types {
+			args = append(args, t)
+		}
+	}
+	if q.ActorID != uuid.Nil {
+		conds = append(conds, "actor_id = ?")
+		args = append(args, q.ActorID)
+	}
+	if q.TargetID != uuid.Nil {
+		conds = append(conds, "target_id = ?")
+		args = append(args, q.TargetID)
+	}
+	if len(q.IP) > 0 {
+		conds = append(conds, "ip = ?")
+		args = append(args, q.IP)
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, q.Since)
+	}
+	if !q.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, q.Until)
+	}
+
+	// continue after the cursor, using id to order events that happened at the same time
+	if q.Cursor != "" {
+		c := auditCursor{}
+		b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		if err != nil || c.ID == uuid.Nil {
+			return AuditList{}, ErrInvalidQuery
+		}
+		conds = append(conds, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, c.CreatedAt, c.CreatedAt, c.ID)
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	// fetch one extra event to find out if there is another page
+	list := AuditList{Events: []AuditEvent{}}
+	sqlQuery := "SELECT * FROM audit_event" + where + " ORDER BY created_at DESC, id DESC LIMIT ?"
+	err := s.db.SelectContext(ctx, &list.Events, s.db.Rebind(sqlQuery), append(args, q.Limit+1)...)
+	if err != nil {
+		return AuditList{}, err
+	}
+	if len(list.Events) > q.Limit {
+		list.Events = list.Events[:q.Limit]
+		last := list.Events[q.Limit-1]
+		b, _ := json.Marshal(auditCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+		list.NextCursor = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	return list, nil
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// AuditSink receives every audit event after it is stored in the database
+type AuditSink interface {
+	// WriteAuditEvent delivers e. Errors are logged; they don't undo the event.
+	WriteAuditEvent(e AuditEvent) error
+}
+
+// AuditSinks can/should be set by applications using auth.
+// Every recorded audit event is also written to each sink, i.e. a file a SIEM agent ships.
+var AuditSinks []AuditSink
+
+// AuditSinkFunc adapts a function to an AuditSink
+type AuditSinkFunc func(e AuditEvent) error
+
+// WriteAuditEvent calls f(e)
+func (f AuditSinkFunc) WriteAuditEvent(e AuditEvent) error {
+	return f(e)
+}
+
+// WriterAuditSink writes every event as a line of JSON, the format most log shippers and SIEMs ingest
+type WriterAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterAuditSink creates a WriterAuditSink that writes to w
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{w: w}
+}
+
+// NewFileAuditSink creates a WriterAuditSink that appends to the file at path, creating it if needed
+func NewFileAuditSink(path string) (*WriterAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterAuditSink(f), nil
+}
+
+// WriteAuditEvent writes e followed by a newline
+func (s *WriterAuditSink) WriteAuditEvent(e AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying writer if it is an io.Closer
+func (s *WriterAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// MemoryAuditSink records every event it receives. It is intended for tests.
+type MemoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+// NewMemoryAuditSink creates an empty MemoryAuditSink
+func NewMemoryAuditSink() *MemoryAuditSink {
+	return &MemoryAuditSink{}
+}
+
+// WriteAuditEvent records e
+func (s *MemoryAuditSink) WriteAuditEvent(e AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+// Events returns a copy of every recorded event in the order they were written
+func (s *MemoryAuditSink) Events() []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AuditEvent(nil), s.events...)
+}
+
+// Reset forgets every recorded event
+func (s *MemoryAuditSink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = nil
+}
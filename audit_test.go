@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+func TestWriterAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterAuditSink(&buf)
+
+	events := []AuditEvent{
+		{ID: uuid.NewV4(), Type: AuditLoginSucceeded, Details: AuditDetails{"method": "password"}, CreatedAt: time.Now()},
+		{ID: uuid.NewV4(), Type: AuditLogout, CreatedAt: time.Now()},
+	}
+	for _, e := range events {
+		err := sink.WriteAuditEvent(e)
+		if err != nil {
+			t.Fatalf("Expected to write audit event. Instead got the error: %v", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(events) {
+		t.Fatalf("Expected one line per event. Instead got: %q", buf.String())
+	}
+	for i, line := range lines {
+		e := AuditEvent{}
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatalf("Expected line %d to be JSON. Instead got the error: %v", i, err)
+		}
+		if !uuid.Equal(e.ID, events[i].ID) || e.Type != events[i].Type || e.Details["method"] != events[i].Details["method"] {
+			t.Fatalf("Expected %+v. Instead got: %+v", events[i], e)
+		}
+	}
+}
+
+func TestAuditDetails(t *testing.T) {
+	v, err := AuditDetails(nil).Value()
+	if err != nil || v != "{}" {
+		t.Fatalf("Expected empty details to be stored as {}. Instead got: %v (error: %v)", v, err)
+	}
+
+	d := AuditDetails{}
+	err = d.Scan([]byte(`{"method":"passkey"}`))
+	if err != nil || d["method"] != "passkey" {
+		t.Fatalf("Expected to scan details. Instead got: %v (error: %v)", d, err)
+	}
+	err = d.Scan(42)
+	if err == nil {
+		t.Fatalf("Expected scanning a number to fail.")
+	}
+}
@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	tmpl "github.com/bryanjeal/go-tmpl"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+	"gopkg.in/mailgun/mailgun-go.v1"
+)
+
+// ConfigEnvPrefix is prepended to every environment variable LoadConfig reads.
+// "http.csrf_key" is read from AUTH_HTTP_CSRF_KEY.
+const ConfigEnvPrefix = "AUTH"
+
+// Config holds everything needed to build the auth Service and its HTTP handler
+type Config struct {
+	Database  DatabaseConfig
+	Mail      MailConfig
+	Mailgun   MailgunConfig
+	SMTP      SMTPConfig
+	Maildir   MaildirConfig
+	HTTP      HTTPConfig
+	Retention RetentionConfig
+}
+
+// DatabaseConfig holds the sqlx driver name and data source.
+// The driver must be "sqlite3", which the application imports: the queries use $N placeholders and an unquoted user table,
+// which MySQL and Postgres reject.
+type DatabaseConfig struct {
+	Driver string
+	DSN    string
+}
+
+// MailConfig selects the Mailer: "mailgun", "smtp" or "maildir"
+type MailConfig struct {
+	Driver string
+}
+
+// MailgunConfig holds the Mailgun account details
+type MailgunConfig struct {
+	Domain       string
+	APIKey       string
+	PublicAPIKey string
+}
+
+// SMTPConfig holds the SMTP server address and optional PLAIN auth credentials
+type SMTPConfig struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+// MaildirConfig holds the directory development email is delivered to
+type MaildirConfig struct {
+	Path string
+}
+
+// HTTPConfig holds the settings used by MakeHTTPHandler and the session store.
+// Keys are raw bytes; in config files they are base64 encoded.
+type HTTPConfig struct {
+	URLPrefix            string
+	BaseTemplate         string
+	CSRFKey              []byte
+	SessionAuthKey       []byte
+	SessionEncryptionKey []byte
+}
+
+// RetentionConfig holds how long deleted users are kept before a RetentionJob purges them
+type RetentionConfig struct {
+	Period time.Duration
+}
+
+// ConfigError holds every problem LoadConfig found
+type ConfigError []error
+
+func (e ConfigError) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return "invalid config: " + strings.Join(s, "; ")
+}
+
+// configKeys lists every key LoadConfig reads so each one can be bound to its environment variable
+var configKeys = []string{
+	"database.driver",
+	"database.dsn",
+	"mail.driver",
+	"mailgun.domain",
+	"mailgun.api_key",
+	"mailgun.public_api_key",
+	"smtp.addr",
+	"smtp.username",
+	"maildir.path",
+	"http.url_prefix",
+	"http.base_template",
+	"retention.period",
+}
+
+// secretKeys can be set directly or read from the file named by "<key>_file"
+var secretKeys = []string{
+	"database.dsn",
+	"mailgun.api_key",
+	"smtp.password",
+	"http.csrf_key",
+	"http.session_auth_key",
+	"http.session_encryption_key",
+}
+
+// LoadConfig reads the given TOML, YAML or HCL files (later files override earlier ones)
+// and then applies environment variable overrides.
+// Every problem found is returned together in a ConfigError.
+func LoadConfig(files ...string) (Config, error) {
+	v := viper.New()
+	v.SetDefault("database.driver", "sqlite3")
+	v.SetDefault("mail.driver", "mailgun")
+	v.SetDefault("http.url_prefix", "/auth")
+	v.SetDefault("retention.period", "720h")
+
+	for i, f := range files {
+		v.SetConfigFile(f)
+		var err error
+		if i == 0 {
+			err = v.ReadInConfig()
+		} else {
+			err = v.MergeInConfig()
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config file %s: %v", f, err)
+		}
+	}
+
+	keys := append([]string{}, configKeys...)
+	for _, k := range secretKeys {
+		keys = append(keys, k, k+"_file")
+	}
+	for _, k := range keys {
+		v.BindEnv(k, configEnvName(k))
+	}
+
+	var errs ConfigError
+	c := Config{
+		Database: DatabaseConfig{
+			Driver: v.GetString("database.driver"),
+			DSN:    configSecret(v, "database.dsn", &errs),
+		},
+		Mail: MailConfig{
+			Driver: v.GetString("mail.driver"),
+		},
+		Mailgun: MailgunConfig{
+			Domain:       v.GetString("mailgun.domain"),
+			APIKey:       configSecret(v, "mailgun.api_key", &errs),
+			PublicAPIKey: v.GetString("mailgun.public_api_key"),
+		},
+		SMTP: SMTPConfig{
+			Addr:     v.GetString("smtp.addr"),
+			Username: v.GetString("smtp.username"),
+			Password: configSecret(v, "smtp.password", &errs),
+		},
+		Maildir: MaildirConfig{
+			Path: v.GetString("maildir.path"),
+		},
+		HTTP: HTTPConfig{
+			URLPrefix:            v.GetString("http.url_prefix"),
+			BaseTemplate:         v.GetString("http.base_template"),
+			CSRFKey:              configKey(v, "http.csrf_key", &errs),
+			SessionAuthKey:       configKey(v, "http.session_auth_key", &errs),
+			SessionEncryptionKey: configKey(v, "http.session_encryption_key", &errs),
+		},
+		Retention: RetentionConfig{
+			Period: v.GetDuration("retention.period"),
+		},
+	}
+
+	errs = append(errs, c.Validate()...)
+	if len(errs) > 0 {
+		return Config{}, errs
+	}
+	return c, nil
+}
+
+// Validate checks that every required field is set
+func (c Config) Validate() ConfigError {
+	var errs ConfigError
+	required := func(key, val string) {
+		if len(strings.TrimSpace(val)) == 0 {
+			errs = append(errs, fmt.Errorf("%s is required", key))
+		}
+	}
+
+	switch c.Database.Driver {
+	case "sqlite3":
+	default:
+		errs = append(errs, fmt.Errorf("database.driver %q is not supported", c.Database.Driver))
+	}
+	required("database.dsn", c.Database.DSN)
+	switch c.Mail.Driver {
+	case "mailgun":
+		required("mailgun.domain", c.Mailgun.Domain)
+		required("mailgun.api_key", c.Mailgun.APIKey)
+	case "smtp":
+		required("smtp.addr", c.SMTP.Addr)
+	case "maildir":
+		required("maildir.path", c.Maildir.Path)
+	default:
+		errs = append(errs, fmt.Errorf("mail.driver %q is not supported", c.Mail.Driver))
+	}
+	required("http.base_template", c.HTTP.BaseTemplate)
+
+	if len(c.HTTP.CSRFKey) != 32 {
+		errs = append(errs, fmt.Errorf("http.csrf_key must be 32 bytes, got %d", len(c.HTTP.CSRFKey)))
+	}
+	switch len(c.HTTP.SessionAuthKey) {
+	case 32, 64:
+	default:
+		errs = append(errs, fmt.Errorf("http.session_auth_key must be 32 or 64 bytes, got %d", len(c.HTTP.SessionAuthKey)))
+	}
+	switch len(c.HTTP.SessionEncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		errs = append(errs, fmt.Errorf("http.session_encryption_key must be 16, 24 or 32 bytes, got %d", len(c.HTTP.SessionEncryptionKey)))
+	}
+
+	if c.Retention.Period <= 0 {
+		errs = append(errs, fmt.Errorf("retention.period must be positive, got %v", c.Retention.Period))
+	}
+
+	return errs
+}
+
+// OpenDB connects to the configured database
+func (c Config) OpenDB() (*sqlx.DB, error) {
+	return sqlx.Connect(c.Database.Driver, c.Database.DSN)
+}
+
+// NewMailer creates the configured Mailer
+func (c Config) NewMailer() (Mailer, error) {
+	switch c.Mail.Driver {
+	case "mailgun":
+		return NewMailgunMailer(mailgun.NewMailgun(c.Mailgun.Domain, c.Mailgun.APIKey, c.Mailgun.PublicAPIKey)), nil
+	case "smtp":
+		var a smtp.Auth
+		if len(c.SMTP.Username) > 0 {
+			host, _, err := net.SplitHostPort(c.SMTP.Addr)
+			if err != nil {
+				return nil, err
+			}
+			a = smtp.PlainAuth("", c.SMTP.Username, c.SMTP.Password, host)
+		}
+		return NewSMTPMailer(c.SMTP.Addr, a), nil
+	case "maildir":
+		return NewMaildirMailer(c.Maildir.Path)
+	}
+	return nil, fmt.Errorf("mail.driver %q is not supported", c.Mail.Driver)
+}
+
+// NewRetentionJob creates a RetentionJob using the configured retention period
+func (c Config) NewRetentionJob(auth Service) *RetentionJob {
+	return NewRetentionJob(auth, c.Retention.Period)
+}
+
+// NewSessionStore creates a cookie session store from the configured session keys
+func (c Config) NewSessionStore() sessions.Store {
+	if len(c.HTTP.SessionEncryptionKey) == 0 {
+		return sessions.NewCookieStore(c.HTTP.SessionAuthKey)
+	}
+	return sessions.NewCookieStore(c.HTTP.SessionAuthKey, c.HTTP.SessionEncryptionKey)
+}
+
+// MakeHTTPHandler is MakeHTTPHandler using the configured URL prefix, base template and CSRF key
+func (c Config) MakeHTTPHandler(auth Service, tpl *tmpl.TplSys, store sessions.Store) (http.Handler, error) {
+	return makeHTTPHandler(auth, c.HTTP.URLPrefix, c.HTTP.BaseTemplate, tpl, store, c.HTTP.CSRFKey)
+}
+
+// configEnvName maps a config key to its environment variable
+func configEnvName(key string) string {
+	return ConfigEnvPrefix + "_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// configSecret reads a secret either directly from key or from the file named by key_file.
+// The environment overrides the config files whichever form each uses; only setting both forms in the same place is an error.
+func configSecret(v *viper.Viper, key string, errs *ConfigError) string {
+	val, file := os.Getenv(configEnvName(key)), os.Getenv(configEnvName(key+"_file"))
+	name, fileName := configEnvName(key), configEnvName(key+"_file")
+	if len(val) == 0 && len(file) == 0 {
+		// nothing in the environment, so viper returns what the config files set
+		val, file = v.GetString(key), v.GetString(key+"_file")
+		name, fileName = key, key+"_file"
+	}
+	if len(file) == 0 {
+		return val
+	}
+	if len(val) > 0 {
+		*errs = append(*errs, fmt.Errorf("only one of %s and %s may be set", name, fileName))
+		return ""
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s: %v", fileName, err))
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// configKey reads a base64 encoded secret key
+func configKey(v *viper.Viper, key string, errs *ConfigError) []byte {
+	s := configSecret(v, key, errs)
+	if len(s) == 0 {
+		return nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s is not valid base64: %v", key, err))
+		return nil
+	}
+	return b
+}
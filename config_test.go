@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-config")
+	if err != nil {
+		t.Fatalf("Expected to create temp dir. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	csrfKey := bytes.Repeat([]byte("c"), 32)
+	sessKey := bytes.Repeat([]byte("s"), 32)
+
+	write := func(name, content string) string {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte(content), 0600); err != nil {
+			t.Fatalf("Expected to write %s. Instead got the error: %v", name, err)
+		}
+		return f
+	}
+
+	keyFile := write("csrf.key", base64.StdEncoding.EncodeToString(csrfKey)+"\n")
+	tomlFile := write("auth.toml", `
+[database]
+driver = "sqlite3"
+dsn = "auth.sdb"
+
+[mailgun]
+domain = "mg.example.com"
+api_key = "key-toml"
+
+[http]
+base_template = "base"
+csrf_key_file = "`+keyFile+`"
+session_auth_key = "`+base64.StdEncoding.EncodeToString(sessKey)+`"
+`)
+	yamlFile := write("auth.yaml", `
+mailgun:
+  api_key: key-yaml
+http:
+  url_prefix: /account
+`)
+
+	t.Run("Files", func(t *testing.T) {
+		c, err := LoadConfig(tomlFile, yamlFile)
+		if err != nil {
+			t.Fatalf("Expected to load config. Instead got the error: %v", err)
+		}
+		if c.Database.DSN != "auth.sdb" {
+			t.Fatalf("Expected Database.DSN to be: auth.sdb. Instead got: %s", c.Database.DSN)
+		}
+		if c.Mailgun.APIKey != "key-yaml" {
+			t.Fatalf("Expected later files to override earlier ones. Instead got Mailgun.APIKey: %s", c.Mailgun.APIKey)
+		}
+		if c.Retention.Period != 720*time.Hour {
+			t.Fatalf("Expected Retention.Period to default to 720h. Instead got: %v", c.Retention.Period)
+		}
+		if c.HTTP.URLPrefix != "/account" {
+			t.Fatalf("Expected HTTP.URLPrefix to be: /account. Instead got: %s", c.HTTP.URLPrefix)
+		}
+		if !bytes.Equal(c.HTTP.CSRFKey, csrfKey) {
+			t.Fatalf("Expected HTTP.CSRFKey to be read from %s", keyFile)
+		}
+		if !bytes.Equal(c.HTTP.SessionAuthKey, sessKey) {
+			t.Fatal("Expected HTTP.SessionAuthKey to be decoded from base64")
+		}
+	})
+
+	t.Run("Env", func(t *testing.T) {
+		os.Setenv("AUTH_MAILGUN_DOMAIN", "env.example.com")
+		defer os.Unsetenv("AUTH_MAILGUN_DOMAIN")
+		os.Setenv("AUTH_RETENTION_PERIOD", "48h")
+		defer os.Unsetenv("AUTH_RETENTION_PERIOD")
+
+		c, err := LoadConfig(tomlFile)
+		if err != nil {
+			t.Fatalf("Expected to load config. Instead got the error: %v", err)
+		}
+		if c.Mailgun.Domain != "env.example.com" {
+			t.Fatalf("Expected Mailgun.Domain to be: env.example.com. Instead got: %s", c.Mailgun.Domain)
+		}
+		if c.Retention.Period != 48*time.Hour {
+			t.Fatalf("Expected Retention.Period to be: 48h. Instead got: %v", c.Retention.Period)
+		}
+	})
+
+	t.Run("EnvSecret", func(t *testing.T) {
+		// the environment wins over the config files even when it uses the other form of the secret
+		dsnFile := write("dsn", "env.sdb\n")
+		os.Setenv("AUTH_DATABASE_DSN_FILE", dsnFile)
+		defer os.Unsetenv("AUTH_DATABASE_DSN_FILE")
+		envKey := bytes.Repeat([]byte("e"), 32)
+		os.Setenv("AUTH_HTTP_CSRF_KEY", base64.StdEncoding.EncodeToString(envKey))
+		defer os.Unsetenv("AUTH_HTTP_CSRF_KEY")
+
+		c, err := LoadConfig(tomlFile)
+		if err != nil {
+			t.Fatalf("Expected to load config. Instead got the error: %v", err)
+		}
+		if c.Database.DSN != "env.sdb" {
+			t.Fatalf("Expected Database.DSN to be read from %s. Instead got: %s", dsnFile, c.Database.DSN)
+		}
+		if !bytes.Equal(c.HTTP.CSRFKey, envKey) {
+			t.Fatal("Expected AUTH_HTTP_CSRF_KEY to override http.csrf_key_file")
+		}
+
+		os.Setenv("AUTH_DATABASE_DSN", "both.sdb")
+		defer os.Unsetenv("AUTH_DATABASE_DSN")
+		_, err = LoadConfig(tomlFile)
+		if err == nil || !strings.Contains(err.Error(), "only one of AUTH_DATABASE_DSN and AUTH_DATABASE_DSN_FILE") {
+			t.Fatalf("Expected both environment forms of database.dsn to be rejected. Instead got: %v", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		f := write("invalid.toml", `
+[database]
+driver = "postgres"
+
+[http]
+csrf_key = "not base64!"
+`)
+		_, err := LoadConfig(f)
+		errs, ok := err.(ConfigError)
+		if !ok {
+			t.Fatalf("Expected to get a ConfigError. Instead got: %v", err)
+		}
+		for _, want := range []string{"database.driver", "database.dsn", "mailgun.domain", "mailgun.api_key", "http.base_template", "http.csrf_key", "http.session_auth_key"} {
+			if !strings.Contains(errs.Error(), want) {
+				t.Fatalf("Expected errors to mention %s. Instead got: %v", want, errs)
+			}
+		}
+	})
+}
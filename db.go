@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// pgUniqueViolation is the Postgres SQLSTATE for unique_violation
+const pgUniqueViolation = "23505"
+
+// isUniqueViolation reports whether err is a unique constraint violation from sqlite3, MySQL or Postgres
+func isUniqueViolation(err error) bool {
+	switch e := err.(type) {
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	case *mysql.MySQLError:
+		// ER_DUP_ENTRY
+		return e.Number == 1062
+	}
+
+	// lib/pq and pgx errors report their SQLSTATE
+	if e, ok := err.(interface {
+		SQLState() string
+	}); ok {
+		return e.SQLState() == pgUniqueViolation
+	}
+	// older lib/pq releases only describe it in the message
+	return strings.Contains(err.Error(), "duplicate key value violates unique constraint")
+}
+
+// timedDB records how long each query takes in MetricDBDuration and starts a span for it
+type timedDB struct {
+	*sqlx.DB
+}
+
+// startStatementSpan starts a span for running query, named after its queryOperation
+func startStatementSpan(ctx context.Context, query string) (context.Context, Span) {
+	ctx, span := startSpan(ctx, "sql "+queryOperation(query))
+	span.SetAttribute("db.statement", query)
+	return ctx, span
+}
+
+func (db timedDB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	defer observeSince(MetricDBDuration, time.Now(), Labels{"operation": queryOperation(query)})
+	ctx, span := startStatementSpan(ctx, query)
+	err := db.DB.GetContext(ctx, dest, query, args...)
+	endSpan(span, err)
+	return err
+}
+
+func (db timedDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	defer observeSince(MetricDBDuration, time.Now(), Labels{"operation": queryOperation(query)})
+	ctx, span := startStatementSpan(ctx, query)
+	err := db.DB.SelectContext(ctx, dest, query, args...)
+	endSpan(span, err)
+	return err
+}
+
+func (db timedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer observeSince(MetricDBDuration, time.Now(), Labels{"operation": queryOperation(query)})
+	ctx, span := startStatementSpan(ctx, query)
+	res, err := db.DB.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	return res, err
+}
+
+func (db timedDB) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	defer observeSince(MetricDBDuration, time.Now(), Labels{"operation": queryOperation(query)})
+	ctx, span := startStatementSpan(ctx, query)
+	res, err := db.DB.NamedExecContext(ctx, query, arg)
+	endSpan(span, err)
+	return res, err
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// ErrInvalidEmail is returned when an email address can't be normalized
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// EmailLocalPartPolicy normalizes the local part (before the @) of an email address.
+// domain is already normalized so a policy can treat mail providers differently.
+type EmailLocalPartPolicy func(local, domain string) string
+
+// EmailLocalPart can/should be set by applications using auth.
+// Addresses whose normalized forms are equal belong to the same account.
+var EmailLocalPart EmailLocalPartPolicy = LowercaseLocalPart
+
+// ExactLocalPart keeps the local part as it was typed. RFC 5321 allows mail servers to treat it case-sensitively.
+func ExactLocalPart(local, domain string) string {
+	return local
+}
+
+// LowercaseLocalPart ignores the case of the local part, as nearly every mail provider does
+func LowercaseLocalPart(local, domain string) string {
+	return strings.ToLower(local)
+}
+
+// GmailLocalPart is LowercaseLocalPart that also ignores dots and "+tag" suffixes in Gmail addresses,
+// which Gmail delivers to the same mailbox
+func GmailLocalPart(local, domain string) string {
+	local = strings.ToLower(local)
+	if domain != "gmail.com" && domain != "googlemail.com" {
+		return local
+	}
+	if i := strings.Index(local, "+"); i >= 0 {
+		local = local[:i]
+	}
+	return strings.Replace(local, ".", "", -1)
+}
+
+// NormalizeEmail returns the form of addr used to tell whether two addresses belong to the same account.
+// The domain is lowercased and IDNA encoded and the local part is normalized with EmailLocalPart.
+func NormalizeEmail(addr string) (string, error) {
+	_, normalized, err := normalizeEmail(addr)
+	return normalized, err
+}
+
+// normalizeEmail parses addr and returns the address to store (with its domain lowercased and IDNA encoded)
+// and the normalized address that must be unique
+func normalizeEmail(addr string) (string, string, error) {
+	e, err := mail.ParseAddress(addr)
+	if err != nil {
+		return "", "", err
+	}
+
+	i := strings.LastIndex(e.Address, "@")
+	if i <= 0 || i == len(e.Address)-1 {
+		return "", "", ErrInvalidEmail
+	}
+	local := e.Address[:i]
+	domain, err := idna.ToASCII(strings.ToLower(strings.TrimSuffix(e.Address[i+1:], ".")))
+	if err != nil || len(domain) == 0 {
+		return "", "", ErrInvalidEmail
+	}
+	domain = strings.ToLower(domain)
+
+	return local + "@" + domain, EmailLocalPart(local, domain) + "@" + domain, nil
+}
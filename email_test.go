@@ -0,0 +1,37 @@
+package auth
+
+import "testing"
+
+func TestNormalizeEmail(t *testing.T) {
+	defer func(p EmailLocalPartPolicy) { EmailLocalPart = p }(EmailLocalPart)
+
+	cases := []struct {
+		policy     EmailLocalPartPolicy
+		in         string
+		stored     string
+		normalized string
+	}{
+		{LowercaseLocalPart, "John.Doe@Example.COM", "John.Doe@example.com", "john.doe@example.com"},
+		{LowercaseLocalPart, "John Doe <jdoe@EXAMPLE.com>", "jdoe@example.com", "jdoe@example.com"},
+		{ExactLocalPart, "John.Doe@Example.COM", "John.Doe@example.com", "John.Doe@example.com"},
+		{GmailLocalPart, "John.Doe+news@GMail.com", "John.Doe+news@gmail.com", "johndoe@gmail.com"},
+		{GmailLocalPart, "John.Doe+news@example.com", "John.Doe+news@example.com", "john.doe+news@example.com"},
+	}
+	for _, c := range cases {
+		EmailLocalPart = c.policy
+		stored, normalized, err := normalizeEmail(c.in)
+		if err != nil {
+			t.Fatalf("Expected to normalize %s. Instead got the error: %v", c.in, err)
+		}
+		if stored != c.stored || normalized != c.normalized {
+			t.Fatalf("Expected %s to normalize to %s and %s. Instead got: %s and %s", c.in, c.stored, c.normalized, stored, normalized)
+		}
+	}
+
+	for _, bad := range []string{"", "not-an-email", "@example.com"} {
+		_, err := NormalizeEmail(bad)
+		if err == nil {
+			t.Fatalf("Expected %q to be rejected. Instead got: nil", bad)
+		}
+	}
+}
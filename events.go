@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// EventType names something that happened to a user
+type EventType string
+
+// Event types
+const (
+	// EventUserRegistered is published when a new user is saved
+	EventUserRegistered EventType = "user.registered"
+	// EventUserUpdated is published when UpdateUser, CancelEmailChange or RevokeSessions saves a user
+	EventUserUpdated EventType = "user.updated"
+	// EventEmailVerified is published when a user confirms a new email address
+	EventEmailVerified EventType = "user.email_verified"
+	// EventUserLoggedIn is published once per login, when the user has passed every factor. See ContextWithDeferredLogin.
+	EventUserLoggedIn EventType = "user.logged_in"
+	// EventPasswordReset is published when a user sets a new password with a reset link
+	EventPasswordReset EventType = "user.password_reset"
+	// EventUserDeleted and EventUserRestored are published by DeleteUser and RestoreUser
+	EventUserDeleted  EventType = "user.deleted"
+	EventUserRestored EventType = "user.restored"
+	// EventUserPurged is published when a deleted user is removed for good. Only User.ID is set.
+	EventUserPurged EventType = "user.purged"
+)
+
+// eventTypes lists every type of event a Service publishes
+var eventTypes = []EventType{
+	EventUserRegistered,
+	EventUserUpdated,
+	EventEmailVerified,
+	EventUserLoggedIn,
+	EventPasswordReset,
+	EventUserDeleted,
+	EventUserRestored,
+	EventUserPurged,
+}
+
+// Event is passed to the hooks and subscribers of an EventBus
+type Event struct {
+	Type EventType
+	// User is the user the event is about, as it is being saved
+	User User
+	// Method is how the user logged in, as in LoginRecord.Method. It is only set for EventUserLoggedIn.
+	Method string
+	// Info describes the request that caused the event. See WithAuditInfo.
+	Info      AuditInfo
+	CreatedAt time.Time
+}
+
+// Hook is called synchronously inside the transaction that saves the change an event describes.
+// Returning an error vetoes the change: the transaction is rolled back and the Service method returns the error.
+// Hooks can use tx to keep their own writes (i.e. provisioning a workspace) consistent with the user.
+type Hook func(ctx context.Context, tx *sqlx.Tx, e Event) error
+
+// Subscriber is called in its own goroutine after the change an event describes has been committed
+type Subscriber func(e Event)
+
+// EventBus delivers the events an auth Service publishes to the application.
+// Every Service has one; get it with Service.Events.
+type EventBus struct {
+	mu    sync.RWMutex
+	hooks map[EventType][]Hook
+	subs  map[EventType][]Subscriber
+	wg    sync.WaitGroup
+}
+
+// NewEventBus creates an EventBus without hooks or subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		hooks: make(map[EventType][]Hook),
+		subs:  make(map[EventType][]Subscriber),
+	}
+}
+
+// Hook adds h to the hooks run for events of type t. Hooks run in the order they were added.
+func (b *EventBus) Hook(t EventType, h Hook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks[t] = append(b.hooks[t], h)
+}
+
+// Subscribe adds fn to the subscribers of events of type t
+func (b *EventBus) Subscribe(t EventType, fn Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[t] = append(b.subs[t], fn)
+}
+
+// Wait blocks until every subscriber called so far has returned.
+// Applications should call it before exiting so no event is lost.
+func (b *EventBus) Wait() {
+	b.wg.Wait()
+}
+
+// runHooks calls the hooks for e in order, stopping at the first error
+func (b *EventBus) runHooks(ctx context.Context, tx *sqlx.Tx, e Event) error {
+	b.mu.RLock()
+	hooks := b.hooks[e.Type]
+	b.mu.RUnlock()
+	for _, h := range hooks {
+		err := h(ctx, tx, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish calls every subscriber for e in the background.
+// A subscriber that panics is logged; it doesn't take the application down.
+func (b *EventBus) publish(e Event) {
+	b.mu.RLock()
+	subs := b.subs[e.Type]
+	b.mu.RUnlock()
+	for _, fn := range subs {
+		b.wg.Add(1)
+		go func(fn Subscriber) {
+			defer b.wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					logCtx(context.Background(), LevelError, "Event subscriber panicked", Fields{"event_type": e.Type, "target_id": e.User.ID, "panic": r})
+				}
+			}()
+			fn(e)
+		}(fn)
+	}
+}
+
+func (s *authService) Events() *EventBus {
+	return s.events
+}
+
+// newEvent describes an event about u caused by the current request
+func (s *authService) newEvent(typ EventType, u User) Event {
+	return Event{Type: typ, User: u, Info: s.auditInfo, CreatedAt: time.Now()}
+}
+
+// hooks returns a txFunc that runs the hooks for e.
+// Use it as the last txFunc so hooks see everything the transaction wrote.
+func (s *authService) hooks(ctx context.Context, e Event) txFunc {
+	return func(tx *sqlx.Tx) error {
+		return s.events.runHooks(ctx, tx, e)
+	}
+}
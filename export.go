@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// UserProvider links a user to their account with an oAuth provider
+type UserProvider struct {
+	UserID         uuid.UUID `db:"user_id" json:"user_id"`
+	Provider       string    `db:"provider" json:"provider"`
+	ProviderUserID string    `db:"provider_user_id" json:"provider_user_id"`
+}
+
+// dataExport is an archive waiting to be downloaded from the link in DataExportEmail
+type dataExport struct {
+	UserID    uuid.UUID `db:"user_id"`
+	Data      []byte    `db:"data"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// exportManifest is the manifest.json of an export archive
+type exportManifest struct {
+	UserID      uuid.UUID `json:"user_id"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Files       []string  `json:"files"`
+	// Notes explains what is not in the archive and why
+	Notes []string `json:"notes"`
+}
+
+// exportNotes are listed in every manifest
+var exportNotes = []string{
+	"Sessions are kept in a cookie in your browser and are not stored by the server. The time your sessions were last revoked is in user.json.",
+	"Password hashes are never exported.",
+	"API key secrets are never stored, so only the name, prefix and scopes of each key are exported.",
+	"Audit events where you acted on another user are exported without their details, which are about that user.",
+}
+
+func (s *authService) ExportUserData(ctx context.Context, id uuid.UUID) ([]byte, error) {
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	providers := []UserProvider{}
+	err = s.db.SelectContext(ctx, &providers, "SELECT * FROM user_provider WHERE user_id=$1 ORDER BY provider", u.ID)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := s.ListWebAuthnCredentials(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	changes := []EmailChange{}
+	err = s.db.SelectContext(ctx, &changes, "SELECT * FROM email_change WHERE user_id=$1 ORDER BY created_at", u.ID)
+	if err != nil {
+		return nil, err
+	}
+	logins := []LoginRecord{}
+	err = s.db.SelectContext(ctx, &logins, "SELECT * FROM login_history WHERE user_id=$1 ORDER BY created_at", u.ID)
+	if err != nil {
+		return nil, err
+	}
+	orgs, err := s.ListUserOrganizations(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	err = s.db.SelectContext(ctx, &keys, "SELECT * FROM api_key WHERE user_id=$1 ORDER BY created_at", u.ID)
+	if err != nil {
+		return nil, err
+	}
+	events := []AuditEvent{}
+	err = s.db.SelectContext(ctx, &events, "SELECT * FROM audit_event WHERE target_id=$1 OR actor_id=$2 ORDER BY created_at", u.ID, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	// the details of what the user did to someone else are about that person
+	for i := range events {
+		if !uuid.Equal(events[i].TargetID, u.ID) {
+			events[i].Details = AuditDetails{}
+		}
+	}
+
+	// every file is JSON; the manifest is written last so it can list them
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{"user.json", u},
+		{"providers.json", providers},
+		{"passkeys.json", passkeys},
+		{"email_changes.json", changes},
+		{"logins.json", logins},
+		{"organizations.json", orgs},
+		{"api_keys.json", keys},
+		{"audit_events.json", events},
+	}
+	m := exportManifest{UserID: u.ID, GeneratedAt: time.Now().UTC(), Files: []string{}, Notes: exportNotes}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	write := func(name string, v interface{}) error {
+		h := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		h.SetModTime(m.GeneratedAt)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	for _, f := range files {
+		err = write(f.name, f.v)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, f.name)
+	}
+	err = write("manifest.json", m)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *authService) BeginDataExport(ctx context.Context, id uuid.UUID) error {
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return err
+	}
+
+	archive, err := s.ExportUserData(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	// create nonce for download token
+	n, err := s.nonce.New("auth.DataExport", u.ID, DataExportExpiry)
+	if err != nil {
+		return err
+	}
+	t := time.Now()
+	e := dataExport{
+		UserID:    u.ID,
+		Data:      archive,
+		CreatedAt: t,
+		ExpiresAt: t.Add(DataExportExpiry),
+	}
+	data := newEmailData(u)
+	data.Token = userToken(u.ID, n.Token)
+	data.Link = BaseURL + "/data-export/" + data.Token
+	data.ExpiresAt = e.ExpiresAt
+
+	// a user has at most one export waiting; a newer one replaces it
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM user_export WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NamedExecContext(ctx, "INSERT INTO user_export (user_id, data, created_at, expires_at) VALUES (:user_id, :data, :created_at, :expires_at)", &e)
+		if err != nil {
+			return err
+		}
+		return s.queueEmail(ctx, tx, DataExportEmail, u.Email, data)
+	})
+}
+
+func (s *authService) CompleteDataExport(ctx context.Context, token string) ([]byte, error) {
+	u, err := s.useUserToken(ctx, token, "auth.DataExport")
+	if err != nil {
+		return nil, err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return nil, err
+	}
+
+	// the archive is removed once it has been handed out
+	e := dataExport{}
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &e, "SELECT * FROM user_export WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM user_export WHERE user_id=$1", u.ID)
+		return err
+	})
+	if err == sql.ErrNoRows || (err == nil && e.ExpiresAt.Before(time.Now())) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	s.auditAs(ctx, AuditDataExported, u.ID, u.ID, nil)
+
+	return e.Data, nil
+}
+
+func (s *authService) PurgeExpiredExports(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM user_export WHERE expires_at<$1", before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultLocale is used when neither the user nor the request ask for a locale that has a catalog.
+// It can/should be set by applications using auth.
+var DefaultLocale = "en"
+
+// Catalog maps message keys to a locale's translation.
+// Messages may contain fmt verbs which are filled from the arguments given to T.
+type Catalog map[string]string
+
+// Catalogs holds a Catalog per locale (i.e. "en", "pt-br").
+// It can/should be extended by applications using auth, either directly or with LoadCatalog, before serving requests.
+var Catalogs = map[string]Catalog{
+	"en": defaultCatalog,
+}
+
+// LoadCatalog reads a JSON (.json) or TOML (.toml) message file and merges it into Catalogs[locale].
+// Nested objects/tables are flattened with "." so {"login": {"title": "..."}} sets "login.title".
+func LoadCatalog(locale, file string) error {
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		err = json.NewDecoder(f).Decode(&raw)
+		if err != nil {
+			return err
+		}
+	case ".toml":
+		_, err := toml.DecodeFile(file, &raw)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported catalog file type: %s", file)
+	}
+
+	locale = normalizeLocale(locale)
+	c, ok := Catalogs[locale]
+	if !ok {
+		c = Catalog{}
+		Catalogs[locale] = c
+	}
+	return flattenCatalog(c, "", raw)
+}
+
+func flattenCatalog(c Catalog, prefix string, raw map[string]interface{}) error {
+	for k, v := range raw {
+		key := prefix + k
+		switch v := v.(type) {
+		case string:
+			c[key] = v
+		case map[string]interface{}:
+			err := flattenCatalog(c, key+".", v)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("catalog message %s must be a string, got %T", key, v)
+		}
+	}
+	return nil
+}
+
+// T translates key into locale, falling back to DefaultLocale and then to the key itself.
+// If args are given the message is formatted with fmt.Sprintf.
+func T(locale, key string, args ...interface{}) string {
+	msg, ok := lookupMessage(locale, key)
+	if !ok {
+		msg, ok = lookupMessage(DefaultLocale, key)
+	}
+	if !ok {
+		msg = key
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// lookupMessage finds key in locale's catalog or its base language's catalog ("pt" for "pt-br")
+func lookupMessage(locale, key string) (string, bool) {
+	locale = normalizeLocale(locale)
+	if msg, ok := Catalogs[locale][key]; ok {
+		return msg, true
+	}
+	if i := strings.Index(locale, "-"); i > 0 {
+		msg, ok := Catalogs[locale[:i]][key]
+		return msg, ok
+	}
+	return "", false
+}
+
+// ResolveLocale picks the locale to render in. The user's preference is tried first,
+// then each language in the Accept-Language header by quality, then DefaultLocale.
+func ResolveLocale(userLocale, acceptLanguage string) string {
+	if l, ok := supportedLocale(userLocale); ok {
+		return l
+	}
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if l, ok := supportedLocale(tag); ok {
+			return l
+		}
+	}
+	return DefaultLocale
+}
+
+// supportedLocale returns the catalog locale for tag, trying the base language if the full tag has no catalog
+func supportedLocale(tag string) (string, bool) {
+	tag = normalizeLocale(tag)
+	if len(tag) == 0 {
+		return "", false
+	}
+	if _, ok := Catalogs[tag]; ok {
+		return tag, true
+	}
+	if i := strings.Index(tag, "-"); i > 0 {
+		if _, ok := Catalogs[tag[:i]]; ok {
+			return tag[:i], true
+		}
+	}
+	return "", false
+}
+
+// normalizeLocale lowercases a locale and uses "-" as the separator ("pt_BR" becomes "pt-br")
+func normalizeLocale(l string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(l), "_", "-", -1))
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language header ordered by quality
+func parseAcceptLanguage(header string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if len(tag) == 0 || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				v, err := strconv.ParseFloat(f[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, lang{tag, q})
+		}
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
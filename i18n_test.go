@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveLocale(t *testing.T) {
+	Catalogs["fr"] = Catalog{}
+	Catalogs["pt-br"] = Catalog{}
+	defer delete(Catalogs, "fr")
+	defer delete(Catalogs, "pt-br")
+
+	tests := []struct {
+		user, accept, want string
+	}{
+		{"", "", DefaultLocale},
+		{"fr", "pt-BR", "fr"},
+		{"fr_CA", "", "fr"},
+		{"xx", "pt-BR,fr;q=0.8", "pt-br"},
+		{"", "de;q=0.9, fr;q=0.5, pt;q=0.7", "fr"},
+		{"", "fr;q=0, de", DefaultLocale},
+		{"", "*", DefaultLocale},
+	}
+	for _, tt := range tests {
+		got := ResolveLocale(tt.user, tt.accept)
+		if got != tt.want {
+			t.Errorf("ResolveLocale(%q, %q): Expected %s. Instead got: %s", tt.user, tt.accept, tt.want, got)
+		}
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-i18n")
+	if err != nil {
+		t.Fatalf("Expected to create temp dir. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(Catalogs, "es")
+	defer delete(Catalogs, "it")
+
+	jsonFile := filepath.Join(dir, "es.json")
+	ioutil.WriteFile(jsonFile, []byte(`{"auth": {"flash": {"loggedOut": "Has cerrado la sesión."}}, "auth.email.greeting": "Hola %s %s,"}`), 0600)
+	tomlFile := filepath.Join(dir, "it.toml")
+	ioutil.WriteFile(tomlFile, []byte("[auth.flash]\nloggedOut = \"Sei uscito.\"\n"), 0600)
+
+	if err := LoadCatalog("es", jsonFile); err != nil {
+		t.Fatalf("Expected to load %s. Instead got the error: %v", jsonFile, err)
+	}
+	if err := LoadCatalog("it", tomlFile); err != nil {
+		t.Fatalf("Expected to load %s. Instead got the error: %v", tomlFile, err)
+	}
+
+	if got := T("es", "auth.flash.loggedOut"); got != "Has cerrado la sesión." {
+		t.Fatalf("Expected nested JSON keys to be flattened. Instead got: %s", got)
+	}
+	if got := T("es-MX", "auth.email.greeting", "Ana", "Ruiz"); got != "Hola Ana Ruiz," {
+		t.Fatalf("Expected es-MX to use the es catalog with arguments. Instead got: %s", got)
+	}
+	if got := T("it", "auth.flash.loggedOut"); got != "Sei uscito." {
+		t.Fatalf("Expected TOML tables to be flattened. Instead got: %s", got)
+	}
+	if got := T("it", "auth.Tpl.Login.submit"); got != defaultCatalog["auth.Tpl.Login.submit"] {
+		t.Fatalf("Expected missing messages to fall back to %s. Instead got: %s", DefaultLocale, got)
+	}
+	if got := T("it", "no.such.key"); got != "no.such.key" {
+		t.Fatalf("Expected unknown keys to be returned as is. Instead got: %s", got)
+	}
+
+	if err := LoadCatalog("es", filepath.Join(dir, "es.yaml")); err == nil {
+		t.Fatal("Expected an error for an unsupported file type. Instead got: nil")
+	}
+}
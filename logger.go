@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Fields are the structured data of a log entry, i.e. "user_id", "request_id" and "operation"
+type Fields map[string]interface{}
+
+// Logger writes structured, leveled log entries. Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+// Log can/should be set by applications using auth.
+// Everything auth logs is written to it; by default that is glog. See NewSlogLogger for log/slog.
+var Log Logger = NewGlogLogger()
+
+// logFieldsKey is the context key of the fields added to every entry logged for a request
+type logFieldsKey struct{}
+
+// ContextWithLogFields returns a copy of ctx whose log entries have fields, in addition to those ctx already has
+func ContextWithLogFields(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	for k, v := range LogFieldsFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+// LogFieldsFromContext returns the fields added to ctx with ContextWithLogFields
+func LogFieldsFromContext(ctx context.Context) Fields {
+	fields, _ := ctx.Value(logFieldsKey{}).(Fields)
+	return fields
+}
+
+// logCtx writes msg to Log with the fields of ctx and fields. An "error" field that is an error is logged as its message.
+func logCtx(ctx context.Context, level Level, msg string, fields Fields) {
+	if Log == nil {
+		return
+	}
+	merged := Fields{}
+	for k, v := range LogFieldsFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	if err, ok := merged["error"].(error); ok {
+		merged["error"] = err.Error()
+	}
+	Log.Log(level, msg, merged)
+}
+
+// glogLogger writes to glog. Debug entries are written at verbosity 1.
+type glogLogger struct{}
+
+// NewGlogLogger creates a Logger that writes to glog, formatting fields as key=value pairs
+func NewGlogLogger() Logger {
+	return glogLogger{}
+}
+
+func (glogLogger) Log(level Level, msg string, fields Fields) {
+	line := formatLogLine(msg, fields)
+	switch level {
+	case LevelDebug:
+		glog.V(1).Info(line)
+	case LevelInfo:
+		glog.Info(line)
+	case LevelWarn:
+		glog.Warning(line)
+	default:
+		glog.Error(line)
+	}
+}
+
+// formatLogLine formats msg followed by fields as key=value pairs, sorted by key
+func formatLogLine(msg string, fields Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString(msg)
+	for _, k := range keys {
+		v := fmt.Sprint(fields[k])
+		if len(v) == 0 || strings.ContainsAny(v, " =\"\n") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(" " + k + "=" + v)
+	}
+	return b.String()
+}
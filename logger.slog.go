@@ -0,0 +1,50 @@
+//go:build go1.21
+// +build go1.21
+
+package auth
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// slogLogger writes to a log/slog Logger
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger creates a Logger that writes to l, with fields as attributes sorted by key.
+// If l is nil slog.Default() is used.
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) Log(level Level, msg string, fields Fields) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]slog.Attr, len(keys))
+	for i, k := range keys {
+		attrs[i] = slog.Any(k, fields[k])
+	}
+	s.l.LogAttrs(context.Background(), slogLevel(level), msg, attrs...)
+}
+
+// slogLevel maps a Level to the slog level of the same name
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelInfo:
+		return slog.LevelInfo
+	case LevelWarn:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
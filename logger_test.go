@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// captureLogger keeps every entry logged to it
+type captureLogger struct {
+	mu      sync.Mutex
+	entries []captureEntry
+}
+
+type captureEntry struct {
+	level  Level
+	msg    string
+	fields Fields
+}
+
+func (c *captureLogger) Log(level Level, msg string, fields Fields) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, captureEntry{level, msg, fields})
+}
+
+func (c *captureLogger) find(msg string) (captureEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return captureEntry{}, false
+}
+
+func TestFormatLogLine(t *testing.T) {
+	line := formatLogLine("Error sending email", Fields{"user_id": "abc", "error": "dial tcp: timeout", "empty": "", "attempts": 3})
+	expected := `Error sending email attempts=3 empty="" error="dial tcp: timeout" user_id=abc`
+	if line != expected {
+		t.Fatalf("Expected %s. Instead got: %s", expected, line)
+	}
+	if line := formatLogLine("no fields", nil); line != "no fields" {
+		t.Fatalf("Expected just the message. Instead got: %s", line)
+	}
+}
+
+func TestLogCtx(t *testing.T) {
+	orig := Log
+	defer func() { Log = orig }()
+	capture := &captureLogger{}
+	Log = capture
+
+	ctx := ContextWithLogFields(context.Background(), Fields{"request_id": "r1", "user_id": "u1"})
+	ctx = ContextWithLogFields(ctx, Fields{"operation": "auth.GetUser"})
+	if f := LogFieldsFromContext(ctx); len(f) != 3 {
+		t.Fatalf("Expected the fields to be merged. Instead got: %v", f)
+	}
+
+	logCtx(ctx, LevelWarn, "something failed", Fields{"error": errors.New("boom"), "user_id": "u2"})
+	e, ok := capture.find("something failed")
+	if !ok || e.level != LevelWarn {
+		t.Fatalf("Expected a warning to be logged. Instead got: %+v", capture.entries)
+	}
+	if e.fields["request_id"] != "r1" || e.fields["operation"] != "auth.GetUser" || e.fields["user_id"] != "u2" {
+		t.Fatalf("Expected the context's fields, overridden by the entry's. Instead got: %v", e.fields)
+	}
+	if e.fields["error"] != "boom" {
+		t.Fatalf("Expected the error to be logged as its message. Instead got: %#v", e.fields["error"])
+	}
+
+	// a nil Log discards entries
+	Log = nil
+	logCtx(ctx, LevelError, "discarded", nil)
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// LoginAlerts can/should be set by applications using auth.
+// When it is true a LoginAlertEmail is sent for logins from a device or network the user has not logged in from before.
+var LoginAlerts = true
+
+// LoginHistoryLimit is the number of logins ListLoginHistory returns when limit is zero.
+// It can/should be set by applications using auth.
+var LoginHistoryLimit = 50
+
+// LoginRecord is a successful login to a user's account
+type LoginRecord struct {
+	ID     uuid.UUID `db:"id" json:"id"`
+	UserID uuid.UUID `db:"user_id" json:"user_id"`
+	// Method is how the user proved who they are: "password", "magic_link", "passkey", "register" or "invite".
+	// A login that also needed a passkey as a second factor is "password+passkey" or "magic_link+passkey".
+	Method    string `db:"method" json:"method"`
+	IP        string `db:"ip" json:"ip"`
+	UserAgent string `db:"user_agent" json:"user_agent"`
+	// Fingerprint and Network identify the device and network the login came from. See DeviceFingerprint and LoginNetwork.
+	Fingerprint string `db:"fingerprint" json:"fingerprint"`
+	Network     string `db:"network" json:"network"`
+	// IsNew is true when the device or network had not been seen before
+	IsNew     bool      `db:"is_new" json:"is_new"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// uaVersion matches the version numbers in a user agent
+var uaVersion = regexp.MustCompile(`[0-9]+([._][0-9]+)*`)
+
+// DeviceFingerprint derives an identifier for the device a user agent belongs to.
+// Version numbers are ignored so updating the browser or OS does not make it a new device.
+func DeviceFingerprint(userAgent string) string {
+	ua := uaVersion.ReplaceAllString(strings.ToLower(strings.TrimSpace(userAgent)), "")
+	sum := sha256.Sum256([]byte(ua))
+	return hex.EncodeToString(sum[:8])
+}
+
+// LoginNetwork returns the network ip belongs to: its /24 for IPv4 and /48 for IPv6.
+// Addresses that can't be parsed are returned unchanged.
+func LoginNetwork(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+func (s *authService) ListLoginHistory(ctx context.Context, userID uuid.UUID, limit int) ([]LoginRecord, error) {
+	if limit <= 0 {
+		limit = LoginHistoryLimit
+	}
+	logins := []LoginRecord{}
+	err := s.db.SelectContext(ctx, &logins, "SELECT * FROM login_history WHERE user_id=$1 ORDER BY created_at DESC LIMIT $2", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return logins, nil
+}
+
+func (s *authService) ReportLogin(ctx context.Context, token string) (User, error) {
+	u, err := s.useUserToken(ctx, token, "auth.LoginAlert")
+	if err != nil {
+		return User{}, err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return User{}, err
+	}
+
+	// whoever logged in is thrown out and has to race the user for the reset link in their inbox
+	u, err = s.RevokeSessions(ctx, u.ID)
+	if err != nil {
+		return User{}, err
+	}
+	err = s.BeginPasswordReset(ctx, u.Email)
+	if err != nil {
+		return User{}, err
+	}
+	s.auditAs(ctx, AuditLoginReported, u.ID, u.ID, nil)
+
+	return u, nil
+}
+
+// deferredLoginKey is the context key set by ContextWithDeferredLogin
+type deferredLoginKey struct{}
+
+// ContextWithDeferredLogin returns a copy of ctx in which AuthenticateUser, CompleteMagicLogin and FinishWebAuthnLogin
+// only check who the user is. The login is not recorded, and EventUserLoggedIn is not published, until the caller
+// calls CompleteLogin: the HTTP handler does so once a user who must also use a passkey has.
+func ContextWithDeferredLogin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deferredLoginKey{}, true)
+}
+
+// loginDeferred reports whether ctx was made by ContextWithDeferredLogin
+func loginDeferred(ctx context.Context) bool {
+	deferred, _ := ctx.Value(deferredLoginKey{}).(bool)
+	return deferred
+}
+
+// loggedIn completes the login of u, who has just proven who they are with method, unless ctx defers it
+func (s *authService) loggedIn(ctx context.Context, u User, method string) (User, error) {
+	if loginDeferred(ctx) {
+		return u, nil
+	}
+	err := s.CompleteLogin(ctx, u, method)
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+func (s *authService) CompleteLogin(ctx context.Context, u User, method string) error {
+	err := u.checkUsable()
+	if err != nil {
+		s.loginFailed(ctx, method, u.ID, u.Email, err)
+		return err
+	}
+
+	// the hooks for a successful login may veto it
+	e := s.newEvent(EventUserLoggedIn, u)
+	e.Method = method
+	err = s.inTx(ctx, s.hooks(ctx, e))
+	if err != nil {
+		incMetric(MetricLockouts, Labels{"reason": "vetoed"})
+		s.loginFailed(ctx, method, u.ID, u.Email, err)
+		return err
+	}
+	incMetric(MetricLogins, Labels{"method": method, "result": "success"})
+	s.auditAs(ctx, AuditLoginSucceeded, u.ID, u.ID, AuditDetails{"method": method})
+	s.recordLogin(ctx, u, method)
+	s.events.publish(e)
+	return nil
+}
+
+// recordLogin adds a successful login to the user's history and alerts them if it came from somewhere new.
+// The user is already logged in, so failures are logged rather than returned.
+func (s *authService) recordLogin(ctx context.Context, u User, method string) {
+	err := s.addLogin(detach(ctx), u, method)
+	if err != nil {
+		logCtx(ctx, LevelError, "Error recording login", Fields{"target_id": u.ID, "error": err})
+	}
+}
+
+func (s *authService) addLogin(ctx context.Context, u User, method string) error {
+	l := LoginRecord{
+		ID:          uuid.NewV4(),
+		UserID:      u.ID,
+		Method:      method,
+		IP:          s.auditInfo.IP,
+		UserAgent:   s.auditInfo.UserAgent,
+		Fingerprint: DeviceFingerprint(s.auditInfo.UserAgent),
+		Network:     LoginNetwork(s.auditInfo.IP),
+		CreatedAt:   time.Now(),
+	}
+
+	// the first login has nothing to compare against
+	var seen struct {
+		Logins  int `db:"logins"`
+		Devices int `db:"devices"`
+		Nets    int `db:"nets"`
+	}
+	err := s.db.GetContext(ctx, &seen, `SELECT COUNT(*) AS logins,
+	COALESCE(SUM(CASE WHEN fingerprint=$1 THEN 1 ELSE 0 END), 0) AS devices,
+	COALESCE(SUM(CASE WHEN network=$2 THEN 1 ELSE 0 END), 0) AS nets
+	FROM login_history WHERE user_id=$3`, l.Fingerprint, l.Network, u.ID)
+	if err != nil {
+		return err
+	}
+	l.IsNew = seen.Logins > 0 && (seen.Devices == 0 || seen.Nets == 0)
+
+	fns := []txFunc{func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, `INSERT INTO login_history
+		(id, user_id, method, ip, user_agent, fingerprint, network, is_new, created_at)
+		VALUES (:id, :user_id, :method, :ip, :user_agent, :fingerprint, :network, :is_new, :created_at)`, &l)
+		return err
+	}}
+	if l.IsNew && LoginAlerts {
+		// create nonce for the "this wasn't me" link
+		n, err := s.nonce.New("auth.LoginAlert", u.ID, LoginAlertExpiry)
+		if err != nil {
+			return err
+		}
+		data := newEmailData(u)
+		data.Token = userToken(u.ID, n.Token)
+		data.Link = BaseURL + "/logins/report/" + data.Token
+		data.ExpiresAt = l.CreatedAt.Add(LoginAlertExpiry)
+		data.Login = l
+		fns = append(fns, func(tx *sqlx.Tx) error {
+			return s.queueEmail(ctx, tx, LoginAlertEmail, u.Email, data)
+		})
+	}
+
+	return s.inTx(ctx, fns...)
+}
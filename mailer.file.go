@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// maildirMailer writes every email to a Maildir so it can be read during development
+type maildirMailer struct {
+	dir   string
+	host  string
+	count uint64
+}
+
+// NewMaildirMailer creates a Mailer that delivers into the Maildir at dir.
+// The tmp, new and cur subdirectories are created if they do not exist.
+func NewMaildirMailer(dir string) (Mailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	return &maildirMailer{dir: dir, host: host}, nil
+}
+
+func (m *maildirMailer) Send(ctx context.Context, e Email) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t := time.Now()
+	name := fmt.Sprintf("%d.%d_%d.%s", t.Unix(), t.UnixNano(), atomic.AddUint64(&m.count, 1), m.host)
+	tmp := filepath.Join(m.dir, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeMIME(f, e, t)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// delivery is the atomic move from tmp to new
+	return os.Rename(tmp, filepath.Join(m.dir, "new", name))
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"context"
+
+	"gopkg.in/mailgun/mailgun-go.v1"
+)
+
+// mailgunMailer sends email through the Mailgun API
+type mailgunMailer struct {
+	mg mailgun.Mailgun
+}
+
+// NewMailgunMailer creates a Mailer that sends through Mailgun
+func NewMailgunMailer(mg mailgun.Mailgun) Mailer {
+	return &mailgunMailer{mg: mg}
+}
+
+// Send checks ctx before calling Mailgun; the v1 client can't be interrupted once the request is made.
+func (m *mailgunMailer) Send(ctx context.Context, e Email) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg := m.mg.NewMessage(e.From, e.Subject, e.PlainText, e.To)
+	if len(e.HTML) > 0 {
+		msg.SetHtml(e.HTML)
+	}
+
+	_, _, err := m.mg.Send(msg)
+	return err
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryMailer records every email it is asked to send. It is intended for tests.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Email
+	err  error
+}
+
+// NewMemoryMailer creates an empty MemoryMailer
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send records e. If FailWith was given an error, or ctx is done, nothing is recorded and that error is returned.
+func (m *MemoryMailer) Send(ctx context.Context, e Email) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, e)
+	return nil
+}
+
+// FailWith makes every following Send return err. Pass nil to succeed again.
+func (m *MemoryMailer) FailWith(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// Messages returns a copy of every recorded email in the order they were sent
+func (m *MemoryMailer) Messages() []Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Email(nil), m.sent...)
+}
+
+// Last returns the most recently recorded email
+func (m *MemoryMailer) Last() (Email, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		return Email{}, false
+	}
+	return m.sent[len(m.sent)-1], true
+}
+
+// Reset forgets every recorded email
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = nil
+}
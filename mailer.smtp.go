@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// smtpMailer sends email through an SMTP server
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates a Mailer that sends through the SMTP server at addr ("host:port").
+// auth may be nil if the server does not require authentication.
+func NewSMTPMailer(addr string, auth smtp.Auth) Mailer {
+	return &smtpMailer{addr: addr, auth: auth}
+}
+
+func (m *smtpMailer) Send(ctx context.Context, e Email) error {
+	from, err := mail.ParseAddress(e.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(e.To)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = writeMIME(&buf, e, time.Now())
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+
+	// smtp.Client has no context, so a done ctx interrupts it through the connection's deadline
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	err = m.send(conn, host, from.Address, to.Address, buf.Bytes())
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// send has the conversation smtp.SendMail has, over conn
+func (m *smtpMailer) send(conn net.Conn, host, from, to string, msg []byte) error {
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		err = c.Auth(m.auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(to)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
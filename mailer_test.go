@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildirMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-maildir")
+	if err != nil {
+		t.Fatalf("Expected to create temp dir. Instead got the error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewMaildirMailer(dir)
+	if err != nil {
+		t.Fatalf("Expected to create Maildir. Instead got the error: %v", err)
+	}
+
+	e := Email{
+		From:      "from@example.com",
+		To:        "to@example.com",
+		Subject:   "Hello",
+		PlainText: "plain body",
+		HTML:      "<p>html body</p>",
+	}
+	err = m.Send(context.Background(), e)
+	if err != nil {
+		t.Fatalf("Expected to send email. Instead got the error: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 message in new/. Instead got: %d (error: %v)", len(files), err)
+	}
+	f, err := os.Open(filepath.Join(dir, "new", files[0].Name()))
+	if err != nil {
+		t.Fatalf("Expected to open message. Instead got the error: %v", err)
+	}
+	defer f.Close()
+
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("Expected to parse message. Instead got the error: %v", err)
+	}
+	if msg.Header.Get("To") != e.To || msg.Header.Get("Subject") != e.Subject {
+		t.Fatalf("Expected To: %s and Subject: %s. Instead got: %v", e.To, e.Subject, msg.Header)
+	}
+	if !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/alternative") {
+		t.Fatalf("Expected a multipart/alternative message. Instead got: %s", msg.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	if !strings.Contains(string(body), e.PlainText) || !strings.Contains(string(body), e.HTML) {
+		t.Fatalf("Expected body to contain both parts. Instead got: %s", body)
+	}
+}
@@ -0,0 +1,284 @@
+package auth
+
+// defaultCatalog holds the English copy of every message auth renders.
+// Keys are prefixed with the template that uses them.
+// Email subjects are translated with the key "<TplName>.subject"; when a locale has no subject the EmailMessage's Subject is used.
+var defaultCatalog = Catalog{
+	// Flash messages
+	"auth.flash.incorrectLogin":       "Error: Username and/or Password was incorrect!",
+	"auth.flash.loggedOut":            "You have been logged out.",
+	"auth.flash.magicLoginSent":       "If an account exists for that email, a login link has been sent to it.",
+	"auth.flash.invalidLink":          "Error: That link is invalid or has expired.",
+	"auth.flash.passkeyFailed":        "Error: Your passkey could not be verified.",
+	"auth.flash.passkeyExists":        "That passkey is already registered.",
+	"auth.flash.loginRequired":        "Error: You must be logged in.",
+	"auth.flash.invalidEmail":         "Error: That email address is not valid.",
+	"auth.flash.emailInUse":           "Error: That email address is already in use.",
+	"auth.flash.emailChangeSent":      "A confirmation link has been sent to %s.",
+	"auth.flash.emailChanged":         "Your email address has been changed.",
+	"auth.flash.emailChangeCancelled": "The email address change has been cancelled.",
+	"auth.flash.forbidden":            "Error: You do not have permission to do that.",
+	"auth.flash.adminSelf":            "Error: You cannot do that to your own account.",
+	"auth.flash.userUpdated":          "The user has been updated.",
+	"auth.flash.invalidName":          "Error: First and last name cannot be blank.",
+	"auth.flash.passwordResetSent":    "A password reset link has been sent to %s.",
+	"auth.flash.accountDisabled":      "Error: This account has been disabled.",
+	"auth.flash.userDeleted":          "Error: The user has been deleted. Restore them first.",
+	"auth.flash.userInactive":         "Error: The user is not active.",
+	"auth.flash.dataExportStarted":    "Your data is being gathered. A download link will be emailed to %s.",
+	"auth.flash.dataExportPending":    "Your data is already being gathered. Wait for the email with the download link.",
+	"auth.flash.loginReported":        "Every session has been logged out. A password reset link has been sent to %s.",
+	"auth.flash.orgCreated":           "%s has been created.",
+	"auth.flash.orgUpdated":           "The organization has been updated.",
+	"auth.flash.orgDeleted":           "%s has been deleted.",
+	"auth.flash.orgNameRequired":      "Error: The organization name cannot be blank.",
+	"auth.flash.orgInviteSent":        "An invitation has been sent to %s.",
+	"auth.flash.orgInviteRevoked":     "The invitation has been revoked.",
+	"auth.flash.orgInviteLogin":       "Log in with the email address the invitation was sent to, then open the link again.",
+	"auth.flash.orgJoined":            "You have joined %s.",
+	"auth.flash.orgAlreadyMember":     "You are already a member of that organization.",
+	"auth.flash.orgMemberExists":      "Error: %s is already a member.",
+	"auth.flash.orgMemberUpdated":     "The member's role has been changed.",
+	"auth.flash.orgMemberRemoved":     "The member has been removed.",
+	"auth.flash.orgLeft":              "You have left %s.",
+	"auth.flash.orgLastOwner":         "Error: An organization must keep at least one owner.",
+	"auth.flash.registered":           "Welcome! Your account has been created.",
+	"auth.flash.registerInvalid":      "Error: Please fill in every field.",
+	"auth.flash.userInviteSent":       "An invitation to sign up has been sent to %s.",
+	"auth.flash.userInviteRevoked":    "The invitation has been revoked.",
+	"auth.flash.invalidRole":          "Error: Choose a role and an existing organization, or leave the organization blank.",
+	"auth.flash.apiKeyNameRequired":   "Error: The API key needs a name.",
+	"auth.flash.apiKeyInvalidScope":   "Error: One of the scopes can't be given to an API key.",
+	"auth.flash.apiKeyRevoked":        "The API key has been revoked.",
+
+	// Login page
+	"auth.Tpl.Login.legend":              "Sign In",
+	"auth.Tpl.Login.email":               "Email",
+	"auth.Tpl.Login.emailPlaceholder":    "your.email@example.com",
+	"auth.Tpl.Login.password":            "Password",
+	"auth.Tpl.Login.passwordPlaceholder": "Your Password",
+	"auth.Tpl.Login.submit":              "Login",
+	"auth.Tpl.Login.registerHeading":     "Or Create a New Account",
+	"auth.Tpl.Login.register":            "Sign Up",
+	"auth.Tpl.Login.magicLogin":          "Email me a login link instead",
+	"auth.Tpl.Login.passkey":             "Sign in with a passkey",
+
+	// Register page
+	"auth.Tpl.Register.legend":    "Create an Account",
+	"auth.Tpl.Register.invited":   "You have been invited. Choose a name and password to finish creating your account.",
+	"auth.Tpl.Register.firstName": "First Name",
+	"auth.Tpl.Register.lastName":  "Last Name",
+	"auth.Tpl.Register.submit":    "Sign Up",
+	"auth.Tpl.Register.login":     "Already have an account? Sign in",
+
+	// Magic login page
+	"auth.Tpl.MagicLogin.legend": "Sign In With an Email Link",
+	"auth.Tpl.MagicLogin.submit": "Send Link",
+
+	// Email change page
+	"auth.Tpl.EmailChange.legend":  "Change Your Email Address",
+	"auth.Tpl.EmailChange.current": "Your current address is %s.",
+	"auth.Tpl.EmailChange.email":   "New Email",
+	"auth.Tpl.EmailChange.submit":  "Send Confirmation Link",
+
+	// Confirmation pages for the links in emails
+	"auth.Tpl.EmailChangeCancel.legend":   "Keep Your Email Address",
+	"auth.Tpl.EmailChangeCancel.explain":  "Cancel the change of your account's email address and keep this one.",
+	"auth.Tpl.EmailChangeCancel.submit":   "Cancel Email Change",
+	"auth.Tpl.DataExportDownload.legend":  "Download Your Data",
+	"auth.Tpl.DataExportDownload.explain": "Your data is ready. The link works once, so keep the zip file somewhere safe.",
+	"auth.Tpl.DataExportDownload.submit":  "Download",
+	"auth.Tpl.LoginReport.legend":         "Report a Login",
+	"auth.Tpl.LoginReport.explain":        "If you didn't log in, every session of your account will be logged out and a password reset link will be emailed to you.",
+	"auth.Tpl.LoginReport.submit":         "This Wasn't Me",
+
+	// Data export page
+	"auth.Tpl.DataExport.legend":  "Download Your Data",
+	"auth.Tpl.DataExport.explain": "We will gather everything your account holds into a zip file of JSON documents and email you a link to download it.",
+	"auth.Tpl.DataExport.submit":  "Request My Data",
+
+	// Login history page
+	"auth.Tpl.LoginHistory.legend":                    "Recent Logins",
+	"auth.Tpl.LoginHistory.when":                      "When",
+	"auth.Tpl.LoginHistory.method":                    "Method",
+	"auth.Tpl.LoginHistory.ip":                        "IP Address",
+	"auth.Tpl.LoginHistory.device":                    "Device",
+	"auth.Tpl.LoginHistory.new":                       "New",
+	"auth.Tpl.LoginHistory.none":                      "There are no logins to show.",
+	"auth.Tpl.LoginHistory.notMe":                     "If you don't recognize a login, change your password.",
+	"auth.Tpl.LoginHistory.method.password":           "Password",
+	"auth.Tpl.LoginHistory.method.magic_link":         "Email link",
+	"auth.Tpl.LoginHistory.method.passkey":            "Passkey",
+	"auth.Tpl.LoginHistory.method.password+passkey":   "Password and passkey",
+	"auth.Tpl.LoginHistory.method.magic_link+passkey": "Email link and passkey",
+	"auth.Tpl.LoginHistory.method.register":           "Sign up",
+	"auth.Tpl.LoginHistory.method.invite":             "Invitation",
+
+	// Passkey pages
+	"auth.Tpl.WebAuthn.legend":   "Passkeys",
+	"auth.Tpl.WebAuthn.created":  "Added %s",
+	"auth.Tpl.WebAuthn.lastUsed": "last used %s",
+	"auth.Tpl.WebAuthn.delete":   "Remove",
+	"auth.Tpl.WebAuthn.none":     "You have not added a passkey yet.",
+	"auth.Tpl.WebAuthn.add":      "Add a Passkey",
+
+	"auth.Tpl.WebAuthnVerify.legend": "Confirm It's You",
+	"auth.Tpl.WebAuthnVerify.intro":  "Use one of your passkeys to finish signing in.",
+	"auth.Tpl.WebAuthnVerify.submit": "Use a Passkey",
+
+	// Admin pages
+	"auth.Tpl.AdminUsers.legend":           "Users",
+	"auth.Tpl.AdminUsers.search":           "Name or email",
+	"auth.Tpl.AdminUsers.submit":           "Search",
+	"auth.Tpl.AdminUsers.total":            "%d users found.",
+	"auth.Tpl.AdminUsers.name":             "Name",
+	"auth.Tpl.AdminUsers.email":            "Email",
+	"auth.Tpl.AdminUsers.status":           "Status",
+	"auth.Tpl.AdminUsers.created":          "Created",
+	"auth.Tpl.AdminUsers.none":             "No users match.",
+	"auth.Tpl.AdminUsers.next":             "Next Page",
+	"auth.Tpl.AdminUsers.invites":          "Invite Someone",
+	"auth.Tpl.AdminUsers.status.current":   "Not deleted",
+	"auth.Tpl.AdminUsers.status.active":    "Active",
+	"auth.Tpl.AdminUsers.status.inactive":  "Inactive",
+	"auth.Tpl.AdminUsers.status.superuser": "Superuser",
+	"auth.Tpl.AdminUsers.status.deleted":   "Deleted",
+	"auth.Tpl.AdminUsers.status.all":       "All",
+
+	"auth.Tpl.AdminUser.back":                   "Back to Users",
+	"auth.Tpl.AdminUser.firstName":              "First Name",
+	"auth.Tpl.AdminUser.lastName":               "Last Name",
+	"auth.Tpl.AdminUser.email":                  "Email",
+	"auth.Tpl.AdminUser.locale":                 "Locale",
+	"auth.Tpl.AdminUser.submit":                 "Save",
+	"auth.Tpl.AdminUser.created":                "Created %s",
+	"auth.Tpl.AdminUser.deleted":                "Deleted %s",
+	"auth.Tpl.AdminUser.action.activate":        "Activate",
+	"auth.Tpl.AdminUser.action.deactivate":      "Deactivate",
+	"auth.Tpl.AdminUser.action.promote":         "Make Superuser",
+	"auth.Tpl.AdminUser.action.demote":          "Remove Superuser",
+	"auth.Tpl.AdminUser.action.reset-password":  "Send Password Reset",
+	"auth.Tpl.AdminUser.action.revoke-sessions": "Log Out Everywhere",
+	"auth.Tpl.AdminUser.action.delete":          "Delete",
+	"auth.Tpl.AdminUser.action.restore":         "Restore",
+
+	"auth.Tpl.AdminInvites.legend":    "Invite Someone",
+	"auth.Tpl.AdminInvites.email":     "Email",
+	"auth.Tpl.AdminInvites.org":       "Organization ID (optional)",
+	"auth.Tpl.AdminInvites.superuser": "Make them a superuser",
+	"auth.Tpl.AdminInvites.submit":    "Send Invitation",
+	"auth.Tpl.AdminInvites.roles":     "Roles",
+	"auth.Tpl.AdminInvites.expires":   "Expires",
+	"auth.Tpl.AdminInvites.revoke":    "Revoke",
+	"auth.Tpl.AdminInvites.none":      "There are no pending invitations.",
+
+	// API keys page
+	"auth.Tpl.APIKeys.legend":            "API Keys",
+	"auth.Tpl.APIKeys.created":           "Your new API key is below. Copy it now; it won't be shown again.",
+	"auth.Tpl.APIKeys.name":              "Name",
+	"auth.Tpl.APIKeys.key":               "Key",
+	"auth.Tpl.APIKeys.scopes":            "Scopes",
+	"auth.Tpl.APIKeys.scopesPlaceholder": "read write",
+	"auth.Tpl.APIKeys.lastUsed":          "Last Used",
+	"auth.Tpl.APIKeys.expires":           "Expires",
+	"auth.Tpl.APIKeys.never":             "Never",
+	"auth.Tpl.APIKeys.days":              "In %d days",
+	"auth.Tpl.APIKeys.revoke":            "Revoke",
+	"auth.Tpl.APIKeys.none":              "You don't have any API keys.",
+	"auth.Tpl.APIKeys.create":            "Create an API Key",
+	"auth.Tpl.APIKeys.submit":            "Create",
+
+	// Organization pages
+	"auth.Tpl.Orgs.legend":      "Your Organizations",
+	"auth.Tpl.Orgs.active":      "Active",
+	"auth.Tpl.Orgs.switch":      "Switch",
+	"auth.Tpl.Orgs.none":        "You don't belong to an organization yet.",
+	"auth.Tpl.Orgs.create":      "Create an Organization",
+	"auth.Tpl.Orgs.name":        "Name",
+	"auth.Tpl.Orgs.submit":      "Create",
+	"auth.Tpl.Orgs.role.owner":  "Owner",
+	"auth.Tpl.Orgs.role.admin":  "Admin",
+	"auth.Tpl.Orgs.role.member": "Member",
+
+	"auth.Tpl.Org.back":      "Back to Organizations",
+	"auth.Tpl.Org.name":      "Name",
+	"auth.Tpl.Org.rename":    "Rename",
+	"auth.Tpl.Org.member":    "Member",
+	"auth.Tpl.Org.email":     "Email",
+	"auth.Tpl.Org.role":      "Role",
+	"auth.Tpl.Org.setRole":   "Change",
+	"auth.Tpl.Org.remove":    "Remove",
+	"auth.Tpl.Org.leave":     "Leave",
+	"auth.Tpl.Org.invites":   "Invitations",
+	"auth.Tpl.Org.noInvites": "There are no pending invitations.",
+	"auth.Tpl.Org.expires":   "expires %s",
+	"auth.Tpl.Org.revoke":    "Revoke",
+	"auth.Tpl.Org.invite":    "Send Invitation",
+	"auth.Tpl.Org.delete":    "Delete Organization",
+
+	// Emails
+	"auth.email.greeting": "Hello %s %s,",
+	"auth.email.expires":  "This link expires at %s.",
+
+	"auth.NewUserEmail.title": "Welcome New User",
+	"auth.NewUserEmail.body":  "Welcome to %s. Thank you for signing up.",
+
+	"auth.PasswordResetEmail.title":      "Password Reset",
+	"auth.PasswordResetEmail.intro":      "Forgot your password? No problem!",
+	"auth.PasswordResetEmail.action":     "To reset your password, click the following link:",
+	"auth.PasswordResetEmail.actionText": "To reset your password, visit the following link:",
+	"auth.PasswordResetEmail.link":       "Reset Password",
+	"auth.PasswordResetEmail.ignore":     "If you did not request to have your password reset you can safely ignore this email. Rest assured your customer account is safe.",
+
+	"auth.MagicLoginEmail.title":  "Your Login Link",
+	"auth.MagicLoginEmail.action": "To log in to %s, click the following link:",
+	"auth.MagicLoginEmail.link":   "Log In",
+	"auth.MagicLoginEmail.once":   "It can only be used once.",
+	"auth.MagicLoginEmail.ignore": "If you did not ask for a login link you can safely ignore this email.",
+
+	"auth.EmailChangeConfirmEmail.title":  "Confirm Your New Email Address",
+	"auth.EmailChangeConfirmEmail.action": "To use this address for your %s account, click the following link:",
+	"auth.EmailChangeConfirmEmail.link":   "Confirm Email Address",
+	"auth.EmailChangeConfirmEmail.ignore": "If you did not ask to change your email address you can safely ignore this email.",
+
+	"auth.EmailChangeNoticeEmail.title":  "Your Email Address Is Changing",
+	"auth.EmailChangeNoticeEmail.body":   "Someone asked to change the email address of your %s account to %s.",
+	"auth.EmailChangeNoticeEmail.action": "If this wasn't you, click the following link to keep this address:",
+	"auth.EmailChangeNoticeEmail.link":   "Cancel Email Change",
+
+	"auth.PasswordResetConfirmEmail.title": "Password Reset Complete",
+	"auth.PasswordResetConfirmEmail.body":  "Your %s account's password was recently changed.",
+
+	"auth.DataExportEmail.title":  "Your Data Export Is Ready",
+	"auth.DataExportEmail.action": "A copy of the personal data your %s account holds is ready. To download it, click the following link:",
+	"auth.DataExportEmail.link":   "Download My Data",
+	"auth.DataExportEmail.once":   "It can only be used once.",
+	"auth.DataExportEmail.ignore": "If you did not ask for a copy of your data, please change your password.",
+
+	"auth.LoginAlertEmail.title":  "New Login to Your Account",
+	"auth.LoginAlertEmail.body":   "Your %s account was just logged in to from a device or network it has not been used from before.",
+	"auth.LoginAlertEmail.when":   "When: %s",
+	"auth.LoginAlertEmail.ip":     "IP address: %s",
+	"auth.LoginAlertEmail.device": "Device: %s",
+	"auth.LoginAlertEmail.ignore": "If this was you, you can safely ignore this email.",
+	"auth.LoginAlertEmail.action": "If this wasn't you, click the following link. It logs out every session and sends you a link to choose a new password:",
+	"auth.LoginAlertEmail.link":   "This Wasn't Me",
+
+	"auth.OrgInviteEmail.title":  "You Have Been Invited to Join an Organization",
+	"auth.OrgInviteEmail.body":   "%s %s has invited you to join %s on %s as %s.",
+	"auth.OrgInviteEmail.action": "To accept the invitation, log in or sign up with this email address and click the following link:",
+	"auth.OrgInviteEmail.link":   "Accept Invitation",
+	"auth.OrgInviteEmail.ignore": "If you don't want to join you can safely ignore this email.",
+
+	"auth.UserInviteEmail.title":    "You Have Been Invited",
+	"auth.UserInviteEmail.greeting": "Hello,",
+	"auth.UserInviteEmail.body":     "%s %s has invited you to sign up for %s.",
+	"auth.UserInviteEmail.org":      "You will join %s as %s.",
+	"auth.UserInviteEmail.action":   "To accept the invitation and create your account, click the following link:",
+	"auth.UserInviteEmail.link":     "Create My Account",
+	"auth.UserInviteEmail.ignore":   "If you don't want an account you can safely ignore this email.",
+
+	"auth.orgRole.owner":  "an owner",
+	"auth.orgRole.admin":  "an admin",
+	"auth.orgRole.member": "a member",
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"strings"
+	"time"
+)
+
+// Metric names. Counters end in _total and histograms in _seconds.
+const (
+	// MetricLogins counts login attempts by "method" and "result" ("success", "failure" or "locked")
+	MetricLogins = "auth_logins_total"
+	// MetricLockouts counts logins refused to an account that may not log in, by "reason":
+	// "inactive", "deleted" or "vetoed" (an EventUserLoggedIn hook returned an error)
+	MetricLockouts = "auth_lockouts_total"
+	// MetricRegistrations counts NewUserLocal calls by "result" ("success", "exists" or "error")
+	MetricRegistrations = "auth_registrations_total"
+	// MetricPasswordResetRequests and MetricPasswordResetCompletions count BeginPasswordReset
+	// and CompletePasswordReset calls by "result" ("success" or "failure")
+	MetricPasswordResetRequests    = "auth_password_reset_requests_total"
+	MetricPasswordResetCompletions = "auth_password_reset_completions_total"
+	// MetricEmails counts outbox delivery attempts by "result" ("sent", "failed" or "dead")
+	MetricEmails = "auth_emails_total"
+	// MetricDBDuration observes database calls by "operation", i.e. "select user" or "transaction"
+	MetricDBDuration = "auth_db_duration_seconds"
+	// MetricHTTPRequests counts requests to the HTTP handler by "route", "method" and "code"
+	MetricHTTPRequests = "auth_http_requests_total"
+	// MetricHTTPDuration observes requests to the HTTP handler by "route" and "method"
+	MetricHTTPDuration = "auth_http_request_duration_seconds"
+)
+
+// metricHelp describes every metric auth records. Exporters use it for their help text.
+var metricHelp = map[string]string{
+	MetricLogins:                   "Login attempts by method and result.",
+	MetricLockouts:                 "Logins refused to accounts that may not log in, by reason.",
+	MetricRegistrations:            "Local user registrations by result.",
+	MetricPasswordResetRequests:    "Password reset requests by result.",
+	MetricPasswordResetCompletions: "Password reset completions by result.",
+	MetricEmails:                   "Outbox email delivery attempts by result.",
+	MetricDBDuration:               "Duration of database calls by operation.",
+	MetricHTTPRequests:             "HTTP requests by route, method and status code.",
+	MetricHTTPDuration:             "Duration of HTTP requests by route and method.",
+}
+
+// Labels are the label names and values of one series of a metric
+type Labels map[string]string
+
+// Metrics receives the measurements auth takes. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Inc adds one to the counter name
+	Inc(name string, labels Labels)
+	// Observe adds v to the histogram name
+	Observe(name string, v float64, labels Labels)
+}
+
+// MetricsRecorder can/should be set by applications using auth.
+// Every measurement auth takes is given to it, i.e. a PrometheusMetrics. By default they are discarded.
+var MetricsRecorder Metrics
+
+// incMetric adds one to a counter of MetricsRecorder
+func incMetric(name string, labels Labels) {
+	if MetricsRecorder != nil {
+		MetricsRecorder.Inc(name, labels)
+	}
+}
+
+// observeSince adds the time since start to a histogram of MetricsRecorder
+func observeSince(name string, start time.Time, labels Labels) {
+	if MetricsRecorder != nil {
+		MetricsRecorder.Observe(name, time.Since(start).Seconds(), labels)
+	}
+}
+
+// resultLabel is "success" when err is nil and "failure" otherwise
+func resultLabel(err error) Labels {
+	if err != nil {
+		return Labels{"result": "failure"}
+	}
+	return Labels{"result": "success"}
+}
+
+// queryOperation names a query by its verb and table, i.e. "select user", so it can be used as a label
+func queryOperation(query string) string {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return "unknown"
+	}
+
+	verb, table := words[0], ""
+	next := func(after string) {
+		for i, w := range words[:len(words)-1] {
+			if w == after {
+				table = words[i+1]
+				return
+			}
+		}
+	}
+	switch verb {
+	case "select", "delete":
+		next("from")
+	case "insert":
+		next("into")
+	case "update":
+		if len(words) > 1 {
+			table = words[1]
+		}
+	}
+	table = strings.Trim(table, "(`\"")
+	if len(table) == 0 {
+		return verb
+	}
+	return verb + " " + table
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets, in seconds, a PrometheusMetrics uses unless Buckets is set
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics keeps the measurements auth takes in memory and serves them in the
+// Prometheus text exposition format. Set it as the MetricsRecorder and mount it on the
+// router, i.e. router.Handle("/metrics", m).
+type PrometheusMetrics struct {
+	// Buckets are the upper bounds of the histogram buckets. Set it before the first measurement.
+	Buckets []float64
+
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// histogram is one series of a histogram metric
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusMetrics creates an empty PrometheusMetrics with the DefaultBuckets
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		Buckets:    DefaultBuckets,
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// Inc adds one to the counter name
+func (m *PrometheusMetrics) Inc(name string, labels Labels) {
+	key := formatLabels(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.counters[name] = series
+	}
+	series[key]++
+}
+
+// Observe adds v to the histogram name
+func (m *PrometheusMetrics) Observe(name string, v float64, labels Labels) {
+	key := formatLabels(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.histograms[name] = series
+	}
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.Buckets))}
+		series[key] = h
+	}
+	for i, le := range m.Buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.text())
+}
+
+// text renders the metrics, sorted by name and labels so the output is stable
+func (m *PrometheusMetrics) text() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, name := range sortedKeys(m.counters) {
+		writeHeader(&buf, name, "counter")
+		series := m.counters[name]
+		for _, key := range sortedKeys(series) {
+			fmt.Fprintf(&buf, "%s%s %s\n", name, key, formatFloat(series[key]))
+		}
+	}
+	for _, name := range sortedKeys(m.histograms) {
+		writeHeader(&buf, name, "histogram")
+		series := m.histograms[name]
+		for _, key := range sortedKeys(series) {
+			h := series[key]
+			for i, le := range m.Buckets {
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, withLabel(key, "le", formatFloat(le)), h.counts[i])
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, withLabel(key, "le", "+Inf"), h.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", name, key, formatFloat(h.sum))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, name, typ string) {
+	if help, ok := metricHelp[name]; ok {
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+}
+
+// formatLabels renders labels as {name="value",...} sorted by name. No labels render as "".
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, k := range names {
+		pairs[i] = k + `="` + labelEscaper.Replace(labels[k]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes a label value as the text format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// withLabel adds name="value" to labels formatted by formatLabels
+func withLabel(key, name, value string) string {
+	pair := name + `="` + value + `"`
+	if len(key) == 0 {
+		return "{" + pair + "}"
+	}
+	return key[:len(key)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.Buckets = []float64{0.1, 1}
+	m.Inc(MetricLogins, Labels{"result": "success", "method": "password"})
+	m.Inc(MetricLogins, Labels{"method": "password", "result": "success"})
+	m.Inc(MetricLogins, Labels{"method": "passkey", "result": "failure"})
+	m.Inc("custom_total", Labels{"path": "a\"b\\c\nd"})
+	m.Observe(MetricDBDuration, 0.05, Labels{"operation": "select user"})
+	m.Observe(MetricDBDuration, 0.5, Labels{"operation": "select user"})
+	m.Observe(MetricDBDuration, 2, Labels{"operation": "select user"})
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Expected the Prometheus text format. Instead got Content-Type: %s", ct)
+	}
+
+	expected := `# HELP auth_logins_total Login attempts by method and result.
+# TYPE auth_logins_total counter
+auth_logins_total{method="passkey",result="failure"} 1
+auth_logins_total{method="password",result="success"} 2
+# TYPE custom_total counter
+custom_total{path="a\"b\\c\nd"} 1
+# HELP auth_db_duration_seconds Duration of database calls by operation.
+# TYPE auth_db_duration_seconds histogram
+auth_db_duration_seconds_bucket{operation="select user",le="0.1"} 1
+auth_db_duration_seconds_bucket{operation="select user",le="1"} 2
+auth_db_duration_seconds_bucket{operation="select user",le="+Inf"} 3
+auth_db_duration_seconds_sum{operation="select user"} 2.55
+auth_db_duration_seconds_count{operation="select user"} 3
+`
+	if w.Body.String() != expected {
+		t.Fatalf("Expected:\n%s\nInstead got:\n%s", expected, w.Body.String())
+	}
+}
+
+func TestQueryOperation(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM user WHERE id=$1":                         "select user",
+		"SELECT COUNT(*) FROM login_history WHERE user_id=$1":    "select login_history",
+		"INSERT INTO audit_event (id, type) VALUES (:id, :type)": "insert audit_event",
+		"UPDATE email_outbox SET status=$1 WHERE id=$2":          "update email_outbox",
+		"\n\tDELETE FROM webauthn_credential WHERE user_id=$1":   "delete webauthn_credential",
+		"SELECT 1": "select",
+		"":         "unknown",
+	}
+	for q, expected := range cases {
+		if op := queryOperation(q); op != expected {
+			t.Errorf("Expected %q for %q. Instead got: %q", expected, q, op)
+		}
+	}
+}
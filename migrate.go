@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// Upgrading a user table created before email_normalized existed takes three steps:
+// run SQLAddNormalizedEmail, then BackfillNormalizedEmails, then SQLAddNormalizedEmailIndex.
+// The index can only be created once every row has its own normalized address.
+const (
+	// SQLAddNormalizedEmail adds the email_normalized column, empty for every existing user
+	SQLAddNormalizedEmail = `ALTER TABLE user ADD COLUMN email_normalized VARCHAR(255) NOT NULL DEFAULT ''`
+	// SQLAddNormalizedEmailIndex makes normalized addresses unique
+	SQLAddNormalizedEmailIndex = `CREATE UNIQUE INDEX user_email_normalized ON user(email_normalized)`
+)
+
+// BackfillNormalizedEmails sets email_normalized for every user who doesn't have one yet, using EmailLocalPart,
+// and returns how many users were updated. Run it before anyone logs in after the upgrade:
+// until then lookups by email don't find those users.
+//
+// Nothing is written if an address can't be normalized, or if two users' addresses normalize to the same one;
+// the error names them so they can be fixed by hand first.
+func BackfillNormalizedEmails(ctx context.Context, db *sqlx.DB) (int, error) {
+	rows := []struct {
+		ID              uuid.UUID
+		Email           string
+		NormalizedEmail string `db:"email_normalized"`
+		IsDeleted       bool   `db:"is_deleted"`
+	}{}
+	err := timedDB{db}.SelectContext(ctx, &rows, "SELECT id, email, email_normalized, is_deleted FROM user ORDER BY created_at")
+	if err != nil {
+		return 0, err
+	}
+
+	// every normalized address in use, with the address it came from
+	taken := map[string]string{}
+	for _, r := range rows {
+		if len(r.NormalizedEmail) > 0 {
+			taken[r.NormalizedEmail] = r.Email
+		}
+	}
+	updates := map[uuid.UUID]string{}
+	for _, r := range rows {
+		if len(r.NormalizedEmail) > 0 {
+			continue
+		}
+		normalized := deletedEmailPrefix + r.ID.String()
+		// like saveUser, a deleted user's address is only kept when it can't be reused
+		if !r.IsDeleted || !ReuseDeletedEmails {
+			normalized, err = NormalizeEmail(r.Email)
+			if err != nil {
+				return 0, fmt.Errorf("normalizing the email address of user %s (%s): %v", r.ID, r.Email, err)
+			}
+		}
+		if other, ok := taken[normalized]; ok {
+			return 0, fmt.Errorf("the email addresses %s and %s both normalize to %s", other, r.Email, normalized)
+		}
+		taken[normalized] = r.Email
+		updates[r.ID] = normalized
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for id, normalized := range updates {
+		_, err = tx.ExecContext(ctx, "UPDATE user SET email_normalized=$1 WHERE id=$2", normalized, id)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return len(updates), nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/satori/go.uuid"
+)
+
+func TestBackfillNormalizedEmails(t *testing.T) {
+	ctx := context.Background()
+	open := func(emails ...string) *sqlx.DB {
+		db := sqlx.MustConnect("sqlite3", ":memory:")
+		// every connection to :memory: is a new database
+		db.SetMaxOpenConns(1)
+		// the user table as it was before email_normalized
+		db.MustExec(`CREATE TABLE user(
+  id BINARY(16) NOT NULL,
+  email VARCHAR(255) NOT NULL,
+  is_deleted BOOL NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL
+)`)
+		for _, e := range emails {
+			db.MustExec("INSERT INTO user (id, email, is_deleted, created_at) VALUES ($1, $2, $3, $4)", uuid.NewV4(), e, false, time.Now())
+		}
+		db.MustExec(SQLAddNormalizedEmail)
+		return db
+	}
+
+	db := open("John.Doe@Example.COM", "jane@example.com")
+	defer db.Close()
+	n, err := BackfillNormalizedEmails(ctx, db)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 users to be backfilled. Instead got: %d (error: %v)", n, err)
+	}
+	_, err = db.Exec(SQLAddNormalizedEmailIndex)
+	if err != nil {
+		t.Fatalf("Expected to create the unique index. Instead got the error: %v", err)
+	}
+	var normalized []string
+	db.Select(&normalized, "SELECT email_normalized FROM user ORDER BY email_normalized")
+	if strings.Join(normalized, ",") != "jane@example.com,john.doe@example.com" {
+		t.Fatalf("Expected every address to be normalized. Instead got: %v", normalized)
+	}
+	n, err = BackfillNormalizedEmails(ctx, db)
+	if err != nil || n != 0 {
+		t.Fatalf("Expected nothing left to backfill. Instead got: %d (error: %v)", n, err)
+	}
+
+	// addresses that only differed by case can't both be kept
+	dup := open("jane@example.com", "JANE@example.com")
+	defer dup.Close()
+	_, err = BackfillNormalizedEmails(ctx, dup)
+	if err == nil || !strings.Contains(err.Error(), "JANE@example.com") {
+		t.Fatalf("Expected the clashing addresses to be reported. Instead got: %v", err)
+	}
+	var empty int
+	dup.Get(&empty, "SELECT COUNT(*) FROM user WHERE email_normalized=''")
+	if empty != 2 {
+		t.Fatalf("Expected nothing to be written. Instead %d users are left without a normalized address", empty)
+	}
+}
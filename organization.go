@@ -0,0 +1,496 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// Organization errors
+var (
+	ErrOrgNotFound    = errors.New("organization not found")
+	ErrNotMember      = errors.New("user is not a member of the organization")
+	ErrInvalidRole    = errors.New("invalid organization role")
+	ErrLastOwner      = errors.New("an organization must keep at least one owner")
+	ErrInviteNotFound = errors.New("invitation not found")
+)
+
+// Organization roles, from most to least privileged.
+// Owners manage the organization and its owners; admins manage members and invitations.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// OrgRoles lists the organization roles from most to least privileged
+var OrgRoles = []string{OrgRoleOwner, OrgRoleAdmin, OrgRoleMember}
+
+// OrgRoleAtLeast reports whether role is min or a more privileged role. Unknown roles are never enough.
+func OrgRoleAtLeast(role, min string) bool {
+	r, m := orgRoleRank(role), orgRoleRank(min)
+	return r >= 0 && m >= 0 && r <= m
+}
+
+// orgRoleRank is the position of role in OrgRoles, -1 if it is not one
+func orgRoleRank(role string) int {
+	for i, r := range OrgRoles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// Organization invite statuses
+const (
+	OrgInvitePending  = "pending"
+	OrgInviteAccepted = "accepted"
+	OrgInviteRevoked  = "revoked"
+)
+
+// Organization is a group of users, i.e. a customer of a B2B application
+type Organization struct {
+	ID        uuid.UUID `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Validate trims the organization's name and checks it isn't blank
+func (o *Organization) Validate() error {
+	o.Name = strings.TrimSpace(o.Name)
+	if len(o.Name) == 0 {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// Membership gives a user a role in an organization. A user has at most one membership per organization.
+type Membership struct {
+	OrgID     uuid.UUID `db:"org_id" json:"org_id"`
+	UserID    uuid.UUID `db:"user_id" json:"user_id"`
+	Role      string    `db:"role" json:"role"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// UserOrganization is an organization a user belongs to, with their role in it. See ListUserOrganizations.
+type UserOrganization struct {
+	Organization
+	Role string `db:"role" json:"role"`
+}
+
+// OrgMember is a user who belongs to an organization, with their role in it. See ListOrgMembers.
+type OrgMember struct {
+	User
+	Role     string    `db:"role"`
+	JoinedAt time.Time `db:"joined_at"`
+}
+
+// OrgInvite invites an email address to join an organization with a role.
+// It is accepted from the link in OrgInviteEmail by the user the address belongs to.
+type OrgInvite struct {
+	ID     uuid.UUID `db:"id" json:"id"`
+	OrgID  uuid.UUID `db:"org_id" json:"org_id"`
+	Email  string    `db:"email" json:"email"`
+	Role   string    `db:"role" json:"role"`
+	Status string    `db:"status" json:"status"`
+	// InvitedBy is the user who sent the invitation
+	InvitedBy uuid.UUID `db:"invited_by" json:"invited_by"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+}
+
+func (s *authService) CreateOrganization(ctx context.Context, name string, ownerID uuid.UUID) (Organization, error) {
+	owner, err := s.GetUser(ctx, ownerID)
+	if err != nil {
+		return Organization{}, err
+	}
+	err = owner.checkUsable()
+	if err != nil {
+		return Organization{}, err
+	}
+
+	t := time.Now()
+	o := Organization{ID: uuid.NewV4(), Name: name, CreatedAt: t, UpdatedAt: t}
+	err = o.Validate()
+	if err != nil {
+		return Organization{}, err
+	}
+	m := Membership{OrgID: o.ID, UserID: owner.ID, Role: OrgRoleOwner, CreatedAt: t, UpdatedAt: t}
+
+	// the organization is created with its first owner
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, "INSERT INTO organization (id, name, created_at, updated_at) VALUES (:id, :name, :created_at, :updated_at)", &o)
+		if err != nil {
+			return err
+		}
+		return insertMembership(ctx, tx, &m)
+	})
+	if err != nil {
+		return Organization{}, err
+	}
+	s.audit(ctx, AuditOrgCreated, owner.ID, AuditDetails{"org": o.ID.String(), "name": o.Name})
+
+	return o, nil
+}
+
+func (s *authService) GetOrganization(ctx context.Context, id uuid.UUID) (Organization, error) {
+	if id == uuid.Nil {
+		return Organization{}, ErrInvalidID
+	}
+
+	o := Organization{}
+	err := s.db.GetContext(ctx, &o, "SELECT * FROM organization WHERE id=$1", id)
+	if err == sql.ErrNoRows {
+		return Organization{}, ErrOrgNotFound
+	} else if err != nil {
+		return Organization{}, err
+	}
+	return o, nil
+}
+
+func (s *authService) UpdateOrganization(ctx context.Context, o Organization) (Organization, error) {
+	eOrg, err := s.GetOrganization(ctx, o.ID)
+	if err != nil {
+		return Organization{}, err
+	}
+	err = o.Validate()
+	if err != nil {
+		return Organization{}, err
+	}
+
+	o.CreatedAt = eOrg.CreatedAt
+	o.UpdatedAt = time.Now()
+	_, err = s.db.NamedExecContext(ctx, "UPDATE organization SET name=:name, updated_at=:updated_at WHERE id=:id", &o)
+	if err != nil {
+		return Organization{}, err
+	}
+	s.audit(ctx, AuditOrgUpdated, uuid.Nil, AuditDetails{"org": o.ID.String(), "name": o.Name})
+
+	return o, nil
+}
+
+func (s *authService) DeleteOrganization(ctx context.Context, id uuid.UUID) error {
+	o, err := s.GetOrganization(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		for _, q := range []string{
+			"DELETE FROM org_invite WHERE org_id=$1",
+			"DELETE FROM org_membership WHERE org_id=$1",
+			"DELETE FROM organization WHERE id=$1",
+		} {
+			_, err := tx.ExecContext(ctx, q, o.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, AuditOrgDeleted, uuid.Nil, AuditDetails{"org": o.ID.String(), "name": o.Name})
+
+	return nil
+}
+
+func (s *authService) ListUserOrganizations(ctx context.Context, userID uuid.UUID) ([]UserOrganization, error) {
+	if userID == uuid.Nil {
+		return nil, ErrInvalidID
+	}
+
+	orgs := []UserOrganization{}
+	err := s.db.SelectContext(ctx, &orgs, `SELECT o.*, m.role FROM organization o
+	JOIN org_membership m ON m.org_id=o.id WHERE m.user_id=$1 ORDER BY o.name, o.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+func (s *authService) GetMembership(ctx context.Context, orgID, userID uuid.UUID) (Membership, error) {
+	if orgID == uuid.Nil || userID == uuid.Nil {
+		return Membership{}, ErrInvalidID
+	}
+
+	m := Membership{}
+	err := s.db.GetContext(ctx, &m, "SELECT * FROM org_membership WHERE org_id=$1 AND user_id=$2", orgID, userID)
+	if err == sql.ErrNoRows {
+		return Membership{}, ErrNotMember
+	} else if err != nil {
+		return Membership{}, err
+	}
+	return m, nil
+}
+
+func (s *authService) ListOrgMembers(ctx context.Context, orgID uuid.UUID) ([]OrgMember, error) {
+	if orgID == uuid.Nil {
+		return nil, ErrInvalidID
+	}
+
+	members := []OrgMember{}
+	err := s.db.SelectContext(ctx, &members, `SELECT u.*, m.role, m.created_at AS joined_at FROM user u
+	JOIN org_membership m ON m.user_id=u.id WHERE m.org_id=$1 ORDER BY u.lastname, u.firstname, u.id`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (s *authService) SetMemberRole(ctx context.Context, orgID, userID uuid.UUID, role string) (Membership, error) {
+	if orgRoleRank(role) < 0 {
+		return Membership{}, ErrInvalidRole
+	}
+	m, err := s.GetMembership(ctx, orgID, userID)
+	if err != nil {
+		return Membership{}, err
+	}
+	if m.Role == role {
+		return m, nil
+	}
+
+	old := m.Role
+	m.Role = role
+	m.UpdatedAt = time.Now()
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, "UPDATE org_membership SET role=:role, updated_at=:updated_at WHERE org_id=:org_id AND user_id=:user_id", &m)
+		if err != nil {
+			return err
+		}
+		return checkOrgHasOwner(ctx, tx, orgID)
+	})
+	if err != nil {
+		return Membership{}, err
+	}
+	s.audit(ctx, AuditOrgMemberRoleChanged, userID, AuditDetails{"org": orgID.String(), "old_role": old, "role": role})
+
+	return m, nil
+}
+
+func (s *authService) RemoveOrgMember(ctx context.Context, orgID, userID uuid.UUID) error {
+	m, err := s.GetMembership(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM org_membership WHERE org_id=$1 AND user_id=$2", m.OrgID, m.UserID)
+		if err != nil {
+			return err
+		}
+		return checkOrgHasOwner(ctx, tx, orgID)
+	})
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, AuditOrgMemberRemoved, userID, AuditDetails{"org": orgID.String(), "role": m.Role})
+
+	return nil
+}
+
+func (s *authService) InviteOrgMember(ctx context.Context, orgID, inviterID uuid.UUID, email, role string) (OrgInvite, error) {
+	e, err := mail.ParseAddress(email)
+	if err != nil {
+		return OrgInvite{}, err
+	}
+	if orgRoleRank(role) < 0 {
+		return OrgInvite{}, ErrInvalidRole
+	}
+	o, err := s.GetOrganization(ctx, orgID)
+	if err != nil {
+		return OrgInvite{}, err
+	}
+	inviter, err := s.GetUser(ctx, inviterID)
+	if err != nil {
+		return OrgInvite{}, err
+	}
+
+	// people who already belong to the organization have their role changed instead
+	invitee, err := s.getUserByEmail(ctx, e.Address)
+	if err == nil {
+		_, err = s.GetMembership(ctx, o.ID, invitee.ID)
+		if err == nil {
+			return OrgInvite{}, ErrAlreadyExists
+		} else if err != ErrNotMember {
+			return OrgInvite{}, err
+		}
+	} else if err != ErrIncorrectAuth {
+		return OrgInvite{}, err
+	}
+
+	t := time.Now()
+	inv := OrgInvite{
+		ID:        uuid.NewV4(),
+		OrgID:     o.ID,
+		Email:     e.Address,
+		Role:      role,
+		Status:    OrgInvitePending,
+		InvitedBy: inviter.ID,
+		CreatedAt: t,
+		UpdatedAt: t,
+		ExpiresAt: t.Add(OrgInviteExpiry),
+	}
+	n, err := s.nonce.New("auth.OrgInvite", inv.ID, OrgInviteExpiry)
+	if err != nil {
+		return OrgInvite{}, err
+	}
+
+	// the email is in the invitee's locale when they already have an account
+	if invitee.ID == uuid.Nil {
+		invitee.Email = e.Address
+	}
+	data := newEmailData(invitee)
+	data.Token = userToken(inv.ID, n.Token)
+	data.Link = BaseURL + "/orgs/invite/" + data.Token
+	data.ExpiresAt = inv.ExpiresAt
+	data.Organization = o
+	data.Inviter = inviter
+	data.Role = role
+
+	// a new invitation for the address replaces any pending one
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE org_invite SET status=$1, updated_at=$2 WHERE org_id=$3 AND email=$4 AND status=$5",
+			OrgInviteRevoked, t, o.ID, inv.Email, OrgInvitePending)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NamedExecContext(ctx, `INSERT INTO org_invite (id, org_id, email, role, status, invited_by, created_at, updated_at, expires_at)
+		VALUES (:id, :org_id, :email, :role, :status, :invited_by, :created_at, :updated_at, :expires_at)`, &inv)
+		if err != nil {
+			return err
+		}
+		return s.queueEmail(ctx, tx, OrgInviteEmail, inv.Email, data)
+	})
+	if err != nil {
+		return OrgInvite{}, err
+	}
+	s.audit(ctx, AuditOrgInviteSent, invitee.ID, AuditDetails{"org": o.ID.String(), "email": inv.Email, "role": role})
+
+	return inv, nil
+}
+
+func (s *authService) ListOrgInvites(ctx context.Context, orgID uuid.UUID) ([]OrgInvite, error) {
+	if orgID == uuid.Nil {
+		return nil, ErrInvalidID
+	}
+
+	invites := []OrgInvite{}
+	err := s.db.SelectContext(ctx, &invites, "SELECT * FROM org_invite WHERE org_id=$1 AND status=$2 AND expires_at>$3 ORDER BY created_at",
+		orgID, OrgInvitePending, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (s *authService) RevokeOrgInvite(ctx context.Context, orgID, id uuid.UUID) error {
+	if orgID == uuid.Nil || id == uuid.Nil {
+		return ErrInvalidID
+	}
+
+	res, err := s.db.ExecContext(ctx, "UPDATE org_invite SET status=$1, updated_at=$2 WHERE id=$3 AND org_id=$4 AND status=$5",
+		OrgInviteRevoked, time.Now(), id, orgID, OrgInvitePending)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInviteNotFound
+	}
+	s.audit(ctx, AuditOrgInviteRevoked, uuid.Nil, AuditDetails{"org": orgID.String(), "invite": id.String()})
+	return nil
+}
+
+func (s *authService) AcceptOrgInvite(ctx context.Context, token string, userID uuid.UUID) (Membership, error) {
+	id, nonceToken, err := parseUserToken(token)
+	if err != nil {
+		return Membership{}, err
+	}
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return Membership{}, err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return Membership{}, err
+	}
+
+	inv := OrgInvite{}
+	err = s.db.GetContext(ctx, &inv, "SELECT * FROM org_invite WHERE id=$1", id)
+	if err == sql.ErrNoRows {
+		return Membership{}, ErrInvalidToken
+	} else if err != nil {
+		return Membership{}, err
+	}
+	if inv.Status != OrgInvitePending {
+		return Membership{}, ErrInvalidToken
+	}
+
+	// the invitation is for whoever holds the address it was sent to
+	invited, err := NormalizeEmail(inv.Email)
+	if err != nil || invited != u.NormalizedEmail {
+		return Membership{}, ErrInvalidToken
+	}
+	_, err = s.GetMembership(ctx, inv.OrgID, u.ID)
+	if err == nil {
+		return Membership{}, ErrAlreadyExists
+	} else if err != ErrNotMember {
+		return Membership{}, err
+	}
+
+	_, err = s.nonce.CheckThenConsume(nonceToken, "auth.OrgInvite", inv.ID)
+	if err != nil {
+		return Membership{}, ErrInvalidToken
+	}
+
+	t := time.Now()
+	m := Membership{OrgID: inv.OrgID, UserID: u.ID, Role: inv.Role, CreatedAt: t, UpdatedAt: t}
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE org_invite SET status=$1, updated_at=$2 WHERE id=$3", OrgInviteAccepted, t, inv.ID)
+		if err != nil {
+			return err
+		}
+		return insertMembership(ctx, tx, &m)
+	})
+	if err != nil {
+		return Membership{}, err
+	}
+	s.auditAs(ctx, AuditOrgMemberAdded, u.ID, u.ID, AuditDetails{"org": inv.OrgID.String(), "role": m.Role, "invite": inv.ID.String()})
+
+	return m, nil
+}
+
+// insertMembership adds m within tx
+func insertMembership(ctx context.Context, tx *sqlx.Tx, m *Membership) error {
+	_, err := tx.NamedExecContext(ctx, `INSERT INTO org_membership (org_id, user_id, role, created_at, updated_at)
+	VALUES (:org_id, :user_id, :role, :created_at, :updated_at)`, m)
+	return err
+}
+
+// checkOrgHasOwner returns ErrLastOwner if the organization has no owner left within tx
+func checkOrgHasOwner(ctx context.Context, tx *sqlx.Tx, orgID uuid.UUID) error {
+	var n int
+	err := tx.GetContext(ctx, &n, "SELECT COUNT(*) FROM org_membership WHERE org_id=$1 AND role=$2", orgID, OrgRoleOwner)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
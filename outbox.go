@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// Outbox message statuses
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// Outbox errors
+var (
+	ErrEmailNotFound = errors.New("email not found")
+	ErrEmailNotDead  = errors.New("only dead emails can be retried")
+)
+
+// OutboxMessage is an email stored in the outbox table
+type OutboxMessage struct {
+	ID            uuid.UUID
+	From          string    `db:"from_addr"`
+	To            string    `db:"to_addr"`
+	Subject       string    `db:"subject"`
+	PlainText     string    `db:"plain_text"`
+	HTML          string    `db:"html"`
+	Status        string    `db:"status"`
+	Attempts      int       `db:"attempts"`
+	LastError     string    `db:"last_error"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	CreatedAt     time.Time `db:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
+	SentAt        time.Time `db:"sent_at"`
+}
+
+// Email returns the message as an Email ready for a Mailer
+func (m OutboxMessage) Email() Email {
+	return Email{
+		From:      m.From,
+		To:        m.To,
+		Subject:   m.Subject,
+		PlainText: m.PlainText,
+		HTML:      m.HTML,
+	}
+}
+
+// Outbox stores outgoing email in the database and delivers it in the background.
+// Emails are written in the same transaction as the change that caused them,
+// so they are never lost when the Mailer is unavailable.
+type Outbox struct {
+	db     timedDB
+	mailer Mailer
+
+	// MaxAttempts is how many times delivery is tried before a message is marked dead
+	MaxAttempts int
+	// BaseDelay is the wait after the first failure. It doubles after every failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// PollInterval is how often the dispatcher looks for due messages
+	PollInterval time.Duration
+	// BatchSize is the most messages sent per poll
+	BatchSize int
+	// Lease is how long a message is reserved while it is being sent
+	Lease time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOutbox creates an Outbox that delivers through mailer
+func NewOutbox(db *sqlx.DB, mailer Mailer) *Outbox {
+	return &Outbox{
+		db:           timedDB{db},
+		mailer:       mailer,
+		MaxAttempts:  8,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     time.Hour,
+		PollInterval: 10 * time.Second,
+		BatchSize:    50,
+		Lease:        time.Minute,
+	}
+}
+
+// Enqueue stores e within tx. It is sent once tx commits and the dispatcher next runs.
+func (o *Outbox) Enqueue(ctx context.Context, tx *sqlx.Tx, e Email) error {
+	t := time.Now().UTC()
+	m := OutboxMessage{
+		ID:            uuid.NewV4(),
+		From:          e.From,
+		To:            e.To,
+		Subject:       e.Subject,
+		PlainText:     e.PlainText,
+		HTML:          e.HTML,
+		Status:        OutboxPending,
+		NextAttemptAt: t,
+		CreatedAt:     t,
+		UpdatedAt:     t,
+	}
+
+	_, err := tx.NamedExecContext(ctx, `INSERT INTO email_outbox
+	(id, from_addr, to_addr, subject, plain_text, html, status, attempts, last_error, next_attempt_at, created_at, updated_at, sent_at)
+	VALUES (:id, :from_addr, :to_addr, :subject, :plain_text, :html, :status, :attempts, :last_error, :next_attempt_at, :created_at, :updated_at, :sent_at)`, &m)
+	return err
+}
+
+// Start runs the dispatcher in the background until Stop is called
+func (o *Outbox) Start() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stop != nil {
+		return
+	}
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(o.PollInterval)
+		defer ticker.Stop()
+		for {
+			_, err := o.DispatchPending(context.Background())
+			if err != nil {
+				logCtx(context.Background(), LevelError, "Error dispatching outbox", Fields{"error": err})
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(o.stop, o.done)
+}
+
+// Stop stops the dispatcher and waits for the current batch to finish
+func (o *Outbox) Stop() {
+	o.mu.Lock()
+	stop, done := o.stop, o.done
+	o.stop, o.done = nil, nil
+	o.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// DispatchPending sends every message that is due and returns how many were sent
+func (o *Outbox) DispatchPending(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	msgs := []OutboxMessage{}
+	err := o.db.SelectContext(ctx, &msgs, "SELECT * FROM email_outbox WHERE status=$1 AND next_attempt_at<=$2 ORDER BY next_attempt_at LIMIT $3", OutboxPending, now, o.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, m := range msgs {
+		// leave the rest of the batch for the next run
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+		ok, err := o.claim(ctx, m, now)
+		if err != nil {
+			return sent, err
+		}
+		if !ok {
+			// another dispatcher has it
+			continue
+		}
+
+		err = o.deliver(ctx, &m)
+		if err != nil {
+			return sent, err
+		}
+		if m.Status == OutboxSent {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// claim reserves m for Lease so concurrent dispatchers don't send it twice
+func (o *Outbox) claim(ctx context.Context, m OutboxMessage, now time.Time) (bool, error) {
+	res, err := o.db.ExecContext(ctx, "UPDATE email_outbox SET next_attempt_at=$1 WHERE id=$2 AND status=$3 AND next_attempt_at=$4",
+		now.Add(o.Lease), m.ID, OutboxPending, m.NextAttemptAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// deliver sends m and records the outcome.
+// The outcome is recorded even if ctx is cancelled meanwhile so a sent message isn't sent again.
+func (o *Outbox) deliver(ctx context.Context, m *OutboxMessage) error {
+	sendCtx, span := startSpan(ctx, "email.send")
+	span.SetAttribute("email.id", m.ID.String())
+	sendErr := o.mailer.Send(sendCtx, m.Email())
+	endSpan(span, sendErr)
+
+	t := time.Now().UTC()
+	m.Attempts++
+	m.UpdatedAt = t
+	result := "sent"
+	if sendErr == nil {
+		m.Status = OutboxSent
+		m.SentAt = t
+		m.LastError = ""
+	} else {
+		m.LastError = sendErr.Error()
+		result = "failed"
+		if m.Attempts >= o.MaxAttempts {
+			result = "dead"
+			m.Status = OutboxDead
+			logCtx(ctx, LevelError, "Giving up sending email", Fields{"email_id": m.ID, "to": m.To, "attempts": m.Attempts, "error": sendErr})
+		} else {
+			m.NextAttemptAt = t.Add(o.backoff(m.Attempts))
+		}
+	}
+	incMetric(MetricEmails, Labels{"result": result})
+
+	_, err := o.db.NamedExecContext(detach(ctx), `UPDATE email_outbox SET status=:status, attempts=:attempts, last_error=:last_error,
+	next_attempt_at=:next_attempt_at, updated_at=:updated_at, sent_at=:sent_at WHERE id=:id`, m)
+	return err
+}
+
+// backoff returns the delay after the given number of failed attempts
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.BaseDelay
+	for i := 1; i < attempts && d < o.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > o.MaxDelay {
+		d = o.MaxDelay
+	}
+	return d
+}
+
+// Failed lists dead messages, oldest first
+func (o *Outbox) Failed(ctx context.Context) ([]OutboxMessage, error) {
+	msgs := []OutboxMessage{}
+	err := o.db.SelectContext(ctx, &msgs, "SELECT * FROM email_outbox WHERE status=$1 ORDER BY created_at", OutboxDead)
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// Retry requeues a dead message for immediate delivery with a fresh set of attempts.
+// Pending and sent messages can't be retried and return ErrEmailNotDead.
+func (o *Outbox) Retry(ctx context.Context, id uuid.UUID) error {
+	if id == uuid.Nil {
+		return ErrInvalidID
+	}
+
+	m := OutboxMessage{}
+	err := o.db.GetContext(ctx, &m, "SELECT * FROM email_outbox WHERE id=$1", id)
+	if err == sql.ErrNoRows {
+		return ErrEmailNotFound
+	} else if err != nil {
+		return err
+	}
+	if m.Status != OutboxDead {
+		return ErrEmailNotDead
+	}
+
+	t := time.Now().UTC()
+	m.Status = OutboxPending
+	m.Attempts = 0
+	m.NextAttemptAt = t
+	m.UpdatedAt = t
+	// the status is checked again in case another Retry requeued it meanwhile
+	res, err := o.db.ExecContext(ctx, "UPDATE email_outbox SET status=$1, attempts=$2, next_attempt_at=$3, updated_at=$4 WHERE id=$5 AND status=$6",
+		m.Status, m.Attempts, m.NextAttemptAt, m.UpdatedAt, m.ID, OutboxDead)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEmailNotDead
+	}
+	return nil
+}
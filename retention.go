@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// userNonceActions are the nonce actions auth creates for a user
+var userNonceActions = []string{
+	"auth.PasswordReset",
+	"auth.MagicLogin",
+	"auth.EmailChange",
+	"auth.EmailChangeCancel",
+	"auth.WebAuthnRegistration",
+	"auth.WebAuthnLogin",
+	"auth.DataExport",
+	"auth.LoginAlert",
+}
+
+// PurgeReport counts what PurgeUser, PurgeDeletedUsers or a RetentionJob removed.
+// Sessions are not listed: they are stored in cookies and end on the next request once their user is gone.
+type PurgeReport struct {
+	Users        []uuid.UUID `json:"users"`
+	Providers    int         `json:"providers"`
+	Passkeys     int         `json:"passkeys"`
+	EmailChanges int         `json:"email_changes"`
+	Emails       int         `json:"emails"`
+	Nonces       int         `json:"nonces"`
+	Exports      int         `json:"exports"`
+	AuditEvents  int         `json:"audit_events"`
+	Logins       int         `json:"logins"`
+	Webhooks     int         `json:"webhooks"`
+	Memberships  int         `json:"memberships"`
+	OrgInvites   int         `json:"org_invites"`
+	UserInvites  int         `json:"user_invites"`
+	APIKeys      int         `json:"api_keys"`
+	// ExpiredInvites counts the invitations a RetentionJob marked expired; nothing is removed for them
+	ExpiredInvites int `json:"expired_invites"`
+	// ExpiredExports counts the export archives a RetentionJob removed because they were never downloaded in time
+	ExpiredExports int `json:"expired_exports"`
+	// AnonymizedAuditEvents counts the events the user acted in on someone else; they are kept without the actor
+	AnonymizedAuditEvents int `json:"anonymized_audit_events"`
+}
+
+// add adds the counts in o to r
+func (r *PurgeReport) add(o PurgeReport) {
+	r.Users = append(r.Users, o.Users...)
+	r.Providers += o.Providers
+	r.Passkeys += o.Passkeys
+	r.EmailChanges += o.EmailChanges
+	r.Emails += o.Emails
+	r.Nonces += o.Nonces
+	r.Exports += o.Exports
+	r.AuditEvents += o.AuditEvents
+	r.Logins += o.Logins
+	r.Webhooks += o.Webhooks
+	r.Memberships += o.Memberships
+	r.OrgInvites += o.OrgInvites
+	r.UserInvites += o.UserInvites
+	r.APIKeys += o.APIKeys
+	r.ExpiredInvites += o.ExpiredInvites
+	r.ExpiredExports += o.ExpiredExports
+	r.AnonymizedAuditEvents += o.AnonymizedAuditEvents
+}
+
+func (s *authService) PurgeUser(ctx context.Context, id uuid.UUID) (PurgeReport, error) {
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return PurgeReport{}, err
+	}
+	if !u.IsDeleted {
+		return PurgeReport{}, ErrUserNotDeleted
+	}
+	return s.purgeUser(ctx, u)
+}
+
+func (s *authService) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (PurgeReport, error) {
+	users := []User{}
+	err := s.db.SelectContext(ctx, &users, "SELECT * FROM user WHERE is_deleted=$1 AND deleted_at<$2", true, deletedBefore)
+	if err != nil {
+		return PurgeReport{}, err
+	}
+
+	// a failure stops the run; what was purged so far is still reported
+	report := PurgeReport{Users: []uuid.UUID{}}
+	for _, u := range users {
+		r, err := s.purgeUser(ctx, u)
+		if err != nil {
+			return report, err
+		}
+		report.add(r)
+	}
+	return report, nil
+}
+
+// purgeUser deletes u and the rows that belong to them, and invalidates their outstanding tokens
+func (s *authService) purgeUser(ctx context.Context, u User) (PurgeReport, error) {
+	r := PurgeReport{Users: []uuid.UUID{u.ID}}
+
+	// the nonce service can't delete, so consume the latest nonce for every action.
+	// Older tokens are useless once the user they name is gone.
+	now := time.Now()
+	for _, action := range userNonceActions {
+		n, err := s.nonce.Get(action, u.ID)
+		if err != nil || !n.IsValid || n.ExpiresAt.Before(now) {
+			continue
+		}
+		_, err = s.nonce.CheckThenConsume(n.Token, action, u.ID)
+		if err == nil {
+			r.Nonces++
+		}
+	}
+
+	// emails went to the current address and any address from an email change, unless it now belongs to someone else.
+	// With ReuseDeletedEmails even the current address may have been taken by a new account.
+	candidates := []string{u.Email}
+	changes := []EmailChange{}
+	err := s.db.SelectContext(ctx, &changes, "SELECT * FROM email_change WHERE user_id=$1", u.ID)
+	if err != nil {
+		return PurgeReport{}, err
+	}
+	for _, c := range changes {
+		candidates = append(candidates, c.OldEmail, c.NewEmail)
+	}
+	addrs := []string{}
+	for _, a := range candidates {
+		holder, err := s.getUserByEmail(ctx, a)
+		if err == nil && !uuid.Equal(holder.ID, u.ID) {
+			continue
+		} else if err != nil && err != ErrIncorrectAuth {
+			return PurgeReport{}, err
+		}
+		addrs = append(addrs, a)
+	}
+
+	exec := func(tx *sqlx.Tx, n *int, query string, args ...interface{}) error {
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if n != nil {
+			*n += int(affected)
+		}
+		return err
+	}
+	// execIn runs a query that matches the addresses with "IN (?)", unless none of them are the user's
+	execIn := func(tx *sqlx.Tx, n *int, query string) error {
+		if len(addrs) == 0 {
+			return nil
+		}
+		q, args, err := sqlx.In(query, addrs)
+		if err != nil {
+			return err
+		}
+		return exec(tx, n, tx.Rebind(q), args...)
+	}
+	// the event outlives the purge in webhook deliveries, so it names nothing but the ID
+	e := s.newEvent(EventUserPurged, User{ID: u.ID})
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		err := exec(tx, &r.Providers, "DELETE FROM user_provider WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		err = exec(tx, &r.Passkeys, "DELETE FROM webauthn_credential WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		err = exec(tx, &r.EmailChanges, "DELETE FROM email_change WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		err = exec(tx, &r.Exports, "DELETE FROM user_export WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		err = exec(tx, &r.Logins, "DELETE FROM login_history WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		err = exec(tx, &r.Webhooks, "DELETE FROM webhook_delivery WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		err = exec(tx, &r.APIKeys, "DELETE FROM api_key WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		// organizations are kept, even one the user was the only owner of
+		err = exec(tx, &r.Memberships, "DELETE FROM org_membership WHERE user_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		// what the user did to others stays in those users' history, without saying who did it
+		err = exec(tx, &r.AuditEvents, "DELETE FROM audit_event WHERE target_id=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		err = exec(tx, &r.AnonymizedAuditEvents, "UPDATE audit_event SET actor_id=$1, ip='', user_agent='' WHERE actor_id=$2", uuid.Nil, u.ID)
+		if err != nil {
+			return err
+		}
+		err = execIn(tx, &r.Emails, "DELETE FROM email_outbox WHERE to_addr IN (?)")
+		if err != nil {
+			return err
+		}
+		err = execIn(tx, &r.OrgInvites, "DELETE FROM org_invite WHERE email IN (?)")
+		if err != nil {
+			return err
+		}
+		err = execIn(tx, &r.UserInvites, "DELETE FROM user_invite WHERE email IN (?)")
+		if err != nil {
+			return err
+		}
+		err = exec(tx, &r.UserInvites, "DELETE FROM user_invite WHERE accepted_by=$1", u.ID)
+		if err != nil {
+			return err
+		}
+		return exec(tx, nil, "DELETE FROM user WHERE id=$1", u.ID)
+	}, s.hooks(ctx, e))
+	if err != nil {
+		return PurgeReport{}, err
+	}
+	s.events.publish(e)
+	// the purge itself is kept; it names nothing but the ID
+	s.audit(ctx, AuditUserPurged, u.ID, nil)
+
+	return r, nil
+}
+
+// RetentionJob purges users who were deleted more than Period ago, marks expired invitations
+// and removes expired export archives.
+// Like the Outbox dispatcher it runs in the background between Start and Stop.
+type RetentionJob struct {
+	auth Service
+
+	// Period is how long a deleted user is kept before being purged
+	Period time.Duration
+	// Interval is how often the job runs
+	Interval time.Duration
+	// OnPurge, when set, is called with the report of every run that purged a user
+	OnPurge func(PurgeReport)
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRetentionJob creates a RetentionJob that purges users deleted more than period ago
+func NewRetentionJob(auth Service, period time.Duration) *RetentionJob {
+	return &RetentionJob{
+		auth:     auth,
+		Period:   period,
+		Interval: time.Hour,
+	}
+}
+
+// Run purges every user deleted more than Period ago, marks the invitations that have expired,
+// removes the export archives that have expired and returns what was done
+func (j *RetentionJob) Run() (PurgeReport, error) {
+	r, err := j.auth.PurgeDeletedUsers(context.Background(), time.Now().Add(-j.Period))
+	if err != nil {
+		return r, err
+	}
+	r.ExpiredInvites, err = j.auth.ExpireInvites(context.Background(), time.Now())
+	if err != nil {
+		return r, err
+	}
+	r.ExpiredExports, err = j.auth.PurgeExpiredExports(context.Background(), time.Now())
+	return r, err
+}
+
+// Start runs the job in the background until Stop is called
+func (j *RetentionJob) Start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil {
+		return
+	}
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(j.Interval)
+		defer ticker.Stop()
+		for {
+			r, err := j.Run()
+			if err != nil {
+				logCtx(context.Background(), LevelError, "Error purging deleted users", Fields{"error": err})
+			}
+			if r.ExpiredInvites > 0 {
+				logCtx(context.Background(), LevelInfo, "Expired invitations", Fields{"invites": r.ExpiredInvites})
+			}
+			if r.ExpiredExports > 0 {
+				logCtx(context.Background(), LevelInfo, "Removed expired data exports", Fields{"exports": r.ExpiredExports})
+			}
+			if len(r.Users) > 0 {
+				logCtx(context.Background(), LevelInfo, "Purged deleted users", Fields{"users": len(r.Users)})
+				if j.OnPurge != nil {
+					j.OnPurge(r)
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(j.stop, j.done)
+}
+
+// Stop stops the job and waits for the current run to finish
+func (j *RetentionJob) Stop() {
+	j.mu.Lock()
+	stop, done := j.stop, j.done
+	j.stop, j.done = nil, nil
+	j.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -1,12 +1,16 @@
 package auth
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"errors"
-	"html/template"
+	"fmt"
 	"net/mail"
+	"strconv"
 	"strings"
+	textTemplate "text/template"
 	"time"
 
 	"github.com/bryanjeal/go-helpers"
@@ -18,11 +22,9 @@ import (
 	// handle sqlite3 database
 	_ "github.com/mattn/go-sqlite3"
 
-	"github.com/golang/glog"
 	"github.com/jmoiron/sqlx"
 	"github.com/markbates/goth"
 	"github.com/satori/go.uuid"
-	"gopkg.in/mailgun/mailgun-go.v1"
 )
 
 // Errors
@@ -34,85 +36,320 @@ var (
 	ErrInvalidPassword = errors.New("password cannot blank or all spaces")
 	ErrInvalidName     = errors.New("name cannot be blank or all spaces")
 	ErrIncorrectAuth   = errors.New("incorrect email or password")
+	ErrInvalidToken    = errors.New("invalid or expired token")
+	ErrUserNotDeleted  = errors.New("user must be deleted before it is purged")
+	ErrUserDeleted     = errors.New("user has been deleted")
+	ErrUserInactive    = errors.New("user is not active")
 	ErrTodo            = errors.New("unimplemented feature or function")
 )
 
 // Service is the interface that provides auth methods.
+//
+// Users are active, inactive or deleted. Methods that log a user in or that a user
+// calls on their own account need an active user; they return ErrUserDeleted or
+// ErrUserInactive otherwise, after any password check. Management methods (GetUser,
+// ListUsers, UpdateUser, RevokeSessions and the passkey list) work on users in any
+// state, except that a deleted user must be restored before it can be updated.
+// CancelEmailChange also works for inactive users so they can always protect their address.
+//
+// Methods that do I/O take a context.Context. Its deadline and cancellation apply to the
+// database queries and transactions a method runs; an email is queued with the change it
+// belongs to and sent later by the Outbox. Audit events and login records are still written
+// if ctx is cancelled after the change they describe was saved.
 type Service interface {
 	// NewUserLocal registers a new user by a local account (email and password)
-	NewUserLocal(email, password, firstName, lastName string, isSuperuser bool) (User, error)
+	NewUserLocal(ctx context.Context, email, password, firstName, lastName string, isSuperuser bool) (User, error)
 
 	// NewUserProvider registers a new user by some oAuth Provider
-	NewUserProvider(user goth.User, isSuperuser bool) (User, error)
+	NewUserProvider(ctx context.Context, user goth.User, isSuperuser bool) (User, error)
 
 	// UserAddProvider associates a new oAuth Provider with the user account
-	UserAddProvider(id uuid.UUID, user goth.User) (User, error)
+	UserAddProvider(ctx context.Context, id uuid.UUID, user goth.User) (User, error)
 
 	// GetUser gets a user account by their ID
-	GetUser(id uuid.UUID) (User, error)
+	GetUser(ctx context.Context, id uuid.UUID) (User, error)
+
+	// ListUsers lists a page of users matching q, with the total number of matches
+	ListUsers(ctx context.Context, q UserQuery) (UserList, error)
 
 	// UpdateUser update the user's details
-	UpdateUser(u User) (User, error)
+	UpdateUser(ctx context.Context, u User) (User, error)
+
+	// BeginEmailChange emails a confirmation link to newEmail and a cancel link to the user's current address
+	BeginEmailChange(ctx context.Context, userID uuid.UUID, newEmail string) error
+
+	// CompleteEmailChange moves the user to the new address the confirmation link was sent to
+	CompleteEmailChange(ctx context.Context, token string) (User, error)
+
+	// CancelEmailChange cancels a pending email change, or reverts a completed one, with the link sent to the old address
+	CancelEmailChange(ctx context.Context, token string) (User, error)
 
 	// DeleteUser flag a user as deleted
-	DeleteUser(id uuid.UUID) (User, error)
+	DeleteUser(ctx context.Context, id uuid.UUID) (User, error)
+
+	// RestoreUser undoes DeleteUser
+	RestoreUser(ctx context.Context, id uuid.UUID) (User, error)
+
+	// PurgeUser permanently removes a deleted user and everything stored about them.
+	// Only their ID is kept: in the audit log's purge event and in the EventUserPurged webhook deliveries.
+	// Audit events where they acted on another user are kept for that user, with the actor, IP and user agent removed.
+	PurgeUser(ctx context.Context, id uuid.UUID) (PurgeReport, error)
 
-	// AuthenticateUser logs in a Local User with an email and password
-	AuthenticateUser(email, password string) (User, error)
+	// PurgeDeletedUsers purges every user deleted before deletedBefore
+	PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (PurgeReport, error)
+
+	// RevokeSessions logs the user out of every session started before now
+	RevokeSessions(ctx context.Context, id uuid.UUID) (User, error)
+
+	// AuthenticateUser logs in a Local User with an email and password. See ContextWithDeferredLogin.
+	AuthenticateUser(ctx context.Context, email, password string) (User, error)
+
+	// CompleteLogin records that the user logged in with method. Only callers that deferred the login
+	// with ContextWithDeferredLogin call it, once the user has passed every factor.
+	// EventUserLoggedIn hooks can refuse the login by returning an error.
+	CompleteLogin(ctx context.Context, u User, method string) error
 
 	// Start the Password Reset process
-	BeginPasswordReset(email string) error
+	BeginPasswordReset(ctx context.Context, email string) error
 
 	// Complete the Password Reset process
-	CompletePasswordReset(token, email, password string) (User, error)
+	CompletePasswordReset(ctx context.Context, token, email, password string) (User, error)
+
+	// BeginMagicLogin emails a single-use login link to the user
+	BeginMagicLogin(ctx context.Context, email string) error
+
+	// CompleteMagicLogin logs in the user a magic login token was sent to. See ContextWithDeferredLogin.
+	CompleteMagicLogin(ctx context.Context, token string) (User, error)
+
+	// ListLoginHistory lists the user's latest logins, newest first. A limit of zero lists LoginHistoryLimit logins.
+	ListLoginHistory(ctx context.Context, userID uuid.UUID, limit int) ([]LoginRecord, error)
+
+	// ReportLogin handles the "this wasn't me" link of a LoginAlertEmail.
+	// It revokes the user's sessions and emails them a password reset link.
+	ReportLogin(ctx context.Context, token string) (User, error)
+
+	// ExportUserData returns everything stored about the user as a zip archive of JSON files
+	ExportUserData(ctx context.Context, id uuid.UUID) ([]byte, error)
+
+	// BeginDataExport builds the user's export archive and emails them a single-use download link
+	BeginDataExport(ctx context.Context, id uuid.UUID) error
+
+	// CompleteDataExport returns the archive a data export token was sent for
+	CompleteDataExport(ctx context.Context, token string) ([]byte, error)
+
+	// PurgeExpiredExports removes the export archives that expired before the given time without being downloaded.
+	// It returns how many were removed.
+	PurgeExpiredExports(ctx context.Context, before time.Time) (int, error)
+
+	// WithAuditInfo returns a Service that adds info to every audit event it records.
+	// The HTTP handler uses it to record who made each request and from where.
+	WithAuditInfo(info AuditInfo) Service
+
+	// RecordAuditEvent stores e and writes it to the AuditSinks.
+	// Applications use it for events that happen outside of auth, i.e. logging out.
+	RecordAuditEvent(ctx context.Context, e AuditEvent) error
+
+	// ListAuditEvents lists audit events matching q, newest first
+	ListAuditEvents(ctx context.Context, q AuditQuery) (AuditList, error)
+
+	// Events returns the EventBus the Service publishes to. Add hooks and subscribers before serving requests.
+	Events() *EventBus
+
+	// ListFailedEmails lists outbox emails that ran out of delivery attempts
+	ListFailedEmails(ctx context.Context) ([]OutboxMessage, error)
+
+	// RetryEmail requeues a failed outbox email
+	RetryEmail(ctx context.Context, id uuid.UUID) error
+
+	// BeginWebAuthnRegistration creates the options for registering a new passkey for the user
+	BeginWebAuthnRegistration(ctx context.Context, userID uuid.UUID) (WebAuthnCreationOptions, error)
+
+	// FinishWebAuthnRegistration verifies the authenticator's response and stores the new passkey
+	FinishWebAuthnRegistration(ctx context.Context, userID uuid.UUID, resp WebAuthnAttestationResponse) (WebAuthnCredential, error)
+
+	// BeginWebAuthnLogin creates the options for logging in with a passkey.
+	// If email is empty any discoverable passkey registered with the application may be used.
+	BeginWebAuthnLogin(ctx context.Context, email string) (WebAuthnRequestOptions, error)
+
+	// FinishWebAuthnLogin verifies a passkey assertion and logs in the user the passkey belongs to. See ContextWithDeferredLogin.
+	FinishWebAuthnLogin(ctx context.Context, resp WebAuthnAssertionResponse) (User, error)
+
+	// ListWebAuthnCredentials lists the user's passkeys
+	ListWebAuthnCredentials(ctx context.Context, userID uuid.UUID) ([]WebAuthnCredential, error)
+
+	// DeleteWebAuthnCredential removes one of the user's passkeys
+	DeleteWebAuthnCredential(ctx context.Context, userID, id uuid.UUID) error
+
+	// CreateOrganization creates an organization with the user as its owner
+	CreateOrganization(ctx context.Context, name string, ownerID uuid.UUID) (Organization, error)
+
+	// GetOrganization gets an organization by its ID
+	GetOrganization(ctx context.Context, id uuid.UUID) (Organization, error)
+
+	// UpdateOrganization updates the organization's details
+	UpdateOrganization(ctx context.Context, o Organization) (Organization, error)
+
+	// DeleteOrganization removes an organization with its memberships and invitations
+	DeleteOrganization(ctx context.Context, id uuid.UUID) error
+
+	// ListUserOrganizations lists the organizations the user belongs to, with their role in each, by name
+	ListUserOrganizations(ctx context.Context, userID uuid.UUID) ([]UserOrganization, error)
+
+	// GetMembership gets the user's membership of an organization. ErrNotMember is returned if they don't belong to it.
+	GetMembership(ctx context.Context, orgID, userID uuid.UUID) (Membership, error)
+
+	// ListOrgMembers lists the users who belong to an organization, with their roles
+	ListOrgMembers(ctx context.Context, orgID uuid.UUID) ([]OrgMember, error)
+
+	// SetMemberRole changes a member's role. ErrLastOwner is returned if it would leave the organization without an owner.
+	SetMemberRole(ctx context.Context, orgID, userID uuid.UUID, role string) (Membership, error)
+
+	// RemoveOrgMember removes a user from an organization. ErrLastOwner is returned for its only owner.
+	RemoveOrgMember(ctx context.Context, orgID, userID uuid.UUID) error
+
+	// InviteOrgMember emails an invitation to join an organization with role, replacing any pending one for the address.
+	// ErrAlreadyExists is returned if the address belongs to a member.
+	InviteOrgMember(ctx context.Context, orgID, inviterID uuid.UUID, email, role string) (OrgInvite, error)
+
+	// ListOrgInvites lists an organization's pending invitations that have not expired
+	ListOrgInvites(ctx context.Context, orgID uuid.UUID) ([]OrgInvite, error)
+
+	// RevokeOrgInvite cancels a pending invitation
+	RevokeOrgInvite(ctx context.Context, orgID, id uuid.UUID) error
+
+	// AcceptOrgInvite makes the user a member with the token from an invitation.
+	// The invitation must have been sent to the user's email address.
+	AcceptOrgInvite(ctx context.Context, token string, userID uuid.UUID) (Membership, error)
+
+	// InviteUser emails an invitation to sign up to an address that has no account, replacing any pending one for it.
+	// The roles are given to the user when the invitation is accepted. ErrAlreadyExists is returned if the address belongs to a user.
+	InviteUser(ctx context.Context, email string, inviterID uuid.UUID, roles []Role) (UserInvite, error)
+
+	// GetUserInvite gets the pending invitation a token from UserInviteEmail is for, without using the token up
+	GetUserInvite(ctx context.Context, token string) (UserInvite, error)
+
+	// AcceptUserInvite registers a user with the invited email address and gives them the invitation's roles.
+	// The address is not verified again; the token proves it was received.
+	AcceptUserInvite(ctx context.Context, token, password, firstName, lastName string) (User, error)
+
+	// ListUserInvites lists the pending invitations that have not expired, newest first.
+	// Only the invitations with a role in orgID are listed unless it is uuid.Nil.
+	ListUserInvites(ctx context.Context, orgID uuid.UUID) ([]UserInvite, error)
+
+	// RevokeUserInvite cancels a pending invitation
+	RevokeUserInvite(ctx context.Context, id uuid.UUID) error
+
+	// ExpireInvites marks the user and organization invitations that expired before the given time and were never used.
+	// It returns how many were marked.
+	ExpireInvites(ctx context.Context, before time.Time) (int, error)
+
+	// CreateAPIKey issues an API key for the user with the scopes, which expires at expiresAt unless it is the zero time.
+	// The key is returned once, next to the APIKey describing it; only a hash of it is stored.
+	CreateAPIKey(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt time.Time) (APIKey, string, error)
+
+	// ListAPIKeys lists the user's API keys that have not been revoked, newest first. Expired keys are included.
+	ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]APIKey, error)
+
+	// RevokeAPIKey stops one of the user's API keys from working. ErrAPIKeyNotFound is returned if it is not theirs.
+	RevokeAPIKey(ctx context.Context, userID, id uuid.UUID) error
+
+	// AuthenticateAPIKey returns the user an API key belongs to and records that it was used.
+	// ErrInvalidAPIKey is returned for an unknown, revoked or expired key.
+	AuthenticateAPIKey(ctx context.Context, key string) (User, APIKey, error)
 }
 
 // authService satisfies the auth.Service interface
 type authService struct {
-	db    *sqlx.DB
-	mg    mailgun.Mailgun
-	nonce nonce.Service
-	tpl   *tmpl.TplSys
+	db     timedDB
+	outbox *Outbox
+	nonce  nonce.Service
+	tpl    *tmpl.TplSys
+	txt    map[string]*textTemplate.Template
+
+	// auditInfo is added to every audit event. See WithAuditInfo.
+	auditInfo AuditInfo
+
+	// events is shared by every copy WithAuditInfo makes
+	events *EventBus
+}
+
+// detachedContext carries the values of a context but not its deadline or cancellation
+type detachedContext struct {
+	parent context.Context
 }
 
-// NewService creates an Auth Service that connects to provided DB information
-func NewService(db *sqlx.DB, mg mailgun.Mailgun, nonce nonce.Service, tpl *tmpl.TplSys) Service {
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// detach returns a context for work that must finish even if ctx is cancelled,
+// i.e. recording what a request did after the client has gone away.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+// txFunc is run inside a database transaction. Returning an error rolls the transaction back.
+type txFunc func(tx *sqlx.Tx) error
+
+// NewService creates an Auth Service that connects to provided DB information.
+// Emails are queued in outbox; the application is responsible for running its dispatcher.
+// An error is returned if one of the email templates can't be parsed.
+func NewService(db *sqlx.DB, outbox *Outbox, nonce nonce.Service, tpl *tmpl.TplSys) (Service, error) {
 	s := &authService{
-		db:    db,
-		mg:    mg,
-		nonce: nonce,
-		tpl:   tpl,
+		db:     timedDB{db},
+		outbox: outbox,
+		nonce:  nonce,
+		tpl:    tpl,
+		events: NewEventBus(),
 	}
 
-	// TODO
-	// Move hardcoded Template Strings to templates.go
-	template.Must(s.tpl.AddTemplate("auth.baseHTMLEmailTemplate", "", baseHTMLEmailTemplate))
-	template.Must(s.tpl.AddTemplate("auth.NewUserEmail", "auth.baseHTMLEmailTemplate", `{{define "title"}}Welcome New User{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> Hello %recipient.firstname% %recipient.lastname%, <br/> <br/> Welcome to our service. Thank you for signing up.<br/> <br/> </p>{{end}}`))
-	template.Must(s.tpl.AddTemplate("auth.PasswordResetEmail", "auth.baseHTMLEmailTemplate", `{{define "title"}}Password Reset{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> Hello %recipient.firstname% %recipient.lastname%, <br/> <br/> Forgot your password? No problem! <br/> <br/> To reset your password, click the following link: <br/> <a href="https://www.example.com/auth/password-reset/%recipient.token%">Reset Password</a> <br/> <br/> If you did not request to have your password reset you can safely ignore this email. Rest assured your customer account is safe. <br/> <br/> </p>{{end}}`))
-	template.Must(s.tpl.AddTemplate("auth.PasswordResetConfirmEmail", "auth.baseHTMLEmailTemplate", `{{define "title"}}Password Reset Complete{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> Hello %recipient.firstname% %recipient.lastname%, <br/> <br/> Your account's password was recently changed. <br/> <br/> </p>{{end}}`))
+	_, err := s.tpl.AddTemplate("auth.baseHTMLEmailTemplate", "", baseHTMLEmailTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("adding template auth.baseHTMLEmailTemplate: %v", err)
+	}
+	for k, v := range EmailHTMLTemplates {
+		_, err := s.tpl.AddTemplate(k, "auth.baseHTMLEmailTemplate", v)
+		if err != nil {
+			return nil, fmt.Errorf("adding template %s: %v", k, err)
+		}
+	}
+	s.txt = make(map[string]*textTemplate.Template, len(EmailTextTemplates))
+	for k, v := range EmailTextTemplates {
+		txt, err := textTemplate.New(k).Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template %s: %v", k, err)
+		}
+		s.txt[k] = txt
+	}
 
-	return s
+	return tracedService{s}, nil
 }
 
-func (s *authService) NewUserLocal(email, password, firstName, lastName string, isSuperuser bool) (User, error) {
-	eUser := User{}
-	err := s.db.Get(&eUser, "SELECT * FROM user WHERE email=$1", email)
-	if err == nil {
-		return User{}, ErrAlreadyExists
-	} else if err != sql.ErrNoRows {
+func (s *authService) NewUserLocal(ctx context.Context, email, password, firstName, lastName string, isSuperuser bool) (User, error) {
+	// TODO:
+	// Have users activate their account via an email
+	u := newLocalUser(ctx, email, password, firstName, lastName, isSuperuser)
+
+	err := s.register(ctx, &u, AuditDetails{})
+	if err != nil {
 		return User{}, err
 	}
+	return u, nil
+}
 
+// newLocalUser creates an active user with a local account; it is not saved
+func newLocalUser(ctx context.Context, email, password, firstName, lastName string, isSuperuser bool) User {
 	// get current time
 	t := time.Now()
 
 	// hash password
+	_, span := startSpan(ctx, "bcrypt.hash")
 	hashed, err := helpers.Crypto.BCryptPasswordHasher([]byte(password))
+	endSpan(span, err)
 	hashedB64 := base64.StdEncoding.EncodeToString(hashed)
 
-	// TODO:
-	// Have users activate their account via an email
-	u := User{
+	return User{
 		Email:       email,
 		Password:    hashedB64,
 		FirstName:   firstName,
@@ -127,61 +364,54 @@ func (s *authService) NewUserLocal(email, password, firstName, lastName string,
 		newPassword: true,
 		rawPassword: password,
 	}
+}
 
-	// Save user to DB
-	err = s.saveUser(&u)
-	if err != nil {
-		return User{}, err
-	}
-
-	// Create Email Message
-	msg := s.mg.NewMessage(NewUserEmail.From, NewUserEmail.Subject, NewUserEmail.PlainText, u.Email)
-	b, err := s.tpl.ExecuteTemplate(NewUserEmail.TplName, u)
-	if err != nil {
-		glog.Errorf("Error creating HTML Email. Got error: %v", err)
-		return u, nil
-	}
-	msg.SetHtml(string(b))
-
-	// Add custom information via AddRecipientAndVariables
-	err = msg.AddRecipientAndVariables(u.Email, map[string]interface{}{
-		"firstname": u.FirstName,
-		"lastname":  u.LastName,
-	})
-	if err != nil {
-		glog.Errorf("Error with AddRecipientAndVariables. Got error: %v", err)
-		return u, nil
-	}
-
-	// Send Message
-	_, _, err = s.mg.Send(msg)
-	if err != nil {
-		glog.Errorf("Error sending email. Got error: %v", err)
-		return u, nil
+// register saves a new user, queues the Welcome Email and records the registration with details.
+// Each fn is run in the same transaction after the user is written.
+func (s *authService) register(ctx context.Context, u *User, details AuditDetails, fns ...txFunc) error {
+	// Save user to DB and queue Welcome Email
+	fns = append([]txFunc{func(tx *sqlx.Tx) error {
+		return s.queueEmail(ctx, tx, NewUserEmail, u.Email, newEmailData(*u))
+	}}, fns...)
+	err := s.saveUser(ctx, u, EventUserRegistered, fns...)
+	if err == ErrAlreadyExists {
+		incMetric(MetricRegistrations, Labels{"result": "exists"})
+		// the address still belongs to a deleted user unless ReuseDeletedEmails is set
+		if holder, lookupErr := s.getUserByEmail(ctx, u.Email); lookupErr == nil && holder.IsDeleted {
+			return ErrUserDeleted
+		}
+		return err
+	} else if err != nil {
+		incMetric(MetricRegistrations, Labels{"result": "error"})
+		return err
 	}
+	incMetric(MetricRegistrations, Labels{"result": "success"})
+	details["email"] = u.Email
+	details["is_superuser"] = strconv.FormatBool(u.IsSuperuser)
+	s.audit(ctx, AuditUserCreated, u.ID, details)
 
-	return u, nil
+	return nil
 }
 
-func (s *authService) NewUserProvider(u goth.User, isSuperuser bool) (User, error) {
+func (s *authService) NewUserProvider(ctx context.Context, u goth.User, isSuperuser bool) (User, error) {
 	// TODO:
 	// Implement Feature
 	return User{}, ErrTodo
 }
 
-func (s *authService) UserAddProvider(id uuid.UUID, u goth.User) (User, error) {
+func (s *authService) UserAddProvider(ctx context.Context, id uuid.UUID, u goth.User) (User, error) {
 	// TODO:
-	// Implement Feature
+	// Implement Feature and record AuditProviderLinked
 	return User{}, ErrTodo
 }
 
-func (s *authService) GetUser(id uuid.UUID) (User, error) {
+func (s *authService) GetUser(ctx context.Context, id uuid.UUID) (User, error) {
 	if id == uuid.Nil {
 		return User{}, ErrInvalidID
 	}
 
 	u := User{}
-	err := s.db.Get(&u, "SELECT * FROM user WHERE id=$1", id)
+	err := s.db.GetContext(ctx, &u, "SELECT * FROM user WHERE id=$1", id)
 	if err != nil && err != sql.ErrNoRows {
 		return User{}, err
 	} else if err == sql.ErrNoRows {
@@ -191,46 +421,242 @@ func (s *authService) GetUser(id uuid.UUID) (User, error) {
 	return u, nil
 }
 
-func (s *authService) UpdateUser(u User) (User, error) {
-	eUser := User{}
-	err := s.db.Get(&eUser, "SELECT * FROM user WHERE email=$1", u.Email)
-	if err == sql.ErrNoRows {
-		return User{}, ErrUserNotFound
-	} else if err != nil {
+func (s *authService) UpdateUser(ctx context.Context, u User) (User, error) {
+	eUser, err := s.GetUser(ctx, u.ID)
+	if err != nil {
+		return User{}, err
+	}
+	if eUser.IsDeleted {
+		return User{}, ErrUserDeleted
+	}
+
+	// the lifecycle is changed through DeleteUser, RestoreUser and RevokeSessions
+	u.IsDeleted = eUser.IsDeleted
+	u.DeletedAt = eUser.DeletedAt
+	u.SessionsRevokedAt = eUser.SessionsRevokedAt
+
+	// saving fails with ErrAlreadyExists if the address belongs to someone else
+	err = s.saveUser(ctx, &u, EventUserUpdated)
+	if err != nil {
+		return User{}, err
+	}
+	s.audit(ctx, AuditUserUpdated, u.ID, AuditDetails{"fields": strings.Join(userChanges(eUser, u), ",")})
+	if u.IsSuperuser != eUser.IsSuperuser {
+		s.audit(ctx, AuditRoleChanged, u.ID, AuditDetails{"is_superuser": strconv.FormatBool(u.IsSuperuser)})
+	}
+
+	return u, nil
+}
+
+func (s *authService) BeginEmailChange(ctx context.Context, userID uuid.UUID, newEmail string) error {
+	// Check email
+	e, err := mail.ParseAddress(newEmail)
+	if err != nil {
+		return err
+	}
+
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return err
+	}
+	err = s.checkEmailAvailable(ctx, e.Address)
+	if err != nil {
+		return err
+	}
+
+	// create nonces for the confirm and cancel links
+	confirm, err := s.nonce.New("auth.EmailChange", u.ID, EmailChangeExpiry)
+	if err != nil {
+		return err
+	}
+	cancel, err := s.nonce.New("auth.EmailChangeCancel", u.ID, EmailChangeCancelExpiry)
+	if err != nil {
+		return err
+	}
+
+	t := time.Now()
+	c := EmailChange{
+		ID:        uuid.NewV4(),
+		UserID:    u.ID,
+		OldEmail:  u.Email,
+		NewEmail:  e.Address,
+		Status:    EmailChangePending,
+		CreatedAt: t,
+		UpdatedAt: t,
+	}
+
+	confirmData := newEmailData(u)
+	confirmData.Token = userToken(u.ID, confirm.Token)
+	confirmData.Link = BaseURL + "/email-change/" + confirmData.Token
+	confirmData.ExpiresAt = t.Add(EmailChangeExpiry)
+	confirmData.NewEmail = c.NewEmail
+
+	noticeData := newEmailData(u)
+	noticeData.Token = userToken(u.ID, cancel.Token)
+	noticeData.Link = BaseURL + "/email-change/cancel/" + noticeData.Token
+	noticeData.ExpiresAt = t.Add(EmailChangeCancelExpiry)
+	noticeData.NewEmail = c.NewEmail
+
+	// Record the change (replacing any pending one) and queue both emails
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE email_change SET status=$1, updated_at=$2 WHERE user_id=$3 AND status=$4",
+			EmailChangeCancelled, t, u.ID, EmailChangePending)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NamedExecContext(ctx, `INSERT INTO email_change (id, user_id, old_email, new_email, status, created_at, updated_at)
+		VALUES (:id, :user_id, :old_email, :new_email, :status, :created_at, :updated_at)`, &c)
+		if err != nil {
+			return err
+		}
+		err = s.queueEmail(ctx, tx, EmailChangeConfirmEmail, c.NewEmail, confirmData)
+		if err != nil {
+			return err
+		}
+		return s.queueEmail(ctx, tx, EmailChangeNoticeEmail, c.OldEmail, noticeData)
+	})
+}
+
+func (s *authService) CompleteEmailChange(ctx context.Context, token string) (User, error) {
+	u, err := s.useUserToken(ctx, token, "auth.EmailChange")
+	if err != nil {
+		return User{}, err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return User{}, err
+	}
+
+	c, err := s.getEmailChange(ctx, u.ID, EmailChangePending)
+	if err != nil {
 		return User{}, err
 	}
 
-	if !uuid.Equal(eUser.ID, u.ID) {
-		return User{}, ErrInconsistentIDs
+	// the address may have been taken since the change began
+	err = s.checkEmailAvailable(ctx, c.NewEmail)
+	if err != nil {
+		return User{}, err
 	}
 
-	err = s.saveUser(&u)
+	u.Email = c.NewEmail
+	u.UpdatedAt = time.Now()
+	err = s.saveUser(ctx, &u, EventEmailVerified, s.setEmailChangeStatus(ctx, &c, EmailChangeCompleted))
 	if err != nil {
 		return User{}, err
 	}
+	s.auditAs(ctx, AuditEmailChanged, u.ID, u.ID, AuditDetails{"old_email": c.OldEmail, "new_email": c.NewEmail})
 
 	return u, nil
 }
 
-func (s *authService) DeleteUser(id uuid.UUID) (User, error) {
-	u, err := s.GetUser(id)
+func (s *authService) CancelEmailChange(ctx context.Context, token string) (User, error) {
+	u, err := s.useUserToken(ctx, token, "auth.EmailChangeCancel")
 	if err != nil {
 		return User{}, err
 	}
 
+	c, err := s.getEmailChange(ctx, u.ID, EmailChangePending, EmailChangeCompleted)
+	if err != nil {
+		return User{}, err
+	}
+
+	// a pending change is simply dropped
+	if c.Status == EmailChangePending {
+		err = s.inTx(ctx, s.setEmailChangeStatus(ctx, &c, EmailChangeCancelled))
+		if err != nil {
+			return User{}, err
+		}
+		return u, nil
+	}
+
+	// a completed change is reverted, unless the user has moved on to another address since
+	if !strings.EqualFold(u.Email, c.NewEmail) {
+		return User{}, ErrInvalidToken
+	}
+	err = s.checkEmailAvailable(ctx, c.OldEmail)
+	if err != nil {
+		return User{}, err
+	}
+	u.Email = c.OldEmail
+	u.UpdatedAt = time.Now()
+	err = s.saveUser(ctx, &u, EventUserUpdated, s.setEmailChangeStatus(ctx, &c, EmailChangeCancelled))
+	if err != nil {
+		return User{}, err
+	}
+	s.auditAs(ctx, AuditEmailChanged, u.ID, u.ID, AuditDetails{"old_email": c.NewEmail, "new_email": c.OldEmail, "reverted": "true"})
+
+	return u, nil
+}
+
+func (s *authService) DeleteUser(ctx context.Context, id uuid.UUID) (User, error) {
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	// deleting again would restart the retention period
+	if u.IsDeleted {
+		return User{}, ErrUserDeleted
+	}
+
 	u.IsDeleted = true
 	u.DeletedAt = time.Now()
 
 	// Save user to DB
-	err = s.saveUser(&u)
+	err = s.saveUser(ctx, &u, EventUserDeleted)
+	if err != nil {
+		return User{}, err
+	}
+	s.audit(ctx, AuditUserDeleted, u.ID, nil)
+
+	return u, nil
+}
+
+func (s *authService) RestoreUser(ctx context.Context, id uuid.UUID) (User, error) {
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	if !u.IsDeleted {
+		return u, nil
+	}
+
+	u.IsDeleted = false
+	u.DeletedAt = time.Time{}
+
+	// Save user to DB. With ReuseDeletedEmails this fails with ErrAlreadyExists
+	// if someone signed up with the address in the meantime.
+	err = s.saveUser(ctx, &u, EventUserRestored)
+	if err != nil {
+		return User{}, err
+	}
+	s.audit(ctx, AuditUserRestored, u.ID, nil)
+
+	return u, nil
+}
+
+func (s *authService) RevokeSessions(ctx context.Context, id uuid.UUID) (User, error) {
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	u.SessionsRevokedAt = time.Now()
+
+	// Save user to DB
+	err = s.saveUser(ctx, &u, EventUserUpdated)
 	if err != nil {
 		return User{}, err
 	}
+	s.audit(ctx, AuditSessionsRevoked, u.ID, nil)
 
 	return u, nil
 }
 
-func (s *authService) AuthenticateUser(email, password string) (User, error) {
+func (s *authService) AuthenticateUser(ctx context.Context, email, password string) (User, error) {
 	// Check Email
 	e, err := mail.ParseAddress(email)
 	if err != nil {
@@ -244,8 +670,11 @@ func (s *authService) AuthenticateUser(email, password string) (User, error) {
 	}
 
 	// Get user from database
-	u, err := s.getUserByEmail(e.Address)
-	if err != nil {
+	u, err := s.getUserByEmail(ctx, e.Address)
+	if err == ErrIncorrectAuth {
+		s.loginFailed(ctx, "password", uuid.Nil, e.Address, err)
+		return User{}, err
+	} else if err != nil {
 		return User{}, err
 	}
 
@@ -254,14 +683,31 @@ func (s *authService) AuthenticateUser(email, password string) (User, error) {
 	if err != nil {
 		return User{}, err
 	}
+	_, span := startSpan(ctx, "bcrypt.compare")
 	err = helpers.Crypto.BCryptCompareHashPassword(hashed, []byte(password))
+	span.End()
 	if err != nil {
+		s.loginFailed(ctx, "password", u.ID, e.Address, ErrIncorrectAuth)
 		return User{}, ErrIncorrectAuth
 	}
-	return u, nil
+
+	// only tell the user about their account's state once they have proven who they are
+	err = u.checkUsable()
+	if err != nil {
+		s.loginFailed(ctx, "password", u.ID, e.Address, err)
+		return User{}, err
+	}
+	return s.loggedIn(ctx, u, "password")
+}
+
+func (s *authService) BeginPasswordReset(ctx context.Context, email string) error {
+	err := s.beginPasswordReset(ctx, email)
+	incMetric(MetricPasswordResetRequests, resultLabel(err))
+	return err
 }
 
-func (s *authService) BeginPasswordReset(email string) error {
+// beginPasswordReset queues the reset email for BeginPasswordReset
+func (s *authService) beginPasswordReset(ctx context.Context, email string) error {
 	// Check email
 	e, err := mail.ParseAddress(email)
 	if err != nil {
@@ -269,45 +715,44 @@ func (s *authService) BeginPasswordReset(email string) error {
 	}
 
 	// Get user from database
-	u, err := s.getUserByEmail(e.Address)
+	u, err := s.getUserByEmail(ctx, e.Address)
 	if err != nil {
 		return err
 	}
-
-	// create nonce for reset token
-	n, err := s.nonce.New("auth.PasswordReset", u.ID, time.Hour*3)
+	err = u.checkUsable()
 	if err != nil {
 		return err
 	}
 
-	// Create Email Message
-	msg := s.mg.NewMessage(PasswordResetEmail.From, PasswordResetEmail.Subject, PasswordResetEmail.PlainText, u.Email)
-	b, err := s.tpl.ExecuteTemplate(PasswordResetEmail.TplName, u)
+	// create nonce for reset token
+	n, err := s.nonce.New("auth.PasswordReset", u.ID, PasswordResetExpiry)
 	if err != nil {
 		return err
 	}
-	msg.SetHtml(string(b))
-
-	// Add custom information via AddRecipientAndVariables
-	err = msg.AddRecipientAndVariables(u.Email, map[string]interface{}{
-		"token":     n.Token,
-		"firstname": u.FirstName,
-		"lastname":  u.LastName,
+	data := newEmailData(u)
+	data.Token = n.Token
+	data.Link = BaseURL + "/forgot-password/" + n.Token
+	data.ExpiresAt = time.Now().Add(PasswordResetExpiry)
+
+	// Queue Password Reset Email
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		return s.queueEmail(ctx, tx, PasswordResetEmail, u.Email, data)
 	})
 	if err != nil {
 		return err
 	}
-
-	// Send Message
-	_, _, err = s.mg.Send(msg)
-	if err != nil {
-		return err
-	}
-
+	s.audit(ctx, AuditPasswordResetRequested, u.ID, nil)
 	return nil
 }
 
-func (s *authService) CompletePasswordReset(token, email, password string) (User, error) {
+func (s *authService) CompletePasswordReset(ctx context.Context, token, email, password string) (User, error) {
+	u, err := s.completePasswordReset(ctx, token, email, password)
+	incMetric(MetricPasswordResetCompletions, resultLabel(err))
+	return u, err
+}
+
+// completePasswordReset checks the token and saves the new password for CompletePasswordReset
+func (s *authService) completePasswordReset(ctx context.Context, token, email, password string) (User, error) {
 	// Check email
 	e, err := mail.ParseAddress(email)
 	if err != nil {
@@ -315,7 +760,11 @@ func (s *authService) CompletePasswordReset(token, email, password string) (User
 	}
 
 	// Get User
-	u, err := s.getUserByEmail(e.Address)
+	u, err := s.getUserByEmail(ctx, e.Address)
+	if err != nil {
+		return User{}, err
+	}
+	err = u.checkUsable()
 	if err != nil {
 		return User{}, err
 	}
@@ -327,51 +776,219 @@ func (s *authService) CompletePasswordReset(token, email, password string) (User
 	}
 
 	// hash password
+	_, span := startSpan(ctx, "bcrypt.hash")
 	hashed, err := helpers.Crypto.BCryptPasswordHasher([]byte(password))
+	endSpan(span, err)
 	hashedB64 := base64.StdEncoding.EncodeToString(hashed)
 
 	u.Password = hashedB64
 	u.newPassword = true
 	u.rawPassword = password
 
-	err = s.saveUser(&u)
+	// Save user to DB and queue Confirmation Email
+	err = s.saveUser(ctx, &u, EventPasswordReset, func(tx *sqlx.Tx) error {
+		return s.queueEmail(ctx, tx, PasswordResetConfirmEmail, u.Email, newEmailData(u))
+	})
 	if err != nil {
 		return User{}, err
 	}
+	s.auditAs(ctx, AuditPasswordResetCompleted, u.ID, u.ID, nil)
+
+	return u, nil
+}
+
+func (s *authService) BeginMagicLogin(ctx context.Context, email string) error {
+	// Check email
+	e, err := mail.ParseAddress(email)
+	if err != nil {
+		return err
+	}
 
-	// Create Email Message
-	msg := s.mg.NewMessage(PasswordResetConfirmEmail.From, PasswordResetConfirmEmail.Subject, PasswordResetConfirmEmail.PlainText, u.Email)
-	b, err := s.tpl.ExecuteTemplate(PasswordResetConfirmEmail.TplName, u)
+	// Get user from database
+	u, err := s.getUserByEmail(ctx, e.Address)
 	if err != nil {
-		glog.Errorf("Error creating HTML Email. Got error: %v", err)
-		return u, nil
+		return err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return err
 	}
-	msg.SetHtml(string(b))
 
-	// Add custom information via AddRecipientAndVariables
-	err = msg.AddRecipientAndVariables(u.Email, map[string]interface{}{
-		"firstname": u.FirstName,
-		"lastname":  u.LastName,
+	// create nonce for login token
+	n, err := s.nonce.New("auth.MagicLogin", u.ID, MagicLoginExpiry)
+	if err != nil {
+		return err
+	}
+	data := newEmailData(u)
+	data.Token = userToken(u.ID, n.Token)
+	data.Link = BaseURL + "/magic-login/" + data.Token
+	data.ExpiresAt = time.Now().Add(MagicLoginExpiry)
+
+	// Queue Magic Login Email
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		return s.queueEmail(ctx, tx, MagicLoginEmail, u.Email, data)
 	})
+}
+
+func (s *authService) CompleteMagicLogin(ctx context.Context, token string) (User, error) {
+	u, err := s.useUserToken(ctx, token, "auth.MagicLogin")
 	if err != nil {
-		glog.Errorf("Error with AddRecipientAndVariables. Got error: %v", err)
-		return u, nil
+		id, _, _ := parseUserToken(token)
+		s.loginFailed(ctx, "magic_link", id, "", err)
+		return User{}, err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		s.loginFailed(ctx, "magic_link", u.ID, u.Email, err)
+		return User{}, err
+	}
+	return s.loggedIn(ctx, u, "magic_link")
+}
+
+func (s *authService) ListFailedEmails(ctx context.Context) ([]OutboxMessage, error) {
+	return s.outbox.Failed(ctx)
+}
+
+func (s *authService) RetryEmail(ctx context.Context, id uuid.UUID) error {
+	return s.outbox.Retry(ctx, id)
+}
+
+// userToken prefixes a nonce token with the ID of the user it was issued to (or, for an OrgInvite, of the invitation).
+// It is used for links that must identify the user without an email address.
+func userToken(id uuid.UUID, nonceToken string) string {
+	return id.String() + "." + nonceToken
+}
+
+// parseUserToken splits a token created by userToken
+func parseUserToken(token string) (uuid.UUID, string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return uuid.Nil, "", ErrInvalidToken
+	}
+	id, err := uuid.FromString(parts[0])
+	if err != nil || id == uuid.Nil {
+		return uuid.Nil, "", ErrInvalidToken
 	}
+	return id, parts[1], nil
+}
 
-	// Send Message
-	_, _, err = s.mg.Send(msg)
+// newEmailData creates the template data for an email about u in u's preferred locale
+func newEmailData(u User) EmailData {
+	return EmailData{
+		User:    u,
+		AppName: AppName,
+		Locale:  ResolveLocale(u.Locale, ""),
+	}
+}
+
+// queueEmail renders msg with data and adds it to the outbox within tx.
+// The HTML body is rendered from the msg.TplName template in TplSys and the
+// plain-text body from EmailTextTemplates[msg.TplName] (or msg.PlainText if there is none).
+func (s *authService) queueEmail(ctx context.Context, tx *sqlx.Tx, msg tmpl.EmailMessage, to string, data EmailData) error {
+	html, err := s.tpl.ExecuteTemplate(msg.TplName, data)
 	if err != nil {
-		glog.Errorf("Error sending email. Got error: %v", err)
-		return u, nil
+		return err
+	}
+
+	t, ok := s.txt[msg.TplName]
+	if !ok {
+		t, err = textTemplate.New(msg.TplName).Parse(msg.PlainText)
+		if err != nil {
+			return err
+		}
+	}
+	var text bytes.Buffer
+	err = t.Execute(&text, data)
+	if err != nil {
+		return err
+	}
+
+	subject, ok := lookupMessage(data.Locale, msg.TplName+".subject")
+	if !ok {
+		subject = msg.Subject
+	}
+
+	return s.outbox.Enqueue(ctx, tx, Email{
+		From:      msg.From,
+		To:        to,
+		Subject:   subject,
+		PlainText: text.String(),
+		HTML:      string(html),
+	})
+}
+
+// useUserToken consumes a token created by userToken for action and returns the user it was issued to
+func (s *authService) useUserToken(ctx context.Context, token, action string) (User, error) {
+	id, nonceToken, err := parseUserToken(token)
+	if err != nil {
+		return User{}, err
 	}
 
+	u, err := s.GetUser(ctx, id)
+	if err == ErrUserNotFound {
+		return User{}, ErrInvalidToken
+	} else if err != nil {
+		return User{}, err
+	}
+	if u.IsDeleted {
+		return User{}, ErrUserDeleted
+	}
+
+	_, err = s.nonce.CheckThenConsume(nonceToken, action, u.ID)
+	if err != nil {
+		return User{}, ErrInvalidToken
+	}
 	return u, nil
 }
 
-// getUserByEmail gets a user from the database by email address
-func (s *authService) getUserByEmail(email string) (User, error) {
+// getEmailChange gets the user's latest email change with one of statuses.
+// ErrInvalidToken is returned if there is none, i.e. the change was replaced or already cancelled.
+func (s *authService) getEmailChange(ctx context.Context, userID uuid.UUID, statuses ...string) (EmailChange, error) {
+	q, args, err := sqlx.In("SELECT * FROM email_change WHERE user_id=? AND status IN (?) ORDER BY created_at DESC LIMIT 1", userID, statuses)
+	if err != nil {
+		return EmailChange{}, err
+	}
+
+	c := EmailChange{}
+	err = s.db.GetContext(ctx, &c, s.db.Rebind(q), args...)
+	if err == sql.ErrNoRows {
+		return EmailChange{}, ErrInvalidToken
+	} else if err != nil {
+		return EmailChange{}, err
+	}
+	return c, nil
+}
+
+// setEmailChangeStatus returns a txFunc that records status on c
+func (s *authService) setEmailChangeStatus(ctx context.Context, c *EmailChange, status string) txFunc {
+	return func(tx *sqlx.Tx) error {
+		c.Status = status
+		c.UpdatedAt = time.Now()
+		_, err := tx.NamedExecContext(ctx, "UPDATE email_change SET status=:status, updated_at=:updated_at WHERE id=:id", c)
+		return err
+	}
+}
+
+// checkEmailAvailable returns ErrAlreadyExists if email belongs to a user
+func (s *authService) checkEmailAvailable(ctx context.Context, email string) error {
+	_, err := s.getUserByEmail(ctx, email)
+	if err == nil {
+		return ErrAlreadyExists
+	} else if err != ErrIncorrectAuth {
+		return err
+	}
+	return nil
+}
+
+// getUserByEmail gets a user from the database by (normalized) email address
+func (s *authService) getUserByEmail(ctx context.Context, email string) (User, error) {
+	normalized, err := NormalizeEmail(email)
+	if err != nil {
+		return User{}, ErrIncorrectAuth
+	}
+
 	u := User{}
-	err := s.db.Get(&u, "SELECT * FROM user WHERE email=$1", email)
+	err = s.db.GetContext(ctx, &u, "SELECT * FROM user WHERE email_normalized=$1", normalized)
 	if err != nil && err != sql.ErrNoRows {
 		return User{}, err
 	} else if err == sql.ErrNoRows {
@@ -381,8 +998,10 @@ func (s *authService) getUserByEmail(email string) (User, error) {
 	return u, nil
 }
 
-// saveUser saves a new user to the database or updates an existing user
-func (s *authService) saveUser(u *User) error {
+// saveUser saves a new user to the database or updates an existing user and publishes an event of type typ.
+// Each fn is run in the same transaction after the user is written, followed by the hooks for the event;
+// if one fails nothing is saved and the event is not published.
+func (s *authService) saveUser(ctx context.Context, u *User, typ EventType, fns ...txFunc) error {
 	if err := u.Validate(); err != nil {
 		return err
 	}
@@ -390,30 +1009,64 @@ func (s *authService) saveUser(u *User) error {
 	var sqlExec string
 
 	// if id is nil then it is a new user
-	if u.ID == uuid.Nil {
+	isNew := u.ID == uuid.Nil
+	if isNew {
 		// generate ID
 		u.ID = uuid.NewV4()
 		sqlExec = `INSERT INTO user 
-		(id, email, password, firstname, lastname, is_superuser, is_active, is_deleted, created_at, updated_at, deleted_at, avatar_url) 
-		VALUES (:id, :email, :password, :firstname, :lastname, :is_superuser, :is_active, :is_deleted, :created_at, :updated_at, :deleted_at, :avatar_url)`
+		(id, email, email_normalized, password, firstname, lastname, is_superuser, is_active, is_deleted, created_at, updated_at, deleted_at, avatar_url, locale, sessions_revoked_at) 
+		VALUES (:id, :email, :email_normalized, :password, :firstname, :lastname, :is_superuser, :is_active, :is_deleted, :created_at, :updated_at, :deleted_at, :avatar_url, :locale, :sessions_revoked_at)`
 	} else {
-		sqlExec = `UPDATE user SET email=:email, password=:password, firstname=:firstname, lastname=:lastname, is_superuser=:is_superuser, 
-		is_active=:is_active, is_deleted=:is_deleted, created_at=:created_at, updated_at=:updated_at, deleted_at=:deleted_at, avatar_url=:avatar_url WHERE id=:id`
+		sqlExec = `UPDATE user SET email=:email, email_normalized=:email_normalized, password=:password, firstname=:firstname, lastname=:lastname, is_superuser=:is_superuser, 
+		is_active=:is_active, is_deleted=:is_deleted, created_at=:created_at, updated_at=:updated_at, deleted_at=:deleted_at, avatar_url=:avatar_url, locale=:locale, 
+		sessions_revoked_at=:sessions_revoked_at WHERE id=:id`
+	}
+
+	// a deleted user's unique address is swapped for one nobody can sign up with
+	if u.IsDeleted && ReuseDeletedEmails {
+		u.NormalizedEmail = deletedEmailPrefix + u.ID.String()
 	}
 
-	tx, err := s.db.Beginx()
+	e := s.newEvent(typ, *u)
+	fns = append([]txFunc{func(tx *sqlx.Tx) error {
+		ctx, span := startStatementSpan(ctx, sqlExec)
+		_, err := tx.NamedExecContext(ctx, sqlExec, u)
+		endSpan(span, err)
+		return err
+	}}, fns...)
+	err := s.inTx(ctx, append(fns, s.hooks(ctx, e))...)
 	if err != nil {
+		if isNew {
+			u.ID = uuid.Nil
+		}
 		return err
 	}
-	_, err = tx.NamedExec(sqlExec, &u)
+	s.events.publish(e)
+	return nil
+}
+
+// inTx runs each fn in order inside a single transaction.
+// The transaction is committed only if every fn succeeds.
+// Unique constraint violations are returned as ErrAlreadyExists.
+func (s *authService) inTx(ctx context.Context, fns ...txFunc) error {
+	defer observeSince(MetricDBDuration, time.Now(), Labels{"operation": "transaction"})
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
+	for _, fn := range fns {
+		err = fn(tx)
+		if err != nil {
+			tx.Rollback()
+			if isUniqueViolation(err) {
+				return ErrAlreadyExists
+			}
+			return err
+		}
+	}
 	err = tx.Commit()
-	if err != nil {
-		return err
+	if err != nil && isUniqueViolation(err) {
+		return ErrAlreadyExists
 	}
-
-	return nil
+	return err
 }
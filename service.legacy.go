@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/markbates/goth"
+	"github.com/satori/go.uuid"
+)
+
+// LegacyService has the methods of Service as they were before they took a context.Context.
+// See Service for what each method does.
+//
+// Deprecated: Use Service and pass each call the context of the request it serves.
+type LegacyService interface {
+	NewUserLocal(email, password, firstName, lastName string, isSuperuser bool) (User, error)
+	NewUserProvider(user goth.User, isSuperuser bool) (User, error)
+	UserAddProvider(id uuid.UUID, user goth.User) (User, error)
+	GetUser(id uuid.UUID) (User, error)
+	ListUsers(q UserQuery) (UserList, error)
+	UpdateUser(u User) (User, error)
+	BeginEmailChange(userID uuid.UUID, newEmail string) error
+	CompleteEmailChange(token string) (User, error)
+	CancelEmailChange(token string) (User, error)
+	DeleteUser(id uuid.UUID) (User, error)
+	RestoreUser(id uuid.UUID) (User, error)
+	PurgeUser(id uuid.UUID) (PurgeReport, error)
+	PurgeDeletedUsers(deletedBefore time.Time) (PurgeReport, error)
+	RevokeSessions(id uuid.UUID) (User, error)
+	AuthenticateUser(email, password string) (User, error)
+	BeginPasswordReset(email string) error
+	CompletePasswordReset(token, email, password string) (User, error)
+	BeginMagicLogin(email string) error
+	CompleteMagicLogin(token string) (User, error)
+	ListLoginHistory(userID uuid.UUID, limit int) ([]LoginRecord, error)
+	ReportLogin(token string) (User, error)
+	ExportUserData(id uuid.UUID) ([]byte, error)
+	BeginDataExport(id uuid.UUID) error
+	CompleteDataExport(token string) ([]byte, error)
+	WithAuditInfo(info AuditInfo) LegacyService
+	RecordAuditEvent(e AuditEvent) error
+	ListAuditEvents(q AuditQuery) (AuditList, error)
+	Events() *EventBus
+	ListFailedEmails() ([]OutboxMessage, error)
+	RetryEmail(id uuid.UUID) error
+	BeginWebAuthnRegistration(userID uuid.UUID) (WebAuthnCreationOptions, error)
+	FinishWebAuthnRegistration(userID uuid.UUID, resp WebAuthnAttestationResponse) (WebAuthnCredential, error)
+	BeginWebAuthnLogin(email string) (WebAuthnRequestOptions, error)
+	FinishWebAuthnLogin(resp WebAuthnAssertionResponse) (User, error)
+	ListWebAuthnCredentials(userID uuid.UUID) ([]WebAuthnCredential, error)
+	DeleteWebAuthnCredential(userID, id uuid.UUID) error
+}
+
+// legacyService satisfies LegacyService by calling a Service with context.Background()
+type legacyService struct {
+	s Service
+}
+
+// NewLegacyService wraps s for code written against the signatures without a context.
+// Calls can't be cancelled and don't carry request-scoped values.
+//
+// Deprecated: Use s directly.
+func NewLegacyService(s Service) LegacyService {
+	return legacyService{s: s}
+}
+
+func (l legacyService) NewUserLocal(email, password, firstName, lastName string, isSuperuser bool) (User, error) {
+	return l.s.NewUserLocal(context.Background(), email, password, firstName, lastName, isSuperuser)
+}
+
+func (l legacyService) NewUserProvider(user goth.User, isSuperuser bool) (User, error) {
+	return l.s.NewUserProvider(context.Background(), user, isSuperuser)
+}
+
+func (l legacyService) UserAddProvider(id uuid.UUID, user goth.User) (User, error) {
+	return l.s.UserAddProvider(context.Background(), id, user)
+}
+
+func (l legacyService) GetUser(id uuid.UUID) (User, error) {
+	return l.s.GetUser(context.Background(), id)
+}
+
+func (l legacyService) ListUsers(q UserQuery) (UserList, error) {
+	return l.s.ListUsers(context.Background(), q)
+}
+
+func (l legacyService) UpdateUser(u User) (User, error) {
+	return l.s.UpdateUser(context.Background(), u)
+}
+
+func (l legacyService) BeginEmailChange(userID uuid.UUID, newEmail string) error {
+	return l.s.BeginEmailChange(context.Background(), userID, newEmail)
+}
+
+func (l legacyService) CompleteEmailChange(token string) (User, error) {
+	return l.s.CompleteEmailChange(context.Background(), token)
+}
+
+func (l legacyService) CancelEmailChange(token string) (User, error) {
+	return l.s.CancelEmailChange(context.Background(), token)
+}
+
+func (l legacyService) DeleteUser(id uuid.UUID) (User, error) {
+	return l.s.DeleteUser(context.Background(), id)
+}
+
+func (l legacyService) RestoreUser(id uuid.UUID) (User, error) {
+	return l.s.RestoreUser(context.Background(), id)
+}
+
+func (l legacyService) PurgeUser(id uuid.UUID) (PurgeReport, error) {
+	return l.s.PurgeUser(context.Background(), id)
+}
+
+func (l legacyService) PurgeDeletedUsers(deletedBefore time.Time) (PurgeReport, error) {
+	return l.s.PurgeDeletedUsers(context.Background(), deletedBefore)
+}
+
+func (l legacyService) RevokeSessions(id uuid.UUID) (User, error) {
+	return l.s.RevokeSessions(context.Background(), id)
+}
+
+func (l legacyService) AuthenticateUser(email, password string) (User, error) {
+	return l.s.AuthenticateUser(context.Background(), email, password)
+}
+
+func (l legacyService) BeginPasswordReset(email string) error {
+	return l.s.BeginPasswordReset(context.Background(), email)
+}
+
+func (l legacyService) CompletePasswordReset(token, email, password string) (User, error) {
+	return l.s.CompletePasswordReset(context.Background(), token, email, password)
+}
+
+func (l legacyService) BeginMagicLogin(email string) error {
+	return l.s.BeginMagicLogin(context.Background(), email)
+}
+
+func (l legacyService) CompleteMagicLogin(token string) (User, error) {
+	return l.s.CompleteMagicLogin(context.Background(), token)
+}
+
+func (l legacyService) ListLoginHistory(userID uuid.UUID, limit int) ([]LoginRecord, error) {
+	return l.s.ListLoginHistory(context.Background(), userID, limit)
+}
+
+func (l legacyService) ReportLogin(token string) (User, error) {
+	return l.s.ReportLogin(context.Background(), token)
+}
+
+func (l legacyService) ExportUserData(id uuid.UUID) ([]byte, error) {
+	return l.s.ExportUserData(context.Background(), id)
+}
+
+func (l legacyService) BeginDataExport(id uuid.UUID) error {
+	return l.s.BeginDataExport(context.Background(), id)
+}
+
+func (l legacyService) CompleteDataExport(token string) ([]byte, error) {
+	return l.s.CompleteDataExport(context.Background(), token)
+}
+
+func (l legacyService) WithAuditInfo(info AuditInfo) LegacyService {
+	return legacyService{l.s.WithAuditInfo(info)}
+}
+
+func (l legacyService) RecordAuditEvent(e AuditEvent) error {
+	return l.s.RecordAuditEvent(context.Background(), e)
+}
+
+func (l legacyService) ListAuditEvents(q AuditQuery) (AuditList, error) {
+	return l.s.ListAuditEvents(context.Background(), q)
+}
+
+func (l legacyService) Events() *EventBus {
+	return l.s.Events()
+}
+
+func (l legacyService) ListFailedEmails() ([]OutboxMessage, error) {
+	return l.s.ListFailedEmails(context.Background())
+}
+
+func (l legacyService) RetryEmail(id uuid.UUID) error {
+	return l.s.RetryEmail(context.Background(), id)
+}
+
+func (l legacyService) BeginWebAuthnRegistration(userID uuid.UUID) (WebAuthnCreationOptions, error) {
+	return l.s.BeginWebAuthnRegistration(context.Background(), userID)
+}
+
+func (l legacyService) FinishWebAuthnRegistration(userID uuid.UUID, resp WebAuthnAttestationResponse) (WebAuthnCredential, error) {
+	return l.s.FinishWebAuthnRegistration(context.Background(), userID, resp)
+}
+
+func (l legacyService) BeginWebAuthnLogin(email string) (WebAuthnRequestOptions, error) {
+	return l.s.BeginWebAuthnLogin(context.Background(), email)
+}
+
+func (l legacyService) FinishWebAuthnLogin(resp WebAuthnAssertionResponse) (User, error) {
+	return l.s.FinishWebAuthnLogin(context.Background(), resp)
+}
+
+func (l legacyService) ListWebAuthnCredentials(userID uuid.UUID) ([]WebAuthnCredential, error) {
+	return l.s.ListWebAuthnCredentials(context.Background(), userID)
+}
+
+func (l legacyService) DeleteWebAuthnCredential(userID, id uuid.UUID) error {
+	return l.s.DeleteWebAuthnCredential(context.Background(), userID, id)
+}
@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/markbates/goth"
+	"github.com/satori/go.uuid"
+)
+
+// tracedService starts a span around every call to a Service and names it as the "operation" of what is logged during the call
+type tracedService struct {
+	s Service
+}
+
+func (t tracedService) NewUserLocal(ctx context.Context, email, password, firstName, lastName string, isSuperuser bool) (User, error) {
+	ctx, span := startOperation(ctx, "auth.NewUserLocal")
+	v, err := t.s.NewUserLocal(ctx, email, password, firstName, lastName, isSuperuser)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) NewUserProvider(ctx context.Context, user goth.User, isSuperuser bool) (User, error) {
+	ctx, span := startOperation(ctx, "auth.NewUserProvider")
+	v, err := t.s.NewUserProvider(ctx, user, isSuperuser)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) UserAddProvider(ctx context.Context, id uuid.UUID, user goth.User) (User, error) {
+	ctx, span := startOperation(ctx, "auth.UserAddProvider")
+	v, err := t.s.UserAddProvider(ctx, id, user)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) GetUser(ctx context.Context, id uuid.UUID) (User, error) {
+	ctx, span := startOperation(ctx, "auth.GetUser")
+	v, err := t.s.GetUser(ctx, id)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) ListUsers(ctx context.Context, q UserQuery) (UserList, error) {
+	ctx, span := startOperation(ctx, "auth.ListUsers")
+	v, err := t.s.ListUsers(ctx, q)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) UpdateUser(ctx context.Context, u User) (User, error) {
+	ctx, span := startOperation(ctx, "auth.UpdateUser")
+	v, err := t.s.UpdateUser(ctx, u)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) BeginEmailChange(ctx context.Context, userID uuid.UUID, newEmail string) error {
+	ctx, span := startOperation(ctx, "auth.BeginEmailChange")
+	err := t.s.BeginEmailChange(ctx, userID, newEmail)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) CompleteEmailChange(ctx context.Context, token string) (User, error) {
+	ctx, span := startOperation(ctx, "auth.CompleteEmailChange")
+	v, err := t.s.CompleteEmailChange(ctx, token)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) CancelEmailChange(ctx context.Context, token string) (User, error) {
+	ctx, span := startOperation(ctx, "auth.CancelEmailChange")
+	v, err := t.s.CancelEmailChange(ctx, token)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) DeleteUser(ctx context.Context, id uuid.UUID) (User, error) {
+	ctx, span := startOperation(ctx, "auth.DeleteUser")
+	v, err := t.s.DeleteUser(ctx, id)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) RestoreUser(ctx context.Context, id uuid.UUID) (User, error) {
+	ctx, span := startOperation(ctx, "auth.RestoreUser")
+	v, err := t.s.RestoreUser(ctx, id)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) PurgeUser(ctx context.Context, id uuid.UUID) (PurgeReport, error) {
+	ctx, span := startOperation(ctx, "auth.PurgeUser")
+	v, err := t.s.PurgeUser(ctx, id)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (PurgeReport, error) {
+	ctx, span := startOperation(ctx, "auth.PurgeDeletedUsers")
+	v, err := t.s.PurgeDeletedUsers(ctx, deletedBefore)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) RevokeSessions(ctx context.Context, id uuid.UUID) (User, error) {
+	ctx, span := startOperation(ctx, "auth.RevokeSessions")
+	v, err := t.s.RevokeSessions(ctx, id)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) AuthenticateUser(ctx context.Context, email, password string) (User, error) {
+	ctx, span := startOperation(ctx, "auth.AuthenticateUser")
+	v, err := t.s.AuthenticateUser(ctx, email, password)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) CompleteLogin(ctx context.Context, u User, method string) error {
+	ctx, span := startOperation(ctx, "auth.CompleteLogin")
+	err := t.s.CompleteLogin(ctx, u, method)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) BeginPasswordReset(ctx context.Context, email string) error {
+	ctx, span := startOperation(ctx, "auth.BeginPasswordReset")
+	err := t.s.BeginPasswordReset(ctx, email)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) CompletePasswordReset(ctx context.Context, token, email, password string) (User, error) {
+	ctx, span := startOperation(ctx, "auth.CompletePasswordReset")
+	v, err := t.s.CompletePasswordReset(ctx, token, email, password)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) BeginMagicLogin(ctx context.Context, email string) error {
+	ctx, span := startOperation(ctx, "auth.BeginMagicLogin")
+	err := t.s.BeginMagicLogin(ctx, email)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) CompleteMagicLogin(ctx context.Context, token string) (User, error) {
+	ctx, span := startOperation(ctx, "auth.CompleteMagicLogin")
+	v, err := t.s.CompleteMagicLogin(ctx, token)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) ListLoginHistory(ctx context.Context, userID uuid.UUID, limit int) ([]LoginRecord, error) {
+	ctx, span := startOperation(ctx, "auth.ListLoginHistory")
+	v, err := t.s.ListLoginHistory(ctx, userID, limit)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) ReportLogin(ctx context.Context, token string) (User, error) {
+	ctx, span := startOperation(ctx, "auth.ReportLogin")
+	v, err := t.s.ReportLogin(ctx, token)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) ExportUserData(ctx context.Context, id uuid.UUID) ([]byte, error) {
+	ctx, span := startOperation(ctx, "auth.ExportUserData")
+	v, err := t.s.ExportUserData(ctx, id)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) BeginDataExport(ctx context.Context, id uuid.UUID) error {
+	ctx, span := startOperation(ctx, "auth.BeginDataExport")
+	err := t.s.BeginDataExport(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) CompleteDataExport(ctx context.Context, token string) ([]byte, error) {
+	ctx, span := startOperation(ctx, "auth.CompleteDataExport")
+	v, err := t.s.CompleteDataExport(ctx, token)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) PurgeExpiredExports(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := startOperation(ctx, "auth.PurgeExpiredExports")
+	v, err := t.s.PurgeExpiredExports(ctx, before)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) WithAuditInfo(info AuditInfo) Service {
+	return tracedService{t.s.WithAuditInfo(info)}
+}
+
+func (t tracedService) RecordAuditEvent(ctx context.Context, e AuditEvent) error {
+	ctx, span := startOperation(ctx, "auth.RecordAuditEvent")
+	err := t.s.RecordAuditEvent(ctx, e)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) ListAuditEvents(ctx context.Context, q AuditQuery) (AuditList, error) {
+	ctx, span := startOperation(ctx, "auth.ListAuditEvents")
+	v, err := t.s.ListAuditEvents(ctx, q)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) Events() *EventBus {
+	return t.s.Events()
+}
+
+func (t tracedService) ListFailedEmails(ctx context.Context) ([]OutboxMessage, error) {
+	ctx, span := startOperation(ctx, "auth.ListFailedEmails")
+	v, err := t.s.ListFailedEmails(ctx)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) RetryEmail(ctx context.Context, id uuid.UUID) error {
+	ctx, span := startOperation(ctx, "auth.RetryEmail")
+	err := t.s.RetryEmail(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) BeginWebAuthnRegistration(ctx context.Context, userID uuid.UUID) (WebAuthnCreationOptions, error) {
+	ctx, span := startOperation(ctx, "auth.BeginWebAuthnRegistration")
+	v, err := t.s.BeginWebAuthnRegistration(ctx, userID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) FinishWebAuthnRegistration(ctx context.Context, userID uuid.UUID, resp WebAuthnAttestationResponse) (WebAuthnCredential, error) {
+	ctx, span := startOperation(ctx, "auth.FinishWebAuthnRegistration")
+	v, err := t.s.FinishWebAuthnRegistration(ctx, userID, resp)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) BeginWebAuthnLogin(ctx context.Context, email string) (WebAuthnRequestOptions, error) {
+	ctx, span := startOperation(ctx, "auth.BeginWebAuthnLogin")
+	v, err := t.s.BeginWebAuthnLogin(ctx, email)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) FinishWebAuthnLogin(ctx context.Context, resp WebAuthnAssertionResponse) (User, error) {
+	ctx, span := startOperation(ctx, "auth.FinishWebAuthnLogin")
+	v, err := t.s.FinishWebAuthnLogin(ctx, resp)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) ListWebAuthnCredentials(ctx context.Context, userID uuid.UUID) ([]WebAuthnCredential, error) {
+	ctx, span := startOperation(ctx, "auth.ListWebAuthnCredentials")
+	v, err := t.s.ListWebAuthnCredentials(ctx, userID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) DeleteWebAuthnCredential(ctx context.Context, userID, id uuid.UUID) error {
+	ctx, span := startOperation(ctx, "auth.DeleteWebAuthnCredential")
+	err := t.s.DeleteWebAuthnCredential(ctx, userID, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) CreateOrganization(ctx context.Context, name string, ownerID uuid.UUID) (Organization, error) {
+	ctx, span := startOperation(ctx, "auth.CreateOrganization")
+	v, err := t.s.CreateOrganization(ctx, name, ownerID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) GetOrganization(ctx context.Context, id uuid.UUID) (Organization, error) {
+	ctx, span := startOperation(ctx, "auth.GetOrganization")
+	v, err := t.s.GetOrganization(ctx, id)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) UpdateOrganization(ctx context.Context, o Organization) (Organization, error) {
+	ctx, span := startOperation(ctx, "auth.UpdateOrganization")
+	v, err := t.s.UpdateOrganization(ctx, o)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) DeleteOrganization(ctx context.Context, id uuid.UUID) error {
+	ctx, span := startOperation(ctx, "auth.DeleteOrganization")
+	err := t.s.DeleteOrganization(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) ListUserOrganizations(ctx context.Context, userID uuid.UUID) ([]UserOrganization, error) {
+	ctx, span := startOperation(ctx, "auth.ListUserOrganizations")
+	v, err := t.s.ListUserOrganizations(ctx, userID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) GetMembership(ctx context.Context, orgID, userID uuid.UUID) (Membership, error) {
+	ctx, span := startOperation(ctx, "auth.GetMembership")
+	v, err := t.s.GetMembership(ctx, orgID, userID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) ListOrgMembers(ctx context.Context, orgID uuid.UUID) ([]OrgMember, error) {
+	ctx, span := startOperation(ctx, "auth.ListOrgMembers")
+	v, err := t.s.ListOrgMembers(ctx, orgID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) SetMemberRole(ctx context.Context, orgID, userID uuid.UUID, role string) (Membership, error) {
+	ctx, span := startOperation(ctx, "auth.SetMemberRole")
+	v, err := t.s.SetMemberRole(ctx, orgID, userID, role)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) RemoveOrgMember(ctx context.Context, orgID, userID uuid.UUID) error {
+	ctx, span := startOperation(ctx, "auth.RemoveOrgMember")
+	err := t.s.RemoveOrgMember(ctx, orgID, userID)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) InviteOrgMember(ctx context.Context, orgID, inviterID uuid.UUID, email, role string) (OrgInvite, error) {
+	ctx, span := startOperation(ctx, "auth.InviteOrgMember")
+	v, err := t.s.InviteOrgMember(ctx, orgID, inviterID, email, role)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) ListOrgInvites(ctx context.Context, orgID uuid.UUID) ([]OrgInvite, error) {
+	ctx, span := startOperation(ctx, "auth.ListOrgInvites")
+	v, err := t.s.ListOrgInvites(ctx, orgID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) RevokeOrgInvite(ctx context.Context, orgID, id uuid.UUID) error {
+	ctx, span := startOperation(ctx, "auth.RevokeOrgInvite")
+	err := t.s.RevokeOrgInvite(ctx, orgID, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) AcceptOrgInvite(ctx context.Context, token string, userID uuid.UUID) (Membership, error) {
+	ctx, span := startOperation(ctx, "auth.AcceptOrgInvite")
+	v, err := t.s.AcceptOrgInvite(ctx, token, userID)
+	endSpan(span, err)
+	return v, err
+}
+
+// startOperation starts the span of the Service method name and adds it to the log fields of ctx as "operation"
+func startOperation(ctx context.Context, name string) (context.Context, Span) {
+	return startSpan(ContextWithLogFields(ctx, Fields{"operation": name}), name)
+}
+
+func (t tracedService) InviteUser(ctx context.Context, email string, inviterID uuid.UUID, roles []Role) (UserInvite, error) {
+	ctx, span := startOperation(ctx, "auth.InviteUser")
+	v, err := t.s.InviteUser(ctx, email, inviterID, roles)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) GetUserInvite(ctx context.Context, token string) (UserInvite, error) {
+	ctx, span := startOperation(ctx, "auth.GetUserInvite")
+	v, err := t.s.GetUserInvite(ctx, token)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) AcceptUserInvite(ctx context.Context, token, password, firstName, lastName string) (User, error) {
+	ctx, span := startOperation(ctx, "auth.AcceptUserInvite")
+	v, err := t.s.AcceptUserInvite(ctx, token, password, firstName, lastName)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) ListUserInvites(ctx context.Context, orgID uuid.UUID) ([]UserInvite, error) {
+	ctx, span := startOperation(ctx, "auth.ListUserInvites")
+	v, err := t.s.ListUserInvites(ctx, orgID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) RevokeUserInvite(ctx context.Context, id uuid.UUID) error {
+	ctx, span := startOperation(ctx, "auth.RevokeUserInvite")
+	err := t.s.RevokeUserInvite(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) ExpireInvites(ctx context.Context, before time.Time) (int, error) {
+	ctx, span := startOperation(ctx, "auth.ExpireInvites")
+	v, err := t.s.ExpireInvites(ctx, before)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) CreateAPIKey(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt time.Time) (APIKey, string, error) {
+	ctx, span := startOperation(ctx, "auth.CreateAPIKey")
+	v, key, err := t.s.CreateAPIKey(ctx, userID, name, scopes, expiresAt)
+	endSpan(span, err)
+	return v, key, err
+}
+
+func (t tracedService) ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]APIKey, error) {
+	ctx, span := startOperation(ctx, "auth.ListAPIKeys")
+	v, err := t.s.ListAPIKeys(ctx, userID)
+	endSpan(span, err)
+	return v, err
+}
+
+func (t tracedService) RevokeAPIKey(ctx context.Context, userID, id uuid.UUID) error {
+	ctx, span := startOperation(ctx, "auth.RevokeAPIKey")
+	err := t.s.RevokeAPIKey(ctx, userID, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t tracedService) AuthenticateAPIKey(ctx context.Context, key string) (User, APIKey, error) {
+	ctx, span := startOperation(ctx, "auth.AuthenticateAPIKey")
+	u, k, err := t.s.AuthenticateAPIKey(ctx, key)
+	endSpan(span, err)
+	return u, k, err
+}
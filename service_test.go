@@ -1,17 +1,35 @@
 package auth
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bryanjeal/go-nonce"
 	tmpl "github.com/bryanjeal/go-tmpl"
 
+	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/satori/go.uuid"
-	mailgun "gopkg.in/mailgun/mailgun-go.v1"
 )
 
 const sqlCreateUserTable string = `
@@ -22,6 +40,7 @@ BEGIN;
 CREATE TABLE "auth"."user"(
   "id" BINARY(16) NOT NULL,
   "email" VARCHAR(255) NOT NULL,
+  "email_normalized" VARCHAR(255) NOT NULL,
   "password" VARCHAR(255) NOT NULL,
   "firstname" VARCHAR(45) NOT NULL,
   "lastname" VARCHAR(45) NOT NULL,
@@ -31,8 +50,154 @@ CREATE TABLE "auth"."user"(
   "created_at" DATETIME NOT NULL,
   "updated_at" DATETIME NOT NULL,
   "deleted_at" DATETIME NOT NULL,
-  "avatar_url" VARCHAR(45)
+  "avatar_url" VARCHAR(45),
+  "locale" VARCHAR(16) NOT NULL DEFAULT '',
+  "sessions_revoked_at" DATETIME NOT NULL
 );
+CREATE UNIQUE INDEX "auth"."user_email_normalized" ON "user"("email_normalized");
+CREATE TABLE "auth"."user_provider"(
+  "user_id" BINARY(16) NOT NULL,
+  "provider" VARCHAR(45) NOT NULL,
+  "provider_user_id" VARCHAR(255) NOT NULL
+);
+CREATE TABLE "auth"."email_outbox"(
+  "id" BINARY(16) NOT NULL,
+  "from_addr" VARCHAR(255) NOT NULL,
+  "to_addr" VARCHAR(255) NOT NULL,
+  "subject" VARCHAR(255) NOT NULL,
+  "plain_text" TEXT NOT NULL,
+  "html" TEXT NOT NULL,
+  "status" VARCHAR(16) NOT NULL,
+  "attempts" INTEGER NOT NULL DEFAULT 0,
+  "last_error" TEXT NOT NULL,
+  "next_attempt_at" DATETIME NOT NULL,
+  "created_at" DATETIME NOT NULL,
+  "updated_at" DATETIME NOT NULL,
+  "sent_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."email_change"(
+  "id" BINARY(16) NOT NULL,
+  "user_id" BINARY(16) NOT NULL,
+  "old_email" VARCHAR(255) NOT NULL,
+  "new_email" VARCHAR(255) NOT NULL,
+  "status" VARCHAR(16) NOT NULL,
+  "created_at" DATETIME NOT NULL,
+  "updated_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."webauthn_credential"(
+  "id" BINARY(16) NOT NULL,
+  "user_id" BINARY(16) NOT NULL,
+  "credential_id" VARBINARY(1023) NOT NULL UNIQUE,
+  "public_key" BLOB NOT NULL,
+  "sign_count" INTEGER NOT NULL DEFAULT 0,
+  "transports" VARCHAR(255) NOT NULL DEFAULT '',
+  "created_at" DATETIME NOT NULL,
+  "last_used_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."user_export"(
+  "user_id" BINARY(16) NOT NULL UNIQUE,
+  "data" BLOB NOT NULL,
+  "created_at" DATETIME NOT NULL,
+  "expires_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."audit_event"(
+  "id" BINARY(16) NOT NULL,
+  "type" VARCHAR(64) NOT NULL,
+  "actor_id" BINARY(16) NOT NULL,
+  "target_id" BINARY(16) NOT NULL,
+  "ip" VARCHAR(45) NOT NULL,
+  "user_agent" VARCHAR(255) NOT NULL,
+  "details" TEXT NOT NULL,
+  "created_at" DATETIME NOT NULL
+);
+CREATE INDEX "auth"."audit_event_target" ON "audit_event"("target_id", "created_at");
+CREATE TABLE "auth"."login_history"(
+  "id" BINARY(16) NOT NULL,
+  "user_id" BINARY(16) NOT NULL,
+  "method" VARCHAR(16) NOT NULL,
+  "ip" VARCHAR(45) NOT NULL,
+  "user_agent" VARCHAR(255) NOT NULL,
+  "fingerprint" VARCHAR(16) NOT NULL,
+  "network" VARCHAR(64) NOT NULL,
+  "is_new" BOOL NOT NULL DEFAULT 0,
+  "created_at" DATETIME NOT NULL
+);
+CREATE INDEX "auth"."login_history_user" ON "login_history"("user_id", "created_at");
+CREATE TABLE "auth"."webhook_endpoint"(
+  "id" BINARY(16) NOT NULL,
+  "url" VARCHAR(2048) NOT NULL,
+  "secret" VARCHAR(255) NOT NULL,
+  "events" TEXT NOT NULL,
+  "is_active" BOOL NOT NULL DEFAULT 1,
+  "created_at" DATETIME NOT NULL,
+  "updated_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."webhook_delivery"(
+  "id" BINARY(16) NOT NULL,
+  "endpoint_id" BINARY(16) NOT NULL,
+  "user_id" BINARY(16) NOT NULL,
+  "event_type" VARCHAR(64) NOT NULL,
+  "payload" BLOB NOT NULL,
+  "status" VARCHAR(16) NOT NULL,
+  "attempts" INTEGER NOT NULL DEFAULT 0,
+  "last_error" TEXT NOT NULL,
+  "response_status" INTEGER NOT NULL DEFAULT 0,
+  "next_attempt_at" DATETIME NOT NULL,
+  "created_at" DATETIME NOT NULL,
+  "updated_at" DATETIME NOT NULL,
+  "delivered_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."organization"(
+  "id" BINARY(16) NOT NULL,
+  "name" VARCHAR(255) NOT NULL,
+  "created_at" DATETIME NOT NULL,
+  "updated_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."org_membership"(
+  "org_id" BINARY(16) NOT NULL,
+  "user_id" BINARY(16) NOT NULL,
+  "role" VARCHAR(16) NOT NULL,
+  "created_at" DATETIME NOT NULL,
+  "updated_at" DATETIME NOT NULL,
+  PRIMARY KEY ("org_id", "user_id")
+);
+CREATE INDEX "auth"."org_membership_user" ON "org_membership"("user_id");
+CREATE TABLE "auth"."org_invite"(
+  "id" BINARY(16) NOT NULL,
+  "org_id" BINARY(16) NOT NULL,
+  "email" VARCHAR(255) NOT NULL,
+  "role" VARCHAR(16) NOT NULL,
+  "status" VARCHAR(16) NOT NULL,
+  "invited_by" BINARY(16) NOT NULL,
+  "created_at" DATETIME NOT NULL,
+  "updated_at" DATETIME NOT NULL,
+  "expires_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."user_invite"(
+  "id" BINARY(16) NOT NULL,
+  "email" VARCHAR(255) NOT NULL,
+  "roles" TEXT NOT NULL,
+  "status" VARCHAR(16) NOT NULL,
+  "invited_by" BINARY(16) NOT NULL,
+  "accepted_by" BINARY(16) NOT NULL,
+  "created_at" DATETIME NOT NULL,
+  "updated_at" DATETIME NOT NULL,
+  "expires_at" DATETIME NOT NULL
+);
+CREATE TABLE "auth"."api_key"(
+  "id" BINARY(16) NOT NULL,
+  "user_id" BINARY(16) NOT NULL,
+  "name" VARCHAR(255) NOT NULL,
+  "prefix" VARCHAR(64) NOT NULL UNIQUE,
+  "hash" VARCHAR(64) NOT NULL,
+  "scopes" TEXT NOT NULL,
+  "expires_at" DATETIME NOT NULL,
+  "last_used_at" DATETIME NOT NULL,
+  "is_revoked" BOOLEAN NOT NULL,
+  "revoked_at" DATETIME NOT NULL,
+  "created_at" DATETIME NOT NULL
+);
+CREATE INDEX "auth"."api_key_user" ON "api_key"("user_id");
 COMMIT;`
 
 // tUser is the base test user
@@ -41,30 +206,19 @@ var tUser User
 // Service that all tests will use
 var auth Service
 
-// ENV variables
-var (
-	DOMAIN       string
-	APIKEY       string
-	PUBLICAPIKEY string
-	EMAILTO      string
-)
-
-// To run TestService successfully you will need to include the following ENV variables:
-// MGDOMAIN: Mailgun Account DOMAIN
-// MGAPIKEY: Mailgun Account Secret/Private API Key
-// MGPUBLICAPIKEY: Mailgun Account Public API Key
-// TOEMAIL: Email account to verify the test emails are working
-//
-// Example Command: env MGDOMAIN=sandboxXXXX.mailgun.org MGAPIKEY=key-XXXX MGPUBLICAPIKEY=pubkey-XXXX TOEMAIL=email@XXXX.com go test
 func TestService(t *testing.T) {
+	ctx := context.Background()
 	dbFile := "auth.sdb"
 	// create database
 	db := sqlx.MustConnect("sqlite3", dbFile)
 	// create user table
 	db.MustExec(sqlCreateUserTable)
 
-	// initialize mailgun
-	mg := mailgun.NewMailgun(DOMAIN, APIKEY, PUBLICAPIKEY)
+	// initialize mailer and outbox
+	mailer := NewMemoryMailer()
+	outbox := NewOutbox(db, mailer)
+	outbox.BaseDelay = 0
+	outbox.MaxAttempts = 2
 
 	// initialize new nonce service
 	nonce := nonce.NewInMemoryService()
@@ -73,11 +227,25 @@ func TestService(t *testing.T) {
 	tpl := tmpl.NewTplSys("")
 
 	// initialize new auth service
-	auth = NewService(db, mg, nonce, tpl)
+	var err error
+	auth, err = NewService(db, outbox, nonce, tpl)
+	if err != nil {
+		t.Fatalf("Expected to create the service. Instead got the error: %v", err)
+	}
+
+	// initialize the HTTP handler, with a base template that only shows each page's content
+	_, err = tpl.AddTemplate("base", "", `{{block "content" .}}{{end}}`)
+	if err != nil {
+		t.Fatalf("Expected to add the base template. Instead got the error: %v", err)
+	}
+	httpHandler, err := MakeHTTPHandler(auth, "/auth", "base", tpl, sessions.NewCookieStore(bytes.Repeat([]byte("k"), 32)))
+	if err != nil {
+		t.Fatalf("Expected to create the HTTP handler. Instead got the error: %v", err)
+	}
 
 	// Run tests
 	t.Run("NewUserLocal", func(t *testing.T) {
-		u, err := auth.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err != nil {
 			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
 		}
@@ -91,7 +259,7 @@ func TestService(t *testing.T) {
 			t.Fatalf("Expected LastName to be: %s. Instead got: %s", tUser.LastName, u.LastName)
 		}
 		if u.IsSuperuser != tUser.IsSuperuser {
-			t.Fatalf("Expected IsSuperuser to be: %s. Instead got: %s", tUser.IsSuperuser, u.IsSuperuser)
+			t.Fatalf("Expected IsSuperuser to be: %t. Instead got: %t", tUser.IsSuperuser, u.IsSuperuser)
 		}
 
 		// Clean Up (removed the user we just added)
@@ -101,14 +269,18 @@ func TestService(t *testing.T) {
 	})
 
 	t.Run("NewUserLocalDuplicate", func(t *testing.T) {
-		u, err := auth.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err != nil {
 			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
 		}
-		_, err = auth.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err != ErrAlreadyExists {
 			t.Fatalf("Expected to get error: ErrAlreadyExists. Instead got: %v", err)
 		}
+		_, err = auth.NewUserLocal(ctx, strings.ToUpper(tUser.Email), tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != ErrAlreadyExists {
+			t.Fatalf("Expected an address differing only in case to get ErrAlreadyExists. Instead got: %v", err)
+		}
 
 		// Clean Up (removed the user we just added)
 		tx := db.MustBegin()
@@ -118,57 +290,57 @@ func TestService(t *testing.T) {
 
 	t.Run("NewUserLocalMalformed", func(t *testing.T) {
 		var err error
-		_, err = auth.NewUserLocal("", tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, "", tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err == nil {
 			t.Fatal("Expected to get an error! Instead got: nil")
 		}
-		_, err = auth.NewUserLocal(tUser.Email, "", tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, tUser.Email, "", tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err == nil {
 			t.Fatal("Expected to get an error! Instead got: nil")
 		}
-		_, err = auth.NewUserLocal(tUser.Email, tUser.Password, "", tUser.LastName, tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, tUser.Email, tUser.Password, "", tUser.LastName, tUser.IsSuperuser)
 		if err == nil {
 			t.Fatal("Expected to get an error! Instead got: nil")
 		}
-		_, err = auth.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, "", tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, "", tUser.IsSuperuser)
 		if err == nil {
 			t.Fatal("Expected to get an error! Instead got: nil")
 		}
-		_, err = auth.NewUserLocal("   ", tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, "   ", tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err == nil {
 			t.Fatal("Expected to get an error! Instead got: nil")
 		}
-		_, err = auth.NewUserLocal(tUser.Email, "   ", tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, tUser.Email, "   ", tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err == nil {
 			t.Fatal("Expected to get an error! Instead got: nil")
 		}
-		_, err = auth.NewUserLocal(tUser.Email, tUser.Password, "   ", tUser.LastName, tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, tUser.Email, tUser.Password, "   ", tUser.LastName, tUser.IsSuperuser)
 		if err == nil {
 			t.Fatal("Expected to get an error! Instead got: nil")
 		}
-		_, err = auth.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, "   ", tUser.IsSuperuser)
+		_, err = auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, "   ", tUser.IsSuperuser)
 		if err == nil {
 			t.Fatal("Expected to get an error! Instead got: nil")
 		}
 	})
 
 	t.Run("GetUser", func(t *testing.T) {
-		u, err := auth.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err != nil {
 			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
 		}
 
-		_, err = auth.GetUser(u.ID)
+		_, err = auth.GetUser(ctx, u.ID)
 		if err != nil {
 			t.Fatalf("Expected to get user from DB. Instead got the error: %v", err)
 		}
 
-		_, err = auth.GetUser(uuid.Nil)
+		_, err = auth.GetUser(ctx, uuid.Nil)
 		if err != ErrInvalidID {
 			t.Fatalf("Expected to get an Invalid ID error.")
 		}
 
-		_, err = auth.GetUser(uuid.NewV4())
+		_, err = auth.GetUser(ctx, uuid.NewV4())
 		if err != ErrUserNotFound {
 			t.Fatalf("Expected to get ErrUserNotFound error.")
 		}
@@ -180,17 +352,17 @@ func TestService(t *testing.T) {
 	})
 
 	t.Run("DeleteUser", func(t *testing.T) {
-		u, err := auth.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err != nil {
 			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
 		}
 
-		_, err = auth.DeleteUser(u.ID)
+		_, err = auth.DeleteUser(ctx, u.ID)
 		if err != nil {
 			t.Fatalf("Expected to delete user from DB. Instead got the error: %v", err)
 		}
 
-		u2, err := auth.GetUser(u.ID)
+		u2, err := auth.GetUser(ctx, u.ID)
 		if err != nil {
 			t.Fatalf("Expected to get user from DB. Instead got the error: %v", err)
 		}
@@ -198,7 +370,7 @@ func TestService(t *testing.T) {
 			t.Fatalf("Expected user to be deleted.")
 		}
 
-		_, err = auth.DeleteUser(uuid.Nil)
+		_, err = auth.DeleteUser(ctx, uuid.Nil)
 		if err != ErrInvalidID {
 			t.Fatalf("Expected to get an Invalid ID error.")
 		}
@@ -209,33 +381,158 @@ func TestService(t *testing.T) {
 		tx.Commit()
 	})
 
+	t.Run("RestoreAndPurge", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		other, err := auth.NewUserLocal(ctx, "other@example.com", tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		db.MustExec("INSERT INTO user_provider (user_id, provider, provider_user_id) VALUES (?, 'github', '1')", u.ID)
+		err = auth.BeginPasswordReset(ctx, u.Email)
+		if err != nil {
+			t.Fatalf("Expected to Begin Password Reset. Instead got: %v", err)
+		}
+		err = auth.BeginEmailChange(ctx, u.ID, "new@example.com")
+		if err != nil {
+			t.Fatalf("Expected to Begin Email Change. Instead got: %v", err)
+		}
+		auth.RecordAuditEvent(ctx, AuditEvent{Type: AuditUserUpdated, ActorID: u.ID, TargetID: other.ID, IP: "192.0.2.1", UserAgent: "Test"})
+		auth.RecordAuditEvent(ctx, AuditEvent{Type: AuditUserUpdated, ActorID: other.ID, TargetID: u.ID})
+
+		// only deleted users can be purged, and restored users are no longer deleted
+		_, err = auth.PurgeUser(ctx, u.ID)
+		if err != ErrUserNotDeleted {
+			t.Fatalf("Expected to get ErrUserNotDeleted. Instead got: %v", err)
+		}
+		auth.DeleteUser(ctx, u.ID)
+		u2, err := auth.RestoreUser(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("Expected to restore user. Instead got the error: %v", err)
+		}
+		if u2.IsDeleted || !u2.DeletedAt.IsZero() {
+			t.Fatalf("Expected user not to be deleted. Instead got: %+v", u2)
+		}
+		_, err = auth.PurgeUser(ctx, u.ID)
+		if err != ErrUserNotDeleted {
+			t.Fatalf("Expected to get ErrUserNotDeleted after restoring. Instead got: %v", err)
+		}
+
+		// the retention job only purges users deleted longer ago than its period
+		auth.DeleteUser(ctx, u.ID)
+		job := NewRetentionJob(auth, time.Hour)
+		r, err := job.Run()
+		if err != nil || len(r.Users) != 0 {
+			t.Fatalf("Expected nothing to be purged yet. Instead got: %+v, %v", r, err)
+		}
+		job.Period = -time.Minute
+		r, err = job.Run()
+		if err != nil {
+			t.Fatalf("Expected to purge deleted users. Instead got the error: %v", err)
+		}
+		// new user, password reset and email change confirm/notice emails; 3 nonces
+		want := PurgeReport{Users: []uuid.UUID{u.ID}, Providers: 1, EmailChanges: 1, Emails: 4, Nonces: 3}
+		if len(r.Users) != 1 || !uuid.Equal(r.Users[0], u.ID) || r.Providers != want.Providers || r.EmailChanges != want.EmailChanges || r.Emails != want.Emails || r.Nonces != want.Nonces {
+			t.Fatalf("Expected report %+v. Instead got: %+v", want, r)
+		}
+		_, err = auth.GetUser(ctx, u.ID)
+		if err != ErrUserNotFound {
+			t.Fatalf("Expected purged user to be gone. Instead got: %v", err)
+		}
+		var left int
+		db.Get(&left, "SELECT COUNT(*) FROM email_outbox WHERE to_addr=?", other.Email)
+		if left != 1 {
+			t.Fatalf("Expected other users' emails to be kept. Instead got: %d", left)
+		}
+
+		// events about the user are removed; what they did to others is kept without naming them
+		if r.AnonymizedAuditEvents != 1 {
+			t.Fatalf("Expected one event to be anonymized. Instead got: %+v", r)
+		}
+		l, _ := auth.ListAuditEvents(ctx, AuditQuery{TargetID: other.ID, Types: []string{AuditUserUpdated}})
+		if len(l.Events) != 1 || l.Events[0].ActorID != uuid.Nil || l.Events[0].IP != "" || l.Events[0].UserAgent != "" {
+			t.Fatalf("Expected the other user's event to be kept without its actor. Instead got: %+v", l.Events)
+		}
+		l, _ = auth.ListAuditEvents(ctx, AuditQuery{TargetID: u.ID})
+		if len(l.Events) != 1 || l.Events[0].Type != AuditUserPurged {
+			t.Fatalf("Expected only the purge to be left about the user. Instead got: %+v", l.Events)
+		}
+
+		// Clean Up (removed the user we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", other.ID)
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("RevokeSessions", func(t *testing.T) {
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+
+		before := time.Now()
+		_, err = auth.RevokeSessions(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("Expected to revoke sessions. Instead got the error: %v", err)
+		}
+
+		u2, err := auth.GetUser(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("Expected to get user from DB. Instead got the error: %v", err)
+		}
+		if u2.SessionsRevokedAt.Before(before.Truncate(time.Second)) {
+			t.Fatalf("Expected SessionsRevokedAt to be after %v. Instead got: %v", before, u2.SessionsRevokedAt)
+		}
+
+		_, err = auth.RevokeSessions(ctx, uuid.NewV4())
+		if err != ErrUserNotFound {
+			t.Fatalf("Expected to get ErrUserNotFound. Instead got: %v", err)
+		}
+
+		// Clean Up (removed the user we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
 	t.Run("AuthenticateUser", func(t *testing.T) {
-		u, err := auth.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err != nil {
 			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
 		}
 
-		_, err = auth.AuthenticateUser(tUser.Email, tUser.Password)
+		_, err = auth.AuthenticateUser(ctx, tUser.Email, tUser.Password)
 		if err != nil {
 			t.Fatalf("Expected to get user from DB. Instead got the error: %v", err)
 		}
 
-		_, err = auth.AuthenticateUser("", tUser.Password)
+		_, err = auth.AuthenticateUser(ctx, strings.ToUpper(tUser.Email), tUser.Password)
+		if err != nil {
+			t.Fatalf("Expected email addresses to be case-insensitive. Instead got the error: %v", err)
+		}
+
+		_, err = auth.AuthenticateUser(ctx, "", tUser.Password)
 		if err == nil {
 			t.Fatalf("Expected to get an Invalid Email error. Instead got the error: nil")
 		}
 
-		_, err = auth.AuthenticateUser(tUser.Email, "")
+		_, err = auth.AuthenticateUser(ctx, tUser.Email, "")
 		if err != ErrInvalidPassword {
 			t.Fatalf("Expected to get ErrInvalidPassword. Instead got the error: %v", err)
 		}
 
-		_, err = auth.AuthenticateUser("wrong@email.com", tUser.Password)
+		_, err = auth.AuthenticateUser(ctx, "wrong@email.com", tUser.Password)
 		if err != ErrIncorrectAuth {
 			t.Fatalf("Expected to get ErrIncorrectAuth. Instead got the error: %v", err)
 		}
 
-		_, err = auth.AuthenticateUser(tUser.Email, " wrong-password ")
+		_, err = auth.AuthenticateUser(ctx, tUser.Email, " wrong-password ")
 		if err != ErrIncorrectAuth {
 			t.Fatalf("Expected to get ErrIncorrectAuth. Instead got the error: %v", err)
 		}
@@ -246,57 +543,2652 @@ func TestService(t *testing.T) {
 		tx.Commit()
 	})
 
-	// Run tests
 	t.Run("Emails", func(t *testing.T) {
-		t.Log(DOMAIN, APIKEY, PUBLICAPIKEY, EMAILTO)
-		u, err := auth.NewUserLocal(EMAILTO, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		// drop welcome emails queued by earlier tests
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
 		if err != nil {
 			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
 		}
+		if len(mailer.Messages()) != 0 {
+			t.Fatal("Expected emails to wait in the outbox until dispatched")
+		}
+		outbox.DispatchPending(ctx)
+		m, ok := mailer.Last()
+		if !ok || m.To != tUser.Email || m.Subject != NewUserEmail.Subject {
+			t.Fatalf("Expected a New User Email to be sent to %s. Instead got: %+v", tUser.Email, m)
+		}
+		if !strings.Contains(m.HTML, "Hello "+tUser.FirstName+" "+tUser.LastName) {
+			t.Fatalf("Expected New User Email to greet the user by name. Instead got: %s", m.HTML)
+		}
 
-		err = auth.BeginPasswordReset(EMAILTO)
+		err = auth.BeginPasswordReset(ctx, tUser.Email)
 		if err != nil {
 			t.Fatalf("Expected to Begin Password Reset Process. Instead got: %v", err)
 		}
+		outbox.DispatchPending(ctx)
 		n, err := nonce.Get("auth.PasswordReset", u.ID)
 		if err != nil {
 			t.Fatalf("Expected to get Nonce for auth.PasswordReset. Instead got error: %v", err)
 		}
-		_, err = auth.CompletePasswordReset(n.Token, EMAILTO, "NewTestPassword")
+		m, _ = mailer.Last()
+		if m.Subject != PasswordResetEmail.Subject {
+			t.Fatalf("Expected a Password Reset Email. Instead got: %+v", m)
+		}
+		link := BaseURL + "/forgot-password/" + n.Token
+		if !strings.Contains(m.HTML, link) || !strings.Contains(m.PlainText, link) {
+			t.Fatalf("Expected both parts of the Password Reset Email to contain the link %s. Instead got: %+v", link, m)
+		}
+		if !strings.Contains(m.PlainText, "Hello "+tUser.FirstName+" "+tUser.LastName) {
+			t.Fatalf("Expected plain text Password Reset Email to greet the user by name. Instead got: %s", m.PlainText)
+		}
+
+		_, err = auth.CompletePasswordReset(ctx, n.Token, tUser.Email, "NewTestPassword")
 		if err != nil {
 			t.Fatalf("Expected to Complete the Password Reset Process. Instead got error: %v", err)
 		}
+		outbox.DispatchPending(ctx)
+		m, _ = mailer.Last()
+		if m.Subject != PasswordResetConfirmEmail.Subject {
+			t.Fatalf("Expected a Password Reset Confirmation Email. Instead got: %+v", m)
+		}
+		if len(mailer.Messages()) != 3 {
+			t.Fatalf("Expected 3 emails to be sent. Instead got: %d", len(mailer.Messages()))
+		}
 
 		// Clean Up (removed the user we just added)
 		tx := db.MustBegin()
 		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM email_outbox")
 		tx.Commit()
 	})
 
-	// Drop the Table(s) we created
-	// Close the DB
-	db.MustExec("drop table user;")
-	db.Close()
-	err := os.Remove(dbFile)
-	if err != nil {
-		t.Fatalf("Expected to remove dbFile: %s. Instead got the error: %v", dbFile, err)
-	}
-}
+	t.Run("MagicLogin", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
 
-func init() {
-	DOMAIN = os.Getenv("MGDOMAIN")
-	APIKEY = os.Getenv("MGAPIKEY")
-	PUBLICAPIKEY = os.Getenv("MGPUBLICAPIKEY")
-	EMAILTO = os.Getenv("TOEMAIL")
-
-	// need a default for this
-	EMAILTO = strings.TrimSpace(EMAILTO)
-	if len(EMAILTO) == 0 {
-		EMAILTO = "test@example.com"
-	}
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+
+		err = auth.BeginMagicLogin(ctx, "wrong@email.com")
+		if err != ErrIncorrectAuth {
+			t.Fatalf("Expected to get ErrIncorrectAuth. Instead got: %v", err)
+		}
+
+		err = auth.BeginMagicLogin(ctx, tUser.Email)
+		if err != nil {
+			t.Fatalf("Expected to Begin Magic Login. Instead got: %v", err)
+		}
+		n, err := nonce.Get("auth.MagicLogin", u.ID)
+		if err != nil {
+			t.Fatalf("Expected to get Nonce for auth.MagicLogin. Instead got error: %v", err)
+		}
+		token := userToken(u.ID, n.Token)
+
+		outbox.DispatchPending(ctx)
+		m, _ := mailer.Last()
+		if m.Subject != MagicLoginEmail.Subject || !strings.Contains(m.PlainText, BaseURL+"/magic-login/"+token) {
+			t.Fatalf("Expected a Magic Login Email with the login link. Instead got: %+v", m)
+		}
+
+		u2, err := auth.CompleteMagicLogin(ctx, token)
+		if err != nil {
+			t.Fatalf("Expected to Complete Magic Login. Instead got: %v", err)
+		}
+		if !uuid.Equal(u.ID, u2.ID) {
+			t.Fatalf("Expected to log in as %s. Instead got: %s", u.ID, u2.ID)
+		}
+
+		_, err = auth.CompleteMagicLogin(ctx, token)
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected a used token to be rejected with ErrInvalidToken. Instead got: %v", err)
+		}
+		for _, bad := range []string{"", n.Token, uuid.NewV4().String() + "." + n.Token, "not-a-uuid." + n.Token} {
+			_, err = auth.CompleteMagicLogin(ctx, bad)
+			if err != ErrInvalidToken {
+				t.Fatalf("Expected token %q to be rejected with ErrInvalidToken. Instead got: %v", bad, err)
+			}
+		}
+
+		// Clean Up (removed the user and emails we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("MagicLoginBrowser", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		MagicLoginBindBrowser = true
+		defer func() { MagicLoginBindBrowser = false }()
+
+		// the address is stored IDNA encoded
+		u, err := auth.NewUserLocal(ctx, "idn@bücher.example", tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		srv := httptest.NewTLSServer(httpHandler)
+		defer srv.Close()
+
+		browser := newTestBrowser(t, srv)
+		res, _ := browser.post("/auth/magic-login/", "/auth/magic-login/", url.Values{"email": {"IDN@BÜCHER.example"}})
+		if res.StatusCode != 302 {
+			t.Fatalf("Expected to be redirected after requesting a magic link. Instead got: %d", res.StatusCode)
+		}
+		n, err := nonce.Get("auth.MagicLogin", u.ID)
+		if err != nil {
+			t.Fatalf("Expected to get Nonce for auth.MagicLogin. Instead got error: %v", err)
+		}
+		link := "/auth/magic-login/" + userToken(u.ID, n.Token)
+
+		// opening the link in a browser that asked for another address is refused without using up the token
+		other := newTestBrowser(t, srv)
+		other.post("/auth/magic-login/", "/auth/magic-login/", url.Values{"email": {"other@example.com"}})
+		res, _ = other.get(link)
+		if loc := res.Header.Get("Location"); loc != "/auth/login/" {
+			t.Fatalf("Expected another browser to be sent to the login page. Instead got: %d %s", res.StatusCode, loc)
+		}
+		res, _ = browser.get(link)
+		if loc := res.Header.Get("Location"); loc != "/" {
+			t.Fatalf("Expected the browser that asked for the link to be logged in. Instead got: %d %s", res.StatusCode, loc)
+		}
+		res, _ = browser.get("/auth/api-keys/")
+		if res.StatusCode != 200 {
+			t.Fatalf("Expected the browser to be logged in. Instead got: %d", res.StatusCode)
+		}
+		logins, _ := auth.ListLoginHistory(ctx, u.ID, 0)
+		if len(logins) != 1 || logins[0].Method != "magic_link" {
+			t.Fatalf("Expected the login to be recorded once. Instead got: %+v", logins)
+		}
+
+		// Clean Up (removed the user, logins and emails we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("LocalizedEmail", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
+
+		Catalogs["de"] = Catalog{
+			"auth.email.greeting":             "Hallo %s %s,",
+			"auth.PasswordResetEmail.subject": "Passwort zurücksetzen",
+		}
+		defer delete(Catalogs, "de")
+
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		u.Locale = "de-DE"
+		u, err = auth.UpdateUser(ctx, u)
+		if err != nil {
+			t.Fatalf("Expected to update user. Instead got the error: %v", err)
+		}
+
+		err = auth.BeginPasswordReset(ctx, tUser.Email)
+		if err != nil {
+			t.Fatalf("Expected to Begin Password Reset Process. Instead got: %v", err)
+		}
+		outbox.DispatchPending(ctx)
+
+		m, _ := mailer.Last()
+		if m.Subject != "Passwort zurücksetzen" {
+			t.Fatalf("Expected a German subject. Instead got: %s", m.Subject)
+		}
+		if !strings.HasPrefix(m.PlainText, "Hallo "+tUser.FirstName) || !strings.Contains(m.HTML, "Hallo "+tUser.FirstName) {
+			t.Fatalf("Expected a German greeting. Instead got: %+v", m)
+		}
+		if !strings.Contains(m.PlainText, "Forgot your password?") {
+			t.Fatalf("Expected missing German messages to fall back to English. Instead got: %s", m.PlainText)
+		}
 
+		// Clean Up (removed the user and emails we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("EmailTemplateOverride", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
+
+		orig := EmailTextTemplates["auth.NewUserEmail"]
+		EmailTextTemplates["auth.NewUserEmail"] = "Hi {{.User.FirstName}}, welcome to {{.AppName}}!"
+		defer func() { EmailTextTemplates["auth.NewUserEmail"] = orig }()
+
+		custom, err := NewService(db, outbox, nonce, tmpl.NewTplSys(""))
+		if err != nil {
+			t.Fatalf("Expected to create the service. Instead got the error: %v", err)
+		}
+		u, err := custom.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		outbox.DispatchPending(ctx)
+
+		m, _ := mailer.Last()
+		if m.PlainText != "Hi "+tUser.FirstName+", welcome to "+AppName+"!" {
+			t.Fatalf("Expected the overridden plain text template to be used. Instead got: %s", m.PlainText)
+		}
+		if !strings.Contains(m.HTML, "Welcome to "+AppName) {
+			t.Fatalf("Expected the default HTML template to be used. Instead got: %s", m.HTML)
+		}
+
+		// Clean Up (removed the user and emails we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		mailer.Reset()
+		mailer.FailWith(errors.New("mailer unavailable"))
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+
+		// outbox.MaxAttempts is 2 and outbox.BaseDelay is 0
+		for i := 0; i < 2; i++ {
+			sent, err := outbox.DispatchPending(ctx)
+			if err != nil || sent != 0 {
+				t.Fatalf("Expected sending to fail. Instead sent %d (error: %v)", sent, err)
+			}
+		}
+		failed, err := auth.ListFailedEmails(ctx)
+		if err != nil {
+			t.Fatalf("Expected to list failed emails. Instead got the error: %v", err)
+		}
+		if len(failed) != 1 || failed[0].To != tUser.Email || failed[0].Status != OutboxDead || failed[0].LastError != "mailer unavailable" {
+			t.Fatalf("Expected 1 dead email to %s. Instead got: %+v", tUser.Email, failed)
+		}
+
+		mailer.FailWith(nil)
+		failed0 := failed[0]
+		err = auth.RetryEmail(ctx, failed0.ID)
+		if err != nil {
+			t.Fatalf("Expected to retry email. Instead got the error: %v", err)
+		}
+		sent, err := outbox.DispatchPending(ctx)
+		if err != nil || sent != 1 {
+			t.Fatalf("Expected retried email to be sent. Instead sent %d (error: %v)", sent, err)
+		}
+		failed, _ = auth.ListFailedEmails(ctx)
+		if len(failed) != 0 {
+			t.Fatalf("Expected no failed emails. Instead got: %d", len(failed))
+		}
+
+		// retrying a sent email must not send it again
+		err = auth.RetryEmail(ctx, failed0.ID)
+		if err != ErrEmailNotDead {
+			t.Fatalf("Expected to get ErrEmailNotDead retrying a sent email. Instead got: %v", err)
+		}
+		sent, _ = outbox.DispatchPending(ctx)
+		if sent != 0 || len(mailer.Messages()) != 1 {
+			t.Fatalf("Expected the sent email not to be sent again. Instead sent %d", sent)
+		}
+
+		err = auth.RetryEmail(ctx, uuid.NewV4())
+		if err != ErrEmailNotFound {
+			t.Fatalf("Expected to get ErrEmailNotFound. Instead got: %v", err)
+		}
+
+		// Clean Up (removed the user and emails we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("EmailChange", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
+
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		other, err := auth.NewUserLocal(ctx, "other@example.com", tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		outbox.DispatchPending(ctx)
+		mailer.Reset()
+
+		// UpdateUser finds the user by ID and keeps addresses unique
+		u.Email = other.Email
+		_, err = auth.UpdateUser(ctx, u)
+		if err != ErrAlreadyExists {
+			t.Fatalf("Expected to get ErrAlreadyExists. Instead got: %v", err)
+		}
+		u.Email = tUser.Email
+
+		err = auth.BeginEmailChange(ctx, u.ID, other.Email)
+		if err != ErrAlreadyExists {
+			t.Fatalf("Expected to get ErrAlreadyExists. Instead got: %v", err)
+		}
+
+		// Confirm a change
+		newEmail := "new@example.com"
+		err = auth.BeginEmailChange(ctx, u.ID, newEmail)
+		if err != nil {
+			t.Fatalf("Expected to Begin Email Change. Instead got: %v", err)
+		}
+		confirm, _ := nonce.Get("auth.EmailChange", u.ID)
+		cancel, _ := nonce.Get("auth.EmailChangeCancel", u.ID)
+		confirmToken := userToken(u.ID, confirm.Token)
+		cancelToken := userToken(u.ID, cancel.Token)
+
+		outbox.DispatchPending(ctx)
+		msgs := mailer.Messages()
+		if len(msgs) != 2 {
+			t.Fatalf("Expected 2 emails to be sent. Instead got: %d", len(msgs))
+		}
+		for _, m := range msgs {
+			switch m.To {
+			case newEmail:
+				if !strings.Contains(m.PlainText, BaseURL+"/email-change/"+confirmToken) {
+					t.Fatalf("Expected the new address to get the confirm link. Instead got: %s", m.PlainText)
+				}
+			case tUser.Email:
+				if !strings.Contains(m.PlainText, BaseURL+"/email-change/cancel/"+cancelToken) || !strings.Contains(m.PlainText, newEmail) {
+					t.Fatalf("Expected the old address to get the cancel link. Instead got: %s", m.PlainText)
+				}
+			default:
+				t.Fatalf("Expected no email to %s", m.To)
+			}
+		}
+
+		u2, err := auth.CompleteEmailChange(ctx, confirmToken)
+		if err != nil {
+			t.Fatalf("Expected to Complete Email Change. Instead got: %v", err)
+		}
+		if u2.Email != newEmail {
+			t.Fatalf("Expected Email to be: %s. Instead got: %s", newEmail, u2.Email)
+		}
+		_, err = auth.CompleteEmailChange(ctx, confirmToken)
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected a used token to be rejected with ErrInvalidToken. Instead got: %v", err)
+		}
+
+		// The old address can revert a completed change, but only by submitting the page the link shows
+		srv := httptest.NewTLSServer(httpHandler)
+		defer srv.Close()
+		browser := newTestBrowser(t, srv)
+		res, _ := browser.get("/auth/email-change/cancel/" + cancelToken)
+		if u2, _ = auth.GetUser(ctx, u.ID); res.StatusCode != 200 || u2.Email != newEmail {
+			t.Fatalf("Expected following the cancel link to only ask for confirmation. Instead got: %d %s", res.StatusCode, u2.Email)
+		}
+		res, _ = browser.post("/auth/email-change/cancel/"+cancelToken, "/auth/email-change/cancel/"+cancelToken, url.Values{})
+		if loc := res.Header.Get("Location"); loc != "/" {
+			t.Fatalf("Expected to Cancel Email Change. Instead got: %d %s", res.StatusCode, loc)
+		}
+		if u2, _ = auth.GetUser(ctx, u.ID); u2.Email != tUser.Email {
+			t.Fatalf("Expected Email to be reverted to: %s. Instead got: %s", tUser.Email, u2.Email)
+		}
+
+		// A cancelled change can't be confirmed
+		err = auth.BeginEmailChange(ctx, u.ID, newEmail)
+		if err != nil {
+			t.Fatalf("Expected to Begin Email Change. Instead got: %v", err)
+		}
+		confirm, _ = nonce.Get("auth.EmailChange", u.ID)
+		cancel, _ = nonce.Get("auth.EmailChangeCancel", u.ID)
+		_, err = auth.CancelEmailChange(ctx, userToken(u.ID, cancel.Token))
+		if err != nil {
+			t.Fatalf("Expected to Cancel Email Change. Instead got: %v", err)
+		}
+		_, err = auth.CompleteEmailChange(ctx, userToken(u.ID, confirm.Token))
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected a cancelled change to be rejected with ErrInvalidToken. Instead got: %v", err)
+		}
+		u2, _ = auth.GetUser(ctx, u.ID)
+		if u2.Email != tUser.Email {
+			t.Fatalf("Expected Email to be: %s. Instead got: %s", tUser.Email, u2.Email)
+		}
+
+		// Clean Up (removed the users and emails we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM user WHERE id=?", other.ID)
+		tx.MustExec("DELETE FROM email_change")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("WebAuthn", func(t *testing.T) {
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		a := newSoftAuthenticator(t)
+
+		// Registration
+		creation, err := auth.BeginWebAuthnRegistration(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("Expected to Begin WebAuthn Registration. Instead got: %v", err)
+		}
+		if creation.RP.ID != WebAuthnRPID || creation.User.Name != u.Email {
+			t.Fatalf("Expected creation options for %s at %s. Instead got: %+v", u.Email, WebAuthnRPID, creation)
+		}
+		c, err := auth.FinishWebAuthnRegistration(ctx, u.ID, a.create(t, creation))
+		if err != nil {
+			t.Fatalf("Expected to Finish WebAuthn Registration. Instead got: %v", err)
+		}
+		if !uuid.Equal(c.UserID, u.ID) || c.Transports != "internal" {
+			t.Fatalf("Expected a passkey for %s. Instead got: %+v", u.ID, c)
+		}
+
+		creation, _ = auth.BeginWebAuthnRegistration(ctx, u.ID)
+		if len(creation.ExcludeCredentials) != 1 || creation.ExcludeCredentials[0].ID != b64url(a.credentialID) {
+			t.Fatalf("Expected the registered passkey to be excluded. Instead got: %+v", creation.ExcludeCredentials)
+		}
+		_, err = auth.FinishWebAuthnRegistration(ctx, u.ID, a.create(t, creation))
+		if err != ErrAlreadyExists {
+			t.Fatalf("Expected to get ErrAlreadyExists. Instead got: %v", err)
+		}
+
+		// Login with the user's email
+		request, err := auth.BeginWebAuthnLogin(ctx, tUser.Email)
+		if err != nil {
+			t.Fatalf("Expected to Begin WebAuthn Login. Instead got: %v", err)
+		}
+		if len(request.AllowCredentials) != 1 {
+			t.Fatalf("Expected 1 allowed passkey. Instead got: %+v", request.AllowCredentials)
+		}
+		assertion := a.get(t, request)
+		u2, err := auth.FinishWebAuthnLogin(ctx, assertion)
+		if err != nil {
+			t.Fatalf("Expected to Finish WebAuthn Login. Instead got: %v", err)
+		}
+		if !uuid.Equal(u.ID, u2.ID) {
+			t.Fatalf("Expected to log in as %s. Instead got: %s", u.ID, u2.ID)
+		}
+		_, err = auth.FinishWebAuthnLogin(ctx, assertion)
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected a replayed assertion to be rejected with ErrInvalidToken. Instead got: %v", err)
+		}
+
+		// Login with a discoverable passkey
+		request, err = auth.BeginWebAuthnLogin(ctx, "")
+		if err != nil {
+			t.Fatalf("Expected to Begin WebAuthn Login without an email. Instead got: %v", err)
+		}
+		u2, err = auth.FinishWebAuthnLogin(ctx, a.get(t, request))
+		if err != nil || !uuid.Equal(u.ID, u2.ID) {
+			t.Fatalf("Expected to log in as %s. Instead got: %s (error: %v)", u.ID, u2.ID, err)
+		}
+		creds, _ := auth.ListWebAuthnCredentials(ctx, u.ID)
+		if len(creds) != 1 || creds[0].SignCount != a.signCount {
+			t.Fatalf("Expected the sign count to be %d. Instead got: %+v", a.signCount, creds)
+		}
+
+		// Rejected assertions
+		request, _ = auth.BeginWebAuthnLogin(ctx, tUser.Email)
+		a.origin = "https://evil.example.com"
+		_, err = auth.FinishWebAuthnLogin(ctx, a.get(t, request))
+		if err != ErrWebAuthnFailed {
+			t.Fatalf("Expected a foreign origin to be rejected with ErrWebAuthnFailed. Instead got: %v", err)
+		}
+		a.origin = WebAuthnOrigins[0]
+
+		request, _ = auth.BeginWebAuthnLogin(ctx, tUser.Email)
+		assertion = a.get(t, request)
+		assertion.Response.Signature = b64url([]byte("not a signature"))
+		_, err = auth.FinishWebAuthnLogin(ctx, assertion)
+		if err != ErrWebAuthnFailed {
+			t.Fatalf("Expected a bad signature to be rejected with ErrWebAuthnFailed. Instead got: %v", err)
+		}
+
+		request, _ = auth.BeginWebAuthnLogin(ctx, tUser.Email)
+		a.signCount = 0
+		_, err = auth.FinishWebAuthnLogin(ctx, a.get(t, request))
+		if err != ErrWebAuthnFailed {
+			t.Fatalf("Expected a sign count that went backwards to be rejected with ErrWebAuthnFailed. Instead got: %v", err)
+		}
+
+		request, _ = auth.BeginWebAuthnLogin(ctx, tUser.Email)
+		_, err = auth.FinishWebAuthnLogin(ctx, newSoftAuthenticator(t).get(t, request))
+		if err != ErrCredentialNotFound {
+			t.Fatalf("Expected an unknown passkey to be rejected with ErrCredentialNotFound. Instead got: %v", err)
+		}
+
+		// Deletion
+		err = auth.DeleteWebAuthnCredential(ctx, uuid.NewV4(), c.ID)
+		if err != ErrCredentialNotFound {
+			t.Fatalf("Expected to get ErrCredentialNotFound when deleting another user's passkey. Instead got: %v", err)
+		}
+		err = auth.DeleteWebAuthnCredential(ctx, u.ID, c.ID)
+		if err != nil {
+			t.Fatalf("Expected to delete passkey. Instead got: %v", err)
+		}
+		_, err = auth.BeginWebAuthnLogin(ctx, tUser.Email)
+		if err != ErrCredentialNotFound {
+			t.Fatalf("Expected to get ErrCredentialNotFound. Instead got: %v", err)
+		}
+
+		// Clean Up (removed the user and passkeys we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM webauthn_credential")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("SecondFactor", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		WebAuthnSecondFactor = true
+		defer func() { WebAuthnSecondFactor = false }()
+
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		a := newSoftAuthenticator(t)
+		creation, _ := auth.BeginWebAuthnRegistration(ctx, u.ID)
+		_, err = auth.FinishWebAuthnRegistration(ctx, u.ID, a.create(t, creation))
+		if err != nil {
+			t.Fatalf("Expected to Finish WebAuthn Registration. Instead got: %v", err)
+		}
+		srv := httptest.NewTLSServer(httpHandler)
+		defer srv.Close()
+
+		// a password or a magic link alone doesn't log in a user with a passkey
+		password := newTestBrowser(t, srv)
+		res, _ := password.post("/auth/login/", "/auth/login/", url.Values{"email": {tUser.Email}, "password": {tUser.Password}})
+		if loc := res.Header.Get("Location"); loc != "/auth/webauthn/verify/" {
+			t.Fatalf("Expected a password login to ask for the passkey. Instead got: %d %s", res.StatusCode, loc)
+		}
+		err = auth.BeginMagicLogin(ctx, tUser.Email)
+		if err != nil {
+			t.Fatalf("Expected to Begin Magic Login. Instead got: %v", err)
+		}
+		n, _ := nonce.Get("auth.MagicLogin", u.ID)
+		magic := newTestBrowser(t, srv)
+		res, _ = magic.get("/auth/magic-login/" + userToken(u.ID, n.Token))
+		if loc := res.Header.Get("Location"); loc != "/auth/webauthn/verify/" {
+			t.Fatalf("Expected a magic link to ask for the passkey. Instead got: %d %s", res.StatusCode, loc)
+		}
+		for _, browser := range []*testBrowser{password, magic} {
+			res, _ = browser.get("/auth/api-keys/")
+			if loc := res.Header.Get("Location"); loc != "/auth/login/" {
+				t.Fatalf("Expected the browser not to be logged in before using the passkey. Instead got: %d %s", res.StatusCode, loc)
+			}
+		}
+		if logins, _ := auth.ListLoginHistory(ctx, u.ID, 0); len(logins) != 0 {
+			t.Fatalf("Expected no login to be recorded before using the passkey. Instead got: %+v", logins)
+		}
+
+		// the passkey completes the login
+		request := WebAuthnRequestOptions{}
+		res = magic.postJSON("/auth/webauthn/verify/", "/auth/webauthn/login/begin", struct{}{}, &request)
+		if res.StatusCode != 200 || len(request.AllowCredentials) != 1 {
+			t.Fatalf("Expected to be asked for the user's passkey. Instead got: %d %+v", res.StatusCode, request)
+		}
+		res = magic.postJSON("/auth/webauthn/verify/", "/auth/webauthn/login/finish", a.get(t, request), &struct{}{})
+		if res.StatusCode != 200 {
+			t.Fatalf("Expected the passkey to be accepted. Instead got: %d", res.StatusCode)
+		}
+		res, _ = magic.get("/auth/api-keys/")
+		if res.StatusCode != 200 {
+			t.Fatalf("Expected the browser to be logged in after using the passkey. Instead got: %d", res.StatusCode)
+		}
+		logins, _ := auth.ListLoginHistory(ctx, u.ID, 0)
+		if len(logins) != 1 || logins[0].Method != "magic_link+passkey" {
+			t.Fatalf("Expected the login to be recorded once. Instead got: %+v", logins)
+		}
+
+		// Clean Up (removed the user, passkeys, logins and emails we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM webauthn_credential")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("ListUsers", func(t *testing.T) {
+		names := []string{"Alice Smith", "Bob Jones", "Carol Smith", "Dave Brown", "Erin Smith"}
+		users := make([]User, len(names))
+		for i, name := range names {
+			f := strings.Fields(name)
+			u, err := auth.NewUserLocal(ctx, strings.ToLower(f[0])+"@example.com", tUser.Password, f[0], f[1], i == 1)
+			if err != nil {
+				t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+			}
+			users[i] = u
+		}
+		users[3], _ = auth.DeleteUser(ctx, users[3].ID)
+		users[4].IsActive = false
+		users[4], _ = auth.UpdateUser(ctx, users[4])
+		db.MustExec("INSERT INTO user_provider (user_id, provider, provider_user_id) VALUES (?, 'github', '1')", users[2].ID)
+
+		firstNames := func(l UserList) string {
+			var e []string
+			for _, u := range l.Users {
+				e = append(e, u.FirstName)
+			}
+			return strings.Join(e, ",")
+		}
+		yes, no := true, false
+		cases := []struct {
+			q     UserQuery
+			want  string
+			total int
+		}{
+			{UserQuery{}, "Alice,Bob,Carol,Erin", 4},
+			{UserQuery{IncludeDeleted: true, Desc: true}, "Erin,Dave,Carol,Bob,Alice", 5},
+			{UserQuery{IsDeleted: &yes}, "Dave", 1},
+			{UserQuery{Search: "SMITH"}, "Alice,Carol,Erin", 3},
+			{UserQuery{Search: "smith car"}, "Carol", 1},
+			{UserQuery{Search: "bob@example"}, "Bob", 1},
+			{UserQuery{Search: "%"}, "", 0},
+			{UserQuery{IsActive: &no}, "Erin", 1},
+			{UserQuery{IsSuperuser: &yes}, "Bob", 1},
+			{UserQuery{Provider: "github"}, "Carol", 1},
+			{UserQuery{CreatedAfter: users[1].CreatedAt, CreatedBefore: users[4].CreatedAt}, "Bob,Carol", 2},
+			{UserQuery{Sort: UserSortFirstName, Desc: true}, "Erin,Carol,Bob,Alice", 4},
+		}
+		for _, c := range cases {
+			l, err := auth.ListUsers(ctx, c.q)
+			if err != nil {
+				t.Fatalf("Expected to list users for %+v. Instead got the error: %v", c.q, err)
+			}
+			if firstNames(l) != c.want || l.Total != c.total || l.NextCursor != "" {
+				t.Fatalf("Expected %+v to list %s (total %d). Instead got: %s (total %d)", c.q, c.want, c.total, firstNames(l), l.Total)
+			}
+		}
+
+		// Cursor pagination
+		q := UserQuery{Sort: UserSortEmail, Desc: true, IncludeDeleted: true, Limit: 2}
+		var pages []string
+		for {
+			l, err := auth.ListUsers(ctx, q)
+			if err != nil {
+				t.Fatalf("Expected to list users. Instead got the error: %v", err)
+			}
+			if l.Total != 5 {
+				t.Fatalf("Expected Total to be 5 on every page. Instead got: %d", l.Total)
+			}
+			pages = append(pages, firstNames(l))
+			if l.NextCursor == "" {
+				break
+			}
+			q.Cursor = l.NextCursor
+		}
+		if strings.Join(pages, "|") != "Erin,Dave|Carol,Bob|Alice" {
+			t.Fatalf("Expected pages Erin,Dave|Carol,Bob|Alice. Instead got: %s", strings.Join(pages, "|"))
+		}
+
+		_, err := auth.ListUsers(ctx, UserQuery{Sort: "password"})
+		if err != ErrInvalidQuery {
+			t.Fatalf("Expected an unknown sort to get ErrInvalidQuery. Instead got: %v", err)
+		}
+		q.Desc = false
+		_, err = auth.ListUsers(ctx, q)
+		if err != ErrInvalidQuery {
+			t.Fatalf("Expected a cursor from another order to get ErrInvalidQuery. Instead got: %v", err)
+		}
+
+		// Clean Up (removed the users we just added)
+		tx := db.MustBegin()
+		for _, u := range users {
+			tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		}
+		tx.MustExec("DELETE FROM user_provider")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("AdminConsole", func(t *testing.T) {
+		admin, err := auth.NewUserLocal(ctx, "admin@example.com", tUser.Password, "Admin", "Human", true)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		srv := httptest.NewTLSServer(httpHandler)
+		defer srv.Close()
+		adminPage := "/auth/admin/users/" + admin.ID.String()
+		userPage := "/auth/admin/users/" + u.ID.String()
+
+		// other users can't see or use the console
+		browser := newTestBrowser(t, srv)
+		res, _ := browser.post("/auth/login/", "/auth/login/", url.Values{"email": {tUser.Email}, "password": {tUser.Password}})
+		if res.StatusCode != 302 {
+			t.Fatalf("Expected the user to log in. Instead got: %d", res.StatusCode)
+		}
+		for _, path := range []string{"/auth/admin/users/", adminPage} {
+			res, _ = browser.get(path)
+			if res.StatusCode != http.StatusForbidden {
+				t.Fatalf("Expected %s to be forbidden to a user who isn't a superuser. Instead got: %d", path, res.StatusCode)
+			}
+		}
+		res, _ = browser.post("/auth/api-keys/", adminPage+"/deactivate", url.Values{})
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected an action to be forbidden to a user who isn't a superuser. Instead got: %d", res.StatusCode)
+		}
+		if a, _ := auth.GetUser(ctx, admin.ID); !a.IsActive {
+			t.Fatalf("Expected the superuser to still be active")
+		}
+
+		superuser := newTestBrowser(t, srv)
+		res, _ = superuser.post("/auth/login/", "/auth/login/", url.Values{"email": {admin.Email}, "password": {tUser.Password}})
+		if res.StatusCode != 302 {
+			t.Fatalf("Expected the superuser to log in. Instead got: %d", res.StatusCode)
+		}
+		res, body := superuser.get("/auth/admin/users/")
+		if res.StatusCode != 200 || !strings.Contains(body, tUser.Email) {
+			t.Fatalf("Expected the superuser to see the user list. Instead got: %d %s", res.StatusCode, body)
+		}
+
+		// an action without the CSRF token is rejected
+		req, _ := http.NewRequest("POST", srv.URL+userPage+"/deactivate", strings.NewReader(""))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, _ = superuser.do(req)
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected an action without a CSRF token to get 403. Instead got: %d", res.StatusCode)
+		}
+		if got, _ := auth.GetUser(ctx, u.ID); !got.IsActive {
+			t.Fatalf("Expected the user to still be active")
+		}
+
+		// superusers can't lock themselves out
+		for _, action := range []string{"deactivate", "demote", "delete"} {
+			res, _ = superuser.post(adminPage, adminPage+"/"+action, url.Values{})
+			if loc := res.Header.Get("Location"); loc != adminPage {
+				t.Fatalf("Expected %s on their own account to go back to the page. Instead got: %d %s", action, res.StatusCode, loc)
+			}
+		}
+		a, _ := auth.GetUser(ctx, admin.ID)
+		if !a.IsActive || !a.IsSuperuser || a.IsDeleted {
+			t.Fatalf("Expected the superuser's own account to be unchanged. Instead got: %+v", a)
+		}
+
+		// the actions change the user
+		actions := []struct {
+			action string
+			check  func(User) bool
+		}{
+			{"deactivate", func(u User) bool { return !u.IsActive }},
+			{"activate", func(u User) bool { return u.IsActive }},
+			{"promote", func(u User) bool { return u.IsSuperuser }},
+			{"demote", func(u User) bool { return !u.IsSuperuser }},
+			{"delete", func(u User) bool { return u.IsDeleted }},
+			{"restore", func(u User) bool { return !u.IsDeleted }},
+		}
+		for _, tc := range actions {
+			res, _ = superuser.post(userPage, userPage+"/"+tc.action, url.Values{})
+			if loc := res.Header.Get("Location"); loc != userPage {
+				t.Fatalf("Expected %s to go back to the user's page. Instead got: %d %s", tc.action, res.StatusCode, loc)
+			}
+			if got, _ := auth.GetUser(ctx, u.ID); !tc.check(got) {
+				t.Fatalf("Expected %s to change the user. Instead got: %+v", tc.action, got)
+			}
+		}
+		res, _ = superuser.post(userPage, userPage, url.Values{"email": {"renamed@example.com"}, "firstname": {"Renamed"}, "lastname": {tUser.LastName}})
+		if got, _ := auth.GetUser(ctx, u.ID); res.StatusCode != 302 || got.Email != "renamed@example.com" || got.FirstName != "Renamed" {
+			t.Fatalf("Expected the edit form to update the user. Instead got: %d %+v", res.StatusCode, got)
+		}
+
+		// Clean Up (removed the users, logins, events and emails we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", admin.ID)
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("DataExport", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		db.MustExec("INSERT INTO user_provider (user_id, provider, provider_user_id) VALUES (?, 'github', '1')", u.ID)
+		err = auth.BeginEmailChange(ctx, u.ID, "new@example.com")
+		if err != nil {
+			t.Fatalf("Expected to Begin Email Change. Instead got: %v", err)
+		}
+		someone := uuid.NewV4()
+		auth.RecordAuditEvent(ctx, AuditEvent{Type: AuditUserUpdated, ActorID: u.ID, TargetID: someone, Details: AuditDetails{"fields": "someone's secret"}})
+
+		b, err := auth.ExportUserData(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("Expected to export user data. Instead got the error: %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatalf("Expected the export to be a zip archive. Instead got the error: %v", err)
+		}
+		files := map[string][]byte{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("Expected to open %s. Instead got the error: %v", f.Name, err)
+			}
+			files[f.Name], _ = ioutil.ReadAll(rc)
+			rc.Close()
+			if !json.Valid(files[f.Name]) {
+				t.Fatalf("Expected %s to be JSON. Instead got: %s", f.Name, files[f.Name])
+			}
+		}
+		for _, name := range []string{"manifest.json", "user.json", "providers.json", "passkeys.json", "email_changes.json", "logins.json", "audit_events.json"} {
+			if _, ok := files[name]; !ok {
+				t.Fatalf("Expected the export to contain %s. Instead got: %v", name, zr.File)
+			}
+		}
+		exported := User{}
+		json.Unmarshal(files["user.json"], &exported)
+		if !uuid.Equal(exported.ID, u.ID) || exported.Email != u.Email {
+			t.Fatalf("Expected user.json to hold %s. Instead got: %s", u.ID, files["user.json"])
+		}
+		if bytes.Contains(files["user.json"], []byte(u.Password)) || exported.Password != "" {
+			t.Fatalf("Expected user.json not to contain the password hash. Instead got: %s", files["user.json"])
+		}
+		providers := []UserProvider{}
+		json.Unmarshal(files["providers.json"], &providers)
+		if len(providers) != 1 || providers[0].Provider != "github" {
+			t.Fatalf("Expected providers.json to list the github account. Instead got: %s", files["providers.json"])
+		}
+		if !bytes.Contains(files["email_changes.json"], []byte("new@example.com")) {
+			t.Fatalf("Expected email_changes.json to list the pending change. Instead got: %s", files["email_changes.json"])
+		}
+		events := []AuditEvent{}
+		json.Unmarshal(files["audit_events.json"], &events)
+		acted := 0
+		for _, e := range events {
+			if uuid.Equal(e.TargetID, someone) {
+				acted++
+				if len(e.Details) != 0 {
+					t.Fatalf("Expected the details of an event about someone else to be left out. Instead got: %+v", e)
+				}
+			} else if !uuid.Equal(e.TargetID, u.ID) {
+				t.Fatalf("Expected only events about or by the user. Instead got: %+v", e)
+			}
+		}
+		if acted != 1 || !bytes.Contains(files["audit_events.json"], []byte(AuditUserCreated)) {
+			t.Fatalf("Expected audit_events.json to list the events about and by the user. Instead got: %s", files["audit_events.json"])
+		}
+
+		// the archive is emailed as a single-use download link
+		outbox.DispatchPending(ctx)
+		mailer.Reset()
+		err = auth.BeginDataExport(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("Expected to Begin Data Export. Instead got: %v", err)
+		}
+		outbox.DispatchPending(ctx)
+		n, err := nonce.Get("auth.DataExport", u.ID)
+		if err != nil {
+			t.Fatalf("Expected to get Nonce for auth.DataExport. Instead got error: %v", err)
+		}
+		token := userToken(u.ID, n.Token)
+		m, _ := mailer.Last()
+		link := BaseURL + "/data-export/" + token
+		if m.Subject != DataExportEmail.Subject || !strings.Contains(m.HTML, link) || !strings.Contains(m.PlainText, link) {
+			t.Fatalf("Expected a Data Export Email with the link %s. Instead got: %+v", link, m)
+		}
+		other, err := auth.NewUserLocal(ctx, "other@example.com", tUser.Password, "Other", "Human", false)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		srv := httptest.NewTLSServer(httpHandler)
+		defer srv.Close()
+		path := "/auth/data-export/" + token
+
+		// only the user the export is for can open the link, and opening it doesn't use it up
+		res, _ := newTestBrowser(t, srv).get(path)
+		if loc := res.Header.Get("Location"); loc != "/auth/login/" {
+			t.Fatalf("Expected a visitor who isn't logged in to be sent to the login page. Instead got: %d %s", res.StatusCode, loc)
+		}
+		stranger := newTestBrowser(t, srv)
+		stranger.post("/auth/login/", "/auth/login/", url.Values{"email": {other.Email}, "password": {tUser.Password}})
+		res, _ = stranger.get(path)
+		if loc := res.Header.Get("Location"); loc != "/" {
+			t.Fatalf("Expected another user to be told the link is invalid. Instead got: %d %s", res.StatusCode, loc)
+		}
+		browser := newTestBrowser(t, srv)
+		browser.post("/auth/login/", "/auth/login/", url.Values{"email": {tUser.Email}, "password": {tUser.Password}})
+		res, body := browser.get(path)
+		if res.StatusCode != 200 || !strings.Contains(body, path) {
+			t.Fatalf("Expected the link to show a download button. Instead got: %d %s", res.StatusCode, body)
+		}
+		res, body = browser.post(path, path, url.Values{})
+		if res.StatusCode != 200 || res.Header.Get("Content-Type") != "application/zip" {
+			t.Fatalf("Expected the button to download the archive. Instead got: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		_, err = zip.NewReader(strings.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatalf("Expected the download to be a zip archive. Instead got the error: %v", err)
+		}
+		_, err = auth.CompleteDataExport(ctx, token)
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected a used link to get ErrInvalidToken. Instead got: %v", err)
+		}
+
+		// archives that are never downloaded are removed once they expire
+		err = auth.BeginDataExport(ctx, u.ID)
+		if err != nil {
+			t.Fatalf("Expected to Begin Data Export. Instead got: %v", err)
+		}
+		r, err := NewRetentionJob(auth, time.Hour).Run()
+		if err != nil || r.ExpiredExports != 0 {
+			t.Fatalf("Expected a waiting archive to be kept. Instead got: %+v (error: %v)", r, err)
+		}
+		db.MustExec("UPDATE user_export SET expires_at=?", time.Now().Add(-time.Minute))
+		r, err = NewRetentionJob(auth, time.Hour).Run()
+		if err != nil || r.ExpiredExports != 1 {
+			t.Fatalf("Expected the expired archive to be removed. Instead got: %+v (error: %v)", r, err)
+		}
+		var exports int
+		db.Get(&exports, "SELECT COUNT(*) FROM user_export")
+		if exports != 0 {
+			t.Fatalf("Expected no archive to be left. Instead got: %d", exports)
+		}
+
+		// Clean Up (removed the users we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM user WHERE id=?", other.ID)
+		tx.MustExec("DELETE FROM user_provider")
+		tx.MustExec("DELETE FROM email_change")
+		tx.MustExec("DELETE FROM user_export")
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		db.MustExec("DELETE FROM audit_event")
+		sink := NewMemoryAuditSink()
+		AuditSinks = []AuditSink{sink}
+		defer func() { AuditSinks = nil }()
+
+		admin, err := auth.NewUserLocal(ctx, "admin@example.com", tUser.Password, tUser.FirstName, tUser.LastName, true)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, false)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+
+		// an admin's request names them as the actor
+		info := AuditInfo{ActorID: admin.ID, IP: "192.0.2.1", UserAgent: "test-agent"}
+		u.IsSuperuser = true
+		_, err = auth.WithAuditInfo(info).UpdateUser(ctx, u)
+		if err != nil {
+			t.Fatalf("Expected to update user. Instead got the error: %v", err)
+		}
+		l, err := auth.ListAuditEvents(ctx, AuditQuery{ActorID: admin.ID})
+		if err != nil {
+			t.Fatalf("Expected to list audit events. Instead got the error: %v", err)
+		}
+		if len(l.Events) != 2 || l.Events[0].Type != AuditRoleChanged || l.Events[1].Type != AuditUserUpdated {
+			t.Fatalf("Expected the role change and update, newest first. Instead got: %+v", l.Events)
+		}
+		e := l.Events[1]
+		if !uuid.Equal(e.TargetID, u.ID) || e.IP != info.IP || e.UserAgent != info.UserAgent || e.Details["fields"] != "is_superuser" {
+			t.Fatalf("Expected the update of %s from %s. Instead got: %+v", u.ID, info.IP, e)
+		}
+
+		// logins are recorded with the user as the actor
+		auth.AuthenticateUser(ctx, tUser.Email, "WrongPassword")
+		auth.AuthenticateUser(ctx, "nobody@example.com", tUser.Password)
+		// a deferred login is only recorded once it is completed
+		u, err = auth.AuthenticateUser(ContextWithDeferredLogin(ctx), tUser.Email, tUser.Password)
+		if err != nil {
+			t.Fatalf("Expected to authenticate. Instead got the error: %v", err)
+		}
+		l, _ = auth.ListAuditEvents(ctx, AuditQuery{TargetID: u.ID, Types: []string{AuditLoginSucceeded}})
+		if len(l.Events) != 0 {
+			t.Fatalf("Expected a deferred login not to be recorded. Instead got: %+v", l.Events)
+		}
+		err = auth.CompleteLogin(ctx, u, "password")
+		if err != nil {
+			t.Fatalf("Expected to complete the login. Instead got the error: %v", err)
+		}
+		l, _ = auth.ListAuditEvents(ctx, AuditQuery{TargetID: u.ID, Types: []string{AuditLoginSucceeded, AuditLoginFailed}})
+		if len(l.Events) != 2 || l.Events[0].Type != AuditLoginSucceeded || !uuid.Equal(l.Events[0].ActorID, u.ID) || l.Events[0].Details["method"] != "password" {
+			t.Fatalf("Expected a successful and a failed login. Instead got: %+v", l.Events)
+		}
+		if l.Events[1].Details["reason"] != ErrIncorrectAuth.Error() {
+			t.Fatalf("Expected the failed login to give its reason. Instead got: %+v", l.Events[1])
+		}
+		l, _ = auth.ListAuditEvents(ctx, AuditQuery{TargetID: uuid.Nil, Types: []string{AuditLoginFailed}})
+		if len(l.Events) != 2 || l.Events[0].TargetID != uuid.Nil || l.Events[0].Details["email"] != "nobody@example.com" {
+			t.Fatalf("Expected a failed login for an unknown email. Instead got: %+v", l.Events)
+		}
+
+		// pages cover every event once
+		all, _ := auth.ListAuditEvents(ctx, AuditQuery{})
+		if len(all.Events) != len(sink.Events()) {
+			t.Fatalf("Expected every event to reach the sink. Instead got %d stored and %d written", len(all.Events), len(sink.Events()))
+		}
+		q := AuditQuery{Limit: 2}
+		seen := 0
+		for {
+			page, err := auth.ListAuditEvents(ctx, q)
+			if err != nil {
+				t.Fatalf("Expected to list audit events. Instead got the error: %v", err)
+			}
+			for _, e := range page.Events {
+				if !uuid.Equal(e.ID, all.Events[seen].ID) {
+					t.Fatalf("Expected event %d to be %s. Instead got: %s", seen, all.Events[seen].ID, e.ID)
+				}
+				seen++
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		if seen != len(all.Events) {
+			t.Fatalf("Expected to page through %d events. Instead got: %d", len(all.Events), seen)
+		}
+		_, err = auth.ListAuditEvents(ctx, AuditQuery{Cursor: "not a cursor"})
+		if err != ErrInvalidQuery {
+			t.Fatalf("Expected to get ErrInvalidQuery. Instead got: %v", err)
+		}
+
+		err = auth.RecordAuditEvent(ctx, AuditEvent{TargetID: u.ID})
+		if err == nil {
+			t.Fatalf("Expected an event without a type to be rejected.")
+		}
+
+		// Clean Up (removed the users we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", admin.ID)
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("LoginHistory", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		outbox.DispatchPending(ctx)
+		mailer.Reset()
+
+		login := func(ip, ua string) {
+			_, err := auth.WithAuditInfo(AuditInfo{IP: ip, UserAgent: ua}).AuthenticateUser(ctx, tUser.Email, tUser.Password)
+			if err != nil {
+				t.Fatalf("Expected to authenticate. Instead got the error: %v", err)
+			}
+			outbox.DispatchPending(ctx)
+		}
+		firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:56.0) Gecko/20100101 Firefox/56.0"
+		chrome := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/61.0.3163.100 Safari/537.36"
+
+		// the first login, a browser update and another address on the same network are not alerted
+		login("192.0.2.1", firefox)
+		login("192.0.2.1", strings.Replace(firefox, "56.0", "57.0", -1))
+		login("192.0.2.99", firefox)
+		if len(mailer.Messages()) != 0 {
+			t.Fatalf("Expected no login alerts. Instead got: %+v", mailer.Messages())
+		}
+
+		// a new device and a new network are
+		login("192.0.2.1", chrome)
+		login("198.51.100.7", firefox)
+		if len(mailer.Messages()) != 2 {
+			t.Fatalf("Expected 2 login alerts. Instead got: %d", len(mailer.Messages()))
+		}
+		n, err := nonce.Get("auth.LoginAlert", u.ID)
+		if err != nil {
+			t.Fatalf("Expected to get Nonce for auth.LoginAlert. Instead got error: %v", err)
+		}
+		token := userToken(u.ID, n.Token)
+		m, _ := mailer.Last()
+		link := BaseURL + "/logins/report/" + token
+		if m.Subject != LoginAlertEmail.Subject || !strings.Contains(m.PlainText, link) || !strings.Contains(m.PlainText, "198.51.100.7") {
+			t.Fatalf("Expected a Login Alert Email for 198.51.100.7 with the link %s. Instead got: %+v", link, m)
+		}
+
+		logins, err := auth.ListLoginHistory(ctx, u.ID, 0)
+		if err != nil {
+			t.Fatalf("Expected to list login history. Instead got the error: %v", err)
+		}
+		if len(logins) != 5 || logins[0].IP != "198.51.100.7" || !logins[0].IsNew || logins[0].Network != "198.51.100.0/24" || logins[0].Method != "password" {
+			t.Fatalf("Expected the new network login first. Instead got: %+v", logins)
+		}
+		if logins[2].IsNew || logins[2].Fingerprint != logins[4].Fingerprint {
+			t.Fatalf("Expected an updated browser to be the same device. Instead got: %+v", logins)
+		}
+		logins, _ = auth.ListLoginHistory(ctx, u.ID, 2)
+		if len(logins) != 2 {
+			t.Fatalf("Expected 2 logins. Instead got: %d", len(logins))
+		}
+
+		// "this wasn't me" asks for confirmation, then revokes every session and sends a password reset link
+		mailer.Reset()
+		before := time.Now()
+		srv := httptest.NewTLSServer(httpHandler)
+		defer srv.Close()
+		browser := newTestBrowser(t, srv)
+		path := "/auth/logins/report/" + token
+		res, _ := browser.get(path)
+		if u2, _ := auth.GetUser(ctx, u.ID); res.StatusCode != 200 || !u2.SessionsRevokedAt.IsZero() {
+			t.Fatalf("Expected following the link to only ask for confirmation. Instead got: %d %v", res.StatusCode, u2.SessionsRevokedAt)
+		}
+		res, _ = browser.post(path, path, url.Values{})
+		if loc := res.Header.Get("Location"); loc != "/" {
+			t.Fatalf("Expected to report the login. Instead got: %d %s", res.StatusCode, loc)
+		}
+		u2, _ := auth.GetUser(ctx, u.ID)
+		if u2.SessionsRevokedAt.Before(before) {
+			t.Fatalf("Expected sessions to be revoked. Instead got: %v", u2.SessionsRevokedAt)
+		}
+		outbox.DispatchPending(ctx)
+		m, _ = mailer.Last()
+		if m.Subject != PasswordResetEmail.Subject {
+			t.Fatalf("Expected a Password Reset Email. Instead got: %+v", m)
+		}
+		_, err = auth.ReportLogin(ctx, token)
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected a used link to get ErrInvalidToken. Instead got: %v", err)
+		}
+		l, _ := auth.ListAuditEvents(ctx, AuditQuery{TargetID: u.ID, Types: []string{AuditLoginReported}})
+		if len(l.Events) != 1 {
+			t.Fatalf("Expected the report to be audited. Instead got: %+v", l.Events)
+		}
+
+		// Clean Up (removed the user we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		// a service of its own so the hooks don't leak into other tests
+		svc, err := NewService(db, outbox, nonce, tmpl.NewTplSys(""))
+		if err != nil {
+			t.Fatalf("Expected to create the service. Instead got the error: %v", err)
+		}
+		bus := svc.Events()
+
+		errBlocked := errors.New("blocked domain")
+		errLocked := errors.New("account locked")
+		locked := false
+		bus.Hook(EventUserRegistered, func(ctx context.Context, tx *sqlx.Tx, e Event) error {
+			// hooks run after the user is written, in the same transaction
+			var n int
+			err := tx.Get(&n, "SELECT COUNT(*) FROM user WHERE id=?", e.User.ID)
+			if err != nil || n != 1 {
+				return fmt.Errorf("expected the hook to see the new user, got %d (%v)", n, err)
+			}
+			if strings.HasSuffix(e.User.Email, "@blocked.example.com") {
+				return errBlocked
+			}
+			return nil
+		})
+		bus.Hook(EventUserLoggedIn, func(ctx context.Context, tx *sqlx.Tx, e Event) error {
+			if locked {
+				return errLocked
+			}
+			return nil
+		})
+		bus.Hook(EventUserDeleted, func(ctx context.Context, tx *sqlx.Tx, e Event) error {
+			if e.User.IsSuperuser {
+				return errors.New("superusers can't be deleted")
+			}
+			return nil
+		})
+
+		var mu sync.Mutex
+		var got []Event
+		for _, typ := range []EventType{EventUserRegistered, EventUserLoggedIn, EventUserDeleted} {
+			bus.Subscribe(typ, func(e Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, e)
+			})
+		}
+		bus.Subscribe(EventUserLoggedIn, func(e Event) {
+			panic("a broken subscriber")
+		})
+
+		// a vetoed registration saves nothing and sends no email
+		_, err = svc.NewUserLocal(ctx, "someone@blocked.example.com", tUser.Password, tUser.FirstName, tUser.LastName, false)
+		if err != errBlocked {
+			t.Fatalf("Expected the hook to veto the registration. Instead got: %v", err)
+		}
+		var n int
+		db.Get(&n, "SELECT COUNT(*) FROM user")
+		if n != 0 {
+			t.Fatalf("Expected no users to be saved. Instead got: %d", n)
+		}
+		db.Get(&n, "SELECT COUNT(*) FROM email_outbox")
+		if n != 0 {
+			t.Fatalf("Expected no emails to be queued. Instead got: %d", n)
+		}
+
+		u, err := svc.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, true)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		info := AuditInfo{IP: "192.0.2.1"}
+		_, err = svc.WithAuditInfo(info).AuthenticateUser(ctx, tUser.Email, tUser.Password)
+		if err != nil {
+			t.Fatalf("Expected to authenticate. Instead got the error: %v", err)
+		}
+		locked = true
+		_, err = svc.AuthenticateUser(ctx, tUser.Email, tUser.Password)
+		if err != errLocked {
+			t.Fatalf("Expected the hook to veto the login. Instead got: %v", err)
+		}
+		_, err = svc.DeleteUser(ctx, u.ID)
+		if err == nil {
+			t.Fatalf("Expected the hook to veto deleting a superuser.")
+		}
+		u2, _ := svc.GetUser(ctx, u.ID)
+		if u2.IsDeleted {
+			t.Fatalf("Expected a vetoed delete to be rolled back. Instead got: %+v", u2)
+		}
+
+		// subscribers only hear about committed changes
+		bus.Wait()
+		if len(got) != 2 || got[0].Type != EventUserRegistered || got[1].Type != EventUserLoggedIn {
+			t.Fatalf("Expected the registration and one login. Instead got: %+v", got)
+		}
+		if !uuid.Equal(got[0].User.ID, u.ID) || got[1].Method != "password" || got[1].Info.IP != info.IP {
+			t.Fatalf("Expected the events to describe %s. Instead got: %+v", u.ID, got)
+		}
+
+		// Clean Up (removed the user we just added)
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Webhooks", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		svc, err := NewService(db, outbox, nonce, tmpl.NewTplSys(""))
+		if err != nil {
+			t.Fatalf("Expected to create the service. Instead got the error: %v", err)
+		}
+		webhooks := NewWebhooks(db, nil)
+		webhooks.MaxAttempts = 2
+		webhooks.BaseDelay = 0
+		webhooks.Attach(svc.Events())
+
+		// the receiver checks every signature and fails while failing is set
+		secret := "s3cret"
+		var mu sync.Mutex
+		var received []WebhookPayload
+		failing := true
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(r.Header.Get(WebhookTimestampHeader) + "." + string(body)))
+			want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(want)) {
+				http.Error(w, "bad signature", http.StatusUnauthorized)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if failing {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			p := WebhookPayload{}
+			json.Unmarshal(body, &p)
+			if string(p.Type) != r.Header.Get(WebhookEventHeader) {
+				http.Error(w, "wrong event header", http.StatusBadRequest)
+				return
+			}
+			received = append(received, p)
+		}))
+		defer receiver.Close()
+
+		_, err = webhooks.AddEndpoint(ctx, "ftp://example.com/hook", secret)
+		if err != ErrInvalidURL {
+			t.Fatalf("Expected to get ErrInvalidURL. Instead got: %v", err)
+		}
+		ep, err := webhooks.AddEndpoint(ctx, receiver.URL, secret, EventUserRegistered, EventUserDeleted)
+		if err != nil {
+			t.Fatalf("Expected to add webhook endpoint. Instead got the error: %v", err)
+		}
+		other, err := webhooks.AddEndpoint(ctx, receiver.URL+"/other", "wrong secret")
+		if err != nil {
+			t.Fatalf("Expected to add webhook endpoint. Instead got the error: %v", err)
+		}
+		other.IsActive = false
+		_, err = webhooks.UpdateEndpoint(ctx, other)
+		if err != nil {
+			t.Fatalf("Expected to update webhook endpoint. Instead got the error: %v", err)
+		}
+
+		// only subscribed events of committed changes are queued for active endpoints
+		u, err := svc.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, false)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		svc.AuthenticateUser(ctx, tUser.Email, tUser.Password)
+		_, err = svc.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, false)
+		if err != ErrAlreadyExists {
+			t.Fatalf("Expected to get ErrAlreadyExists. Instead got: %v", err)
+		}
+		log, err := webhooks.Deliveries(ctx, ep.ID, 0)
+		if err != nil {
+			t.Fatalf("Expected to list webhook deliveries. Instead got the error: %v", err)
+		}
+		if len(log) != 1 || log[0].EventType != EventUserRegistered || !uuid.Equal(log[0].UserID, u.ID) {
+			t.Fatalf("Expected one registration delivery. Instead got: %+v", log)
+		}
+
+		// a cancelled dispatch leaves the delivery queued
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		sent, err := webhooks.DispatchPending(cancelled)
+		if err != context.Canceled || sent != 0 {
+			t.Fatalf("Expected dispatch to stop with context.Canceled. Instead sent %d (error: %v)", sent, err)
+		}
+		if log, _ = webhooks.Deliveries(ctx, ep.ID, 0); log[0].Attempts != 0 {
+			t.Fatalf("Expected the delivery not to be attempted. Instead got: %+v", log[0])
+		}
+
+		// failures are retried until MaxAttempts, then the delivery is dead
+		for i := 0; i < 2; i++ {
+			sent, err := webhooks.DispatchPending(ctx)
+			if err != nil || sent != 0 {
+				t.Fatalf("Expected delivery to fail. Instead sent %d (error: %v)", sent, err)
+			}
+		}
+		failed, err := webhooks.Failed(ctx)
+		if err != nil {
+			t.Fatalf("Expected to list failed deliveries. Instead got the error: %v", err)
+		}
+		if len(failed) != 1 || failed[0].Attempts != 2 || failed[0].ResponseStatus != http.StatusServiceUnavailable || failed[0].Status != WebhookDead {
+			t.Fatalf("Expected 1 dead delivery. Instead got: %+v", failed)
+		}
+
+		// a replay is a new delivery of the same payload
+		mu.Lock()
+		failing = false
+		mu.Unlock()
+		replay, err := webhooks.Replay(ctx, failed[0].ID)
+		if err != nil {
+			t.Fatalf("Expected to replay delivery. Instead got the error: %v", err)
+		}
+		if uuid.Equal(replay.ID, failed[0].ID) || !bytes.Equal(replay.Payload, failed[0].Payload) {
+			t.Fatalf("Expected a new delivery of the same payload. Instead got: %+v", replay)
+		}
+		sent, err = webhooks.DispatchPending(ctx)
+		if err != nil || sent != 1 {
+			t.Fatalf("Expected the replay to be sent. Instead sent %d (error: %v)", sent, err)
+		}
+		mu.Lock()
+		if len(received) != 1 || received[0].Type != EventUserRegistered || !uuid.Equal(received[0].User.ID, u.ID) || received[0].User.Password != "" {
+			t.Fatalf("Expected the registration of %s without the password hash. Instead got: %+v", u.ID, received)
+		}
+		mu.Unlock()
+		log, _ = webhooks.Deliveries(ctx, ep.ID, 0)
+		if len(log) != 2 || log[0].Status != WebhookSent || log[0].ResponseStatus != http.StatusOK || log[1].Status != WebhookDead {
+			t.Fatalf("Expected the log to keep the dead delivery and the replay. Instead got: %+v", log)
+		}
+		_, err = webhooks.Replay(ctx, uuid.NewV4())
+		if err != ErrDeliveryNotFound {
+			t.Fatalf("Expected to get ErrDeliveryNotFound. Instead got: %v", err)
+		}
+
+		// purging the user removes their deliveries but notifies the endpoint of the purge if subscribed
+		ep.Events = append(ep.Events, EventUserPurged)
+		ep, err = webhooks.UpdateEndpoint(ctx, ep)
+		if err != nil {
+			t.Fatalf("Expected to update webhook endpoint. Instead got the error: %v", err)
+		}
+		svc.DeleteUser(ctx, u.ID)
+		webhooks.DispatchPending(ctx)
+		r, err := svc.PurgeUser(ctx, u.ID)
+		if err != nil || r.Webhooks != 3 {
+			t.Fatalf("Expected 3 deliveries to be purged. Instead got: %+v, %v", r, err)
+		}
+		log, _ = webhooks.Deliveries(ctx, ep.ID, 0)
+		purged := WebhookPayload{}
+		if len(log) == 1 {
+			json.Unmarshal(log[0].Payload, &purged)
+		}
+		if purged.Type != EventUserPurged || !uuid.Equal(purged.User.ID, u.ID) || purged.User.Email != "" || purged.User.FirstName != "" {
+			t.Fatalf("Expected the purge delivery to name nothing but the user's ID. Instead got: %+v", log)
+		}
+
+		err = webhooks.DeleteEndpoint(ctx, ep.ID)
+		if err != nil {
+			t.Fatalf("Expected to delete webhook endpoint. Instead got the error: %v", err)
+		}
+		_, err = webhooks.GetEndpoint(ctx, ep.ID)
+		if err != ErrWebhookNotFound {
+			t.Fatalf("Expected to get ErrWebhookNotFound. Instead got: %v", err)
+		}
+
+		// Clean Up
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM webhook_endpoint")
+		tx.MustExec("DELETE FROM webhook_delivery")
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := auth.NewUserLocal(cancelled, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != context.Canceled {
+			t.Fatalf("Expected to get context.Canceled. Instead got: %v", err)
+		}
+		var n int
+		db.Get(&n, "SELECT COUNT(*) FROM user")
+		if n != 0 {
+			t.Fatalf("Expected no user to be saved. Instead got: %d", n)
+		}
+
+		// the deprecated wrapper calls through with context.Background()
+		legacy := NewLegacyService(auth)
+		u, err := legacy.NewUserLocal(tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		_, err = legacy.WithAuditInfo(AuditInfo{IP: "192.0.2.1"}).AuthenticateUser(tUser.Email, tUser.Password)
+		if err != nil {
+			t.Fatalf("Expected to authenticate user. Instead got the error: %v", err)
+		}
+
+		// a cancelled dispatch leaves the welcome email queued
+		mailer.Reset()
+		sent, err := outbox.DispatchPending(cancelled)
+		if err != context.Canceled || sent != 0 {
+			t.Fatalf("Expected dispatch to stop with context.Canceled. Instead sent %d (error: %v)", sent, err)
+		}
+		err = mailer.Send(cancelled, Email{To: u.Email})
+		if err != context.Canceled || len(mailer.Messages()) != 0 {
+			t.Fatalf("Expected nothing to be sent with a cancelled context. Instead got: %v", err)
+		}
+		sent, err = outbox.DispatchPending(ctx)
+		if err != nil || sent != 1 {
+			t.Fatalf("Expected the welcome email to be sent. Instead sent %d (error: %v)", sent, err)
+		}
+
+		// Clean Up
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		m := NewPrometheusMetrics()
+		MetricsRecorder = m
+		defer func() { MetricsRecorder = nil }()
+
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		auth.AuthenticateUser(ctx, tUser.Email, "wrong password")
+		auth.AuthenticateUser(ctx, tUser.Email, tUser.Password)
+		auth.BeginPasswordReset(ctx, tUser.Email)
+		u.IsActive = false
+		auth.UpdateUser(ctx, u)
+		auth.AuthenticateUser(ctx, tUser.Email, tUser.Password)
+		outbox.DispatchPending(ctx)
+
+		text := string(m.text())
+		for _, line := range []string{
+			`auth_registrations_total{result="success"} 1`,
+			`auth_registrations_total{result="exists"} 1`,
+			`auth_logins_total{method="password",result="failure"} 1`,
+			`auth_logins_total{method="password",result="success"} 1`,
+			`auth_logins_total{method="password",result="locked"} 1`,
+			`auth_lockouts_total{reason="inactive"} 1`,
+			`auth_password_reset_requests_total{result="success"} 1`,
+			`auth_emails_total{result="sent"} 2`,
+			`auth_db_duration_seconds_count{operation="select user"}`,
+			`auth_db_duration_seconds_count{operation="transaction"}`,
+			`auth_db_duration_seconds_count{operation="select email_outbox"}`,
+			`auth_db_duration_seconds_count{operation="update email_outbox"}`,
+		} {
+			if !strings.Contains(text, line) {
+				t.Fatalf("Expected metrics to contain %q. Instead got:\n%s", line, text)
+			}
+		}
+
+		// Clean Up
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Tracing", func(t *testing.T) {
+		tracer := NewMemoryTracer()
+		Tracing = tracer
+		defer func() { Tracing = NoopTracer{} }()
+
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		tracer.Reset()
+
+		remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		_, err = auth.AuthenticateUser(ContextWithSpanContext(ctx, remote), tUser.Email, "wrong password")
+		if err != ErrIncorrectAuth {
+			t.Fatalf("Expected to get ErrIncorrectAuth. Instead got: %v", err)
+		}
+		login := tracer.Find("auth.AuthenticateUser")
+		if len(login) != 1 || login[0].TraceID != remote.TraceID || login[0].ParentID != remote.SpanID || login[0].Err != ErrIncorrectAuth {
+			t.Fatalf("Expected a failed AuthenticateUser span in the remote trace. Instead got: %+v", login)
+		}
+		for _, name := range []string{"sql select user", "bcrypt.compare"} {
+			spans := tracer.Find(name)
+			if len(spans) == 0 || spans[0].TraceID != remote.TraceID || spans[0].ParentID != login[0].SpanID {
+				t.Fatalf("Expected a %s span in the AuthenticateUser span. Instead got: %+v", name, spans)
+			}
+		}
+		if tracer.Find("sql select user")[0].Attributes["db.statement"] == "" {
+			t.Fatalf("Expected the statement to be recorded")
+		}
+
+		tracer.Reset()
+		u.FirstName = "Traced"
+		_, err = auth.UpdateUser(ctx, u)
+		if err != nil {
+			t.Fatalf("Expected to update user. Instead got the error: %v", err)
+		}
+		if len(tracer.Find("auth.UpdateUser")) != 1 || len(tracer.Find("sql update user")) != 1 {
+			t.Fatalf("Expected UpdateUser and its statement to be traced. Instead got: %+v", tracer.Spans())
+		}
+
+		tracer.Reset()
+		sent, err := outbox.DispatchPending(ctx)
+		if err != nil || sent != 1 {
+			t.Fatalf("Expected the welcome email to be sent. Instead sent %d (error: %v)", sent, err)
+		}
+		if len(tracer.Find("email.send")) != 1 {
+			t.Fatalf("Expected the send to be traced. Instead got: %+v", tracer.Spans())
+		}
+		if len(tracer.Find("sql select email_outbox")) != 1 || len(tracer.Find("sql update email_outbox")) != 2 {
+			t.Fatalf("Expected the outbox statements to be traced. Instead got: %+v", tracer.Spans())
+		}
+
+		tracer.Reset()
+		webhooks := NewWebhooks(db, nil)
+		_, err = webhooks.ListEndpoints(ctx)
+		if err != nil {
+			t.Fatalf("Expected to list webhook endpoints. Instead got the error: %v", err)
+		}
+		if len(tracer.Find("sql select webhook_endpoint")) != 1 {
+			t.Fatalf("Expected the webhook statement to be traced. Instead got: %+v", tracer.Spans())
+		}
+
+		// Clean Up
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Organizations", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
+
+		owner, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		other, err := auth.NewUserLocal(ctx, "other@example.com", tUser.Password, "Other", "Human", false)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		outbox.DispatchPending(ctx)
+		mailer.Reset()
+
+		_, err = auth.CreateOrganization(ctx, "  ", owner.ID)
+		if err != ErrInvalidName {
+			t.Fatalf("Expected to get ErrInvalidName. Instead got: %v", err)
+		}
+		acme, err := auth.CreateOrganization(ctx, " Acme ", owner.ID)
+		if err != nil {
+			t.Fatalf("Expected to create an organization. Instead got the error: %v", err)
+		}
+		if acme.Name != "Acme" {
+			t.Fatalf("Expected the name to be trimmed. Instead got: %q", acme.Name)
+		}
+		globex, err := auth.CreateOrganization(ctx, "Globex", other.ID)
+		if err != nil {
+			t.Fatalf("Expected to create an organization. Instead got the error: %v", err)
+		}
+
+		// the creator is the only owner, who can't leave or be demoted
+		m, err := auth.GetMembership(ctx, acme.ID, owner.ID)
+		if err != nil || m.Role != OrgRoleOwner {
+			t.Fatalf("Expected the creator to be an owner. Instead got: %+v (error: %v)", m, err)
+		}
+		_, err = auth.SetMemberRole(ctx, acme.ID, owner.ID, OrgRoleAdmin)
+		if err != ErrLastOwner {
+			t.Fatalf("Expected to get ErrLastOwner. Instead got: %v", err)
+		}
+		err = auth.RemoveOrgMember(ctx, acme.ID, owner.ID)
+		if err != ErrLastOwner {
+			t.Fatalf("Expected to get ErrLastOwner. Instead got: %v", err)
+		}
+		_, err = auth.GetMembership(ctx, acme.ID, other.ID)
+		if err != ErrNotMember {
+			t.Fatalf("Expected to get ErrNotMember. Instead got: %v", err)
+		}
+
+		// invite the owner of Globex to Acme as an admin
+		_, err = auth.InviteOrgMember(ctx, acme.ID, owner.ID, other.Email, "superhero")
+		if err != ErrInvalidRole {
+			t.Fatalf("Expected to get ErrInvalidRole. Instead got: %v", err)
+		}
+		_, err = auth.InviteOrgMember(ctx, acme.ID, owner.ID, owner.Email, OrgRoleMember)
+		if err != ErrAlreadyExists {
+			t.Fatalf("Expected a member's invitation to return ErrAlreadyExists. Instead got: %v", err)
+		}
+		first, err := auth.InviteOrgMember(ctx, acme.ID, owner.ID, other.Email, OrgRoleMember)
+		if err != nil {
+			t.Fatalf("Expected to invite a member. Instead got the error: %v", err)
+		}
+		firstNonce, _ := nonce.Get("auth.OrgInvite", first.ID)
+		inv, err := auth.InviteOrgMember(ctx, acme.ID, owner.ID, other.Email, OrgRoleAdmin)
+		if err != nil {
+			t.Fatalf("Expected to invite a member. Instead got the error: %v", err)
+		}
+		invites, err := auth.ListOrgInvites(ctx, acme.ID)
+		if err != nil || len(invites) != 1 || !uuid.Equal(invites[0].ID, inv.ID) {
+			t.Fatalf("Expected the second invitation to replace the first. Instead got: %+v (error: %v)", invites, err)
+		}
+		n, _ := nonce.Get("auth.OrgInvite", inv.ID)
+		token := userToken(inv.ID, n.Token)
+
+		outbox.DispatchPending(ctx)
+		msgs := mailer.Messages()
+		if len(msgs) != 2 || msgs[1].To != other.Email {
+			t.Fatalf("Expected 2 invitations to be sent to %s. Instead got: %+v", other.Email, msgs)
+		}
+		if !strings.Contains(msgs[1].PlainText, BaseURL+"/orgs/invite/"+token) || !strings.Contains(msgs[1].PlainText, "join Acme") || !strings.Contains(msgs[1].PlainText, "as an admin") {
+			t.Fatalf("Expected the invitation link, organization and role. Instead got: %s", msgs[1].PlainText)
+		}
+
+		// the replaced invitation and other users can't accept
+		_, err = auth.AcceptOrgInvite(ctx, userToken(first.ID, firstNonce.Token), other.ID)
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected the replaced invitation to return ErrInvalidToken. Instead got: %v", err)
+		}
+		_, err = auth.AcceptOrgInvite(ctx, token, owner.ID)
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected another user's invitation to return ErrInvalidToken. Instead got: %v", err)
+		}
+		m, err = auth.AcceptOrgInvite(ctx, token, other.ID)
+		if err != nil || m.Role != OrgRoleAdmin {
+			t.Fatalf("Expected to join as an admin. Instead got: %+v (error: %v)", m, err)
+		}
+		_, err = auth.AcceptOrgInvite(ctx, token, other.ID)
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected an accepted invitation to return ErrInvalidToken. Instead got: %v", err)
+		}
+		invites, _ = auth.ListOrgInvites(ctx, acme.ID)
+		if len(invites) != 0 {
+			t.Fatalf("Expected no pending invitations. Instead got: %+v", invites)
+		}
+
+		// the same email holds a different role in each organization
+		orgs, err := auth.ListUserOrganizations(ctx, other.ID)
+		if err != nil || len(orgs) != 2 {
+			t.Fatalf("Expected 2 organizations. Instead got: %+v (error: %v)", orgs, err)
+		}
+		if orgs[0].Name != "Acme" || orgs[0].Role != OrgRoleAdmin || orgs[1].Name != "Globex" || orgs[1].Role != OrgRoleOwner {
+			t.Fatalf("Expected to be an admin of Acme and the owner of Globex. Instead got: %+v", orgs)
+		}
+		members, err := auth.ListOrgMembers(ctx, acme.ID)
+		if err != nil || len(members) != 2 {
+			t.Fatalf("Expected 2 members. Instead got: %+v (error: %v)", members, err)
+		}
+
+		// a second owner lets the first step down
+		_, err = auth.SetMemberRole(ctx, acme.ID, other.ID, OrgRoleOwner)
+		if err != nil {
+			t.Fatalf("Expected to make an owner. Instead got the error: %v", err)
+		}
+		err = auth.RemoveOrgMember(ctx, acme.ID, owner.ID)
+		if err != nil {
+			t.Fatalf("Expected the first owner to leave. Instead got the error: %v", err)
+		}
+
+		// revoking and renaming
+		inv, err = auth.InviteOrgMember(ctx, acme.ID, other.ID, "new@example.com", OrgRoleMember)
+		if err != nil {
+			t.Fatalf("Expected to invite an address without an account. Instead got the error: %v", err)
+		}
+		err = auth.RevokeOrgInvite(ctx, acme.ID, inv.ID)
+		if err != nil {
+			t.Fatalf("Expected to revoke the invitation. Instead got the error: %v", err)
+		}
+		err = auth.RevokeOrgInvite(ctx, acme.ID, inv.ID)
+		if err != ErrInviteNotFound {
+			t.Fatalf("Expected to get ErrInviteNotFound. Instead got: %v", err)
+		}
+		acme.Name = "Acme Corp"
+		_, err = auth.UpdateOrganization(ctx, acme)
+		if err != nil {
+			t.Fatalf("Expected to rename the organization. Instead got the error: %v", err)
+		}
+		o, err := auth.GetOrganization(ctx, acme.ID)
+		if err != nil || o.Name != "Acme Corp" {
+			t.Fatalf("Expected the new name. Instead got: %+v (error: %v)", o, err)
+		}
+
+		err = auth.DeleteOrganization(ctx, globex.ID)
+		if err != nil {
+			t.Fatalf("Expected to delete the organization. Instead got the error: %v", err)
+		}
+		_, err = auth.GetOrganization(ctx, globex.ID)
+		if err != ErrOrgNotFound {
+			t.Fatalf("Expected to get ErrOrgNotFound. Instead got: %v", err)
+		}
+		orgs, _ = auth.ListUserOrganizations(ctx, other.ID)
+		if len(orgs) != 1 || !uuid.Equal(orgs[0].ID, acme.ID) {
+			t.Fatalf("Expected only Acme to be left. Instead got: %+v", orgs)
+		}
+
+		// Clean Up
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", owner.ID)
+		tx.MustExec("DELETE FROM user WHERE id=?", other.ID)
+		tx.MustExec("DELETE FROM organization")
+		tx.MustExec("DELETE FROM org_membership")
+		tx.MustExec("DELETE FROM org_invite")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("OrgPermissions", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		users := map[string]User{}
+		for _, name := range []string{"owner", "admin", "member", "outsider", "root"} {
+			u, err := auth.NewUserLocal(ctx, name+"@example.com", tUser.Password, name, "Human", name == "root")
+			if err != nil {
+				t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+			}
+			users[name] = u
+		}
+		acme, err := auth.CreateOrganization(ctx, "Acme", users["owner"].ID)
+		if err != nil {
+			t.Fatalf("Expected to create an organization. Instead got the error: %v", err)
+		}
+		for _, name := range []string{"admin", "member"} {
+			inv, err := auth.InviteOrgMember(ctx, acme.ID, users["owner"].ID, users[name].Email, name)
+			if err != nil {
+				t.Fatalf("Expected to invite the %s. Instead got the error: %v", name, err)
+			}
+			n, _ := nonce.Get("auth.OrgInvite", inv.ID)
+			_, err = auth.AcceptOrgInvite(ctx, userToken(inv.ID, n.Token), users[name].ID)
+			if err != nil {
+				t.Fatalf("Expected the %s to join. Instead got the error: %v", name, err)
+			}
+		}
+		role := func(name string) string {
+			m, err := auth.GetMembership(ctx, acme.ID, users[name].ID)
+			if err != nil {
+				return ""
+			}
+			return m.Role
+		}
+
+		srv := httptest.NewTLSServer(httpHandler)
+		defer srv.Close()
+		browsers := map[string]*testBrowser{}
+		for name, u := range users {
+			browsers[name] = newTestBrowser(t, srv)
+			res, _ := browsers[name].post("/auth/login/", "/auth/login/", url.Values{"email": {u.Email}, "password": {tUser.Password}})
+			if res.StatusCode != 302 {
+				t.Fatalf("Expected the %s to log in. Instead got: %d", name, res.StatusCode)
+			}
+		}
+		orgPage := "/auth/orgs/" + acme.ID.String()
+		memberPath := func(name string) string { return orgPage + "/members/" + users[name].ID.String() }
+		post := func(name, path string, form url.Values) int {
+			page := orgPage
+			if name == "outsider" {
+				page = "/auth/orgs/"
+			}
+			res, _ := browsers[name].post(page, path, form)
+			return res.StatusCode
+		}
+
+		// the organization doesn't exist for someone who doesn't belong to it
+		res, _ := browsers["outsider"].get(orgPage)
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected a non-member to get 404. Instead got: %d", res.StatusCode)
+		}
+		if code := post("outsider", memberPath("member")+"/remove", url.Values{}); code != http.StatusNotFound || role("member") != OrgRoleMember {
+			t.Fatalf("Expected a non-member to get 404 removing a member. Instead got: %d", code)
+		}
+
+		// admins manage admins and members, but not owners
+		tests := []struct {
+			name, who, path string
+			form            url.Values
+			code            int
+		}{
+			{"admin invites an owner", "admin", orgPage + "/invites/", url.Values{"email": {"new@example.com"}, "role": {OrgRoleOwner}}, http.StatusForbidden},
+			{"admin promotes a member to owner", "admin", memberPath("member"), url.Values{"role": {OrgRoleOwner}}, http.StatusForbidden},
+			{"admin demotes the owner", "admin", memberPath("owner"), url.Values{"role": {OrgRoleMember}}, http.StatusForbidden},
+			{"admin removes the owner", "admin", memberPath("owner") + "/remove", url.Values{}, http.StatusForbidden},
+			{"admin renames the organization", "admin", orgPage, url.Values{"name": {"Renamed"}}, http.StatusForbidden},
+			{"member invites a member", "member", orgPage + "/invites/", url.Values{"email": {"new@example.com"}, "role": {OrgRoleMember}}, http.StatusForbidden},
+			{"member removes the admin", "member", memberPath("admin") + "/remove", url.Values{}, http.StatusForbidden},
+			{"member changes their own role", "member", memberPath("member"), url.Values{"role": {OrgRoleAdmin}}, http.StatusForbidden},
+			{"admin invites a member", "admin", orgPage + "/invites/", url.Values{"email": {"new@example.com"}, "role": {OrgRoleMember}}, 302},
+			{"admin promotes a member to admin", "admin", memberPath("member"), url.Values{"role": {OrgRoleAdmin}}, 302},
+			{"admin demotes an admin", "admin", memberPath("member"), url.Values{"role": {OrgRoleMember}}, 302},
+		}
+		for _, tc := range tests {
+			if code := post(tc.who, tc.path, tc.form); code != tc.code {
+				t.Fatalf("Expected %s to get %d. Instead got: %d", tc.name, tc.code, code)
+			}
+		}
+		if role("owner") != OrgRoleOwner || role("member") != OrgRoleMember {
+			t.Fatalf("Expected the refused changes not to be made. Instead the owner is %q and the member %q", role("owner"), role("member"))
+		}
+		invites, _ := auth.ListOrgInvites(ctx, acme.ID)
+		if len(invites) != 1 || invites[0].Role != OrgRoleMember {
+			t.Fatalf("Expected only the admin's invitation of a member. Instead got: %+v", invites)
+		}
+		if o, _ := auth.GetOrganization(ctx, acme.ID); o.Name != "Acme" {
+			t.Fatalf("Expected the organization not to be renamed. Instead got: %s", o.Name)
+		}
+
+		// superusers act as owners of every organization
+		res, _ = browsers["root"].get(orgPage)
+		if res.StatusCode != 200 {
+			t.Fatalf("Expected a superuser to see the organization. Instead got: %d", res.StatusCode)
+		}
+		if code := post("root", memberPath("admin"), url.Values{"role": {OrgRoleOwner}}); code != 302 || role("admin") != OrgRoleOwner {
+			t.Fatalf("Expected a superuser to make an owner. Instead got: %d %s", code, role("admin"))
+		}
+		if code := post("root", orgPage, url.Values{"name": {"Acme Corp"}}); code != 302 {
+			t.Fatalf("Expected a superuser to rename the organization. Instead got: %d", code)
+		}
+		if _, err := auth.GetMembership(ctx, acme.ID, users["root"].ID); err != ErrNotMember {
+			t.Fatalf("Expected the superuser not to become a member. Instead got: %v", err)
+		}
+
+		// members can only remove themselves
+		res, _ = browsers["member"].post(orgPage, memberPath("member")+"/remove", url.Values{})
+		if loc := res.Header.Get("Location"); loc != "/" || role("member") != "" {
+			t.Fatalf("Expected the member to leave. Instead got: %d %s", res.StatusCode, loc)
+		}
+
+		// Clean Up (removed the users and organization we just added)
+		tx := db.MustBegin()
+		for _, u := range users {
+			tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		}
+		tx.MustExec("DELETE FROM organization")
+		tx.MustExec("DELETE FROM org_membership")
+		tx.MustExec("DELETE FROM org_invite")
+		tx.MustExec("DELETE FROM login_history")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("UserInvites", func(t *testing.T) {
+		db.MustExec("DELETE FROM email_outbox")
+		mailer.Reset()
+
+		admin, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, true)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		acme, err := auth.CreateOrganization(ctx, "Acme", admin.ID)
+		if err != nil {
+			t.Fatalf("Expected to create an organization. Instead got the error: %v", err)
+		}
+		outbox.DispatchPending(ctx)
+		mailer.Reset()
+
+		_, err = auth.InviteUser(ctx, admin.Email, admin.ID, nil)
+		if err != ErrAlreadyExists {
+			t.Fatalf("Expected a user's address to return ErrAlreadyExists. Instead got: %v", err)
+		}
+		_, err = auth.InviteUser(ctx, "new@example.com", admin.ID, []Role{{OrgID: acme.ID, Name: "superhero"}})
+		if err != ErrInvalidRole {
+			t.Fatalf("Expected to get ErrInvalidRole. Instead got: %v", err)
+		}
+		_, err = auth.InviteUser(ctx, "new@example.com", admin.ID, []Role{{Name: OrgRoleAdmin}})
+		if err != ErrInvalidRole {
+			t.Fatalf("Expected an organization role without an organization to return ErrInvalidRole. Instead got: %v", err)
+		}
+		_, err = auth.InviteUser(ctx, "new@example.com", admin.ID, []Role{{OrgID: uuid.NewV4(), Name: OrgRoleAdmin}})
+		if err != ErrOrgNotFound {
+			t.Fatalf("Expected to get ErrOrgNotFound. Instead got: %v", err)
+		}
+
+		first, err := auth.InviteUser(ctx, "new@example.com", admin.ID, []Role{{OrgID: acme.ID, Name: OrgRoleMember}})
+		if err != nil {
+			t.Fatalf("Expected to invite a user. Instead got the error: %v", err)
+		}
+		firstNonce, _ := nonce.Get("auth.UserInvite", first.ID)
+		inv, err := auth.InviteUser(ctx, "new@example.com", admin.ID, []Role{{Name: RoleSuperuser}, {OrgID: acme.ID, Name: OrgRoleAdmin}})
+		if err != nil {
+			t.Fatalf("Expected to invite a user. Instead got the error: %v", err)
+		}
+		invites, err := auth.ListUserInvites(ctx, acme.ID)
+		if err != nil || len(invites) != 1 || !uuid.Equal(invites[0].ID, inv.ID) || len(invites[0].Roles) != 2 {
+			t.Fatalf("Expected the second invitation, with its roles, to replace the first. Instead got: %+v (error: %v)", invites, err)
+		}
+		if invites, _ := auth.ListUserInvites(ctx, uuid.NewV4()); len(invites) != 0 {
+			t.Fatalf("Expected no invitations for another organization. Instead got: %+v", invites)
+		}
+		n, _ := nonce.Get("auth.UserInvite", inv.ID)
+		token := userToken(inv.ID, n.Token)
+
+		outbox.DispatchPending(ctx)
+		msgs := mailer.Messages()
+		if len(msgs) != 2 || msgs[1].To != "new@example.com" {
+			t.Fatalf("Expected 2 invitations to be sent to new@example.com. Instead got: %+v", msgs)
+		}
+		if !strings.Contains(msgs[1].PlainText, BaseURL+"/invite/"+token) || !strings.Contains(msgs[1].PlainText, "join Acme as an admin") {
+			t.Fatalf("Expected the sign up link, organization and role. Instead got: %s", msgs[1].PlainText)
+		}
+		mailer.Reset()
+
+		// the replaced invitation can't be used; looking one up doesn't use it
+		_, err = auth.GetUserInvite(ctx, userToken(first.ID, firstNonce.Token))
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected the replaced invitation to return ErrInvalidToken. Instead got: %v", err)
+		}
+		got, err := auth.GetUserInvite(ctx, token)
+		if err != nil || got.Email != "new@example.com" {
+			t.Fatalf("Expected the invitation. Instead got: %+v (error: %v)", got, err)
+		}
+		_, err = auth.AcceptUserInvite(ctx, token, tUser.Password, "", "Human")
+		if err != ErrInvalidName {
+			t.Fatalf("Expected to get ErrInvalidName. Instead got: %v", err)
+		}
+
+		u, err := auth.AcceptUserInvite(ctx, token, tUser.Password, "New", "Human")
+		if err != nil {
+			t.Fatalf("Expected to accept the invitation. Instead got the error: %v", err)
+		}
+		if u.Email != "new@example.com" || !u.IsActive || !u.IsSuperuser {
+			t.Fatalf("Expected an active superuser with the invited address. Instead got: %+v", u)
+		}
+		m, err := auth.GetMembership(ctx, acme.ID, u.ID)
+		if err != nil || m.Role != OrgRoleAdmin {
+			t.Fatalf("Expected to join Acme as an admin. Instead got: %+v (error: %v)", m, err)
+		}
+		_, err = auth.AuthenticateUser(ctx, "new@example.com", tUser.Password)
+		if err != nil {
+			t.Fatalf("Expected to log in with the new password. Instead got the error: %v", err)
+		}
+		_, err = auth.AcceptUserInvite(ctx, token, tUser.Password, "New", "Human")
+		if err != ErrInvalidToken {
+			t.Fatalf("Expected an accepted invitation to return ErrInvalidToken. Instead got: %v", err)
+		}
+		if invites, _ := auth.ListUserInvites(ctx, uuid.Nil); len(invites) != 0 {
+			t.Fatalf("Expected no pending invitations. Instead got: %+v", invites)
+		}
+
+		// revoking
+		inv, err = auth.InviteUser(ctx, "later@example.com", admin.ID, nil)
+		if err != nil {
+			t.Fatalf("Expected to invite a user without roles. Instead got the error: %v", err)
+		}
+		err = auth.RevokeUserInvite(ctx, inv.ID)
+		if err != nil {
+			t.Fatalf("Expected to revoke the invitation. Instead got the error: %v", err)
+		}
+		err = auth.RevokeUserInvite(ctx, inv.ID)
+		if err != ErrInviteNotFound {
+			t.Fatalf("Expected to get ErrInviteNotFound. Instead got: %v", err)
+		}
+
+		// the retention job marks user and organization invitations that have expired
+		orig := UserInviteExpiry
+		UserInviteExpiry = -time.Minute
+		inv, err = auth.InviteUser(ctx, "expired@example.com", admin.ID, nil)
+		UserInviteExpiry = orig
+		if err != nil {
+			t.Fatalf("Expected to invite a user. Instead got the error: %v", err)
+		}
+		orgInv, err := auth.InviteOrgMember(ctx, acme.ID, admin.ID, "expired@example.com", OrgRoleMember)
+		if err != nil {
+			t.Fatalf("Expected to invite a member. Instead got the error: %v", err)
+		}
+		db.MustExec("UPDATE org_invite SET expires_at=? WHERE id=?", time.Now().Add(-time.Minute), orgInv.ID)
+		r, err := NewRetentionJob(auth, time.Hour).Run()
+		if err != nil || r.ExpiredInvites != 2 {
+			t.Fatalf("Expected 2 invitations to expire. Instead got: %+v (error: %v)", r, err)
+		}
+		status := ""
+		db.Get(&status, "SELECT status FROM user_invite WHERE id=?", inv.ID)
+		if status != InviteExpired {
+			t.Fatalf("Expected the invitation to be expired. Instead got: %s", status)
+		}
+		if n, _ := auth.ExpireInvites(ctx, time.Now()); n != 0 {
+			t.Fatalf("Expected nothing left to expire. Instead got: %d", n)
+		}
+
+		// Clean Up
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", admin.ID)
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM organization")
+		tx.MustExec("DELETE FROM org_membership")
+		tx.MustExec("DELETE FROM org_invite")
+		tx.MustExec("DELETE FROM user_invite")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("APIKeys", func(t *testing.T) {
+		u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+
+		_, _, err = auth.CreateAPIKey(ctx, u.ID, "  ", nil, time.Time{})
+		if err != ErrInvalidName {
+			t.Fatalf("Expected to get ErrInvalidName. Instead got: %v", err)
+		}
+		_, _, err = auth.CreateAPIKey(ctx, u.ID, "CI", []string{"read write"}, time.Time{})
+		if err != ErrInvalidScope {
+			t.Fatalf("Expected to get ErrInvalidScope. Instead got: %v", err)
+		}
+		APIKeyScopes = []string{"read", "write"}
+		_, _, err = auth.CreateAPIKey(ctx, u.ID, "CI", []string{"admin"}, time.Time{})
+		APIKeyScopes = nil
+		if err != ErrInvalidScope {
+			t.Fatalf("Expected a scope missing from APIKeyScopes to return ErrInvalidScope. Instead got: %v", err)
+		}
+
+		k, key, err := auth.CreateAPIKey(ctx, u.ID, " CI ", []string{"read", "read", "deploy"}, time.Time{})
+		if err != nil {
+			t.Fatalf("Expected to create an API key. Instead got the error: %v", err)
+		}
+		if k.Name != "CI" || len(k.Scopes) != 2 || !strings.HasPrefix(key, k.Prefix+"_") || !strings.HasPrefix(key, APIKeyPrefix) {
+			t.Fatalf("Expected a key starting with its prefix, a trimmed name and unique scopes. Instead got: %s %+v", key, k)
+		}
+		stored := ""
+		db.Get(&stored, "SELECT hash FROM api_key WHERE id=?", k.ID)
+		if stored == "" || strings.Contains(key, stored) || stored != hashAPIKeySecret(strings.TrimPrefix(key, k.Prefix+"_")) {
+			t.Fatalf("Expected only the hash of the secret to be stored. Instead got: %s", stored)
+		}
+
+		got, gotKey, err := auth.AuthenticateAPIKey(ctx, key)
+		if err != nil || !uuid.Equal(got.ID, u.ID) || !uuid.Equal(gotKey.ID, k.ID) || gotKey.LastUsedAt.IsZero() {
+			t.Fatalf("Expected the key's user and its use recorded. Instead got: %+v %+v (error: %v)", got, gotKey, err)
+		}
+		for _, bad := range []string{"", "nope", APIKeyPrefix, k.Prefix + "_", k.Prefix + "_" + strings.Repeat("A", 43), key + "x"} {
+			_, _, err = auth.AuthenticateAPIKey(ctx, bad)
+			if err != ErrInvalidAPIKey {
+				t.Fatalf("Expected %q to return ErrInvalidAPIKey. Instead got: %v", bad, err)
+			}
+		}
+		keys, err := auth.ListAPIKeys(ctx, u.ID)
+		if err != nil || len(keys) != 1 || keys[0].LastUsedAt.IsZero() {
+			t.Fatalf("Expected the key to be listed as used. Instead got: %+v (error: %v)", keys, err)
+		}
+
+		// the middleware authenticates either header into the auth context
+		var seen APIKey
+		handler := APIKeyMiddleware(auth)(RequireScope("deploy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen, _ = RequestAPIKey(r)
+			ctx, _ := getAuthCtx(r)
+			w.Write([]byte(ctx.User.Email))
+		})))
+		for _, header := range [][2]string{{"Authorization", "Bearer " + key}, {APIKeyHeader, key}} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(header[0], header[1])
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != 200 || rec.Body.String() != u.Email || !uuid.Equal(seen.ID, k.ID) {
+				t.Fatalf("Expected %s to authenticate as the user. Instead got: %d %s", header[0], rec.Code, rec.Body.String())
+			}
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected a request without a key or session to get 401. Instead got: %d", rec.Code)
+		}
+		limited, limitedKey, err := auth.CreateAPIKey(ctx, u.ID, "read only", []string{"read"}, time.Time{})
+		if err != nil {
+			t.Fatalf("Expected to create an API key. Instead got the error: %v", err)
+		}
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(APIKeyHeader, limitedKey)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("Expected a key without the scope to get 403. Instead got: %d", rec.Code)
+		}
+
+		// a key can't act as its user on the built-in pages, even a superuser's key
+		u.IsSuperuser = true
+		u, err = auth.UpdateUser(ctx, u)
+		if err != nil {
+			t.Fatalf("Expected to make the user a superuser. Instead got the error: %v", err)
+		}
+		srv := httptest.NewTLSServer(APIKeyMiddleware(auth)(httpHandler))
+		defer srv.Close()
+		browser := newTestBrowser(t, srv)
+		for _, path := range []string{"/auth/admin/users/", "/auth/api-keys/"} {
+			res, _ := browser.get(path, "Authorization", "Bearer "+key)
+			if res.StatusCode != http.StatusForbidden {
+				t.Fatalf("Expected %s to reject the key. Instead got: %d", path, res.StatusCode)
+			}
+		}
+
+		// revoked and expired keys stop working
+		err = auth.RevokeAPIKey(ctx, uuid.NewV4(), limited.ID)
+		if err != ErrAPIKeyNotFound {
+			t.Fatalf("Expected another user's key to return ErrAPIKeyNotFound. Instead got: %v", err)
+		}
+		err = auth.RevokeAPIKey(ctx, u.ID, limited.ID)
+		if err != nil {
+			t.Fatalf("Expected to revoke the key. Instead got the error: %v", err)
+		}
+		_, _, err = auth.AuthenticateAPIKey(ctx, limitedKey)
+		if err != ErrInvalidAPIKey {
+			t.Fatalf("Expected a revoked key to return ErrInvalidAPIKey. Instead got: %v", err)
+		}
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+limitedKey)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("Expected a revoked key to get 401. Instead got: %d", rec.Code)
+		}
+		_, expiredKey, err := auth.CreateAPIKey(ctx, u.ID, "old", nil, time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatalf("Expected to create an API key. Instead got the error: %v", err)
+		}
+		_, _, err = auth.AuthenticateAPIKey(ctx, expiredKey)
+		if err != ErrInvalidAPIKey {
+			t.Fatalf("Expected an expired key to return ErrInvalidAPIKey. Instead got: %v", err)
+		}
+		keys, _ = auth.ListAPIKeys(ctx, u.ID)
+		if len(keys) != 2 {
+			t.Fatalf("Expected the revoked key not to be listed. Instead got: %+v", keys)
+		}
+
+		// keys stop working while their user is deactivated
+		u.IsActive = false
+		_, err = auth.UpdateUser(ctx, u)
+		if err != nil {
+			t.Fatalf("Expected to deactivate the user. Instead got the error: %v", err)
+		}
+		_, _, err = auth.AuthenticateAPIKey(ctx, key)
+		if err != ErrUserInactive {
+			t.Fatalf("Expected to get ErrUserInactive. Instead got: %v", err)
+		}
+
+		// Clean Up
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM api_key")
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("Logging", func(t *testing.T) {
+		capture := &captureLogger{}
+		Log = capture
+		defer func() { Log = NewGlogLogger() }()
+		AuditSinks = []AuditSink{AuditSinkFunc(func(e AuditEvent) error { return errors.New("sink down") })}
+		defer func() { AuditSinks = nil }()
+
+		reqCtx := ContextWithLogFields(ctx, Fields{"request_id": "req-1"})
+		u, err := auth.NewUserLocal(reqCtx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		e, ok := capture.find("Error writing audit event to sink")
+		if !ok || e.level != LevelError {
+			t.Fatalf("Expected the failing sink to be logged. Instead got: %+v", capture.entries)
+		}
+		if e.fields["request_id"] != "req-1" || e.fields["operation"] != "auth.NewUserLocal" || e.fields["error"] != "sink down" {
+			t.Fatalf("Expected the request ID, operation and error to be logged. Instead got: %v", e.fields)
+		}
+
+		// Clean Up
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM user WHERE id=?", u.ID)
+		tx.MustExec("DELETE FROM audit_event")
+		tx.MustExec("DELETE FROM email_outbox")
+		tx.Commit()
+	})
+
+	t.Run("NewServiceInvalidTemplate", func(t *testing.T) {
+		orig := EmailTextTemplates["auth.NewUserEmail"]
+		EmailTextTemplates["auth.NewUserEmail"] = "Hi {{.User.FirstName"
+		defer func() { EmailTextTemplates["auth.NewUserEmail"] = orig }()
+
+		_, err := NewService(db, outbox, nonce, tmpl.NewTplSys(""))
+		if err == nil {
+			t.Fatalf("Expected an error for the invalid template")
+		}
+	})
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		// fixture is a user who was issued every kind of token while still active
+		type fixture struct {
+			u            User
+			a            *softAuthenticator
+			resetToken   string
+			magicToken   string
+			confirmToken string
+			cancelToken  string
+			exportToken  string
+			reportToken  string
+			creation     WebAuthnCreationOptions
+		}
+		states := []string{"active", "inactive", "deleted"}
+		setUp := func(t *testing.T, state string) fixture {
+			u, err := auth.NewUserLocal(ctx, tUser.Email, tUser.Password, tUser.FirstName, tUser.LastName, tUser.IsSuperuser)
+			if err != nil {
+				t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+			}
+			f := fixture{a: newSoftAuthenticator(t)}
+			creation, err := auth.BeginWebAuthnRegistration(ctx, u.ID)
+			if err != nil {
+				t.Fatalf("Expected to Begin WebAuthn Registration. Instead got: %v", err)
+			}
+			_, err = auth.FinishWebAuthnRegistration(ctx, u.ID, f.a.create(t, creation))
+			if err != nil {
+				t.Fatalf("Expected to Finish WebAuthn Registration. Instead got: %v", err)
+			}
+			f.creation, _ = auth.BeginWebAuthnRegistration(ctx, u.ID)
+			auth.BeginPasswordReset(ctx, u.Email)
+			auth.BeginMagicLogin(ctx, u.Email)
+			auth.BeginEmailChange(ctx, u.ID, "new@example.com")
+			auth.BeginDataExport(ctx, u.ID)
+			auth.WithAuditInfo(AuditInfo{IP: "192.0.2.1"}).AuthenticateUser(ctx, u.Email, tUser.Password)
+			auth.WithAuditInfo(AuditInfo{IP: "198.51.100.1"}).AuthenticateUser(ctx, u.Email, tUser.Password)
+			reset, _ := nonce.Get("auth.PasswordReset", u.ID)
+			magic, _ := nonce.Get("auth.MagicLogin", u.ID)
+			confirm, _ := nonce.Get("auth.EmailChange", u.ID)
+			cancel, _ := nonce.Get("auth.EmailChangeCancel", u.ID)
+			export, _ := nonce.Get("auth.DataExport", u.ID)
+			report, _ := nonce.Get("auth.LoginAlert", u.ID)
+			f.resetToken = reset.Token
+			f.magicToken = userToken(u.ID, magic.Token)
+			f.confirmToken = userToken(u.ID, confirm.Token)
+			f.cancelToken = userToken(u.ID, cancel.Token)
+			f.exportToken = userToken(u.ID, export.Token)
+			f.reportToken = userToken(u.ID, report.Token)
+
+			switch state {
+			case "inactive":
+				u.IsActive = false
+				_, err = auth.UpdateUser(ctx, u)
+			case "deleted":
+				_, err = auth.DeleteUser(ctx, u.ID)
+			}
+			if err != nil {
+				t.Fatalf("Expected user to become %s. Instead got the error: %v", state, err)
+			}
+			f.u, _ = auth.GetUser(ctx, u.ID)
+			return f
+		}
+		tearDown := func(f fixture) {
+			tx := db.MustBegin()
+			tx.MustExec("DELETE FROM user WHERE id=?", f.u.ID)
+			tx.MustExec("DELETE FROM webauthn_credential")
+			tx.MustExec("DELETE FROM email_change")
+			tx.MustExec("DELETE FROM user_export")
+			tx.MustExec("DELETE FROM audit_event")
+			tx.MustExec("DELETE FROM login_history")
+			tx.MustExec("DELETE FROM email_outbox")
+			tx.Commit()
+		}
+
+		tests := []struct {
+			method string
+			fn     func(f fixture) error
+			// want holds the error expected for an active, inactive and deleted user
+			want [3]error
+		}{
+			{"NewUserLocal", func(f fixture) error {
+				_, err := auth.NewUserLocal(ctx, strings.ToUpper(tUser.Email), tUser.Password, tUser.FirstName, tUser.LastName, false)
+				return err
+			}, [3]error{ErrAlreadyExists, ErrAlreadyExists, ErrUserDeleted}},
+			{"GetUser", func(f fixture) error {
+				_, err := auth.GetUser(ctx, f.u.ID)
+				return err
+			}, [3]error{nil, nil, nil}},
+			{"ListUsers", func(f fixture) error {
+				l, err := auth.ListUsers(ctx, UserQuery{IncludeDeleted: true})
+				if err == nil && l.Total != 1 {
+					return fmt.Errorf("listed %d users", l.Total)
+				}
+				return err
+			}, [3]error{nil, nil, nil}},
+			{"UpdateUser", func(f fixture) error {
+				f.u.FirstName = "Changed"
+				_, err := auth.UpdateUser(ctx, f.u)
+				return err
+			}, [3]error{nil, nil, ErrUserDeleted}},
+			{"DeleteUser", func(f fixture) error {
+				_, err := auth.DeleteUser(ctx, f.u.ID)
+				return err
+			}, [3]error{nil, nil, ErrUserDeleted}},
+			{"RestoreUser", func(f fixture) error {
+				_, err := auth.RestoreUser(ctx, f.u.ID)
+				return err
+			}, [3]error{nil, nil, nil}},
+			{"PurgeUser", func(f fixture) error {
+				_, err := auth.PurgeUser(ctx, f.u.ID)
+				return err
+			}, [3]error{ErrUserNotDeleted, ErrUserNotDeleted, nil}},
+			{"RevokeSessions", func(f fixture) error {
+				_, err := auth.RevokeSessions(ctx, f.u.ID)
+				return err
+			}, [3]error{nil, nil, nil}},
+			{"AuthenticateUser", func(f fixture) error {
+				_, err := auth.AuthenticateUser(ctx, tUser.Email, tUser.Password)
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"AuthenticateUserWrongPassword", func(f fixture) error {
+				_, err := auth.AuthenticateUser(ctx, tUser.Email, "WrongPassword")
+				return err
+			}, [3]error{ErrIncorrectAuth, ErrIncorrectAuth, ErrIncorrectAuth}},
+			{"ListLoginHistory", func(f fixture) error {
+				l, err := auth.ListLoginHistory(ctx, f.u.ID, 0)
+				if err == nil && len(l) != 2 {
+					return fmt.Errorf("listed %d logins", len(l))
+				}
+				return err
+			}, [3]error{nil, nil, nil}},
+			{"ReportLogin", func(f fixture) error {
+				_, err := auth.ReportLogin(ctx, f.reportToken)
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"BeginPasswordReset", func(f fixture) error {
+				return auth.BeginPasswordReset(ctx, tUser.Email)
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"CompletePasswordReset", func(f fixture) error {
+				_, err := auth.CompletePasswordReset(ctx, f.resetToken, tUser.Email, "NewTestPassword")
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"BeginMagicLogin", func(f fixture) error {
+				return auth.BeginMagicLogin(ctx, tUser.Email)
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"CompleteMagicLogin", func(f fixture) error {
+				_, err := auth.CompleteMagicLogin(ctx, f.magicToken)
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"BeginEmailChange", func(f fixture) error {
+				return auth.BeginEmailChange(ctx, f.u.ID, "newer@example.com")
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"CompleteEmailChange", func(f fixture) error {
+				_, err := auth.CompleteEmailChange(ctx, f.confirmToken)
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"CancelEmailChange", func(f fixture) error {
+				_, err := auth.CancelEmailChange(ctx, f.cancelToken)
+				return err
+			}, [3]error{nil, nil, ErrUserDeleted}},
+			{"ExportUserData", func(f fixture) error {
+				_, err := auth.ExportUserData(ctx, f.u.ID)
+				return err
+			}, [3]error{nil, nil, nil}},
+			{"BeginDataExport", func(f fixture) error {
+				return auth.BeginDataExport(ctx, f.u.ID)
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"CompleteDataExport", func(f fixture) error {
+				_, err := auth.CompleteDataExport(ctx, f.exportToken)
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"BeginWebAuthnRegistration", func(f fixture) error {
+				_, err := auth.BeginWebAuthnRegistration(ctx, f.u.ID)
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"FinishWebAuthnRegistration", func(f fixture) error {
+				_, err := auth.FinishWebAuthnRegistration(ctx, f.u.ID, newSoftAuthenticator(t).create(t, f.creation))
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"BeginWebAuthnLogin", func(f fixture) error {
+				_, err := auth.BeginWebAuthnLogin(ctx, tUser.Email)
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"FinishWebAuthnLogin", func(f fixture) error {
+				// a discoverable login is not tied to a user until the passkey answers
+				request, err := auth.BeginWebAuthnLogin(ctx, "")
+				if err != nil {
+					return err
+				}
+				_, err = auth.FinishWebAuthnLogin(ctx, f.a.get(t, request))
+				return err
+			}, [3]error{nil, ErrUserInactive, ErrUserDeleted}},
+			{"ListWebAuthnCredentials", func(f fixture) error {
+				creds, err := auth.ListWebAuthnCredentials(ctx, f.u.ID)
+				if err == nil && len(creds) != 1 {
+					return fmt.Errorf("listed %d passkeys", len(creds))
+				}
+				return err
+			}, [3]error{nil, nil, nil}},
+			{"DeleteWebAuthnCredential", func(f fixture) error {
+				creds, _ := auth.ListWebAuthnCredentials(ctx, f.u.ID)
+				return auth.DeleteWebAuthnCredential(ctx, f.u.ID, creds[0].ID)
+			}, [3]error{nil, nil, nil}},
+		}
+		for _, tc := range tests {
+			for i, state := range states {
+				f := setUp(t, state)
+				err := tc.fn(f)
+				if err != tc.want[i] {
+					t.Errorf("Expected %s on a %s user to return %v. Instead got: %v", tc.method, state, tc.want[i], err)
+				}
+				tearDown(f)
+			}
+		}
+
+		// ReuseDeletedEmails releases a deleted user's address, which then blocks restoring them
+		ReuseDeletedEmails = true
+		defer func() { ReuseDeletedEmails = false }()
+		f := setUp(t, "deleted")
+		u, err := auth.NewUserLocal(ctx, strings.ToUpper(tUser.Email), tUser.Password, tUser.FirstName, tUser.LastName, false)
+		if err != nil {
+			t.Fatalf("Expected to reuse a deleted user's email. Instead got the error: %v", err)
+		}
+		u2, err := auth.AuthenticateUser(ctx, tUser.Email, tUser.Password)
+		if err != nil || !uuid.Equal(u2.ID, u.ID) {
+			t.Fatalf("Expected to authenticate as the new user %s. Instead got: %s (error: %v)", u.ID, u2.ID, err)
+		}
+		_, err = auth.RestoreUser(ctx, f.u.ID)
+		if err != ErrAlreadyExists {
+			t.Fatalf("Expected to get ErrAlreadyExists. Instead got: %v", err)
+		}
+
+		// purging the deleted user leaves the email and invitations of the address's new owner alone
+		owner, err := auth.NewUserLocal(ctx, "owner@example.com", tUser.Password, tUser.FirstName, tUser.LastName, false)
+		if err != nil {
+			t.Fatalf("Expected to add user to DB. Instead got the error: %v", err)
+		}
+		o, err := auth.CreateOrganization(ctx, "Acme", owner.ID)
+		if err != nil {
+			t.Fatalf("Expected to create an organization. Instead got the error: %v", err)
+		}
+		_, err = auth.InviteOrgMember(ctx, o.ID, owner.ID, tUser.Email, OrgRoleMember)
+		if err != nil {
+			t.Fatalf("Expected to invite the new user. Instead got the error: %v", err)
+		}
+		db.MustExec("DELETE FROM email_outbox")
+		err = auth.BeginMagicLogin(ctx, tUser.Email)
+		if err != nil {
+			t.Fatalf("Expected to Begin Magic Login for the new user. Instead got: %v", err)
+		}
+		r, err := auth.PurgeUser(ctx, f.u.ID)
+		if err != nil {
+			t.Fatalf("Expected to purge the deleted user. Instead got the error: %v", err)
+		}
+		var emails, invites int
+		db.Get(&emails, "SELECT COUNT(*) FROM email_outbox WHERE to_addr=?", u.Email)
+		db.Get(&invites, "SELECT COUNT(*) FROM org_invite WHERE email=?", tUser.Email)
+		if emails != 1 || invites != 1 || r.Emails != 0 || r.OrgInvites != 0 {
+			t.Fatalf("Expected the new user's email and invitation to be kept. Instead %d emails and %d invitations are left (report: %+v)", emails, invites, r)
+		}
+
+		// Clean Up (removed the users and organization we just added)
+		tearDown(f)
+		tearDown(fixture{u: u})
+		tearDown(fixture{u: owner})
+		tx := db.MustBegin()
+		tx.MustExec("DELETE FROM organization")
+		tx.MustExec("DELETE FROM org_membership")
+		tx.MustExec("DELETE FROM org_invite")
+		tx.Commit()
+	})
+
+	// Drop the Table(s) we created
+	// Close the DB
+	db.MustExec("drop table user;")
+	db.MustExec("drop table email_outbox;")
+	db.MustExec("drop table webauthn_credential;")
+	db.MustExec("drop table email_change;")
+	db.MustExec("drop table user_provider;")
+	db.MustExec("drop table user_export;")
+	db.MustExec("drop table audit_event;")
+	db.MustExec("drop table login_history;")
+	db.MustExec("drop table webhook_endpoint;")
+	db.MustExec("drop table webhook_delivery;")
+	db.MustExec("drop table organization;")
+	db.MustExec("drop table org_membership;")
+	db.MustExec("drop table org_invite;")
+	db.MustExec("drop table user_invite;")
+	db.MustExec("drop table api_key;")
+	db.Close()
+	err = os.Remove(dbFile)
+	if err != nil {
+		t.Fatalf("Expected to remove dbFile: %s. Instead got the error: %v", dbFile, err)
+	}
+}
+
+// testBrowser sends requests to an HTTP handler made by MakeHTTPHandler, keeping its cookies like a browser
+type testBrowser struct {
+	t      *testing.T
+	srv    *httptest.Server
+	client *http.Client
+}
+
+// newTestBrowser starts a browser with no cookies. The server is TLS as the CSRF cookie is secure.
+func newTestBrowser(t *testing.T, srv *httptest.Server) *testBrowser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("Expected to create a cookie jar. Instead got the error: %v", err)
+	}
+	client := *srv.Client()
+	client.Jar = jar
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &testBrowser{t: t, srv: srv, client: &client}
+}
+
+// do sends the request and returns the response with its body read
+func (b *testBrowser) do(req *http.Request) (*http.Response, string) {
+	req.Header.Set("Referer", b.srv.URL+"/")
+	res, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatalf("Expected %s %s to succeed. Instead got the error: %v", req.Method, req.URL.Path, err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res, string(body)
+}
+
+// get requests path. header is pairs of names and values.
+func (b *testBrowser) get(path string, header ...string) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", b.srv.URL+path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return b.do(req)
+}
+
+// post submits form to path with the CSRF token from page
+func (b *testBrowser) post(page, path string, form url.Values) (*http.Response, string) {
+	form.Set("gorilla.csrf.Token", b.csrfToken(page))
+	req, _ := http.NewRequest("POST", b.srv.URL+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(req)
+}
+
+// postJSON sends v as JSON to path with the CSRF token from page, like the passkey script does, and decodes the response into out
+func (b *testBrowser) postJSON(page, path string, v, out interface{}) *http.Response {
+	body, _ := json.Marshal(v)
+	req, _ := http.NewRequest("POST", b.srv.URL+path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", b.csrfToken(page))
+	res, resBody := b.do(req)
+	json.Unmarshal([]byte(resBody), out)
+	return res
+}
+
+// csrfToken returns the CSRF token of the form or passkey button on page
+func (b *testBrowser) csrfToken(page string) string {
+	_, body := b.get(page)
+	m := csrfTokenPattern.FindStringSubmatch(body)
+	if m == nil {
+		b.t.Fatalf("Expected a CSRF token on %s. Instead got: %s", page, body)
+	}
+	return html.UnescapeString(m[1])
+}
+
+var csrfTokenPattern = regexp.MustCompile(`(?:name="gorilla.csrf.Token" value|data-csrf)="([^"]+)"`)
+
+func init() {
 	tUser = User{
-		Email:       EMAILTO,
+		Email:       "test@example.com",
 		Password:    "password",
 		FirstName:   "Test",
 		LastName:    "Human",
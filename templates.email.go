@@ -1,29 +1,301 @@
 package auth
 
-import "github.com/bryanjeal/go-tmpl"
+import (
+	"time"
+
+	"github.com/bryanjeal/go-tmpl"
+)
+
+// AppName is the name of the application used in emails. It can/should be set by applications using auth.
+var AppName = "Our Service"
+
+// BaseURL is the absolute URL of the auth HTTP handler (including its prefix) used to build links in emails.
+// It can/should be set by applications using auth.
+var BaseURL = "https://www.example.com/auth"
+
+// PasswordResetExpiry is how long a password reset link is valid for
+var PasswordResetExpiry = 3 * time.Hour
+
+// MagicLoginExpiry is how long a magic login link is valid for
+var MagicLoginExpiry = 15 * time.Minute
+
+// EmailChangeExpiry is how long the link confirming a new email address is valid for
+var EmailChangeExpiry = 24 * time.Hour
+
+// EmailChangeCancelExpiry is how long the link sent to the old email address can cancel or revert the change
+var EmailChangeCancelExpiry = 7 * 24 * time.Hour
+
+// DataExportExpiry is how long the download link for a personal data export works
+var DataExportExpiry = 24 * time.Hour
+
+// LoginAlertExpiry is how long the "this wasn't me" link in a login alert works
+var LoginAlertExpiry = 7 * 24 * time.Hour
+
+// OrgInviteExpiry is how long the link in an organization invitation works
+var OrgInviteExpiry = 7 * 24 * time.Hour
+
+// UserInviteExpiry is how long the sign up link in a user invitation works
+var UserInviteExpiry = 7 * 24 * time.Hour
+
+// EmailData is passed to both the HTML and plain-text template of every email
+type EmailData struct {
+	User    User
+	AppName string
+	// Locale is the locale the email is rendered in. See ResolveLocale.
+	Locale string
+	// Link is the action link for the email (i.e. the password reset page). It is empty if the email has no link.
+	Link string
+	// Token is the token contained in Link
+	Token string
+	// ExpiresAt is when Link stops working. It is the zero time if the email has no link.
+	ExpiresAt time.Time
+	// NewEmail is the address an email change moves the user to
+	NewEmail string
+	// Login is the login a LoginAlertEmail is about
+	Login LoginRecord
+	// Organization, Inviter and Role describe the invitation an OrgInviteEmail or UserInviteEmail is for.
+	// Organization is the zero Organization when a UserInviteEmail is not for one.
+	// User is the zero User, apart from Email, when the address has no account yet.
+	Organization Organization
+	Inviter      User
+	Role         string
+}
+
+// T translates key into the email's locale. Templates call it as {{.T "key" args...}}.
+func (d EmailData) T(key string, args ...interface{}) string {
+	return T(d.Locale, key, args...)
+}
 
 // NewUserEmail can/should be set by applications using auth.
+// The HTML body is rendered from EmailHTMLTemplates[TplName] and the plain-text body from EmailTextTemplates[TplName].
+// PlainText is only used (as a text/template) when EmailTextTemplates has no entry for TplName.
 var NewUserEmail = tmpl.EmailMessage{
-	From:      "from@example.com",
-	Subject:   "Welcome New User",
-	PlainText: "Welcome to our service. Thank you for signing up.",
-	TplName:   "auth.NewUserEmail",
+	From:    "from@example.com",
+	Subject: "Welcome New User",
+	TplName: "auth.NewUserEmail",
 }
 
 // PasswordResetEmail can/should be set by applications using auth.
 var PasswordResetEmail = tmpl.EmailMessage{
-	From:      "from@example.com",
-	Subject:   "Password Reset",
-	PlainText: "Forgot your password? No problem! To reset your password, visit the following link: https://www.example.com/auth/password-reset/%recipient.token% If you did not request to have your password reset you can safely ignore this email. Rest assured your customer account is safe.",
-	TplName:   "auth.PasswordResetEmail",
+	From:    "from@example.com",
+	Subject: "Password Reset",
+	TplName: "auth.PasswordResetEmail",
+}
+
+// MagicLoginEmail can/should be set by applications using auth.
+var MagicLoginEmail = tmpl.EmailMessage{
+	From:    "from@example.com",
+	Subject: "Your Login Link",
+	TplName: "auth.MagicLoginEmail",
 }
 
 // PasswordResetConfirmEmail can/should be set by applications using auth.
 var PasswordResetConfirmEmail = tmpl.EmailMessage{
-	From:      "from@example.com",
-	Subject:   "Password Reset Confirmation",
-	PlainText: "Your account's password was recently changed.",
-	TplName:   "auth.PasswordResetConfirmEmail",
+	From:    "from@example.com",
+	Subject: "Password Reset Confirmation",
+	TplName: "auth.PasswordResetConfirmEmail",
+}
+
+// EmailChangeConfirmEmail can/should be set by applications using auth.
+// It is sent to the new address with the link that completes the change.
+var EmailChangeConfirmEmail = tmpl.EmailMessage{
+	From:    "from@example.com",
+	Subject: "Confirm Your New Email Address",
+	TplName: "auth.EmailChangeConfirmEmail",
+}
+
+// EmailChangeNoticeEmail can/should be set by applications using auth.
+// It is sent to the old address with the link that cancels the change.
+var EmailChangeNoticeEmail = tmpl.EmailMessage{
+	From:    "from@example.com",
+	Subject: "Your Email Address Is Changing",
+	TplName: "auth.EmailChangeNoticeEmail",
 }
 
-const baseHTMLEmailTemplate string = `<!DOCTYPE html><html lang="en"> <head> <meta charset="utf-8"/> <title>{{block "title" .}}Default Title{{end}}</title> <style type="text/css"> /*<![CDATA[*/ /* Prevent Webkit and Windows Mobile platforms from changing default font sizes, while not breaking desktop design. */ body{width: 100% !important; -webkit-text-size-adjust: 100%; -ms-text-size-adjust: 100%; margin:0; padding:0;}/* Reset Styles */ body{margin: 0; padding: 0; font-family: "Helvetica Neue", Helvetica, Arial, sans-serif;}img{border: 0; line-height: 100%; outline: none; text-decoration: none;}table td{border-collapse: collapse;}#backgroundTable{height: 100% !important; margin: 0; padding: 0; width: 100% !important;}.content p{margin:0;padding:1em 0 0 0;line-height:1.5em;font-family: "Helvetica Neue", Helvetica, Arial, sans-serif;font-size:14px;color:#000;}/*]]>*/ </style> </head> <body leftmargin="0" marginwidth="0" topmargin="0" marginheight="0" offset="0" style="background-color: #EEEEEE;"> <center> <table id="backgroundTable" height="100%" width="100%" border="0" cellpadding="0" cellspacing="0" style="background-color: #EEEEEE;"> <tr> <td align="center" valign="top" width="60"> &nbsp; </td><td align="center" valign="top"> <table width="100%" height="60" border="0" cellpadding="0" cellspacing="0"> <tr> <td height="60"> &nbsp; </td></tr></table> <table id="templateContainer" width="640" border="0" cellpadding="0" cellspacing="0"> <tr> <td id="header" align="center" valign="top" style="background-color: #FFFFFF; border-top-right-radius: 10px; border-top-left-radius: 10px;"> <table id="header-outer" border="0" cellpadding="0" cellspacing="0"> <tr> <td width="50" height="50"> &nbsp; </td></tr></table> <table id="header-inner" border="0" cellpadding="0" cellspacing="0" style="background-color: #FFFFFF;"> <tr> <td width="50" height="55"> &nbsp; </td><td width="540" height="55">{{block "logo" .}}<img src="https://www.google.com/logos/doodles/2016/lantern-festival-2016-hk-6238324839677952-hp2x.jpg" height="52" style="height: 52px;"/>{{end}}</td><td width="50" height="55"> &nbsp; </td></tr><tr> <td width="640" height="20" colspan="3"> &nbsp; </td></tr></table> </td></tr><tr> <td align="center" valign="top"> <table id="body" border="0" cellpadding="0" cellspacing="0" style="background-color: #FFFFFF;"> <tr> <td width="50"> &nbsp; </td><td class="content" width="540" valign="top" style="text-align: left;">{{block "content" .}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> Hello %recipient.firstname% %recipient.lastname%, <br/> <br/> This is a test message. <br/> <br/> </p>{{end}}</td><td width="50"> &nbsp; </td></tr></table> </td></tr><tr> <td id="footer" align="center" valign="top" style="background-color: #FFFFFF; border-bottom-right-radius: 10px; border-bottom-left-radius: 10px;"> <table id="footer-inner" border="0" cellpadding="0" cellspacing="0"> <tr> <td width="50" height="50"> &nbsp; </td></tr></table> </td></tr><tr> <td width="50" height="50"> &nbsp; </td></tr></table> </td><td align="center" valign="top" width="60"> &nbsp; </td></tr></table> </center> </body></html>`
+// DataExportEmail can/should be set by applications using auth.
+// It is sent with the link that downloads the user's personal data export.
+var DataExportEmail = tmpl.EmailMessage{
+	From:    "from@example.com",
+	Subject: "Your Data Export Is Ready",
+	TplName: "auth.DataExportEmail",
+}
+
+// LoginAlertEmail can/should be set by applications using auth.
+// It is sent when the user logs in from a new device or network, with a link to report the login.
+var LoginAlertEmail = tmpl.EmailMessage{
+	From:    "from@example.com",
+	Subject: "New Login to Your Account",
+	TplName: "auth.LoginAlertEmail",
+}
+
+// OrgInviteEmail can/should be set by applications using auth.
+// It is sent to the address invited to join an organization, with the link that accepts the invitation.
+var OrgInviteEmail = tmpl.EmailMessage{
+	From:    "from@example.com",
+	Subject: "You Have Been Invited to Join an Organization",
+	TplName: "auth.OrgInviteEmail",
+}
+
+// UserInviteEmail can/should be set by applications using auth.
+// It is sent to the address invited to sign up by InviteUser, with the link to the sign up page.
+var UserInviteEmail = tmpl.EmailMessage{
+	From:    "from@example.com",
+	Subject: "You Have Been Invited",
+	TplName: "auth.UserInviteEmail",
+}
+
+// EmailHTMLTemplates can/should be set by applications using auth.
+// Each template is added on top of "auth.baseHTMLEmailTemplate" and is executed with EmailData.
+// Entries can be replaced individually before calling NewService.
+var EmailHTMLTemplates = map[string]string{
+	"auth.NewUserEmail":              newUserEmailTemplate,
+	"auth.PasswordResetEmail":        passwordResetEmailTemplate,
+	"auth.PasswordResetConfirmEmail": passwordResetConfirmEmailTemplate,
+	"auth.MagicLoginEmail":           magicLoginEmailTemplate,
+	"auth.EmailChangeConfirmEmail":   emailChangeConfirmEmailTemplate,
+	"auth.EmailChangeNoticeEmail":    emailChangeNoticeEmailTemplate,
+	"auth.DataExportEmail":           dataExportEmailTemplate,
+	"auth.LoginAlertEmail":           loginAlertEmailTemplate,
+	"auth.OrgInviteEmail":            orgInviteEmailTemplate,
+	"auth.UserInviteEmail":           userInviteEmailTemplate,
+}
+
+// EmailTextTemplates can/should be set by applications using auth.
+// They are text/templates executed with the same EmailData as the matching HTML template.
+// Entries can be replaced individually before calling NewService.
+var EmailTextTemplates = map[string]string{
+	"auth.NewUserEmail":              newUserTextTemplate,
+	"auth.PasswordResetEmail":        passwordResetTextTemplate,
+	"auth.PasswordResetConfirmEmail": passwordResetConfirmTextTemplate,
+	"auth.MagicLoginEmail":           magicLoginTextTemplate,
+	"auth.EmailChangeConfirmEmail":   emailChangeConfirmTextTemplate,
+	"auth.EmailChangeNoticeEmail":    emailChangeNoticeTextTemplate,
+	"auth.DataExportEmail":           dataExportTextTemplate,
+	"auth.LoginAlertEmail":           loginAlertTextTemplate,
+	"auth.OrgInviteEmail":            orgInviteTextTemplate,
+	"auth.UserInviteEmail":           userInviteTextTemplate,
+}
+
+const newUserEmailTemplate string = `{{define "title"}}{{.T "auth.NewUserEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.NewUserEmail.body" .AppName}}<br/> <br/> </p>{{end}}`
+
+const passwordResetEmailTemplate string = `{{define "title"}}{{.T "auth.PasswordResetEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.PasswordResetEmail.intro"}} <br/> <br/> {{.T "auth.PasswordResetEmail.action"}} <br/> <a href="{{.Link}}">{{.T "auth.PasswordResetEmail.link"}}</a> <br/> <br/> {{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} <br/> <br/> {{.T "auth.PasswordResetEmail.ignore"}} <br/> <br/> </p>{{end}}`
+
+const passwordResetConfirmEmailTemplate string = `{{define "title"}}{{.T "auth.PasswordResetConfirmEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.PasswordResetConfirmEmail.body" .AppName}} <br/> <br/> </p>{{end}}`
+
+const magicLoginEmailTemplate string = `{{define "title"}}{{.T "auth.MagicLoginEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.MagicLoginEmail.action" .AppName}} <br/> <a href="{{.Link}}">{{.T "auth.MagicLoginEmail.link"}}</a> <br/> <br/> {{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} {{.T "auth.MagicLoginEmail.once"}} <br/> <br/> {{.T "auth.MagicLoginEmail.ignore"}} <br/> <br/> </p>{{end}}`
+
+const emailChangeConfirmEmailTemplate string = `{{define "title"}}{{.T "auth.EmailChangeConfirmEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.EmailChangeConfirmEmail.action" .AppName}} <br/> <a href="{{.Link}}">{{.T "auth.EmailChangeConfirmEmail.link"}}</a> <br/> <br/> {{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} <br/> <br/> {{.T "auth.EmailChangeConfirmEmail.ignore"}} <br/> <br/> </p>{{end}}`
+
+const emailChangeNoticeEmailTemplate string = `{{define "title"}}{{.T "auth.EmailChangeNoticeEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.EmailChangeNoticeEmail.body" .AppName .NewEmail}} <br/> <br/> {{.T "auth.EmailChangeNoticeEmail.action"}} <br/> <a href="{{.Link}}">{{.T "auth.EmailChangeNoticeEmail.link"}}</a> <br/> <br/> {{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} <br/> <br/> </p>{{end}}`
+
+const dataExportEmailTemplate string = `{{define "title"}}{{.T "auth.DataExportEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.DataExportEmail.action" .AppName}} <br/> <a href="{{.Link}}">{{.T "auth.DataExportEmail.link"}}</a> <br/> <br/> {{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} {{.T "auth.DataExportEmail.once"}} <br/> <br/> {{.T "auth.DataExportEmail.ignore"}} <br/> <br/> </p>{{end}}`
+
+const loginAlertEmailTemplate string = `{{define "title"}}{{.T "auth.LoginAlertEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.LoginAlertEmail.body" .AppName}} <br/> <br/> {{.T "auth.LoginAlertEmail.when" (.Login.CreatedAt.Format "Jan 2, 2006 15:04 MST")}} <br/> {{.T "auth.LoginAlertEmail.ip" .Login.IP}} <br/> {{.T "auth.LoginAlertEmail.device" .Login.UserAgent}} <br/> <br/> {{.T "auth.LoginAlertEmail.ignore"}} <br/> <br/> {{.T "auth.LoginAlertEmail.action"}} <br/> <a href="{{.Link}}">{{.T "auth.LoginAlertEmail.link"}}</a> <br/> <br/> {{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} <br/> <br/> </p>{{end}}`
+
+const orgInviteEmailTemplate string = `{{define "title"}}{{.T "auth.OrgInviteEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> {{.T "auth.OrgInviteEmail.body" .Inviter.FirstName .Inviter.LastName .Organization.Name .AppName (.T (print "auth.orgRole." .Role))}} <br/> <br/> {{.T "auth.OrgInviteEmail.action"}} <br/> <a href="{{.Link}}">{{.T "auth.OrgInviteEmail.link"}}</a> <br/> <br/> {{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} <br/> <br/> {{.T "auth.OrgInviteEmail.ignore"}} <br/> <br/> </p>{{end}}`
+
+const userInviteEmailTemplate string = `{{define "title"}}{{.T "auth.UserInviteEmail.title"}}{{end}}{{define "content"}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.UserInviteEmail.greeting"}} <br/> <br/> {{.T "auth.UserInviteEmail.body" .Inviter.FirstName .Inviter.LastName .AppName}}{{if .Organization.Name}} {{.T "auth.UserInviteEmail.org" .Organization.Name (.T (print "auth.orgRole." .Role))}}{{end}} <br/> <br/> {{.T "auth.UserInviteEmail.action"}} <br/> <a href="{{.Link}}">{{.T "auth.UserInviteEmail.link"}}</a> <br/> <br/> {{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} <br/> <br/> {{.T "auth.UserInviteEmail.ignore"}} <br/> <br/> </p>{{end}}`
+
+const newUserTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.NewUserEmail.body" .AppName}}
+`
+
+const passwordResetTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.PasswordResetEmail.intro"}}
+
+{{.T "auth.PasswordResetEmail.actionText"}}
+{{.Link}}
+
+{{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}}
+
+{{.T "auth.PasswordResetEmail.ignore"}}
+`
+
+const passwordResetConfirmTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.PasswordResetConfirmEmail.body" .AppName}}
+`
+
+const magicLoginTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.MagicLoginEmail.action" .AppName}}
+{{.Link}}
+
+{{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} {{.T "auth.MagicLoginEmail.once"}}
+
+{{.T "auth.MagicLoginEmail.ignore"}}
+`
+
+const emailChangeConfirmTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.EmailChangeConfirmEmail.action" .AppName}}
+{{.Link}}
+
+{{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}}
+
+{{.T "auth.EmailChangeConfirmEmail.ignore"}}
+`
+
+const emailChangeNoticeTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.EmailChangeNoticeEmail.body" .AppName .NewEmail}}
+
+{{.T "auth.EmailChangeNoticeEmail.action"}}
+{{.Link}}
+
+{{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}}
+`
+
+const dataExportTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.DataExportEmail.action" .AppName}}
+{{.Link}}
+
+{{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}} {{.T "auth.DataExportEmail.once"}}
+
+{{.T "auth.DataExportEmail.ignore"}}
+`
+
+const loginAlertTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.LoginAlertEmail.body" .AppName}}
+
+{{.T "auth.LoginAlertEmail.when" (.Login.CreatedAt.Format "Jan 2, 2006 15:04 MST")}}
+{{.T "auth.LoginAlertEmail.ip" .Login.IP}}
+{{.T "auth.LoginAlertEmail.device" .Login.UserAgent}}
+
+{{.T "auth.LoginAlertEmail.ignore"}}
+
+{{.T "auth.LoginAlertEmail.action"}}
+{{.Link}}
+
+{{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}}
+`
+
+const orgInviteTextTemplate string = `{{.T "auth.email.greeting" .User.FirstName .User.LastName}}
+
+{{.T "auth.OrgInviteEmail.body" .Inviter.FirstName .Inviter.LastName .Organization.Name .AppName (.T (print "auth.orgRole." .Role))}}
+
+{{.T "auth.OrgInviteEmail.action"}}
+{{.Link}}
+
+{{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}}
+
+{{.T "auth.OrgInviteEmail.ignore"}}
+`
+
+const userInviteTextTemplate string = `{{.T "auth.UserInviteEmail.greeting"}}
+
+{{.T "auth.UserInviteEmail.body" .Inviter.FirstName .Inviter.LastName .AppName}}{{if .Organization.Name}} {{.T "auth.UserInviteEmail.org" .Organization.Name (.T (print "auth.orgRole." .Role))}}{{end}}
+
+{{.T "auth.UserInviteEmail.action"}}
+{{.Link}}
+
+{{.T "auth.email.expires" (.ExpiresAt.Format "Jan 2, 2006 15:04 MST")}}
+
+{{.T "auth.UserInviteEmail.ignore"}}
+`
+
+const baseHTMLEmailTemplate string = `<!DOCTYPE html><html lang="{{.Locale}}"> <head> <meta charset="utf-8"/> <title>{{block "title" .}}Default Title{{end}}</title> <style type="text/css"> /*<![CDATA[*/ /* Prevent Webkit and Windows Mobile platforms from changing default font sizes, while not breaking desktop design. */ body{width: 100% !important; -webkit-text-size-adjust: 100%; -ms-text-size-adjust: 100%; margin:0; padding:0;}/* Reset Styles */ body{margin: 0; padding: 0; font-family: "Helvetica Neue", Helvetica, Arial, sans-serif;}img{border: 0; line-height: 100%; outline: none; text-decoration: none;}table td{border-collapse: collapse;}#backgroundTable{height: 100% !important; margin: 0; padding: 0; width: 100% !important;}.content p{margin:0;padding:1em 0 0 0;line-height:1.5em;font-family: "Helvetica Neue", Helvetica, Arial, sans-serif;font-size:14px;color:#000;}/*]]>*/ </style> </head> <body leftmargin="0" marginwidth="0" topmargin="0" marginheight="0" offset="0" style="background-color: #EEEEEE;"> <center> <table id="backgroundTable" height="100%" width="100%" border="0" cellpadding="0" cellspacing="0" style="background-color: #EEEEEE;"> <tr> <td align="center" valign="top" width="60"> &nbsp; </td><td align="center" valign="top"> <table width="100%" height="60" border="0" cellpadding="0" cellspacing="0"> <tr> <td height="60"> &nbsp; </td></tr></table> <table id="templateContainer" width="640" border="0" cellpadding="0" cellspacing="0"> <tr> <td id="header" align="center" valign="top" style="background-color: #FFFFFF; border-top-right-radius: 10px; border-top-left-radius: 10px;"> <table id="header-outer" border="0" cellpadding="0" cellspacing="0"> <tr> <td width="50" height="50"> &nbsp; </td></tr></table> <table id="header-inner" border="0" cellpadding="0" cellspacing="0" style="background-color: #FFFFFF;"> <tr> <td width="50" height="55"> &nbsp; </td><td width="540" height="55">{{block "logo" .}}<img src="https://www.google.com/logos/doodles/2016/lantern-festival-2016-hk-6238324839677952-hp2x.jpg" height="52" style="height: 52px;"/>{{end}}</td><td width="50" height="55"> &nbsp; </td></tr><tr> <td width="640" height="20" colspan="3"> &nbsp; </td></tr></table> </td></tr><tr> <td align="center" valign="top"> <table id="body" border="0" cellpadding="0" cellspacing="0" style="background-color: #FFFFFF;"> <tr> <td width="50"> &nbsp; </td><td class="content" width="540" valign="top" style="text-align: left;">{{block "content" .}}<p style="margin:0;padding:1em 0 0 0;line-height:1.5em;font-family:Helvetica Neue, Helvetica, Arial, sans-serif;font-size:14px;color:#000;"> {{.T "auth.email.greeting" .User.FirstName .User.LastName}} <br/> <br/> This is a test message. <br/> <br/> </p>{{end}}</td><td width="50"> &nbsp; </td></tr></table> </td></tr><tr> <td id="footer" align="center" valign="top" style="background-color: #FFFFFF; border-bottom-right-radius: 10px; border-bottom-left-radius: 10px;"> <table id="footer-inner" border="0" cellpadding="0" cellspacing="0"> <tr> <td width="50" height="50"> &nbsp; </td></tr></table> </td></tr><tr> <td width="50" height="50"> &nbsp; </td></tr></table> </td><td align="center" valign="top" width="60"> &nbsp; </td></tr></table> </center> </body></html>`
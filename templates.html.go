@@ -2,8 +2,23 @@ package auth
 
 // HTMLTemplates can/should be set by applications using auth.
 // Contains a list of templates used by the auth module.
+// Templates are executed with the auth context; {{ .T "key" }} translates a message into the request's locale.
 var HTMLTemplates = map[string]string{
-	"auth.Tpl.Login": loginTemplate,
+	"auth.Tpl.Login":          loginTemplate,
+	"auth.Tpl.Register":       registerTemplate,
+	"auth.Tpl.MagicLogin":     magicLoginTemplate,
+	"auth.Tpl.EmailChange":    emailChangeTemplate,
+	"auth.Tpl.Confirm":        confirmTemplate,
+	"auth.Tpl.DataExport":     dataExportTemplate,
+	"auth.Tpl.LoginHistory":   loginHistoryTemplate,
+	"auth.Tpl.WebAuthn":       webAuthnTemplate,
+	"auth.Tpl.WebAuthnVerify": webAuthnVerifyTemplate,
+	"auth.Tpl.AdminUsers":     adminUsersTemplate,
+	"auth.Tpl.AdminUser":      adminUserTemplate,
+	"auth.Tpl.AdminInvites":   adminInvitesTemplate,
+	"auth.Tpl.APIKeys":        apiKeysTemplate,
+	"auth.Tpl.Orgs":           orgsTemplate,
+	"auth.Tpl.Org":            orgTemplate,
 }
 
 const loginTemplate = `
@@ -12,20 +27,20 @@ const loginTemplate = `
 <input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
 <fieldset>
 
-<legend>Sign In</legend>
+<legend>{{ .T "auth.Tpl.Login.legend" }}</legend>
 
 <div class="form-group">
-  <label class="col-md-4 control-label" for="email">Email</label>  
+  <label class="col-md-4 control-label" for="email">{{ .T "auth.Tpl.Login.email" }}</label>  
   <div class="col-md-5">
-  <input id="email" name="email" type="text" placeholder="your.email@example.com" class="form-control input-md" required="">
+  <input id="email" name="email" type="text" placeholder="{{ .T "auth.Tpl.Login.emailPlaceholder" }}" class="form-control input-md" required="">
     
   </div>
 </div>
 
 <div class="form-group">
-  <label class="col-md-4 control-label" for="password">Password</label>
+  <label class="col-md-4 control-label" for="password">{{ .T "auth.Tpl.Login.password" }}</label>
   <div class="col-md-5">
-    <input id="password" name="password" type="password" placeholder="Your Password" class="form-control input-md" required="">
+    <input id="password" name="password" type="password" placeholder="{{ .T "auth.Tpl.Login.passwordPlaceholder" }}" class="form-control input-md" required="">
     
   </div>
 </div>
@@ -33,14 +48,731 @@ const loginTemplate = `
 <div class="form-group">
   <label class="col-md-4 control-label" for="btn-submit"></label>
   <div class="col-md-4">
-    <button id="btn-submit" name="btn-submit" class="btn btn-primary">Login</button>
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T "auth.Tpl.Login.submit" }}</button>
   </div>
 </div>
 
 </fieldset>
 </form>
 
-<h1>Or Create a New Account</h1>
-<a href="{{ .Data.RegisterURL }}" class="btn btn-primary btn-lg">Sign Up</a>
+<p><a href="{{ .Data.MagicLoginURL }}">{{ .T "auth.Tpl.Login.magicLogin" }}</a></p>
+<p><button type="button" class="btn btn-default" data-webauthn-login data-begin-url="{{ .Data.WebAuthnLoginBeginURL }}" data-finish-url="{{ .Data.WebAuthnLoginFinishURL }}" data-csrf="{{ .CsrfToken }}" data-error="webauthn-error">{{ .T "auth.Tpl.Login.passkey" }}</button></p>
+<p id="webauthn-error" class="text-danger"></p>
+
+<h1>{{ .T "auth.Tpl.Login.registerHeading" }}</h1>
+<a href="{{ .Data.RegisterURL }}" class="btn btn-primary btn-lg">{{ .T "auth.Tpl.Login.register" }}</a>
+` + webAuthnScript + `
 {{ end }}
 `
+
+const registerTemplate = `
+{{define "content"}}
+<form class="form-horizontal" method="POST" action={{ .Data.RegisterURL }}>
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<legend>{{ .T "auth.Tpl.Register.legend" }}</legend>
+{{ with .Data.Invite }}<p>{{ $.T "auth.Tpl.Register.invited" }}</p>{{ end }}
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="email">{{ .T "auth.Tpl.Login.email" }}</label>  
+  <div class="col-md-5">
+  {{ if .Data.Invite }}
+  <input id="email" name="email" type="text" value="{{ .Data.Invite.Email }}" class="form-control input-md" readonly>
+  {{ else }}
+  <input id="email" name="email" type="text" placeholder="{{ .T "auth.Tpl.Login.emailPlaceholder" }}" class="form-control input-md" required="">
+  {{ end }}
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="firstname">{{ .T "auth.Tpl.Register.firstName" }}</label>
+  <div class="col-md-5">
+  <input id="firstname" name="firstname" type="text" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="lastname">{{ .T "auth.Tpl.Register.lastName" }}</label>
+  <div class="col-md-5">
+  <input id="lastname" name="lastname" type="text" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="password">{{ .T "auth.Tpl.Login.password" }}</label>
+  <div class="col-md-5">
+    <input id="password" name="password" type="password" placeholder="{{ .T "auth.Tpl.Login.passwordPlaceholder" }}" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T "auth.Tpl.Register.submit" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+
+{{ if not .Data.Invite }}<p><a href="{{ .Data.LoginURL }}">{{ .T "auth.Tpl.Register.login" }}</a></p>{{ end }}
+{{ end }}
+`
+
+const magicLoginTemplate = `
+{{define "content"}}
+<form class="form-horizontal" method="POST" action={{ .Data.MagicLoginURL }}>
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<legend>{{ .T "auth.Tpl.MagicLogin.legend" }}</legend>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="email">{{ .T "auth.Tpl.Login.email" }}</label>  
+  <div class="col-md-5">
+  <input id="email" name="email" type="text" placeholder="{{ .T "auth.Tpl.Login.emailPlaceholder" }}" class="form-control input-md" required="">
+    
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T "auth.Tpl.MagicLogin.submit" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+{{ end }}
+`
+
+const emailChangeTemplate = `
+{{define "content"}}
+<form class="form-horizontal" method="POST" action={{ .Data.EmailChangeURL }}>
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<legend>{{ .T "auth.Tpl.EmailChange.legend" }}</legend>
+<p>{{ .T "auth.Tpl.EmailChange.current" .User.Email }}</p>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="email">{{ .T "auth.Tpl.EmailChange.email" }}</label>  
+  <div class="col-md-5">
+  <input id="email" name="email" type="text" placeholder="{{ .T "auth.Tpl.Login.emailPlaceholder" }}" class="form-control input-md" required="">
+    
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T "auth.Tpl.EmailChange.submit" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+{{ end }}
+`
+
+const confirmTemplate = `
+{{define "content"}}
+<form class="form-horizontal" method="POST" action={{ .Data.ConfirmURL }}>
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<legend>{{ .T (printf "%s.legend" .Data.Confirm) }}</legend>
+<p>{{ .T (printf "%s.explain" .Data.Confirm) }}</p>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T (printf "%s.submit" .Data.Confirm) }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+{{ end }}
+`
+
+const dataExportTemplate = `
+{{define "content"}}
+<form class="form-horizontal" method="POST" action={{ .Data.DataExportURL }}>
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<legend>{{ .T "auth.Tpl.DataExport.legend" }}</legend>
+<p>{{ .T "auth.Tpl.DataExport.explain" }}</p>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T "auth.Tpl.DataExport.submit" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+{{ end }}
+`
+
+const loginHistoryTemplate = `
+{{define "content"}}
+<legend>{{ .T "auth.Tpl.LoginHistory.legend" }}</legend>
+
+<table class="table">
+<thead>
+  <tr><th>{{ .T "auth.Tpl.LoginHistory.when" }}</th><th>{{ .T "auth.Tpl.LoginHistory.method" }}</th><th>{{ .T "auth.Tpl.LoginHistory.ip" }}</th><th>{{ .T "auth.Tpl.LoginHistory.device" }}</th></tr>
+</thead>
+<tbody>
+{{ range .Data.Logins }}
+  <tr>
+    <td>{{ .CreatedAt.Format "2006-01-02 15:04 MST" }}{{ if .IsNew }} <span class="label label-warning">{{ $.T "auth.Tpl.LoginHistory.new" }}</span>{{ end }}</td>
+    <td>{{ $.T (printf "auth.Tpl.LoginHistory.method.%s" .Method) }}</td>
+    <td>{{ .IP }}</td>
+    <td>{{ .UserAgent }}</td>
+  </tr>
+{{ else }}
+  <tr><td colspan="4">{{ .T "auth.Tpl.LoginHistory.none" }}</td></tr>
+{{ end }}
+</tbody>
+</table>
+
+<p>{{ .T "auth.Tpl.LoginHistory.notMe" }}</p>
+{{ end }}
+`
+
+const webAuthnTemplate = `
+{{define "content"}}
+<legend>{{ .T "auth.Tpl.WebAuthn.legend" }}</legend>
+
+<ul class="list-group">
+{{ range .Data.Credentials }}
+  <li class="list-group-item">
+    {{ $.T "auth.Tpl.WebAuthn.created" (.CreatedAt.Format "2006-01-02") }}, {{ $.T "auth.Tpl.WebAuthn.lastUsed" (.LastUsedAt.Format "2006-01-02") }}
+    <button type="button" class="btn btn-link" data-webauthn-delete data-url="{{ $.Data.WebAuthnURL }}{{ .ID }}" data-csrf="{{ $.CsrfToken }}" data-error="webauthn-error">{{ $.T "auth.Tpl.WebAuthn.delete" }}</button>
+  </li>
+{{ else }}
+  <li class="list-group-item">{{ .T "auth.Tpl.WebAuthn.none" }}</li>
+{{ end }}
+</ul>
+
+<button type="button" class="btn btn-primary" data-webauthn-register data-begin-url="{{ .Data.WebAuthnRegisterBeginURL }}" data-finish-url="{{ .Data.WebAuthnRegisterFinishURL }}" data-csrf="{{ .CsrfToken }}" data-error="webauthn-error">{{ .T "auth.Tpl.WebAuthn.add" }}</button>
+<p id="webauthn-error" class="text-danger"></p>
+` + webAuthnScript + `
+{{ end }}
+`
+
+const webAuthnVerifyTemplate = `
+{{define "content"}}
+<legend>{{ .T "auth.Tpl.WebAuthnVerify.legend" }}</legend>
+<p>{{ .T "auth.Tpl.WebAuthnVerify.intro" }}</p>
+<button type="button" class="btn btn-primary" data-webauthn-login data-begin-url="{{ .Data.WebAuthnLoginBeginURL }}" data-finish-url="{{ .Data.WebAuthnLoginFinishURL }}" data-csrf="{{ .CsrfToken }}" data-error="webauthn-error">{{ .T "auth.Tpl.WebAuthnVerify.submit" }}</button>
+<p id="webauthn-error" class="text-danger"></p>
+` + webAuthnScript + `
+{{ end }}
+`
+
+const adminUsersTemplate = `
+{{define "content"}}
+<legend>{{ .T "auth.Tpl.AdminUsers.legend" }}</legend>
+<p><a href="{{ .Data.AdminInvitesURL }}">{{ .T "auth.Tpl.AdminUsers.invites" }}</a></p>
+
+<form class="form-inline" method="GET" action="{{ .Data.AdminUsersURL }}">
+  <input name="q" type="text" value="{{ .Data.Search }}" placeholder="{{ .T "auth.Tpl.AdminUsers.search" }}" class="form-control input-md">
+  <select name="status" class="form-control">
+  {{ range .Data.Statuses }}
+    <option value="{{ . }}"{{ if eq . $.Data.Status }} selected{{ end }}>{{ $.T (printf "auth.Tpl.AdminUsers.status.%s" .) }}</option>
+  {{ end }}
+  </select>
+  <button class="btn btn-default">{{ .T "auth.Tpl.AdminUsers.submit" }}</button>
+</form>
+
+<p>{{ .T "auth.Tpl.AdminUsers.total" .Data.Users.Total }}</p>
+<table class="table">
+<thead>
+  <tr><th>{{ .T "auth.Tpl.AdminUsers.name" }}</th><th>{{ .T "auth.Tpl.AdminUsers.email" }}</th><th>{{ .T "auth.Tpl.AdminUsers.status" }}</th><th>{{ .T "auth.Tpl.AdminUsers.created" }}</th></tr>
+</thead>
+<tbody>
+{{ range .Data.Users.Users }}
+  <tr>
+    <td><a href="{{ $.Data.AdminUsersURL }}{{ .ID }}">{{ .FirstName }} {{ .LastName }}</a></td>
+    <td>{{ .Email }}</td>
+    <td>
+      {{ if .IsDeleted }}{{ $.T "auth.Tpl.AdminUsers.status.deleted" }}{{ else if .IsActive }}{{ $.T "auth.Tpl.AdminUsers.status.active" }}{{ else }}{{ $.T "auth.Tpl.AdminUsers.status.inactive" }}{{ end }}
+      {{ if .IsSuperuser }}<span class="label label-info">{{ $.T "auth.Tpl.AdminUsers.status.superuser" }}</span>{{ end }}
+    </td>
+    <td>{{ .CreatedAt.Format "2006-01-02" }}</td>
+  </tr>
+{{ else }}
+  <tr><td colspan="4">{{ .T "auth.Tpl.AdminUsers.none" }}</td></tr>
+{{ end }}
+</tbody>
+</table>
+
+{{ if .Data.NextURL }}<a href="{{ .Data.NextURL }}" class="btn btn-default">{{ .T "auth.Tpl.AdminUsers.next" }}</a>{{ end }}
+{{ end }}
+`
+
+const adminUserTemplate = `
+{{define "content"}}
+<p><a href="{{ .Data.AdminUsersURL }}">{{ .T "auth.Tpl.AdminUser.back" }}</a></p>
+
+{{ with .Data.Account }}
+<form class="form-horizontal" method="POST" action="{{ $.Data.AdminUserURL }}">
+<input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+<fieldset>
+
+<legend>{{ .FirstName }} {{ .LastName }}</legend>
+<p>
+  {{ $.T "auth.Tpl.AdminUser.created" (.CreatedAt.Format "2006-01-02") }}
+  {{ if .IsDeleted }}&middot; {{ $.T "auth.Tpl.AdminUser.deleted" (.DeletedAt.Format "2006-01-02") }}{{ end }}
+</p>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="firstname">{{ $.T "auth.Tpl.AdminUser.firstName" }}</label>
+  <div class="col-md-5">
+  <input id="firstname" name="firstname" type="text" value="{{ .FirstName }}" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="lastname">{{ $.T "auth.Tpl.AdminUser.lastName" }}</label>
+  <div class="col-md-5">
+  <input id="lastname" name="lastname" type="text" value="{{ .LastName }}" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="email">{{ $.T "auth.Tpl.AdminUser.email" }}</label>
+  <div class="col-md-5">
+  <input id="email" name="email" type="text" value="{{ .Email }}" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="locale">{{ $.T "auth.Tpl.AdminUser.locale" }}</label>
+  <div class="col-md-5">
+  <input id="locale" name="locale" type="text" value="{{ .Locale }}" class="form-control input-md">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ $.T "auth.Tpl.AdminUser.submit" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+{{ end }}
+
+{{ range .Data.Actions }}
+<form method="POST" action="{{ $.Data.AdminUserURL }}/{{ . }}" style="display: inline">
+<input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+<button class="btn btn-default">{{ $.T (printf "auth.Tpl.AdminUser.action.%s" .) }}</button>
+</form>
+{{ end }}
+{{ end }}
+`
+
+const adminInvitesTemplate = `
+{{define "content"}}
+<p><a href="{{ .Data.AdminUsersURL }}">{{ .T "auth.Tpl.AdminUser.back" }}</a></p>
+
+<form class="form-horizontal" method="POST" action="{{ .Data.AdminInvitesURL }}">
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<legend>{{ .T "auth.Tpl.AdminInvites.legend" }}</legend>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="email">{{ .T "auth.Tpl.AdminInvites.email" }}</label>
+  <div class="col-md-5">
+  <input id="email" name="email" type="text" placeholder="{{ .T "auth.Tpl.Login.emailPlaceholder" }}" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="org">{{ .T "auth.Tpl.AdminInvites.org" }}</label>
+  <div class="col-md-3">
+  <input id="org" name="org" type="text" class="form-control input-md">
+  </div>
+  <div class="col-md-2">
+  <select name="role" class="form-control">
+  {{ range .Data.Roles }}
+    <option value="{{ . }}">{{ $.T (printf "auth.Tpl.Orgs.role.%s" .) }}</option>
+  {{ end }}
+  </select>
+  </div>
+</div>
+
+<div class="form-group">
+  <div class="col-md-offset-4 col-md-5">
+  <label><input name="superuser" type="checkbox" value="1"> {{ .T "auth.Tpl.AdminInvites.superuser" }}</label>
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T "auth.Tpl.AdminInvites.submit" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+
+<table class="table">
+<thead>
+  <tr><th>{{ .T "auth.Tpl.AdminInvites.email" }}</th><th>{{ .T "auth.Tpl.AdminInvites.roles" }}</th><th>{{ .T "auth.Tpl.AdminInvites.expires" }}</th><th></th></tr>
+</thead>
+<tbody>
+{{ range .Data.Invites }}
+  <tr>
+    <td>{{ .Email }}</td>
+    <td>{{ range .Roles }}{{ if eq .Name "superuser" }}<span class="label label-info">{{ $.T "auth.Tpl.AdminUsers.status.superuser" }}</span>{{ else }}<span class="label label-default">{{ .OrgID }}: {{ $.T (printf "auth.Tpl.Orgs.role.%s" .Name) }}</span>{{ end }} {{ end }}</td>
+    <td>{{ .ExpiresAt.Format "2006-01-02" }}</td>
+    <td>
+      <form method="POST" action="{{ $.Data.AdminInvitesURL }}{{ .ID }}/revoke">
+      <input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+      <button class="btn btn-danger btn-xs">{{ $.T "auth.Tpl.AdminInvites.revoke" }}</button>
+      </form>
+    </td>
+  </tr>
+{{ else }}
+  <tr><td colspan="4">{{ .T "auth.Tpl.AdminInvites.none" }}</td></tr>
+{{ end }}
+</tbody>
+</table>
+{{ end }}
+`
+
+const apiKeysTemplate = `
+{{define "content"}}
+<legend>{{ .T "auth.Tpl.APIKeys.legend" }}</legend>
+
+{{ with .Data.NewKey }}
+<div class="alert alert-success">
+  <p>{{ $.T "auth.Tpl.APIKeys.created" }}</p>
+  <p><code>{{ . }}</code></p>
+</div>
+{{ end }}
+
+<table class="table">
+<thead>
+  <tr><th>{{ .T "auth.Tpl.APIKeys.name" }}</th><th>{{ .T "auth.Tpl.APIKeys.key" }}</th><th>{{ .T "auth.Tpl.APIKeys.scopes" }}</th><th>{{ .T "auth.Tpl.APIKeys.lastUsed" }}</th><th>{{ .T "auth.Tpl.APIKeys.expires" }}</th><th></th></tr>
+</thead>
+<tbody>
+{{ range .Data.Keys }}
+  <tr>
+    <td>{{ .Name }}</td>
+    <td><code>{{ .Prefix }}_&hellip;</code></td>
+    <td>{{ range .Scopes }}<span class="label label-default">{{ . }}</span> {{ end }}</td>
+    <td>{{ if .LastUsedAt.IsZero }}{{ $.T "auth.Tpl.APIKeys.never" }}{{ else }}{{ .LastUsedAt.Format "2006-01-02 15:04" }}{{ end }}</td>
+    <td>{{ if .ExpiresAt.IsZero }}{{ $.T "auth.Tpl.APIKeys.never" }}{{ else }}{{ .ExpiresAt.Format "2006-01-02" }}{{ end }}</td>
+    <td>
+      <form method="POST" action="{{ $.Data.APIKeysURL }}{{ .ID }}/revoke">
+      <input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+      <button class="btn btn-danger btn-xs">{{ $.T "auth.Tpl.APIKeys.revoke" }}</button>
+      </form>
+    </td>
+  </tr>
+{{ else }}
+  <tr><td colspan="6">{{ .T "auth.Tpl.APIKeys.none" }}</td></tr>
+{{ end }}
+</tbody>
+</table>
+
+<form class="form-horizontal" method="POST" action="{{ .Data.APIKeysURL }}">
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<legend>{{ .T "auth.Tpl.APIKeys.create" }}</legend>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="name">{{ .T "auth.Tpl.APIKeys.name" }}</label>
+  <div class="col-md-5">
+  <input id="name" name="name" type="text" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="scopes">{{ .T "auth.Tpl.APIKeys.scopes" }}</label>
+  <div class="col-md-5">
+  {{ range .Data.Scopes }}
+  <label class="checkbox-inline"><input name="scope" type="checkbox" value="{{ . }}"> {{ . }}</label>
+  {{ else }}
+  <input id="scopes" name="scopes" type="text" placeholder="{{ .T "auth.Tpl.APIKeys.scopesPlaceholder" }}" class="form-control input-md">
+  {{ end }}
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="expires">{{ .T "auth.Tpl.APIKeys.expires" }}</label>
+  <div class="col-md-3">
+  <select id="expires" name="expires" class="form-control">
+  {{ range .Data.ExpiryDays }}
+    <option value="{{ . }}">{{ if eq . 0 }}{{ $.T "auth.Tpl.APIKeys.never" }}{{ else }}{{ $.T "auth.Tpl.APIKeys.days" . }}{{ end }}</option>
+  {{ end }}
+  </select>
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T "auth.Tpl.APIKeys.submit" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+{{ end }}
+`
+
+const orgsTemplate = `
+{{define "content"}}
+<legend>{{ .T "auth.Tpl.Orgs.legend" }}</legend>
+
+<ul class="list-group">
+{{ range .Organizations }}
+  <li class="list-group-item">
+    <a href="{{ $.Data.OrgsURL }}{{ .ID }}">{{ .Name }}</a>
+    <span class="label label-default">{{ $.T (printf "auth.Tpl.Orgs.role.%s" .Role) }}</span>
+    {{ if eq .ID.String $.Organization.ID.String }}
+    <span class="label label-primary">{{ $.T "auth.Tpl.Orgs.active" }}</span>
+    {{ else }}
+    <form method="POST" action="{{ $.Data.OrgSwitchURL }}" style="display: inline">
+    <input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+    <input type="hidden" name="org" value="{{ .ID }}">
+    <button class="btn btn-default btn-xs">{{ $.T "auth.Tpl.Orgs.switch" }}</button>
+    </form>
+    {{ end }}
+  </li>
+{{ else }}
+  <li class="list-group-item">{{ .T "auth.Tpl.Orgs.none" }}</li>
+{{ end }}
+</ul>
+
+<form class="form-horizontal" method="POST" action="{{ .Data.OrgsURL }}">
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<legend>{{ .T "auth.Tpl.Orgs.create" }}</legend>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="name">{{ .T "auth.Tpl.Orgs.name" }}</label>
+  <div class="col-md-5">
+  <input id="name" name="name" type="text" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-submit"></label>
+  <div class="col-md-4">
+    <button id="btn-submit" name="btn-submit" class="btn btn-primary">{{ .T "auth.Tpl.Orgs.submit" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+{{ end }}
+`
+
+const orgTemplate = `
+{{define "content"}}
+<p><a href="{{ .Data.OrgsURL }}">{{ .T "auth.Tpl.Org.back" }}</a></p>
+
+{{ with .Data.Org }}
+<legend>{{ .Name }}</legend>
+{{ if eq .Role "owner" }}
+<form class="form-horizontal" method="POST" action="{{ $.Data.OrgURL }}">
+<input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+<div class="form-group">
+  <label class="col-md-4 control-label" for="name">{{ $.T "auth.Tpl.Org.name" }}</label>
+  <div class="col-md-5">
+  <input id="name" name="name" type="text" value="{{ .Name }}" class="form-control input-md" required="">
+  </div>
+  <div class="col-md-3">
+    <button class="btn btn-primary">{{ $.T "auth.Tpl.Org.rename" }}</button>
+  </div>
+</div>
+</form>
+{{ end }}
+{{ end }}
+
+<table class="table">
+<thead>
+  <tr><th>{{ .T "auth.Tpl.Org.member" }}</th><th>{{ .T "auth.Tpl.Org.email" }}</th><th>{{ .T "auth.Tpl.Org.role" }}</th><th></th></tr>
+</thead>
+<tbody>
+{{ range .Data.Members }}
+  <tr>
+    <td>{{ .FirstName }} {{ .LastName }}</td>
+    <td>{{ .Email }}</td>
+    <td>
+    {{ $member := . }}
+    {{ if and $.Data.Roles (or (ne .Role "owner") (eq $.Data.Org.Role "owner")) }}
+    <form method="POST" action="{{ $.Data.OrgURL }}/members/{{ .ID }}" style="display: inline">
+    <input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+    <select name="role">
+    {{ range $.Data.Roles }}<option value="{{ . }}"{{ if eq . $member.Role }} selected{{ end }}>{{ $.T (printf "auth.Tpl.Orgs.role.%s" .) }}</option>{{ end }}
+    </select>
+    <button class="btn btn-default btn-xs">{{ $.T "auth.Tpl.Org.setRole" }}</button>
+    </form>
+    {{ else }}
+    {{ $.T (printf "auth.Tpl.Orgs.role.%s" .Role) }}
+    {{ end }}
+    </td>
+    <td>
+    {{ if eq .ID.String $.User.ID.String }}
+    <form method="POST" action="{{ $.Data.OrgURL }}/members/{{ .ID }}/remove" style="display: inline">
+    <input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+    <button class="btn btn-default btn-xs">{{ $.T "auth.Tpl.Org.leave" }}</button>
+    </form>
+    {{ else if and $.Data.Roles (or (ne .Role "owner") (eq $.Data.Org.Role "owner")) }}
+    <form method="POST" action="{{ $.Data.OrgURL }}/members/{{ .ID }}/remove" style="display: inline">
+    <input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+    <button class="btn btn-default btn-xs">{{ $.T "auth.Tpl.Org.remove" }}</button>
+    </form>
+    {{ end }}
+    </td>
+  </tr>
+{{ end }}
+</tbody>
+</table>
+
+{{ if .Data.Roles }}
+<legend>{{ .T "auth.Tpl.Org.invites" }}</legend>
+<ul class="list-group">
+{{ range .Data.Invites }}
+  <li class="list-group-item">
+    {{ .Email }} &middot; {{ $.T (printf "auth.Tpl.Orgs.role.%s" .Role) }} &middot; {{ $.T "auth.Tpl.Org.expires" (.ExpiresAt.Format "2006-01-02") }}
+    <form method="POST" action="{{ $.Data.OrgURL }}/invites/{{ .ID }}/revoke" style="display: inline">
+    <input type="hidden" name="gorilla.csrf.Token" value="{{ $.CsrfToken }}">
+    <button class="btn btn-default btn-xs">{{ $.T "auth.Tpl.Org.revoke" }}</button>
+    </form>
+  </li>
+{{ else }}
+  <li class="list-group-item">{{ .T "auth.Tpl.Org.noInvites" }}</li>
+{{ end }}
+</ul>
+
+<form class="form-horizontal" method="POST" action="{{ .Data.OrgURL }}/invites/">
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<fieldset>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="email">{{ .T "auth.Tpl.Org.email" }}</label>
+  <div class="col-md-5">
+  <input id="email" name="email" type="text" class="form-control input-md" required="">
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="role">{{ .T "auth.Tpl.Org.role" }}</label>
+  <div class="col-md-5">
+  <select id="role" name="role" class="form-control">
+  {{ range .Data.Roles }}<option value="{{ . }}"{{ if eq . "member" }} selected{{ end }}>{{ $.T (printf "auth.Tpl.Orgs.role.%s" .) }}</option>{{ end }}
+  </select>
+  </div>
+</div>
+
+<div class="form-group">
+  <label class="col-md-4 control-label" for="btn-invite"></label>
+  <div class="col-md-4">
+    <button id="btn-invite" name="btn-invite" class="btn btn-primary">{{ .T "auth.Tpl.Org.invite" }}</button>
+  </div>
+</div>
+
+</fieldset>
+</form>
+{{ end }}
+
+{{ if eq .Data.Org.Role "owner" }}
+<form method="POST" action="{{ .Data.OrgURL }}/delete">
+<input type="hidden" name="gorilla.csrf.Token" value="{{ .CsrfToken }}">
+<button class="btn btn-danger">{{ .T "auth.Tpl.Org.delete" }}</button>
+</form>
+{{ end }}
+{{ end }}
+`
+
+// webAuthnScript runs the passkey ceremonies for buttons marked with
+// data-webauthn-login, data-webauthn-register or data-webauthn-delete.
+// Binary fields are exchanged with the JSON endpoints as base64url strings.
+const webAuthnScript = `<script>
+(function() {
+  function toBuf(s) {
+    s = s.replace(/-/g, "+").replace(/_/g, "/");
+    while (s.length % 4) { s += "="; }
+    return Uint8Array.from(atob(s), function(c) { return c.charCodeAt(0); }).buffer;
+  }
+  function fromBuf(b) {
+    var s = "";
+    new Uint8Array(b).forEach(function(c) { s += String.fromCharCode(c); });
+    return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+  function send(method, url, csrf, body) {
+    return fetch(url, {
+      method: method,
+      credentials: "same-origin",
+      headers: {"Content-Type": "application/json", "X-CSRF-Token": csrf},
+      body: body === undefined ? undefined : JSON.stringify(body)
+    }).then(function(r) {
+      return r.json().then(function(j) { if (!r.ok) { throw new Error(j.error); } return j; });
+    });
+  }
+  function bind(attr, fn) {
+    document.querySelectorAll("[" + attr + "]").forEach(function(el) {
+      el.addEventListener("click", function(e) {
+        e.preventDefault();
+        fn(el).catch(function(err) {
+          var out = document.getElementById(el.getAttribute("data-error"));
+          if (out) { out.textContent = err.message; }
+        });
+      });
+    });
+  }
+
+  bind("data-webauthn-login", function(el) {
+    var email = document.getElementById("email");
+    return send("POST", el.dataset.beginUrl, el.dataset.csrf, {email: email ? email.value : ""}).then(function(o) {
+      o.challenge = toBuf(o.challenge);
+      o.allowCredentials.forEach(function(c) { c.id = toBuf(c.id); });
+      return navigator.credentials.get({publicKey: o});
+    }).then(function(c) {
+      return send("POST", el.dataset.finishUrl, el.dataset.csrf, {id: c.id, rawId: fromBuf(c.rawId), type: c.type, response: {
+        clientDataJSON: fromBuf(c.response.clientDataJSON),
+        authenticatorData: fromBuf(c.response.authenticatorData),
+        signature: fromBuf(c.response.signature),
+        userHandle: c.response.userHandle ? fromBuf(c.response.userHandle) : ""
+      }});
+    }).then(function(r) { window.location = r.redirect; });
+  });
+
+  bind("data-webauthn-register", function(el) {
+    return send("POST", el.dataset.beginUrl, el.dataset.csrf, {}).then(function(o) {
+      o.challenge = toBuf(o.challenge);
+      o.user.id = toBuf(o.user.id);
+      o.excludeCredentials.forEach(function(c) { c.id = toBuf(c.id); });
+      return navigator.credentials.create({publicKey: o});
+    }).then(function(c) {
+      return send("POST", el.dataset.finishUrl, el.dataset.csrf, {id: c.id, rawId: fromBuf(c.rawId), type: c.type, response: {
+        clientDataJSON: fromBuf(c.response.clientDataJSON),
+        attestationObject: fromBuf(c.response.attestationObject),
+        transports: c.response.getTransports ? c.response.getTransports() : []
+      }});
+    }).then(function() { window.location.reload(); });
+  });
+
+  bind("data-webauthn-delete", function(el) {
+    return send("DELETE", el.dataset.url, el.dataset.csrf).then(function() { window.location.reload(); });
+  });
+})();
+</script>`
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidTraceparent is returned by ParseTraceparent for a header that isn't a valid W3C traceparent
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+// SpanContext identifies a span and the trace it belongs to, as a W3C traceparent does
+type SpanContext struct {
+	// TraceID is 32 and SpanID 16 lowercase hex characters
+	TraceID string
+	SpanID  string
+	Sampled bool
+	// Remote is true when the span was started by another process, i.e. the caller of an HTTP request
+	Remote bool
+}
+
+// IsValid reports whether sc has both IDs
+func (sc SpanContext) IsValid() bool {
+	return len(sc.TraceID) == 32 && len(sc.SpanID) == 16
+}
+
+// Traceparent formats sc as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header value. The SpanContext returned is Remote.
+func ParseTraceparent(h string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	// version 00 has exactly four fields; later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version) || !isHex(flags) || len(flags) != 2 ||
+		len(traceID) != 32 || !isHex(traceID) || traceID == strings.Repeat("0", 32) ||
+		len(spanID) != 16 || !isHex(spanID) || spanID == strings.Repeat("0", 16) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	b, _ := hex.DecodeString(flags)
+	return SpanContext{TraceID: traceID, SpanID: spanID, Sampled: b[0]&1 == 1, Remote: true}, nil
+}
+
+// isHex reports whether s is made of lowercase hex digits only
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// spanContextKey is the context key of the current SpanContext
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx whose spans are children of sc
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the SpanContext of the span ctx is in, if any
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Span is one timed operation of a trace
+type Span interface {
+	// SetAttribute describes the operation, i.e. "db.statement"
+	SetAttribute(key, value string)
+	// RecordError marks the operation as failed with err
+	RecordError(err error)
+	// End finishes the span. Calls after the first do nothing.
+	End()
+	// SpanContext identifies the span
+	SpanContext() SpanContext
+}
+
+// Tracer starts spans
+type Tracer interface {
+	// Start starts a span called name. It is a child of the span ctx is in, if any.
+	// The context returned is in the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Tracing can/should be set by applications using auth.
+// Spans are started around every Service method, the SQL statements and password hashing
+// they run, email sends and HTTP requests. By default they are discarded.
+var Tracing Tracer = NoopTracer{}
+
+// startSpan starts a span with Tracing
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if Tracing == nil {
+		return NoopTracer{}.Start(ctx, name)
+	}
+	return Tracing.Start(ctx, name)
+}
+
+// endSpan records err, if there is one, and ends span
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// NoopTracer starts spans that record nothing.
+// Its spans keep the SpanContext of their parent so a remote traceparent is still passed on.
+type NoopTracer struct{}
+
+// Start returns ctx and a span that does nothing
+func (NoopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	sc, _ := SpanContextFromContext(ctx)
+	return ctx, noopSpan{sc: sc}
+}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (noopSpan) SetAttribute(key, value string) {}
+func (noopSpan) RecordError(err error)          {}
+func (noopSpan) End()                           {}
+func (s noopSpan) SpanContext() SpanContext     { return s.sc }
+
+// newSpanContext creates the SpanContext of a new span. It joins parent's trace when parent is valid.
+func newSpanContext(parent SpanContext) SpanContext {
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: true}
+	if !parent.IsValid() {
+		sc.TraceID = randomHex(16)
+	} else {
+		sc.Sampled = parent.Sampled
+	}
+	sc.SpanID = randomHex(8)
+	return sc
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SpanData is a span recorded by a MemoryTracer
+type SpanData struct {
+	Name string
+	SpanContext
+	// ParentID is the SpanID of the parent span, empty for the root of a trace
+	ParentID   string
+	Attributes map[string]string
+	// Err is the last error recorded with RecordError
+	Err   error
+	Start time.Time
+	End   time.Time
+}
+
+// MemoryTracer records every span that ends. It is intended for tests.
+type MemoryTracer struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// NewMemoryTracer creates a MemoryTracer with no spans
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+// Start starts a span that is recorded when it ends
+func (t *MemoryTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := SpanContextFromContext(ctx)
+	s := &memorySpan{
+		tracer: t,
+		data: SpanData{
+			Name:        name,
+			SpanContext: newSpanContext(parent),
+			ParentID:    parent.SpanID,
+			Attributes:  make(map[string]string),
+			Start:       time.Now(),
+		},
+	}
+	return ContextWithSpanContext(ctx, s.data.SpanContext), s
+}
+
+// Spans returns the spans that have ended, in the order they ended
+func (t *MemoryTracer) Spans() []SpanData {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]SpanData(nil), t.spans...)
+}
+
+// Find returns the spans called name, in the order they ended
+func (t *MemoryTracer) Find(name string) []SpanData {
+	var found []SpanData
+	for _, s := range t.Spans() {
+		if s.Name == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// Reset forgets every span
+func (t *MemoryTracer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = nil
+}
+
+// memorySpan is a span of a MemoryTracer
+type memorySpan struct {
+	tracer *MemoryTracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+func (s *memorySpan) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *memorySpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Err = err
+}
+
+func (s *memorySpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, data)
+}
+
+func (s *memorySpan) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
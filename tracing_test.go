@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(h)
+	if err != nil {
+		t.Fatalf("Expected to parse traceparent. Instead got the error: %v", err)
+	}
+	if sc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID != "00f067aa0ba902b7" || !sc.Sampled || !sc.Remote {
+		t.Fatalf("Expected the IDs of %s, sampled and remote. Instead got: %+v", h, sc)
+	}
+	if sc.Traceparent() != h {
+		t.Fatalf("Expected traceparent %s. Instead got: %s", h, sc.Traceparent())
+	}
+
+	// a later version may add fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	if err != nil {
+		t.Fatalf("Expected to parse a later version. Instead got the error: %v", err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+	} {
+		_, err := ParseTraceparent(bad)
+		if err != ErrInvalidTraceparent {
+			t.Errorf("Expected ErrInvalidTraceparent for %q. Instead got: %v", bad, err)
+		}
+	}
+}
+
+func TestMemoryTracer(t *testing.T) {
+	tracer := NewMemoryTracer()
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWithSpanContext(context.Background(), remote)
+
+	ctx, parent := tracer.Start(ctx, "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttribute("key", "value")
+	child.RecordError(errors.New("failed"))
+	child.End()
+	child.End()
+	parent.End()
+
+	spans := tracer.Spans()
+	if len(spans) != 2 || spans[0].Name != "child" || spans[1].Name != "parent" {
+		t.Fatalf("Expected the child and then the parent span. Instead got: %+v", spans)
+	}
+	if spans[1].TraceID != remote.TraceID || spans[1].ParentID != remote.SpanID {
+		t.Fatalf("Expected the parent to continue the remote trace. Instead got: %+v", spans[1])
+	}
+	if spans[0].TraceID != remote.TraceID || spans[0].ParentID != spans[1].SpanID {
+		t.Fatalf("Expected the child to be in the parent span. Instead got: %+v", spans[0])
+	}
+	if spans[0].Attributes["key"] != "value" || spans[0].Err == nil || spans[0].End.Before(spans[0].Start) {
+		t.Fatalf("Expected the child's attribute, error and times. Instead got: %+v", spans[0])
+	}
+
+	// without a parent a new trace is started
+	_, root := tracer.Start(context.Background(), "root")
+	root.End()
+	r := tracer.Find("root")
+	if len(r) != 1 || !r[0].IsValid() || r[0].TraceID == remote.TraceID || len(r[0].ParentID) != 0 {
+		t.Fatalf("Expected a root span of a new trace. Instead got: %+v", r)
+	}
+
+	// the noop tracer passes its parent on
+	ctx, span := NoopTracer{}.Start(ctx, "noop")
+	if sc, ok := SpanContextFromContext(ctx); !ok || sc.SpanID != span.SpanContext().SpanID {
+		t.Fatalf("Expected the noop span to keep its parent's SpanContext. Instead got: %+v", sc)
+	}
+
+	tracer.Reset()
+	if len(tracer.Spans()) != 0 {
+		t.Fatalf("Expected no spans after Reset. Instead got: %d", len(tracer.Spans()))
+	}
+}
@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+// adminUserStatuses are the filters offered on the admin user list, in display order
+var adminUserStatuses = []string{"current", "active", "inactive", "superuser", "deleted", "all"}
+
+// addAdminRoutes adds the user management console. Every page requires an active superuser.
+func (h *httpViewHandler) addAdminRoutes(r *mux.Router) {
+	/*
+		ROUTE							METHOD		Service Call
+		/admin/users/					GET			ListUsers
+		/admin/users/{id}				GET			GetUser
+		/admin/users/{id}				POST		UpdateUser
+		/admin/users/{id}/{action}		POST		see AdminUserAction
+	*/
+	r.HandleFunc("/admin/users/", h.requireSuperuser(h.AdminUsers)).Methods("GET").Name("adminUsers")
+	r.HandleFunc("/admin/users/{id}", h.requireSuperuser(h.AdminUser)).Methods("GET").Name("adminUser")
+	r.HandleFunc("/admin/users/{id}", h.requireSuperuser(h.AdminUserPost)).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/{action:activate|deactivate|promote|demote|reset-password|revoke-sessions|delete|restore}",
+		h.requireSuperuser(h.AdminUserAction)).Methods("POST")
+}
+
+// requireSuperuser only lets active superusers through to fn.
+// Visitors who are not logged in are sent to the login page; other users get 403 Forbidden.
+func (h *httpViewHandler) requireSuperuser(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := getAuthCtx(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !ctx.User.IsActive {
+			url, err := h.router.Get("login").URL()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, url.String(), 302)
+			return
+		}
+		if !ctx.User.IsSuperuser {
+			http.Error(w, ctx.T("auth.flash.forbidden"), http.StatusForbidden)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// AdminUsers Displays a page of users matching the search and status filter
+// Passes the following additional data to the template:
+// • Users (a UserList)
+// • Search and Status, the current filter
+// • Statuses
+// • AdminUsersURL and AdminInvitesURL
+// • NextURL, empty on the last page
+func (h *httpViewHandler) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	params := r.URL.Query()
+	q := UserQuery{
+		Search: params.Get("q"),
+		Cursor: params.Get("cursor"),
+	}
+	status := params.Get("status")
+	yes, no := true, false
+	switch status {
+	case "active":
+		q.IsActive = &yes
+	case "inactive":
+		q.IsActive = &no
+	case "superuser":
+		q.IsSuperuser = &yes
+	case "deleted":
+		q.IsDeleted = &yes
+	case "all":
+		q.IncludeDeleted = true
+	default:
+		status = "current"
+	}
+
+	list, err := h.authFor(r).ListUsers(r.Context(), q)
+	if err == ErrInvalidQuery {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	adminUsersURL, err := h.router.Get("adminUsers").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	adminInvitesURL, err := h.router.Get("adminInvites").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Data["Users"] = list
+	ctx.Data["Search"] = q.Search
+	ctx.Data["Status"] = status
+	ctx.Data["Statuses"] = adminUserStatuses
+	ctx.Data["AdminUsersURL"] = adminUsersURL.String()
+	ctx.Data["AdminInvitesURL"] = adminInvitesURL.String()
+	ctx.Data["NextURL"] = ""
+	if list.NextCursor != "" {
+		next := url.Values{"q": {q.Search}, "status": {status}, "cursor": {list.NextCursor}}
+		ctx.Data["NextURL"] = adminUsersURL.String() + "?" + next.Encode()
+	}
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.AdminUsers", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// AdminUser Displays a user's details with a form to edit them and the actions that apply to them
+// Passes the following additional data to the template:
+// • Account, the user being managed
+// • Actions
+// • AdminUserURL and AdminUsersURL
+func (h *httpViewHandler) AdminUser(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u, ok := h.adminGetUser(w, r)
+	if !ok {
+		return
+	}
+
+	adminUserURL, err := h.router.Get("adminUser").URL("id", u.ID.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	adminUsersURL, err := h.router.Get("adminUsers").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	actions := []string{"deactivate", "promote", "reset-password", "revoke-sessions", "delete"}
+	if !u.IsActive {
+		actions[0] = "activate"
+	}
+	if u.IsSuperuser {
+		actions[1] = "demote"
+	}
+	if u.IsDeleted {
+		actions[4] = "restore"
+	}
+
+	ctx.Data["Account"] = u
+	ctx.Data["Actions"] = actions
+	ctx.Data["AdminUserURL"] = adminUserURL.String()
+	ctx.Data["AdminUsersURL"] = adminUsersURL.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.AdminUser", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// AdminUserPost Handles POST submission of the edit form on the Admin User Template
+func (h *httpViewHandler) AdminUserPost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u, ok := h.adminGetUser(w, r)
+	if !ok {
+		return
+	}
+	url, err := h.router.Get("adminUser").URL("id", u.ID.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		sess.AddFlash(ctx.T("auth.flash.invalidEmail"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+	u.Email = e.Address
+	u.FirstName = r.FormValue("firstname")
+	u.LastName = r.FormValue("lastname")
+	u.Locale = strings.TrimSpace(r.FormValue("locale"))
+	u.UpdatedAt = time.Now()
+
+	_, err = h.authFor(r).UpdateUser(r.Context(), u)
+	switch err {
+	case nil:
+		sess.AddFlash(ctx.T("auth.flash.userUpdated"), "info")
+	case ErrAlreadyExists:
+		sess.AddFlash(ctx.T("auth.flash.emailInUse"), "error")
+	case ErrInvalidName:
+		sess.AddFlash(ctx.T("auth.flash.invalidName"), "error")
+	case ErrInvalidEmail:
+		sess.AddFlash(ctx.T("auth.flash.invalidEmail"), "error")
+	case ErrUserDeleted:
+		sess.AddFlash(ctx.T("auth.flash.userDeleted"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// AdminUserAction Handles the action buttons on the Admin User Template.
+// Admins cannot deactivate, demote or delete their own account so they cannot lock themselves out.
+func (h *httpViewHandler) AdminUserAction(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u, ok := h.adminGetUser(w, r)
+	if !ok {
+		return
+	}
+	url, err := h.router.Get("adminUser").URL("id", u.ID.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	action := mux.Vars(r)["action"]
+	if uuid.Equal(u.ID, ctx.User.ID) && (action == "deactivate" || action == "demote" || action == "delete") {
+		sess.AddFlash(ctx.T("auth.flash.adminSelf"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	flash := ctx.T("auth.flash.userUpdated")
+	switch action {
+	case "activate", "deactivate":
+		u.IsActive = action == "activate"
+		u.UpdatedAt = time.Now()
+		_, err = h.authFor(r).UpdateUser(r.Context(), u)
+	case "promote", "demote":
+		u.IsSuperuser = action == "promote"
+		u.UpdatedAt = time.Now()
+		_, err = h.authFor(r).UpdateUser(r.Context(), u)
+	case "reset-password":
+		err = h.authFor(r).BeginPasswordReset(r.Context(), u.Email)
+		flash = ctx.T("auth.flash.passwordResetSent", u.Email)
+	case "revoke-sessions":
+		_, err = h.authFor(r).RevokeSessions(r.Context(), u.ID)
+	case "delete":
+		_, err = h.authFor(r).DeleteUser(r.Context(), u.ID)
+	case "restore":
+		_, err = h.authFor(r).RestoreUser(r.Context(), u.ID)
+	}
+	switch err {
+	case nil:
+		sess.AddFlash(flash, "info")
+	case ErrUserDeleted:
+		sess.AddFlash(ctx.T("auth.flash.userDeleted"), "error")
+	case ErrUserInactive:
+		sess.AddFlash(ctx.T("auth.flash.userInactive"), "error")
+	case ErrAlreadyExists:
+		sess.AddFlash(ctx.T("auth.flash.emailInUse"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sess.Save(r, w)
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// adminGetUser gets the user named by the {id} route variable.
+// It writes a 404 and returns false if there is no such user.
+func (h *httpViewHandler) adminGetUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return User{}, false
+	}
+
+	u, err := h.auth.GetUser(r.Context(), id)
+	if err == ErrUserNotFound || err == ErrInvalidID {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return User{}, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return User{}, false
+	}
+	return u, true
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bryanjeal/go-helpers"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+// APIKeyHeader is the request header an API key can be sent in instead of "Authorization: Bearer <key>"
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyExpiryDays are the lifetimes offered on the API Keys page, in days. 0 is a key that doesn't expire.
+var apiKeyExpiryDays = []int{30, 90, 365, 0}
+
+// addAPIKeyRoutes adds the page where users manage their API keys
+func (h *httpViewHandler) addAPIKeyRoutes(r *mux.Router) {
+	/*
+		ROUTE						METHOD		Service Call
+		/api-keys/					GET			ListAPIKeys
+		/api-keys/					POST		CreateAPIKey
+		/api-keys/{id}/revoke		POST		RevokeAPIKey
+	*/
+	r.HandleFunc("/api-keys/", h.APIKeys).Methods("GET").Name("apiKeys")
+	r.HandleFunc("/api-keys/", h.APIKeysPost).Methods("POST")
+	r.HandleFunc("/api-keys/{id}/revoke", h.APIKeyRevoke).Methods("POST")
+}
+
+// APIKeyMiddleware authenticates requests that carry an API key, either as "Authorization: Bearer <key>"
+// or in the X-API-Key header. The key's user becomes the User of the request's auth context and the key its APIKey.
+// Requests without a key are passed on unchanged; bearer tokens that don't start with APIKeyPrefix are left for the application.
+// An invalid, expired or revoked key, or one whose user is deactivated or deleted, gets 401 Unauthorized.
+//
+// Wrap the application's API routes with it. The pages MakeHTTPHandler serves refuse requests with a key with 403 Forbidden.
+func APIKeyMiddleware(auth Service) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := requestAPIKey(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			u, k, err := auth.AuthenticateAPIKey(r.Context(), key)
+			if err == ErrInvalidAPIKey || err == ErrUserDeleted || err == ErrUserInactive {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, ErrInvalidAPIKey.Error(), http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			ctx, err := getAuthCtx(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ctx.User = u
+			ctx.APIKey = k
+			ctx.Locale = ResolveLocale(u.Locale, r.Header.Get("Accept-Language"))
+			r = r.WithContext(ContextWithLogFields(r.Context(), Fields{"user_id": u.ID.String(), "api_key_id": k.ID.String()}))
+			r = helpers.Ctx.Http.CtxSave(r, CtxKey, ctx)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequestAPIKey returns the API key APIKeyMiddleware authenticated r with.
+// ok is false when r was not authenticated with a key.
+func RequestAPIKey(r *http.Request) (key APIKey, ok bool) {
+	ctx, err := getAuthCtx(r)
+	if err != nil || ctx.APIKey.ID == uuid.Nil {
+		return APIKey{}, false
+	}
+	return ctx.APIKey, true
+}
+
+// RequireScope only lets requests through to next that are made by a logged in user or with an API key that has scope.
+// Other requests with a key get 403 Forbidden and requests from nobody 401 Unauthorized.
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := getAuthCtx(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !ctx.User.IsActive {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if ctx.APIKey.ID != uuid.Nil && !ctx.APIKey.Scopes.Has(scope) {
+			http.Error(w, ErrInvalidScope.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestAPIKey returns the API key sent with r, "" if there is none
+func requestAPIKey(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get(APIKeyHeader)); key != "" {
+		return key
+	}
+	a := r.Header.Get("Authorization")
+	if len(a) > len("Bearer ") && strings.EqualFold(a[:len("Bearer ")], "Bearer ") {
+		if key := strings.TrimSpace(a[len("Bearer "):]); strings.HasPrefix(key, APIKeyPrefix) {
+			return key
+		}
+	}
+	return ""
+}
+
+// APIKeys Displays the user's API keys with a form to create one, or redirects to the login page if not logged in
+// Passes the following additional data to the template:
+// • Keys
+// • Scopes, APIKeyScopes
+// • ExpiryDays, the lifetimes a key can be given
+// • APIKeysURL
+// • NewKey, the key that was just created. It is only set on the page APIKeysPost shows.
+func (h *httpViewHandler) APIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ctx.User.IsActive {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	h.renderAPIKeys(w, r, ctx)
+}
+
+// APIKeysPost Handles POST submission of the create form on the API Keys Template.
+// The new key is shown on the page it responds with; it can't be seen again.
+func (h *httpViewHandler) APIKeysPost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url, err := h.router.Get("apiKeys").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ctx.User.IsActive {
+		http.Error(w, ctx.T("auth.flash.loginRequired"), http.StatusUnauthorized)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// scopes are checkboxes when APIKeyScopes is set and a space separated list otherwise
+	scopes := append(r.Form["scope"], strings.Fields(r.FormValue("scopes"))...)
+	expiresAt := time.Time{}
+	if days, _ := strconv.Atoi(r.FormValue("expires")); days > 0 {
+		expiresAt = time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	}
+
+	_, key, err := h.authFor(r).CreateAPIKey(r.Context(), ctx.User.ID, r.FormValue("name"), scopes, expiresAt)
+	switch err {
+	case nil:
+		ctx.Data["NewKey"] = key
+		h.renderAPIKeys(w, r, ctx)
+		return
+	case ErrInvalidName:
+		sess.AddFlash(ctx.T("auth.flash.apiKeyNameRequired"), "error")
+	case ErrInvalidScope:
+		sess.AddFlash(ctx.T("auth.flash.apiKeyInvalidScope"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// APIKeyRevoke stops one of the user's API keys from working
+func (h *httpViewHandler) APIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ctx.User.IsActive {
+		http.Error(w, ctx.T("auth.flash.loginRequired"), http.StatusUnauthorized)
+		return
+	}
+
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, ErrAPIKeyNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	err = h.authFor(r).RevokeAPIKey(r.Context(), ctx.User.ID, id)
+	if err == ErrAPIKeyNotFound || err == ErrInvalidID {
+		http.Error(w, ErrAPIKeyNotFound.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.AddFlash(ctx.T("auth.flash.apiKeyRevoked"), "info")
+	sess.Save(r, w)
+
+	url, err := h.router.Get("apiKeys").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// renderAPIKeys writes the API Keys Template for the logged in user
+func (h *httpViewHandler) renderAPIKeys(w http.ResponseWriter, r *http.Request, ctx *authCtx) {
+	keys, err := h.auth.ListAPIKeys(r.Context(), ctx.User.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	url, err := h.router.Get("apiKeys").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Data["Keys"] = keys
+	ctx.Data["Scopes"] = APIKeyScopes
+	ctx.Data["ExpiryDays"] = apiKeyExpiryDays
+	ctx.Data["APIKeysURL"] = url.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.APIKeys", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+// addDataExportRoutes adds the self-service personal data export
+func (h *httpViewHandler) addDataExportRoutes(r *mux.Router) {
+	/*
+		ROUTE						METHOD		Service Call
+		/data-export/				GET
+		/data-export/				POST		BeginDataExport (in the background)
+		/data-export/{token}		GET
+		/data-export/{token}		POST		CompleteDataExport
+	*/
+	r.HandleFunc("/data-export/", h.DataExport).Methods("GET").Name("dataExport")
+	r.HandleFunc("/data-export/", h.DataExportPost).Methods("POST")
+	r.HandleFunc("/data-export/{token}", h.DataExportDownload).Methods("GET")
+	r.HandleFunc("/data-export/{token}", h.DataExportDownloadPost).Methods("POST")
+}
+
+// DataExport Displays the Data Export Template or redirects to the login page if not logged in
+// Passes the following additional data to the template:
+// • DataExportURL
+func (h *httpViewHandler) DataExport(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ctx.User.IsActive {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	dataExportURL, err := h.router.Get("dataExport").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Data["DataExportURL"] = dataExportURL.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.DataExport", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// DataExportPost Handles POST submission of the Data Export Template.
+// Gathering the data can take a while so the archive is built in the background
+// and the user is told to wait for the email with the download link.
+// A user can't start another export until theirs is built.
+func (h *httpViewHandler) DataExportPost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ctx.User.IsActive {
+		http.Error(w, ctx.T("auth.flash.loginRequired"), http.StatusUnauthorized)
+		return
+	}
+
+	url, err := h.router.Get("dataExport").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u := ctx.User
+	if _, pending := h.exporting.LoadOrStore(u.ID, true); pending {
+		sess.AddFlash(ctx.T("auth.flash.dataExportPending"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+	svc := h.authFor(r)
+	// the request is over before the export is, so its cancellation must not stop it
+	bg := detach(r.Context())
+	go func() {
+		defer h.exporting.Delete(u.ID)
+		err := svc.BeginDataExport(bg, u.ID)
+		if err != nil {
+			logCtx(bg, LevelError, "Error exporting user data", Fields{"target_id": u.ID, "error": err})
+		}
+	}()
+
+	sess.AddFlash(ctx.T("auth.flash.dataExportStarted", u.Email), "info")
+	sess.Save(r, w)
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// DataExportDownload Displays the Confirm Template for the link in a data export email,
+// so following the link doesn't use it up. Only the user the export is for can open it.
+func (h *httpViewHandler) DataExportDownload(w http.ResponseWriter, r *http.Request) {
+	if !h.checkDataExportUser(w, r) {
+		return
+	}
+	h.renderConfirm(w, r, "auth.Tpl.DataExportDownload")
+}
+
+// DataExportDownloadPost sends the archive for the token from a data export email.
+// The link works once; afterwards the user has to request a new export.
+func (h *httpViewHandler) DataExportDownloadPost(w http.ResponseWriter, r *http.Request) {
+	if !h.checkDataExportUser(w, r) {
+		return
+	}
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	archive, err := h.authFor(r).CompleteDataExport(r.Context(), mux.Vars(r)["token"])
+	switch err {
+	case nil:
+	case ErrInvalidToken, ErrUserDeleted, ErrUserInactive:
+		sess.AddFlash(ctx.T("auth.flash.invalidLink"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/", 302)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="data-export-`+time.Now().Format("2006-01-02")+`.zip"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(archive)
+}
+
+// checkDataExportUser makes sure the logged in user is the one the {token} route variable was issued to.
+// Visitors who are not logged in are sent to the login page and other users are told the link is invalid.
+// It returns false if the request has been answered.
+func (h *httpViewHandler) checkDataExportUser(w http.ResponseWriter, r *http.Request) bool {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if !ctx.User.IsActive {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return false
+	}
+	id, _, err := parseUserToken(mux.Vars(r)["token"])
+	if err != nil || !uuid.Equal(id, ctx.User.ID) {
+		sess.AddFlash(ctx.T("auth.flash.invalidLink"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/", 302)
+		return false
+	}
+	return true
+}
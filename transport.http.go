@@ -1,16 +1,22 @@
 package auth
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"net/mail"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bryanjeal/go-helpers"
 	tmpl "github.com/bryanjeal/go-tmpl"
 
-	"github.com/golang/glog"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"github.com/satori/go.uuid"
 )
 
 // CtxKey is where other libraries can find the AuthCtx struct within http.Request.Context()
@@ -18,6 +24,16 @@ const CtxKey = "auth.ctx"
 
 const sessKey = "auth.session"
 
+// MagicLoginBindBrowser can/should be set by applications using auth.
+// When true a magic login link only works in the browser session that requested it.
+var MagicLoginBindBrowser = false
+
+// sessMagicLoginKey holds the email a magic login link was requested for in this browser
+const sessMagicLoginKey = "auth.magicLogin"
+
+// sessLoginAtKey holds when the session was logged in (unix seconds). Sessions older than User.SessionsRevokedAt are ended.
+const sessLoginAtKey = "auth.loginAt"
+
 // httpViewHandler holds everything the Auth HTTP Views need to work
 type httpViewHandler struct {
 	auth    Service
@@ -25,15 +41,40 @@ type httpViewHandler struct {
 	session sessions.Store
 	tpl     *tmpl.TplSys
 	router  *mux.Router
+	// exporting holds the IDs of the users whose data export is being built
+	exporting sync.Map
 }
 
 type authCtx struct {
 	tmpl.Ctx
-	User User
+	User   User
+	Locale string
+	// Organization is the organization the user is working in, with their role in it, and
+	// Organizations every one they belong to. See ActiveOrganization.
+	Organization  UserOrganization
+	Organizations []UserOrganization
+	// APIKey is the key APIKeyMiddleware authenticated the request with. It is the zero APIKey for a session.
+	APIKey APIKey
+}
+
+// T translates key into the request's locale. Templates call it as {{ .T "key" args... }}.
+func (ctx *authCtx) T(key string, args ...interface{}) string {
+	return T(ctx.Locale, key, args...)
 }
 
 // MakeHTTPHandler returns a handler that exposes part or all of the service over predefined HTTP paths.
-func MakeHTTPHandler(auth Service, urlPrefix string, baseTmplName string, tpl *tmpl.TplSys, store sessions.Store) http.Handler {
+// A random CSRF key is generated on every call; use Config.MakeHTTPHandler to supply a fixed key.
+// An error is returned if the key can't be generated or a template can't be added to tpl.
+func MakeHTTPHandler(auth Service, urlPrefix string, baseTmplName string, tpl *tmpl.TplSys, store sessions.Store) (http.Handler, error) {
+	csrfKey, err := helpers.Crypto.GenerateRandomKey(32)
+	if err != nil {
+		return nil, fmt.Errorf("generating CSRF key: %v", err)
+	}
+	return makeHTTPHandler(auth, urlPrefix, baseTmplName, tpl, store, csrfKey)
+}
+
+// makeHTTPHandler builds the handler with the given CSRF key
+func makeHTTPHandler(auth Service, urlPrefix string, baseTmplName string, tpl *tmpl.TplSys, store sessions.Store, csrfKey []byte) (http.Handler, error) {
 	h := &httpViewHandler{
 		auth:    auth,
 		tpl:     tpl,
@@ -47,7 +88,7 @@ func MakeHTTPHandler(auth Service, urlPrefix string, baseTmplName string, tpl *t
 	for k, v := range HTMLTemplates {
 		_, err := h.tpl.AddTemplate(k, baseTmplName, v)
 		if err != nil {
-			glog.Fatalf("Expected to add Template \"%s\" to TplSys. Instead got error: %v", k, err)
+			return nil, fmt.Errorf("adding template %s: %v", k, err)
 		}
 	}
 
@@ -59,7 +100,7 @@ func MakeHTTPHandler(auth Service, urlPrefix string, baseTmplName string, tpl *t
 	/* need the following
 	ROUTE	METHOD					Service Call
 	/login GET
-	/login POST 					AuthenticateUser
+	/login POST 					AuthenticateUser, CompleteLogin
 	/logout
 	/register GET
 	/register POST					NewUserLocal
@@ -70,24 +111,54 @@ func MakeHTTPHandler(auth Service, urlPrefix string, baseTmplName string, tpl *t
 	/update GET
 	/update POST		 			UpdateUser
 	/delete GET
+	/magic-login GET
+	/magic-login POST				BeginMagicLogin
+	/magic-login/{token} GET		CompleteMagicLogin, CompleteLogin
+	/email-change GET
+	/email-change POST				BeginEmailChange
+	/email-change/{token} GET		CompleteEmailChange
+	/email-change/cancel/{token} GET
+	/email-change/cancel/{token} POST	CancelEmailChange
+	/data-export/...				see addDataExportRoutes
+	/logins/...						see addLoginHistoryRoutes
+	/invite/...						see addInviteRoutes
+	/webauthn/...					see addWebAuthnRoutes
+	/orgs/...						see addOrgRoutes
+	/api-keys/...					see addAPIKeyRoutes
+	/admin/...						see addAdminRoutes
 	*/
 
 	r.HandleFunc("/login/", h.Login).Methods("GET").Name("login")
 	r.HandleFunc("/login/", h.LoginPost).Methods("POST")
 	r.HandleFunc("/logout/", h.Logout).Methods("GET").Name("logout")
 	r.HandleFunc("/register/", h.Register).Methods("GET").Name("register")
-
-	csrfKey, err := helpers.Crypto.GenerateRandomKey(32)
-	if err != nil {
-		glog.Fatalf("Expected to generate random key for CSRF. Instead got error: %v", err)
-	}
-	return h.addMiddleware(csrf.Protect(csrfKey)(r))
+	r.HandleFunc("/register/", h.RegisterPost).Methods("POST")
+	r.HandleFunc("/magic-login/", h.MagicLogin).Methods("GET").Name("magicLogin")
+	r.HandleFunc("/magic-login/", h.MagicLoginPost).Methods("POST")
+	r.HandleFunc("/magic-login/{token}", h.MagicLoginComplete).Methods("GET")
+	r.HandleFunc("/email-change/", h.EmailChange).Methods("GET").Name("emailChange")
+	r.HandleFunc("/email-change/", h.EmailChangePost).Methods("POST")
+	r.HandleFunc("/email-change/cancel/{token}", h.EmailChangeCancel).Methods("GET")
+	r.HandleFunc("/email-change/cancel/{token}", h.EmailChangeCancelPost).Methods("POST")
+	r.HandleFunc("/email-change/{token}", h.EmailChangeComplete).Methods("GET")
+	h.addDataExportRoutes(r)
+	h.addLoginHistoryRoutes(r)
+	h.addWebAuthnRoutes(r)
+	h.addOrgRoutes(r)
+	h.addAdminRoutes(r)
+	h.addInviteRoutes(r)
+	h.addAPIKeyRoutes(r)
+
+	// the cookie is for every path so a token from one page works for the JSON endpoints under other paths
+	return h.addMiddleware(csrf.Protect(csrfKey, csrf.Path("/"))(r)), nil
 }
 
 // Login Displays Login Template or redirects to "/" if already logged in
 // Passes the following additional data to the template:
 // • LoginURL
 // • RegisterURL
+// • MagicLoginURL
+// • WebAuthnLoginBeginURL and WebAuthnLoginFinishURL
 func (h *httpViewHandler) Login(w http.ResponseWriter, r *http.Request) {
 	ctx, err := getAuthCtx(r)
 	if err != nil {
@@ -111,8 +182,20 @@ func (h *httpViewHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	magicLoginURL, err := h.router.Get("magicLogin").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	ctx.Data["LoginURL"] = loginURL.String()
 	ctx.Data["RegisterURL"] = registerURL.String()
+	ctx.Data["MagicLoginURL"] = magicLoginURL.String()
+	err = h.webAuthnURLs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	page, err := h.tpl.ExecuteTemplate("auth.Tpl.Login", ctx)
 	if err != nil {
@@ -130,27 +213,50 @@ func (h *httpViewHandler) LoginPost(w http.ResponseWriter, r *http.Request) {
 	email := r.FormValue("email")
 	password := r.FormValue("password")
 
-	u, err := h.auth.AuthenticateUser(email, password)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// startSession records the login, once the user has also used their passkey if they must
+	u, err := h.authFor(r).AuthenticateUser(ContextWithDeferredLogin(r.Context()), email, password)
 	if err == ErrIncorrectAuth {
-		sess.AddFlash("Error: Username and/or Password was incorrect!", "error")
+		sess.AddFlash(ctx.T("auth.flash.incorrectLogin"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/login", 302)
+		return
+	} else if err == ErrUserDeleted || err == ErrUserInactive {
+		sess.AddFlash(ctx.T("auth.flash.accountDisabled"), "error")
 		sess.Save(r, w)
 		http.Redirect(w, r, "/login", 302)
+		return
 	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	sess.Values["user"] = u
-	sess.Save(r, w)
-
-	http.Redirect(w, r, "/", 302)
+	h.startSession(w, r, sess, u, "password")
 }
 
 // Logout handles removing session data
 func (h *httpViewHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	sess, _ := h.session.Get(r, sessKey)
-	sess.AddFlash("You have been logged out.")
-	delete(sess.Values, "user")
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ctx.User.ID != uuid.Nil {
+		err = h.authFor(r).RecordAuditEvent(r.Context(), AuditEvent{Type: AuditLogout, TargetID: ctx.User.ID})
+		if err != nil {
+			logCtx(r.Context(), LevelError, "Error recording logout", Fields{"target_id": ctx.User.ID, "error": err})
+		}
+	}
+	sess.AddFlash(ctx.T("auth.flash.loggedOut"))
+	logOut(sess)
+	delete(sess.Values, sessWebAuthnPendingKey)
+	delete(sess.Values, sessWebAuthnPendingMethodKey)
 	sess.Save(r, w)
 
 	url, err := h.router.Get("login").URL()
@@ -169,6 +275,7 @@ func (h *httpViewHandler) Register(w http.ResponseWriter, r *http.Request) {
 	ctx, err := getAuthCtx(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	if ctx.User.IsActive {
@@ -190,7 +297,422 @@ func (h *httpViewHandler) Register(w http.ResponseWriter, r *http.Request) {
 	ctx.Data["LoginURL"] = loginURL.String()
 	ctx.Data["RegisterURL"] = registerURL.String()
 
-	w.Write([]byte("Register Page"))
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.Register", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// RegisterPost Handles POST submission of the Registration Template and logs the new user in
+func (h *httpViewHandler) RegisterPost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url, err := h.router.Get("register").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		sess.AddFlash(ctx.T("auth.flash.invalidEmail"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	u, err := h.authFor(r).NewUserLocal(r.Context(), e.Address, r.FormValue("password"), r.FormValue("firstname"), r.FormValue("lastname"), false)
+	if err != nil {
+		flash, ok := registerErrorFlash(ctx, err)
+		if !ok {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sess.AddFlash(flash, "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	sess.AddFlash(ctx.T("auth.flash.registered"), "info")
+	h.startSession(w, r, sess, u, "register")
+}
+
+// registerErrorFlash returns the flash message for a registration error the user can fix.
+// ok is false for any other error.
+func registerErrorFlash(ctx *authCtx, err error) (flash string, ok bool) {
+	switch err {
+	case ErrAlreadyExists, ErrUserDeleted:
+		return ctx.T("auth.flash.emailInUse"), true
+	case ErrInvalidEmail:
+		return ctx.T("auth.flash.invalidEmail"), true
+	case ErrInvalidName, ErrInvalidPassword:
+		return ctx.T("auth.flash.registerInvalid"), true
+	}
+	return "", false
+}
+
+// MagicLogin Displays the Magic Login Template or redirects to "/" if already logged in
+// Passes the following additional data to the template:
+// • MagicLoginURL
+func (h *httpViewHandler) MagicLogin(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ctx.User.IsActive {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	magicLoginURL, err := h.router.Get("magicLogin").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Data["MagicLoginURL"] = magicLoginURL.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.MagicLogin", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// MagicLoginPost Handles POST submission of the Magic Login Template.
+// The same message is shown whether or not the email belongs to an account.
+func (h *httpViewHandler) MagicLoginPost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// a malformed address is treated like an unknown one
+	e, err := mail.ParseAddress(r.FormValue("email"))
+	if err == nil {
+		err = h.authFor(r).BeginMagicLogin(r.Context(), e.Address)
+		if err != nil && err != ErrIncorrectAuth && err != ErrUserDeleted && err != ErrUserInactive {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if normalized, err := NormalizeEmail(e.Address); err == nil && MagicLoginBindBrowser {
+			sess.Values[sessMagicLoginKey] = normalized
+		}
+	}
+	sess.AddFlash(ctx.T("auth.flash.magicLoginSent"), "info")
+	sess.Save(r, w)
+
+	url, err := h.router.Get("login").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// MagicLoginComplete logs the user in with the token from a magic login link
+func (h *httpViewHandler) MagicLoginComplete(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	loginURL, err := h.router.Get("login").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invalid := func() {
+		sess.AddFlash(ctx.T("auth.flash.invalidLink"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, loginURL.String(), 302)
+	}
+
+	// a bound link is only accepted by the browser that asked for it.
+	// It is checked before the token is used up so opening the link in another browser doesn't waste it.
+	token := mux.Vars(r)["token"]
+	if MagicLoginBindBrowser {
+		requested, _ := sess.Values[sessMagicLoginKey].(string)
+		bound, err := h.magicLoginBound(r.Context(), token, requested)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !bound {
+			invalid()
+			return
+		}
+	}
+
+	u, err := h.authFor(r).CompleteMagicLogin(ContextWithDeferredLogin(r.Context()), token)
+	if err == ErrInvalidToken || err == ErrUserDeleted || err == ErrUserInactive {
+		invalid()
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	delete(sess.Values, sessMagicLoginKey)
+	h.startSession(w, r, sess, u, "magic_link")
+}
+
+// magicLoginBound reports whether a magic login token was sent to requested, the normalized address
+// the link was asked for in this browser
+func (h *httpViewHandler) magicLoginBound(ctx context.Context, token, requested string) (bool, error) {
+	id, _, err := parseUserToken(token)
+	if err != nil || len(requested) == 0 {
+		return false, nil
+	}
+	u, err := h.auth.GetUser(ctx, id)
+	if err == ErrUserNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	normalized, err := NormalizeEmail(u.Email)
+	return err == nil && normalized == requested, nil
+}
+
+// EmailChange Displays the Email Change Template or redirects to the login page if not logged in
+// Passes the following additional data to the template:
+// • EmailChangeURL
+func (h *httpViewHandler) EmailChange(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ctx.User.IsActive {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	emailChangeURL, err := h.router.Get("emailChange").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Data["EmailChangeURL"] = emailChangeURL.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.EmailChange", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// EmailChangePost Handles POST submission of the Email Change Template
+func (h *httpViewHandler) EmailChangePost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url, err := h.router.Get("emailChange").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ctx.User.IsActive {
+		http.Error(w, ctx.T("auth.flash.loginRequired"), http.StatusUnauthorized)
+		return
+	}
+
+	e, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		sess.AddFlash(ctx.T("auth.flash.invalidEmail"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	err = h.authFor(r).BeginEmailChange(r.Context(), ctx.User.ID, e.Address)
+	if err == ErrAlreadyExists {
+		sess.AddFlash(ctx.T("auth.flash.emailInUse"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sess.AddFlash(ctx.T("auth.flash.emailChangeSent", e.Address), "info")
+	sess.Save(r, w)
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// EmailChangeComplete moves the user to their new address with the token from the confirmation link
+func (h *httpViewHandler) EmailChangeComplete(w http.ResponseWriter, r *http.Request) {
+	u, err := h.authFor(r).CompleteEmailChange(r.Context(), mux.Vars(r)["token"])
+	h.finishEmailChange(w, r, u, err, "auth.flash.emailChanged")
+}
+
+// EmailChangeCancel Displays the Confirm Template for the cancel link sent to the old address.
+// Only the POST it submits uses the token, so a mail scanner fetching the link doesn't cancel the change.
+func (h *httpViewHandler) EmailChangeCancel(w http.ResponseWriter, r *http.Request) {
+	h.renderConfirm(w, r, "auth.Tpl.EmailChangeCancel")
+}
+
+// EmailChangeCancelPost cancels or reverts an email change with the token from the link sent to the old address
+func (h *httpViewHandler) EmailChangeCancelPost(w http.ResponseWriter, r *http.Request) {
+	u, err := h.authFor(r).CancelEmailChange(r.Context(), mux.Vars(r)["token"])
+	h.finishEmailChange(w, r, u, err, "auth.flash.emailChangeCancelled")
+}
+
+// finishEmailChange reports the outcome of an email change link and refreshes the logged in user
+func (h *httpViewHandler) finishEmailChange(w http.ResponseWriter, r *http.Request, u User, err error, successKey string) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, ctxErr := getAuthCtx(r)
+	if ctxErr != nil {
+		http.Error(w, ctxErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch err {
+	case nil:
+		sess.AddFlash(ctx.T(successKey), "info")
+		if uuid.Equal(ctx.User.ID, u.ID) {
+			sess.Values["user"] = u
+		}
+	case ErrInvalidToken, ErrUserDeleted, ErrUserInactive:
+		sess.AddFlash(ctx.T("auth.flash.invalidLink"), "error")
+	case ErrAlreadyExists:
+		sess.AddFlash(ctx.T("auth.flash.emailInUse"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/", 302)
+}
+
+// renderConfirm writes the Confirm Template, whose form POSTs back to the requested URL.
+// Links in emails that change something show it so following them doesn't act on its own.
+// Passes the following additional data to the template:
+// • Confirm, the prefix of the page's ".legend", ".explain" and ".submit" messages
+// • ConfirmURL
+func (h *httpViewHandler) renderConfirm(w http.ResponseWriter, r *http.Request, name string) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Data["Confirm"] = name
+	ctx.Data["ConfirmURL"] = r.URL.EscapedPath()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.Confirm", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// authFor returns the Service to handle r with. The audit events it records name
+// the logged in user and the client's address and user agent.
+// Behind a proxy, set r.RemoteAddr from the forwarding headers (i.e. with gorilla/handlers.ProxyHeaders).
+func (h *httpViewHandler) authFor(r *http.Request) Service {
+	info := AuditInfo{IP: r.RemoteAddr, UserAgent: r.UserAgent()}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		info.IP = host
+	}
+	if ctx, err := getAuthCtx(r); err == nil {
+		info.ActorID = ctx.User.ID
+	}
+	return h.auth.WithAuditInfo(info)
+}
+
+// startSession logs u in, records the login as method and redirects to "/", whichever way they proved who they are.
+// A user who must also use a passkey is left waiting for it in the session and sent to verify it instead;
+// their login is recorded once they have.
+func (h *httpViewHandler) startSession(w http.ResponseWriter, r *http.Request, sess *sessions.Session, u User, method string) {
+	required, err := h.requireWebAuthn(r.Context(), u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if required {
+		sess.Values[sessWebAuthnPendingKey] = u.ID.String()
+		sess.Values[sessWebAuthnPendingMethodKey] = method
+		sess.Save(r, w)
+		url, err := h.router.Get("webAuthnVerify").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	err = h.authFor(r).CompleteLogin(r.Context(), u, method)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	delete(sess.Values, sessWebAuthnPendingKey)
+	delete(sess.Values, sessWebAuthnPendingMethodKey)
+	logIn(sess, u)
+	sess.Save(r, w)
+	http.Redirect(w, r, "/", 302)
+}
+
+// logIn stores u in the session and records when they logged in
+func logIn(sess *sessions.Session, u User) {
+	sess.Values["user"] = u
+	sess.Values[sessLoginAtKey] = time.Now().Unix()
+}
+
+// logOut removes the user, and the organization they were working in, from the session
+func logOut(sess *sessions.Session) {
+	delete(sess.Values, "user")
+	delete(sess.Values, sessLoginAtKey)
+	delete(sess.Values, sessOrgKey)
+}
+
+// currentUser reloads the session's user so changes made by an admin apply to their next request.
+// The session is logged out if the user was removed, deactivated or deleted, or had their sessions revoked.
+func (h *httpViewHandler) currentUser(ctx context.Context, sess *sessions.Session, u User) User {
+	fresh, err := h.auth.GetUser(ctx, u.ID)
+	if err != nil && err != ErrUserNotFound && err != ErrInvalidID {
+		logCtx(ctx, LevelError, "Error reloading session user", Fields{"target_id": u.ID, "error": err})
+		return u
+	}
+
+	loginAt, _ := sess.Values[sessLoginAtKey].(int64)
+	revoked := !fresh.SessionsRevokedAt.IsZero() && loginAt <= fresh.SessionsRevokedAt.Unix()
+	if err != nil || !fresh.IsActive || fresh.IsDeleted || revoked {
+		logOut(sess)
+		return User{}
+	}
+
+	sess.Values["user"] = fresh
+	return fresh
 }
 
 // getAuthCtx is a helper to get or create a new Auth.Ctx
@@ -203,16 +725,19 @@ func getAuthCtx(r *http.Request) (*authCtx, error) {
 		return ctx, err
 	}
 
-	if err != helpers.ErrCtxNoValue {
-		if ctx, ok = ctxRaw.(*authCtx); !ok {
-			ctx = &authCtx{
-				Ctx: tmpl.Ctx{
-					Data: make(map[string]interface{}),
-				},
-			}
+	if ctx, ok = ctxRaw.(*authCtx); !ok {
+		ctx = &authCtx{
+			Ctx: tmpl.Ctx{
+				Data: make(map[string]interface{}),
+			},
 		}
 	}
 
+	// the CSRF token is only known once the request has been through csrf.Protect
+	if token := csrf.Token(r); token != "" {
+		ctx.CsrfToken = token
+	}
+
 	return ctx, nil
 }
 
@@ -224,25 +749,41 @@ func (h *httpViewHandler) addMiddleware(next http.Handler) http.Handler {
 
 // ServeHTTP satisfies http.Handler interface. This gathers various items we need into a common context.
 func (h *httpViewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o := h.startRequest(w, r)
+	defer o.end()
+	w, r = o.w, o.r
+
 	sess, _ := h.session.Get(r, sessKey)
 
 	ctx, err := getAuthCtx(r)
 	if err != nil {
-		glog.Errorf("Expected to get Auth Context. Instead got error: %v", err)
+		logCtx(r.Context(), LevelError, "Error getting auth context", Fields{"error": err})
+	}
+	// the pages are for people with a session; no scope lets an API key act on them
+	if ctx.APIKey.ID != uuid.Nil {
+		http.Error(w, ErrInvalidScope.Error(), http.StatusForbidden)
+		return
 	}
 
 	ctx.Flashes = sess.Flashes()
 	ctx.FlashesInfo = sess.Flashes("info")
 	ctx.FlashesWarn = sess.Flashes("warn")
 	ctx.FlashesError = sess.Flashes("error")
-	ctx.CsrfToken = csrf.Token(r)
 
-	usrRaw := sess.Values["user"]
-	usr, ok := usrRaw.(User)
-	if !ok {
-		usr = User{}
+	// gob.Register(&User{}) makes a stored User come back from the cookie as *User
+	usr := User{}
+	switch v := sess.Values["user"].(type) {
+	case User:
+		usr = h.currentUser(r.Context(), sess, v)
+	case *User:
+		usr = h.currentUser(r.Context(), sess, *v)
 	}
 	ctx.User = usr
+	ctx.Locale = ResolveLocale(usr.Locale, r.Header.Get("Accept-Language"))
+	if usr.ID != uuid.Nil {
+		r = r.WithContext(ContextWithLogFields(r.Context(), Fields{"user_id": usr.ID.String()}))
+		ctx.Organization, ctx.Organizations = h.activeOrganization(r.Context(), sess, usr)
+	}
 
 	r = helpers.Ctx.Http.CtxSave(r, CtxKey, ctx)
 	sess.Save(r, w)
@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+// addInviteRoutes adds the sign up page for invitations and the superuser pages that manage them
+func (h *httpViewHandler) addInviteRoutes(r *mux.Router) {
+	/*
+		ROUTE							METHOD		Service Call
+		/invite/{token}					GET			GetUserInvite
+		/invite/{token}					POST		AcceptUserInvite
+		/admin/invites/					GET			ListUserInvites
+		/admin/invites/					POST		InviteUser
+		/admin/invites/{id}/revoke		POST		RevokeUserInvite
+	*/
+	r.HandleFunc("/invite/{token}", h.UserInvite).Methods("GET").Name("userInvite")
+	r.HandleFunc("/invite/{token}", h.UserInvitePost).Methods("POST")
+	r.HandleFunc("/admin/invites/", h.requireSuperuser(h.AdminInvites)).Methods("GET").Name("adminInvites")
+	r.HandleFunc("/admin/invites/", h.requireSuperuser(h.AdminInvitesPost)).Methods("POST")
+	r.HandleFunc("/admin/invites/{id}/revoke", h.requireSuperuser(h.AdminInviteRevoke)).Methods("POST")
+}
+
+// UserInvite Displays the Registration Template for an invitation, with the invited address filled in,
+// or redirects to "/" if already logged in
+// Passes the following additional data to the template:
+// • Invite
+// • RegisterURL, the invitation link
+func (h *httpViewHandler) UserInvite(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ctx.User.IsActive {
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	inv, err := h.auth.GetUserInvite(r.Context(), token)
+	if err == ErrInvalidToken {
+		h.invalidInviteLink(w, r, ctx)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url, err := h.router.Get("userInvite").URL("token", token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Data["Invite"] = inv
+	ctx.Data["RegisterURL"] = url.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.Register", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// UserInvitePost Handles POST submission of the Registration Template for an invitation and logs the new user in.
+// The email address always comes from the invitation.
+func (h *httpViewHandler) UserInvitePost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	u, err := h.authFor(r).AcceptUserInvite(r.Context(), token, r.FormValue("password"), r.FormValue("firstname"), r.FormValue("lastname"))
+	if err == ErrInvalidToken {
+		h.invalidInviteLink(w, r, ctx)
+		return
+	} else if err != nil {
+		flash, ok := registerErrorFlash(ctx, err)
+		if !ok {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		url, err := h.router.Get("userInvite").URL("token", token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sess.AddFlash(flash, "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	sess.AddFlash(ctx.T("auth.flash.registered"), "info")
+	h.startSession(w, r, sess, u, "invite")
+}
+
+// invalidInviteLink sends visitors with a used, revoked or expired invitation to the login page
+func (h *httpViewHandler) invalidInviteLink(w http.ResponseWriter, r *http.Request, ctx *authCtx) {
+	sess, _ := h.session.Get(r, sessKey)
+	url, err := h.router.Get("login").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.AddFlash(ctx.T("auth.flash.invalidLink"), "error")
+	sess.Save(r, w)
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// AdminInvites Displays the pending invitations with a form to invite someone
+// Passes the following additional data to the template:
+// • Invites
+// • Roles, the organization roles an invitation can give
+// • AdminInvitesURL and AdminUsersURL
+func (h *httpViewHandler) AdminInvites(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	invites, err := h.auth.ListUserInvites(r.Context(), uuid.Nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	adminInvitesURL, err := h.router.Get("adminInvites").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	adminUsersURL, err := h.router.Get("adminUsers").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Data["Invites"] = invites
+	ctx.Data["Roles"] = OrgRoles
+	ctx.Data["AdminInvitesURL"] = adminInvitesURL.String()
+	ctx.Data["AdminUsersURL"] = adminUsersURL.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.AdminInvites", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// AdminInvitesPost Handles POST submission of the invite form on the Admin Invites Template.
+// The invitation gives the role in the organization when one is entered and makes the user a superuser when checked.
+func (h *httpViewHandler) AdminInvitesPost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url, err := h.router.Get("adminInvites").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		sess.AddFlash(ctx.T("auth.flash.invalidEmail"), "error")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	roles := []Role{}
+	if r.FormValue("superuser") != "" {
+		roles = append(roles, Role{Name: RoleSuperuser})
+	}
+	if org := strings.TrimSpace(r.FormValue("org")); org != "" {
+		id, err := uuid.FromString(org)
+		if err != nil {
+			sess.AddFlash(ctx.T("auth.flash.invalidRole"), "error")
+			sess.Save(r, w)
+			http.Redirect(w, r, url.String(), 302)
+			return
+		}
+		roles = append(roles, Role{OrgID: id, Name: r.FormValue("role")})
+	}
+
+	_, err = h.authFor(r).InviteUser(r.Context(), e.Address, ctx.User.ID, roles)
+	switch err {
+	case nil:
+		sess.AddFlash(ctx.T("auth.flash.userInviteSent", e.Address), "info")
+	case ErrAlreadyExists:
+		sess.AddFlash(ctx.T("auth.flash.emailInUse"), "error")
+	case ErrInvalidRole, ErrOrgNotFound:
+		sess.AddFlash(ctx.T("auth.flash.invalidRole"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// AdminInviteRevoke cancels a pending invitation
+func (h *httpViewHandler) AdminInviteRevoke(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, ErrInviteNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	err = h.authFor(r).RevokeUserInvite(r.Context(), id)
+	if err == ErrInviteNotFound || err == ErrInvalidID {
+		http.Error(w, ErrInviteNotFound.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.AddFlash(ctx.T("auth.flash.userInviteRevoked"), "info")
+	sess.Save(r, w)
+
+	url, err := h.router.Get("adminInvites").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, url.String(), 302)
+}
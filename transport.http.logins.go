@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+// addLoginHistoryRoutes adds the login history page and the "this wasn't me" link of login alerts
+func (h *httpViewHandler) addLoginHistoryRoutes(r *mux.Router) {
+	/*
+		ROUTE						METHOD		Service Call
+		/logins/					GET			ListLoginHistory
+		/logins/report/{token}		GET
+		/logins/report/{token}		POST		ReportLogin
+	*/
+	r.HandleFunc("/logins/", h.LoginHistory).Methods("GET").Name("loginHistory")
+	r.HandleFunc("/logins/report/{token}", h.LoginReport).Methods("GET")
+	r.HandleFunc("/logins/report/{token}", h.LoginReportPost).Methods("POST")
+}
+
+// LoginHistory Displays the user's recent logins or redirects to the login page if not logged in
+// Passes the following additional data to the template:
+// • Logins
+func (h *httpViewHandler) LoginHistory(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ctx.User.IsActive {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	logins, err := h.authFor(r).ListLoginHistory(r.Context(), ctx.User.ID, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Data["Logins"] = logins
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.LoginHistory", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// LoginReport Displays the Confirm Template for the "this wasn't me" link of a login alert
+func (h *httpViewHandler) LoginReport(w http.ResponseWriter, r *http.Request) {
+	h.renderConfirm(w, r, "auth.Tpl.LoginReport")
+}
+
+// LoginReportPost reports the login with the token from a login alert.
+// The user's sessions are revoked, including this one, and a password reset link is emailed to them.
+func (h *httpViewHandler) LoginReportPost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u, err := h.authFor(r).ReportLogin(r.Context(), mux.Vars(r)["token"])
+	switch err {
+	case nil:
+		if uuid.Equal(ctx.User.ID, u.ID) {
+			logOut(sess)
+		}
+		sess.AddFlash(ctx.T("auth.flash.loginReported", u.Email), "info")
+	case ErrInvalidToken, ErrUserDeleted, ErrUserInactive:
+		sess.AddFlash(ctx.T("auth.flash.invalidLink"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/", 302)
+}
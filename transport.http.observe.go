@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// observedRequest is a request being traced and measured. See startRequest.
+type observedRequest struct {
+	w     *statusRecorder
+	r     *http.Request
+	route string
+	span  Span
+	start time.Time
+}
+
+// RequestIDHeader is the header a request ID is read from and written to.
+// When a request doesn't have one an ID is generated. Everything logged while serving the request has it as "request_id".
+const RequestIDHeader = "X-Request-ID"
+
+// startRequest starts the span of a request, as a child of the caller's span when the request
+// has a W3C traceparent header, and adds its request ID to the log fields of its context.
+// Use the returned writer and request to serve it, then call end.
+func (h *httpViewHandler) startRequest(w http.ResponseWriter, r *http.Request) *observedRequest {
+	o := &observedRequest{
+		w:     &statusRecorder{ResponseWriter: w, status: http.StatusOK},
+		route: h.routeLabel(r),
+		start: time.Now(),
+	}
+
+	id := r.Header.Get(RequestIDHeader)
+	if len(id) == 0 || len(id) > 128 {
+		id = randomHex(8)
+	}
+	w.Header().Set(RequestIDHeader, id)
+	ctx := ContextWithLogFields(r.Context(), Fields{"request_id": id})
+	if sc, err := ParseTraceparent(r.Header.Get("traceparent")); err == nil {
+		ctx = ContextWithSpanContext(ctx, sc)
+	}
+	ctx, o.span = startSpan(ctx, r.Method+" "+o.route)
+	o.span.SetAttribute("http.method", r.Method)
+	o.span.SetAttribute("http.route", o.route)
+	o.r = r.WithContext(ctx)
+	return o
+}
+
+// end finishes the span and records the request in MetricHTTPRequests and MetricHTTPDuration
+func (o *observedRequest) end() {
+	code := strconv.Itoa(o.w.status)
+	o.span.SetAttribute("http.status_code", code)
+	o.span.End()
+
+	incMetric(MetricHTTPRequests, Labels{"route": o.route, "method": o.r.Method, "code": code})
+	observeSince(MetricHTTPDuration, o.start, Labels{"route": o.route, "method": o.r.Method})
+}
+
+// routeLabel names the route r matches by its path template, i.e. "/auth/magic-login/{token}",
+// so tokens and IDs don't create a series each
+func (h *httpViewHandler) routeLabel(r *http.Request) string {
+	var match mux.RouteMatch
+	if h.router.Match(r, &match) && match.Route != nil {
+		if tpl, err := match.Route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unmatched"
+}
@@ -0,0 +1,587 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/mail"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/satori/go.uuid"
+)
+
+// sessOrgKey holds the ID of the organization the user is working in. See activeOrganization.
+const sessOrgKey = "auth.org"
+
+// orgHandlerFunc handles a request about the organization named by the {id} route variable.
+// org carries the logged in user's role in it.
+type orgHandlerFunc func(w http.ResponseWriter, r *http.Request, org UserOrganization)
+
+// addOrgRoutes adds the organization pages, the organization switcher and the invitation link
+func (h *httpViewHandler) addOrgRoutes(r *mux.Router) {
+	/*
+		ROUTE									METHOD		Service Call
+		/orgs/									GET			ListUserOrganizations
+		/orgs/									POST		CreateOrganization
+		/orgs/switch							POST		GetMembership
+		/orgs/invite/{token}					GET			AcceptOrgInvite
+		/orgs/{id}								GET			ListOrgMembers, ListOrgInvites
+		/orgs/{id}								POST		UpdateOrganization
+		/orgs/{id}/delete						POST		DeleteOrganization
+		/orgs/{id}/invites/						POST		InviteOrgMember
+		/orgs/{id}/invites/{invite}/revoke		POST		RevokeOrgInvite
+		/orgs/{id}/members/{user}				POST		SetMemberRole
+		/orgs/{id}/members/{user}/remove		POST		RemoveOrgMember
+	*/
+	r.HandleFunc("/orgs/", h.Orgs).Methods("GET").Name("orgs")
+	r.HandleFunc("/orgs/", h.OrgsPost).Methods("POST")
+	r.HandleFunc("/orgs/switch", h.OrgSwitch).Methods("POST").Name("orgSwitch")
+	r.HandleFunc("/orgs/invite/{token}", h.OrgInviteAccept).Methods("GET")
+	r.HandleFunc("/orgs/{id}", h.requireOrgRole(OrgRoleMember, h.Org)).Methods("GET").Name("org")
+	r.HandleFunc("/orgs/{id}", h.requireOrgRole(OrgRoleOwner, h.OrgPost)).Methods("POST")
+	r.HandleFunc("/orgs/{id}/delete", h.requireOrgRole(OrgRoleOwner, h.OrgDelete)).Methods("POST")
+	r.HandleFunc("/orgs/{id}/invites/", h.requireOrgRole(OrgRoleAdmin, h.OrgInvitePost)).Methods("POST")
+	r.HandleFunc("/orgs/{id}/invites/{invite}/revoke", h.requireOrgRole(OrgRoleAdmin, h.OrgInviteRevoke)).Methods("POST")
+	r.HandleFunc("/orgs/{id}/members/{user}", h.requireOrgRole(OrgRoleAdmin, h.OrgMemberPost)).Methods("POST")
+	r.HandleFunc("/orgs/{id}/members/{user}/remove", h.requireOrgRole(OrgRoleMember, h.OrgMemberRemove)).Methods("POST")
+}
+
+// ActiveOrganization returns the organization the logged in user is working in, with their role in it.
+// ok is false when nobody is logged in or the user doesn't belong to an organization.
+// Applications use it to scope their data to the organization.
+func ActiveOrganization(r *http.Request) (org UserOrganization, ok bool) {
+	ctx, err := getAuthCtx(r)
+	if err != nil || ctx.Organization.ID == uuid.Nil {
+		return UserOrganization{}, false
+	}
+	return ctx.Organization, true
+}
+
+// activeOrganization finds the organization the session's user is working in and the organizations they can switch to.
+// It is the one last chosen with the switcher, or their first organization if they left that one or never chose.
+func (h *httpViewHandler) activeOrganization(ctx context.Context, sess *sessions.Session, u User) (UserOrganization, []UserOrganization) {
+	orgs, err := h.auth.ListUserOrganizations(ctx, u.ID)
+	if err != nil {
+		logCtx(ctx, LevelError, "Error listing organizations", Fields{"target_id": u.ID, "error": err})
+		return UserOrganization{}, nil
+	}
+	if len(orgs) == 0 {
+		delete(sess.Values, sessOrgKey)
+		return UserOrganization{}, orgs
+	}
+
+	id, _ := sess.Values[sessOrgKey].(string)
+	for _, o := range orgs {
+		if o.ID.String() == id {
+			return o, orgs
+		}
+	}
+	sess.Values[sessOrgKey] = orgs[0].ID.String()
+	return orgs[0], orgs
+}
+
+// requireOrgRole only lets members of the {id} organization with min or a more privileged role through to fn.
+// Superusers manage every organization as an owner. Visitors who are not logged in are sent to the login page,
+// non-members get 404 Not Found and members without the role 403 Forbidden.
+func (h *httpViewHandler) requireOrgRole(min string, fn orgHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := getAuthCtx(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !ctx.User.IsActive {
+			url, err := h.router.Get("login").URL()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, url.String(), 302)
+			return
+		}
+
+		id, err := uuid.FromString(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, ErrOrgNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		o, err := h.auth.GetOrganization(r.Context(), id)
+		if err == ErrOrgNotFound || err == ErrInvalidID {
+			http.Error(w, ErrOrgNotFound.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		org := UserOrganization{Organization: o}
+		m, err := h.auth.GetMembership(r.Context(), o.ID, ctx.User.ID)
+		switch {
+		case err == nil:
+			org.Role = m.Role
+		case err == ErrNotMember && ctx.User.IsSuperuser:
+			org.Role = OrgRoleOwner
+		case err == ErrNotMember:
+			http.Error(w, ErrOrgNotFound.Error(), http.StatusNotFound)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !OrgRoleAtLeast(org.Role, min) {
+			http.Error(w, ctx.T("auth.flash.forbidden"), http.StatusForbidden)
+			return
+		}
+
+		fn(w, r, org)
+	}
+}
+
+// Orgs Displays the user's organizations with the switcher and a form to create one, or redirects to the login page if not logged in
+// Passes the following additional data to the template:
+// • OrgsURL, the organization pages are OrgsURL followed by their ID
+// • OrgSwitchURL
+func (h *httpViewHandler) Orgs(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ctx.User.IsActive {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	orgsURL, err := h.router.Get("orgs").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	orgSwitchURL, err := h.router.Get("orgSwitch").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Data["OrgsURL"] = orgsURL.String()
+	ctx.Data["OrgSwitchURL"] = orgSwitchURL.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.Orgs", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// OrgsPost Handles POST submission of the create form on the Orgs Template.
+// The new organization becomes the active one.
+func (h *httpViewHandler) OrgsPost(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ctx.User.IsActive {
+		http.Error(w, ctx.T("auth.flash.loginRequired"), http.StatusUnauthorized)
+		return
+	}
+
+	o, err := h.authFor(r).CreateOrganization(r.Context(), r.FormValue("name"), ctx.User.ID)
+	if err == ErrInvalidName {
+		sess.AddFlash(ctx.T("auth.flash.orgNameRequired"), "error")
+		sess.Save(r, w)
+		url, err := h.router.Get("orgs").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sess.Values[sessOrgKey] = o.ID.String()
+	sess.AddFlash(ctx.T("auth.flash.orgCreated", o.Name), "info")
+	sess.Save(r, w)
+	h.redirectToOrg(w, r, o.ID)
+}
+
+// OrgSwitch makes the organization in the "org" form value the active one
+func (h *httpViewHandler) OrgSwitch(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ctx.User.IsActive {
+		http.Error(w, ctx.T("auth.flash.loginRequired"), http.StatusUnauthorized)
+		return
+	}
+
+	id, err := uuid.FromString(r.FormValue("org"))
+	if err != nil {
+		http.Error(w, ErrOrgNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	_, err = h.auth.GetMembership(r.Context(), id, ctx.User.ID)
+	if err == ErrNotMember || err == ErrInvalidID {
+		http.Error(w, ErrOrgNotFound.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sess.Values[sessOrgKey] = id.String()
+	sess.Save(r, w)
+	http.Redirect(w, r, "/", 302)
+}
+
+// OrgInviteAccept makes the logged in user a member with the token from an invitation link.
+// Visitors who are not logged in are asked to log in with the invited address and open the link again.
+func (h *httpViewHandler) OrgInviteAccept(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ctx.User.IsActive {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sess.AddFlash(ctx.T("auth.flash.orgInviteLogin"), "info")
+		sess.Save(r, w)
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	m, err := h.authFor(r).AcceptOrgInvite(r.Context(), mux.Vars(r)["token"], ctx.User.ID)
+	switch err {
+	case nil:
+		o, err := h.auth.GetOrganization(r.Context(), m.OrgID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sess.Values[sessOrgKey] = o.ID.String()
+		sess.AddFlash(ctx.T("auth.flash.orgJoined", o.Name), "info")
+	case ErrInvalidToken, ErrUserDeleted, ErrUserInactive:
+		sess.AddFlash(ctx.T("auth.flash.invalidLink"), "error")
+	case ErrAlreadyExists:
+		sess.AddFlash(ctx.T("auth.flash.orgAlreadyMember"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+
+	http.Redirect(w, r, "/", 302)
+}
+
+// Org Displays an organization's members. Admins also see its pending invitations and forms to manage them.
+// Passes the following additional data to the template:
+// • Org, the organization with the user's role in it
+// • Members
+// • Invites, empty unless the user is an admin
+// • Roles, the roles the user can give
+// • OrgURL and OrgsURL
+func (h *httpViewHandler) Org(w http.ResponseWriter, r *http.Request, org UserOrganization) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	members, err := h.auth.ListOrgMembers(r.Context(), org.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invites := []OrgInvite{}
+	if OrgRoleAtLeast(org.Role, OrgRoleAdmin) {
+		invites, err = h.auth.ListOrgInvites(r.Context(), org.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	orgURL, err := h.router.Get("org").URL("id", org.ID.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	orgsURL, err := h.router.Get("orgs").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Data["Org"] = org
+	ctx.Data["Members"] = members
+	ctx.Data["Invites"] = invites
+	ctx.Data["Roles"] = assignableOrgRoles(org.Role)
+	ctx.Data["OrgURL"] = orgURL.String()
+	ctx.Data["OrgsURL"] = orgsURL.String()
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.Org", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// OrgPost Handles POST submission of the rename form on the Org Template
+func (h *httpViewHandler) OrgPost(w http.ResponseWriter, r *http.Request, org UserOrganization) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	o := org.Organization
+	o.Name = r.FormValue("name")
+	_, err = h.authFor(r).UpdateOrganization(r.Context(), o)
+	switch err {
+	case nil:
+		sess.AddFlash(ctx.T("auth.flash.orgUpdated"), "info")
+	case ErrInvalidName:
+		sess.AddFlash(ctx.T("auth.flash.orgNameRequired"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+	h.redirectToOrg(w, r, org.ID)
+}
+
+// OrgDelete removes the organization
+func (h *httpViewHandler) OrgDelete(w http.ResponseWriter, r *http.Request, org UserOrganization) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = h.authFor(r).DeleteOrganization(r.Context(), org.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.AddFlash(ctx.T("auth.flash.orgDeleted", org.Name), "info")
+	sess.Save(r, w)
+
+	url, err := h.router.Get("orgs").URL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// OrgInvitePost Handles POST submission of the invite form on the Org Template.
+// Only owners can invite owners.
+func (h *httpViewHandler) OrgInvitePost(w http.ResponseWriter, r *http.Request, org UserOrganization) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	role := r.FormValue("role")
+	if !canAssignOrgRole(org.Role, role) {
+		http.Error(w, ctx.T("auth.flash.forbidden"), http.StatusForbidden)
+		return
+	}
+	e, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		sess.AddFlash(ctx.T("auth.flash.invalidEmail"), "error")
+		sess.Save(r, w)
+		h.redirectToOrg(w, r, org.ID)
+		return
+	}
+
+	_, err = h.authFor(r).InviteOrgMember(r.Context(), org.ID, ctx.User.ID, e.Address, role)
+	switch err {
+	case nil:
+		sess.AddFlash(ctx.T("auth.flash.orgInviteSent", e.Address), "info")
+	case ErrAlreadyExists:
+		sess.AddFlash(ctx.T("auth.flash.orgMemberExists", e.Address), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+	h.redirectToOrg(w, r, org.ID)
+}
+
+// OrgInviteRevoke cancels one of the organization's pending invitations
+func (h *httpViewHandler) OrgInviteRevoke(w http.ResponseWriter, r *http.Request, org UserOrganization) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := uuid.FromString(mux.Vars(r)["invite"])
+	if err != nil {
+		http.Error(w, ErrInviteNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	err = h.authFor(r).RevokeOrgInvite(r.Context(), org.ID, id)
+	if err == ErrInviteNotFound || err == ErrInvalidID {
+		http.Error(w, ErrInviteNotFound.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.AddFlash(ctx.T("auth.flash.orgInviteRevoked"), "info")
+	sess.Save(r, w)
+	h.redirectToOrg(w, r, org.ID)
+}
+
+// OrgMemberPost Handles the role form of a member on the Org Template.
+// Only owners can change the role of an owner or make someone an owner.
+func (h *httpViewHandler) OrgMemberPost(w http.ResponseWriter, r *http.Request, org UserOrganization) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m, ok := h.orgGetMember(w, r, org)
+	if !ok {
+		return
+	}
+	role := r.FormValue("role")
+	if !canAssignOrgRole(org.Role, role) || !canAssignOrgRole(org.Role, m.Role) {
+		http.Error(w, ctx.T("auth.flash.forbidden"), http.StatusForbidden)
+		return
+	}
+
+	_, err = h.authFor(r).SetMemberRole(r.Context(), org.ID, m.UserID, role)
+	switch err {
+	case nil:
+		sess.AddFlash(ctx.T("auth.flash.orgMemberUpdated"), "info")
+	case ErrLastOwner:
+		sess.AddFlash(ctx.T("auth.flash.orgLastOwner"), "error")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.Save(r, w)
+	h.redirectToOrg(w, r, org.ID)
+}
+
+// OrgMemberRemove removes a member from the organization. Members can remove themselves to leave it;
+// removing anyone else needs an admin, and removing an owner an owner.
+func (h *httpViewHandler) OrgMemberRemove(w http.ResponseWriter, r *http.Request, org UserOrganization) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m, ok := h.orgGetMember(w, r, org)
+	if !ok {
+		return
+	}
+	leaving := uuid.Equal(m.UserID, ctx.User.ID)
+	if !leaving && (!OrgRoleAtLeast(org.Role, OrgRoleAdmin) || !canAssignOrgRole(org.Role, m.Role)) {
+		http.Error(w, ctx.T("auth.flash.forbidden"), http.StatusForbidden)
+		return
+	}
+
+	err = h.authFor(r).RemoveOrgMember(r.Context(), org.ID, m.UserID)
+	switch {
+	case err == ErrLastOwner:
+		sess.AddFlash(ctx.T("auth.flash.orgLastOwner"), "error")
+		sess.Save(r, w)
+		h.redirectToOrg(w, r, org.ID)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case leaving:
+		sess.AddFlash(ctx.T("auth.flash.orgLeft", org.Name), "info")
+		sess.Save(r, w)
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	sess.AddFlash(ctx.T("auth.flash.orgMemberRemoved"), "info")
+	sess.Save(r, w)
+	h.redirectToOrg(w, r, org.ID)
+}
+
+// orgGetMember gets the membership of the user named by the {user} route variable.
+// It writes a 404 and returns false if they don't belong to org.
+func (h *httpViewHandler) orgGetMember(w http.ResponseWriter, r *http.Request, org UserOrganization) (Membership, bool) {
+	id, err := uuid.FromString(mux.Vars(r)["user"])
+	if err != nil {
+		http.Error(w, ErrNotMember.Error(), http.StatusNotFound)
+		return Membership{}, false
+	}
+
+	m, err := h.auth.GetMembership(r.Context(), org.ID, id)
+	if err == ErrNotMember || err == ErrInvalidID {
+		http.Error(w, ErrNotMember.Error(), http.StatusNotFound)
+		return Membership{}, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return Membership{}, false
+	}
+	return m, true
+}
+
+// redirectToOrg redirects to the organization's page
+func (h *httpViewHandler) redirectToOrg(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	url, err := h.router.Get("org").URL("id", id.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, url.String(), 302)
+}
+
+// canAssignOrgRole reports whether a member with role can give or take away target.
+// Admins manage admins and members; only owners manage owners.
+func canAssignOrgRole(role, target string) bool {
+	if orgRoleRank(target) < 0 || !OrgRoleAtLeast(role, OrgRoleAdmin) {
+		return false
+	}
+	return target != OrgRoleOwner || role == OrgRoleOwner
+}
+
+// assignableOrgRoles lists the roles a member with role can give, from most to least privileged
+func assignableOrgRoles(role string) []string {
+	roles := []string{}
+	for _, r := range OrgRoles {
+		if canAssignOrgRole(role, r) {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,363 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/satori/go.uuid"
+)
+
+// WebAuthnSecondFactor can/should be set by applications using auth.
+// When true users who have registered a passkey must also use it after logging in with their password or a magic link.
+// Passkeys can always be used on their own to log in.
+var WebAuthnSecondFactor = false
+
+// sessWebAuthnPendingKey holds the ID of a user who entered their password, or used a magic link, but still has to use a passkey
+const sessWebAuthnPendingKey = "auth.webAuthnPending"
+
+// sessWebAuthnPendingMethodKey holds how that user proved who they are, so the login can be recorded as e.g. "password+passkey"
+const sessWebAuthnPendingMethodKey = "auth.webAuthnPendingMethod"
+
+// maxWebAuthnBody limits the size of ceremony requests
+const maxWebAuthnBody = 64 << 10
+
+// addWebAuthnRoutes adds the passkey pages and JSON endpoints
+func (h *httpViewHandler) addWebAuthnRoutes(r *mux.Router) {
+	/*
+		ROUTE							METHOD		Service Call
+		/webauthn/						GET			ListWebAuthnCredentials
+		/webauthn/verify/				GET
+		/webauthn/register/begin		POST		BeginWebAuthnRegistration
+		/webauthn/register/finish		POST		FinishWebAuthnRegistration
+		/webauthn/login/begin			POST		BeginWebAuthnLogin
+		/webauthn/login/finish			POST		FinishWebAuthnLogin, CompleteLogin
+		/webauthn/{id}					DELETE		DeleteWebAuthnCredential
+	*/
+	r.HandleFunc("/webauthn/", h.WebAuthn).Methods("GET").Name("webAuthn")
+	r.HandleFunc("/webauthn/verify/", h.WebAuthnVerify).Methods("GET").Name("webAuthnVerify")
+	r.HandleFunc("/webauthn/register/begin", h.WebAuthnRegisterBegin).Methods("POST").Name("webAuthnRegisterBegin")
+	r.HandleFunc("/webauthn/register/finish", h.WebAuthnRegisterFinish).Methods("POST").Name("webAuthnRegisterFinish")
+	r.HandleFunc("/webauthn/login/begin", h.WebAuthnLoginBegin).Methods("POST").Name("webAuthnLoginBegin")
+	r.HandleFunc("/webauthn/login/finish", h.WebAuthnLoginFinish).Methods("POST").Name("webAuthnLoginFinish")
+	r.HandleFunc("/webauthn/{id}", h.WebAuthnDelete).Methods("DELETE").Name("webAuthnDelete")
+}
+
+// webAuthnURLs adds the URLs the passkey script calls to ctx.Data
+func (h *httpViewHandler) webAuthnURLs(ctx *authCtx) error {
+	for key, name := range map[string]string{
+		"WebAuthnRegisterBeginURL":  "webAuthnRegisterBegin",
+		"WebAuthnRegisterFinishURL": "webAuthnRegisterFinish",
+		"WebAuthnLoginBeginURL":     "webAuthnLoginBegin",
+		"WebAuthnLoginFinishURL":    "webAuthnLoginFinish",
+		"WebAuthnURL":               "webAuthn",
+	} {
+		url, err := h.router.Get(name).URL()
+		if err != nil {
+			return err
+		}
+		ctx.Data[key] = url.String()
+	}
+	return nil
+}
+
+// WebAuthn Displays the user's passkeys or redirects to the login page if not logged in
+// Passes the following additional data to the template:
+// • Credentials
+// • WebAuthnRegisterBeginURL, WebAuthnRegisterFinishURL and WebAuthnURL
+func (h *httpViewHandler) WebAuthn(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ctx.User.IsActive {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	creds, err := h.authFor(r).ListWebAuthnCredentials(r.Context(), ctx.User.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = h.webAuthnURLs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Data["Credentials"] = creds
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.WebAuthn", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// WebAuthnVerify Displays the second factor page to a user who has entered their password
+// Passes the following additional data to the template:
+// • WebAuthnLoginBeginURL and WebAuthnLoginFinishURL
+func (h *httpViewHandler) WebAuthnVerify(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := sess.Values[sessWebAuthnPendingKey].(string); !ok {
+		url, err := h.router.Get("login").URL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, url.String(), 302)
+		return
+	}
+
+	err = h.webAuthnURLs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page, err := h.tpl.ExecuteTemplate("auth.Tpl.WebAuthnVerify", ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(page)
+}
+
+// WebAuthnRegisterBegin returns the options for registering a passkey for the logged in user
+func (h *httpViewHandler) WebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ctx.User.IsActive {
+		writeJSONError(w, http.StatusUnauthorized, ctx.T("auth.flash.loginRequired"))
+		return
+	}
+
+	opts, err := h.authFor(r).BeginWebAuthnRegistration(r.Context(), ctx.User.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, opts)
+}
+
+// WebAuthnRegisterFinish stores the passkey created by the browser for the logged in user
+func (h *httpViewHandler) WebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ctx.User.IsActive {
+		writeJSONError(w, http.StatusUnauthorized, ctx.T("auth.flash.loginRequired"))
+		return
+	}
+
+	resp := WebAuthnAttestationResponse{}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebAuthnBody)).Decode(&resp)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, ctx.T("auth.flash.passkeyFailed"))
+		return
+	}
+
+	c, err := h.authFor(r).FinishWebAuthnRegistration(r.Context(), ctx.User.ID, resp)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, c)
+	case ErrWebAuthnFailed, ErrInvalidToken:
+		writeJSONError(w, http.StatusBadRequest, ctx.T("auth.flash.passkeyFailed"))
+	case ErrAlreadyExists:
+		writeJSONError(w, http.StatusConflict, ctx.T("auth.flash.passkeyExists"))
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// WebAuthnLoginBegin returns the options for logging in with a passkey.
+// The JSON body may contain the email of the account; a user completing
+// a second factor is always asked for one of their own passkeys.
+func (h *httpViewHandler) WebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	req := struct {
+		Email string `json:"email"`
+	}{}
+	// an empty body asks for any discoverable passkey
+	json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebAuthnBody)).Decode(&req)
+
+	if pending, ok := pendingWebAuthnUser(sess); ok {
+		u, err := h.authFor(r).GetUser(r.Context(), pending)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		req.Email = u.Email
+	}
+
+	// a malformed address is treated like an unknown one
+	if len(req.Email) > 0 {
+		if _, err := mail.ParseAddress(req.Email); err != nil {
+			writeJSONError(w, http.StatusBadRequest, ctx.T("auth.flash.passkeyFailed"))
+			return
+		}
+	}
+
+	opts, err := h.authFor(r).BeginWebAuthnLogin(r.Context(), req.Email)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, opts)
+	case ErrIncorrectAuth, ErrCredentialNotFound, ErrUserDeleted, ErrUserInactive:
+		writeJSONError(w, http.StatusBadRequest, ctx.T("auth.flash.passkeyFailed"))
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// WebAuthnLoginFinish logs the user in with the passkey assertion in the JSON body.
+// On success it responds with the URL to continue to as {"redirect": "/"}.
+func (h *httpViewHandler) WebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	sess, _ := h.session.Get(r, sessKey)
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := WebAuthnAssertionResponse{}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebAuthnBody)).Decode(&resp)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, ctx.T("auth.flash.passkeyFailed"))
+		return
+	}
+
+	// the login is recorded below, with the method the user started it with
+	u, err := h.authFor(r).FinishWebAuthnLogin(ContextWithDeferredLogin(r.Context()), resp)
+	switch err {
+	case nil:
+	case ErrWebAuthnFailed, ErrInvalidToken, ErrCredentialNotFound, ErrUserDeleted, ErrUserInactive:
+		writeJSONError(w, http.StatusBadRequest, ctx.T("auth.flash.passkeyFailed"))
+		return
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// a second factor must come from the user who entered their password
+	method := "passkey"
+	if pending, ok := pendingWebAuthnUser(sess); ok {
+		if !uuid.Equal(pending, u.ID) {
+			writeJSONError(w, http.StatusBadRequest, ctx.T("auth.flash.passkeyFailed"))
+			return
+		}
+		if first, ok := sess.Values[sessWebAuthnPendingMethodKey].(string); ok {
+			method = first + "+passkey"
+		}
+	}
+
+	err = h.authFor(r).CompleteLogin(r.Context(), u, method)
+	switch err {
+	case nil:
+	case ErrUserDeleted, ErrUserInactive:
+		writeJSONError(w, http.StatusBadRequest, ctx.T("auth.flash.passkeyFailed"))
+		return
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	delete(sess.Values, sessWebAuthnPendingKey)
+	delete(sess.Values, sessWebAuthnPendingMethodKey)
+	logIn(sess, u)
+	sess.Save(r, w)
+
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/"})
+}
+
+// WebAuthnDelete removes one of the logged in user's passkeys
+func (h *httpViewHandler) WebAuthnDelete(w http.ResponseWriter, r *http.Request) {
+	ctx, err := getAuthCtx(r)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ctx.User.IsActive {
+		writeJSONError(w, http.StatusUnauthorized, ctx.T("auth.flash.loginRequired"))
+		return
+	}
+
+	id, err := uuid.FromString(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, ErrCredentialNotFound.Error())
+		return
+	}
+
+	err = h.authFor(r).DeleteWebAuthnCredential(r.Context(), ctx.User.ID, id)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, map[string]string{})
+	case ErrCredentialNotFound, ErrInvalidID:
+		writeJSONError(w, http.StatusNotFound, ErrCredentialNotFound.Error())
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// requireWebAuthn reports whether u must also use a passkey after proving who they are another way
+func (h *httpViewHandler) requireWebAuthn(ctx context.Context, u User) (bool, error) {
+	if !WebAuthnSecondFactor {
+		return false, nil
+	}
+	creds, err := h.auth.ListWebAuthnCredentials(ctx, u.ID)
+	if err != nil {
+		return false, err
+	}
+	return len(creds) > 0, nil
+}
+
+// pendingWebAuthnUser returns the user waiting to complete a second factor in this session
+func pendingWebAuthnUser(sess *sessions.Session) (uuid.UUID, bool) {
+	raw, ok := sess.Values[sessWebAuthnPendingKey].(string)
+	if !ok {
+		return uuid.Nil, false
+	}
+	id, err := uuid.FromString(raw)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+// writeJSON writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes {"error": msg}
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -2,7 +2,6 @@ package auth
 
 import (
 	"encoding/gob"
-	"net/mail"
 	"strings"
 	"time"
 
@@ -13,31 +12,76 @@ import (
 // User Model holds account details and a slice of Providers
 // Providers are a "linked" oAuth accounts (associated by email address)
 type User struct {
-	ID          uuid.UUID
-	Email       string
-	Password    string
-	FirstName   string
-	LastName    string
-	IsActive    bool      `db:"is_active"`
-	IsSuperuser bool      `db:"is_superuser"`
-	IsDeleted   bool      `db:"is_deleted"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
-	DeletedAt   time.Time `db:"deleted_at"`
-	AvatarURL   string    `db:"avatar_url"`
-	Providers   []goth.User
-	newPassword bool
-	rawPassword string
+	ID    uuid.UUID
+	Email string
+	// NormalizedEmail is Email in the form that must be unique. See NormalizeEmail.
+	// A deleted user's address is released when ReuseDeletedEmails is set.
+	NormalizedEmail string `db:"email_normalized"`
+	Password        string `json:"-"`
+	FirstName       string
+	LastName        string
+	IsActive        bool      `db:"is_active"`
+	IsSuperuser     bool      `db:"is_superuser"`
+	IsDeleted       bool      `db:"is_deleted"`
+	CreatedAt       time.Time `db:"created_at"`
+	UpdatedAt       time.Time `db:"updated_at"`
+	DeletedAt       time.Time `db:"deleted_at"`
+	AvatarURL       string    `db:"avatar_url"`
+	Locale          string    `db:"locale"`
+	// SessionsRevokedAt ends every session started before it. See RevokeSessions.
+	SessionsRevokedAt time.Time `db:"sessions_revoked_at"`
+	Providers         []goth.User
+	newPassword       bool
+	rawPassword       string
+}
+
+// ReuseDeletedEmails lets a new account use the email address of a deleted user.
+// When false (the default) the address stays reserved until the deleted user is purged.
+// can/should be set by applications using auth
+var ReuseDeletedEmails = false
+
+// deletedEmailPrefix marks the NormalizedEmail of a deleted user whose address was released
+const deletedEmailPrefix = "deleted:"
+
+// checkUsable returns ErrUserDeleted or ErrUserInactive if u can't log in or manage their account
+func (u User) checkUsable() error {
+	if u.IsDeleted {
+		return ErrUserDeleted
+	}
+	if !u.IsActive {
+		return ErrUserInactive
+	}
+	return nil
+}
+
+// Email change statuses
+const (
+	EmailChangePending   = "pending"
+	EmailChangeCompleted = "completed"
+	EmailChangeCancelled = "cancelled"
+)
+
+// EmailChange records a request to move a user to a new email address.
+// OldEmail is kept so the change can be reverted from the link sent to the old address.
+type EmailChange struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID `db:"user_id"`
+	OldEmail  string    `db:"old_email"`
+	NewEmail  string    `db:"new_email"`
+	Status    string    `db:"status"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
 }
 
 // Validate will check the User struct fields to ensure they are valid
 func (u *User) Validate() error {
-	// Check Email
-	e, err := mail.ParseAddress(u.Email)
+	// Check and normalize Email
+	email, normalized, err := normalizeEmail(u.Email)
 	if err != nil {
 		return err
 	}
-	u.Email = e.Address
+	u.Email = email
+	u.NormalizedEmail = normalized
 
 	// Check Password
 	if u.newPassword {
@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// RoleSuperuser is the name of the Role that makes an invited user a superuser
+const RoleSuperuser = "superuser"
+
+// Role is given to an invited user when they accept: RoleSuperuser, which has no OrgID,
+// or one of the OrgRoles in the OrgID organization.
+type Role struct {
+	OrgID uuid.UUID `json:"org_id"`
+	Name  string    `json:"name"`
+}
+
+// Roles are the roles of a UserInvite. They are stored as JSON.
+type Roles []Role
+
+// Value implements driver.Valuer
+func (r Roles) Value() (driver.Value, error) {
+	if r == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(r)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner
+func (r *Roles) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	case nil:
+		*r = nil
+		return nil
+	default:
+		return errors.New("auth: cannot scan roles")
+	}
+	return json.Unmarshal(b, r)
+}
+
+// IsSuperuser reports whether r has RoleSuperuser
+func (r Roles) IsSuperuser() bool {
+	for _, role := range r {
+		if role.Name == RoleSuperuser && role.OrgID == uuid.Nil {
+			return true
+		}
+	}
+	return false
+}
+
+// InOrg returns the role r gives in the organization, "" if there is none
+func (r Roles) InOrg(orgID uuid.UUID) string {
+	for _, role := range r {
+		if role.OrgID != uuid.Nil && uuid.Equal(role.OrgID, orgID) {
+			return role.Name
+		}
+	}
+	return ""
+}
+
+// String formats r for audit details, i.e. "superuser,<org id>:admin"
+func (r Roles) String() string {
+	var b []byte
+	for i, role := range r {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		if role.OrgID != uuid.Nil {
+			b = append(b, role.OrgID.String()+":"...)
+		}
+		b = append(b, role.Name...)
+	}
+	return string(b)
+}
+
+// UserInvite statuses. Invitations and OrgInvites that are still pending when they expire are marked InviteExpired.
+const (
+	UserInvitePending  = "pending"
+	UserInviteAccepted = "accepted"
+	UserInviteRevoked  = "revoked"
+	InviteExpired      = "expired"
+)
+
+// UserInvite invites someone without an account to sign up with an email address.
+// Roles are given to the user created when it is accepted from the link in UserInviteEmail.
+type UserInvite struct {
+	ID     uuid.UUID `db:"id" json:"id"`
+	Email  string    `db:"email" json:"email"`
+	Roles  Roles     `db:"roles" json:"roles"`
+	Status string    `db:"status" json:"status"`
+	// InvitedBy is the user who sent the invitation and AcceptedBy the user created from it
+	InvitedBy  uuid.UUID `db:"invited_by" json:"invited_by"`
+	AcceptedBy uuid.UUID `db:"accepted_by" json:"accepted_by"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at" json:"updated_at"`
+	ExpiresAt  time.Time `db:"expires_at" json:"expires_at"`
+}
+
+func (s *authService) InviteUser(ctx context.Context, email string, inviterID uuid.UUID, roles []Role) (UserInvite, error) {
+	e, err := mail.ParseAddress(email)
+	if err != nil {
+		return UserInvite{}, err
+	}
+	inviter, err := s.GetUser(ctx, inviterID)
+	if err != nil {
+		return UserInvite{}, err
+	}
+	err = s.checkEmailAvailable(ctx, e.Address)
+	if err != nil {
+		return UserInvite{}, err
+	}
+
+	// every organization must exist and be given one role
+	orgs := map[uuid.UUID]Organization{}
+	for _, role := range roles {
+		if role.OrgID == uuid.Nil {
+			if role.Name != RoleSuperuser {
+				return UserInvite{}, ErrInvalidRole
+			}
+			continue
+		}
+		if _, ok := orgs[role.OrgID]; ok || orgRoleRank(role.Name) < 0 {
+			return UserInvite{}, ErrInvalidRole
+		}
+		o, err := s.GetOrganization(ctx, role.OrgID)
+		if err != nil {
+			return UserInvite{}, err
+		}
+		orgs[o.ID] = o
+	}
+
+	t := time.Now()
+	inv := UserInvite{
+		ID:        uuid.NewV4(),
+		Email:     e.Address,
+		Roles:     Roles(roles),
+		Status:    UserInvitePending,
+		InvitedBy: inviter.ID,
+		CreatedAt: t,
+		UpdatedAt: t,
+		ExpiresAt: t.Add(UserInviteExpiry),
+	}
+	n, err := s.nonce.New("auth.UserInvite", inv.ID, UserInviteExpiry)
+	if err != nil {
+		return UserInvite{}, err
+	}
+
+	data := newEmailData(User{Email: inv.Email})
+	data.Token = userToken(inv.ID, n.Token)
+	data.Link = BaseURL + "/invite/" + data.Token
+	data.ExpiresAt = inv.ExpiresAt
+	data.Inviter = inviter
+	// the email names the first organization the invitation is for
+	for _, role := range inv.Roles {
+		if o, ok := orgs[role.OrgID]; ok {
+			data.Organization = o
+			data.Role = role.Name
+			break
+		}
+	}
+
+	// a new invitation for the address replaces any pending one
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE user_invite SET status=$1, updated_at=$2 WHERE email=$3 AND status=$4",
+			UserInviteRevoked, t, inv.Email, UserInvitePending)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NamedExecContext(ctx, `INSERT INTO user_invite (id, email, roles, status, invited_by, accepted_by, created_at, updated_at, expires_at)
+		VALUES (:id, :email, :roles, :status, :invited_by, :accepted_by, :created_at, :updated_at, :expires_at)`, &inv)
+		if err != nil {
+			return err
+		}
+		return s.queueEmail(ctx, tx, UserInviteEmail, inv.Email, data)
+	})
+	if err != nil {
+		return UserInvite{}, err
+	}
+	s.audit(ctx, AuditUserInvited, uuid.Nil, AuditDetails{"invite": inv.ID.String(), "email": inv.Email, "roles": inv.Roles.String()})
+
+	return inv, nil
+}
+
+func (s *authService) GetUserInvite(ctx context.Context, token string) (UserInvite, error) {
+	inv, nonceToken, err := s.getPendingUserInvite(ctx, token)
+	if err != nil {
+		return UserInvite{}, err
+	}
+
+	// the token is checked without being used up; AcceptUserInvite uses it
+	n, err := s.nonce.Get("auth.UserInvite", inv.ID)
+	if err != nil || !n.IsValid || !n.ExpiresAt.After(time.Now()) || subtle.ConstantTimeCompare([]byte(n.Token), []byte(nonceToken)) != 1 {
+		return UserInvite{}, ErrInvalidToken
+	}
+	return inv, nil
+}
+
+func (s *authService) AcceptUserInvite(ctx context.Context, token, password, firstName, lastName string) (User, error) {
+	inv, err := s.GetUserInvite(ctx, token)
+	if err != nil {
+		return User{}, err
+	}
+	_, nonceToken, _ := parseUserToken(token)
+
+	// the link proves the address belongs to whoever opened it, so the user starts out verified and active
+	u := newLocalUser(ctx, inv.Email, password, firstName, lastName, inv.Roles.IsSuperuser())
+	err = s.register(ctx, &u, AuditDetails{"invite": inv.ID.String()}, func(tx *sqlx.Tx) error {
+		t := time.Now()
+		inv.Status = UserInviteAccepted
+		inv.AcceptedBy = u.ID
+		inv.UpdatedAt = t
+		_, err := tx.NamedExecContext(ctx, "UPDATE user_invite SET status=:status, accepted_by=:accepted_by, updated_at=:updated_at WHERE id=:id", &inv)
+		if err != nil {
+			return err
+		}
+		for _, role := range inv.Roles {
+			if role.OrgID == uuid.Nil {
+				continue
+			}
+			err = insertMembership(ctx, tx, &Membership{OrgID: role.OrgID, UserID: u.ID, Role: role.Name, CreatedAt: t, UpdatedAt: t})
+			if err != nil {
+				return err
+			}
+		}
+		// the token is used up last so a failure before it leaves the invitation usable
+		_, err = s.nonce.CheckThenConsume(nonceToken, "auth.UserInvite", inv.ID)
+		if err != nil {
+			return ErrInvalidToken
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	for _, role := range inv.Roles {
+		if role.OrgID != uuid.Nil {
+			s.auditAs(ctx, AuditOrgMemberAdded, u.ID, u.ID, AuditDetails{"org": role.OrgID.String(), "role": role.Name, "invite": inv.ID.String()})
+		}
+	}
+
+	return u, nil
+}
+
+func (s *authService) ListUserInvites(ctx context.Context, orgID uuid.UUID) ([]UserInvite, error) {
+	invites := []UserInvite{}
+	err := s.db.SelectContext(ctx, &invites, "SELECT * FROM user_invite WHERE status=$1 AND expires_at>$2 ORDER BY created_at DESC",
+		UserInvitePending, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if orgID == uuid.Nil {
+		return invites, nil
+	}
+
+	// roles are stored as JSON so the organization is matched here
+	inOrg := []UserInvite{}
+	for _, inv := range invites {
+		if inv.Roles.InOrg(orgID) != "" {
+			inOrg = append(inOrg, inv)
+		}
+	}
+	return inOrg, nil
+}
+
+func (s *authService) RevokeUserInvite(ctx context.Context, id uuid.UUID) error {
+	if id == uuid.Nil {
+		return ErrInvalidID
+	}
+
+	res, err := s.db.ExecContext(ctx, "UPDATE user_invite SET status=$1, updated_at=$2 WHERE id=$3 AND status=$4",
+		UserInviteRevoked, time.Now(), id, UserInvitePending)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInviteNotFound
+	}
+	s.audit(ctx, AuditUserInviteRevoked, uuid.Nil, AuditDetails{"invite": id.String()})
+	return nil
+}
+
+func (s *authService) ExpireInvites(ctx context.Context, before time.Time) (int, error) {
+	expired := 0
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		for _, q := range []string{
+			"UPDATE user_invite SET status=$1, updated_at=$2 WHERE status=$3 AND expires_at<=$4",
+			"UPDATE org_invite SET status=$1, updated_at=$2 WHERE status=$3 AND expires_at<=$4",
+		} {
+			res, err := tx.ExecContext(ctx, q, InviteExpired, time.Now(), UserInvitePending, before)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			expired += int(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+// getPendingUserInvite gets the pending, unexpired invitation a token created by userToken was issued for.
+// The nonce part of the token is returned for the caller to check.
+func (s *authService) getPendingUserInvite(ctx context.Context, token string) (UserInvite, string, error) {
+	id, nonceToken, err := parseUserToken(token)
+	if err != nil {
+		return UserInvite{}, "", err
+	}
+
+	inv := UserInvite{}
+	err = s.db.GetContext(ctx, &inv, "SELECT * FROM user_invite WHERE id=$1", id)
+	if err == sql.ErrNoRows {
+		return UserInvite{}, "", ErrInvalidToken
+	} else if err != nil {
+		return UserInvite{}, "", err
+	}
+	if inv.Status != UserInvitePending || !inv.ExpiresAt.After(time.Now()) {
+		return UserInvite{}, "", ErrInvalidToken
+	}
+	return inv, nonceToken, nil
+}
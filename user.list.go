@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// ErrInvalidQuery is returned by ListUsers and ListAuditEvents for an unknown sort or a malformed cursor
+var ErrInvalidQuery = errors.New("invalid query")
+
+// UserListLimit and UserListMaxLimit can be set by applications using auth.
+// UserListLimit is the page size used when UserQuery.Limit is zero; larger limits are capped at UserListMaxLimit.
+var (
+	UserListLimit    = 50
+	UserListMaxLimit = 500
+)
+
+// Sort orders for UserQuery.Sort
+const (
+	UserSortCreatedAt = "created_at"
+	UserSortUpdatedAt = "updated_at"
+	UserSortEmail     = "email"
+	UserSortFirstName = "firstname"
+	UserSortLastName  = "lastname"
+)
+
+// UserQuery selects the users returned by ListUsers.
+// The zero value lists the oldest users that are not deleted.
+type UserQuery struct {
+	// Search matches users whose first name, last name or email contain every word of Search (case-insensitive)
+	Search string
+
+	// IsActive and IsSuperuser filter on the user's flags when set
+	IsActive    *bool
+	IsSuperuser *bool
+
+	// IsDeleted filters on the deleted flag when set.
+	// When it is nil deleted users are left out unless IncludeDeleted is true.
+	IsDeleted      *bool
+	IncludeDeleted bool
+
+	// Provider matches users with an account linked from the named goth provider, e.g. "github"
+	Provider string
+
+	// CreatedAfter (inclusive) and CreatedBefore (exclusive) limit when the user registered when not zero
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Sort is one of the UserSort constants; it defaults to UserSortCreatedAt
+	Sort string
+	Desc bool
+
+	// Cursor is the NextCursor of the previous page. It is only valid with the same Sort and Desc.
+	Cursor string
+	Limit  int
+}
+
+// UserList is a page of users
+type UserList struct {
+	Users []User `json:"users"`
+
+	// Total is the number of users matching the query across all pages
+	Total int `json:"total"`
+
+	// NextCursor fetches the following page; it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// userCursor is the position after the last user of a page
+type userCursor struct {
+	Sort  string    `json:"s"`
+	Desc  bool      `json:"d"`
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+func (s *authService) ListUsers(ctx context.Context, q UserQuery) (UserList, error) {
+	if q.Sort == "" {
+		q.Sort = UserSortCreatedAt
+	}
+	switch q.Sort {
+	case UserSortCreatedAt, UserSortUpdatedAt, UserSortEmail, UserSortFirstName, UserSortLastName:
+	default:
+		return UserList{}, ErrInvalidQuery
+	}
+	if q.Limit <= 0 {
+		q.Limit = UserListLimit
+	}
+	if q.Limit > UserListMaxLimit {
+		q.Limit = UserListMaxLimit
+	}
+
+	where, args := q.where()
+
+	list := UserList{Users: []User{}}
+	err := s.db.GetContext(ctx, &list.Total, s.db.Rebind("SELECT COUNT(*) FROM user"+where), args...)
+	if err != nil {
+		return UserList{}, err
+	}
+
+	// continue after the cursor, using id to order users with the same sort value
+	if q.Cursor != "" {
+		c, err := decodeUserCursor(q)
+		if err != nil {
+			return UserList{}, err
+		}
+		op := ">"
+		if q.Desc {
+			op = "<"
+		}
+		if where == "" {
+			where = " WHERE "
+		} else {
+			where += " AND "
+		}
+		where += "(" + q.Sort + " " + op + " ? OR (" + q.Sort + " = ? AND id " + op + " ?))"
+		v := c.value(q.Sort)
+		args = append(args, v, v, c.ID)
+	}
+
+	order := " ASC"
+	if q.Desc {
+		order = " DESC"
+	}
+	sqlQuery := "SELECT * FROM user" + where + " ORDER BY " + q.Sort + order + ", id" + order + " LIMIT ?"
+
+	// fetch one extra user to find out if there is another page
+	err = s.db.SelectContext(ctx, &list.Users, s.db.Rebind(sqlQuery), append(args, q.Limit+1)...)
+	if err != nil {
+		return UserList{}, err
+	}
+	if len(list.Users) > q.Limit {
+		list.Users = list.Users[:q.Limit]
+		list.NextCursor = encodeUserCursor(q, list.Users[q.Limit-1])
+	}
+
+	return list, nil
+}
+
+// where builds the WHERE clause (with ? placeholders) for the query's filters
+func (q UserQuery) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	for _, word := range strings.Fields(strings.ToLower(q.Search)) {
+		like := "%" + escapeLike(word) + "%"
+		conds = append(conds, `(LOWER(firstname) LIKE ? ESCAPE '\' OR LOWER(lastname) LIKE ? ESCAPE '\' OR LOWER(email) LIKE ? ESCAPE '\')`)
+		args = append(args, like, like, like)
+	}
+	if q.IsActive != nil {
+		conds = append(conds, "is_active = ?")
+		args = append(args, *q.IsActive)
+	}
+	if q.IsSuperuser != nil {
+		conds = append(conds, "is_superuser = ?")
+		args = append(args, *q.IsSuperuser)
+	}
+	if q.IsDeleted != nil {
+		conds = append(conds, "is_deleted = ?")
+		args = append(args, *q.IsDeleted)
+	} else if !q.IncludeDeleted {
+		conds = append(conds, "is_deleted = ?")
+		args = append(args, false)
+	}
+	if q.Provider != "" {
+		conds = append(conds, "EXISTS (SELECT 1 FROM user_provider WHERE user_provider.user_id = user.id AND user_provider.provider = ?)")
+		args = append(args, q.Provider)
+	}
+	if !q.CreatedAfter.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, q.CreatedBefore)
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// escapeLike escapes the LIKE wildcards in s with a backslash
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func encodeUserCursor(q UserQuery, u User) string {
+	c := userCursor{Sort: q.Sort, Desc: q.Desc, ID: u.ID}
+	switch q.Sort {
+	case UserSortCreatedAt:
+		c.Value = u.CreatedAt.Format(time.RFC3339Nano)
+	case UserSortUpdatedAt:
+		c.Value = u.UpdatedAt.Format(time.RFC3339Nano)
+	case UserSortEmail:
+		c.Value = u.Email
+	case UserSortFirstName:
+		c.Value = u.FirstName
+	case UserSortLastName:
+		c.Value = u.LastName
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(q UserQuery) (userCursor, error) {
+	c := userCursor{}
+	b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return c, ErrInvalidQuery
+	}
+	err = json.Unmarshal(b, &c)
+	if err != nil || c.Sort != q.Sort || c.Desc != q.Desc {
+		return c, ErrInvalidQuery
+	}
+	if q.Sort == UserSortCreatedAt || q.Sort == UserSortUpdatedAt {
+		_, err = time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return c, ErrInvalidQuery
+		}
+	}
+	return c, nil
+}
+
+// value returns the cursor's sort value as the type stored in the database
+func (c userCursor) value(sort string) interface{} {
+	if sort == UserSortCreatedAt || sort == UserSortUpdatedAt {
+		t, _ := time.Parse(time.RFC3339Nano, c.Value)
+		return t
+	}
+	return c.Value
+}
@@ -0,0 +1,647 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// WebAuthnRPID is the relying party ID passkeys are scoped to, usually the site's domain.
+// It can/should be set by applications using auth.
+var WebAuthnRPID = "www.example.com"
+
+// WebAuthnOrigins are the origins (scheme, host and port) ceremonies are accepted from.
+// It can/should be set by applications using auth.
+var WebAuthnOrigins = []string{"https://www.example.com"}
+
+// WebAuthnTimeout is how long a registration or login ceremony may take
+var WebAuthnTimeout = 5 * time.Minute
+
+// WebAuthnUserVerification is asked of authenticators: "required", "preferred" or "discouraged".
+// When "required" assertions without user verification (PIN, biometrics) are rejected.
+var WebAuthnUserVerification = "preferred"
+
+// Errors
+var (
+	ErrWebAuthnFailed     = errors.New("passkey verification failed")
+	ErrCredentialNotFound = errors.New("passkey not found")
+)
+
+// COSE algorithm identifiers of the supported public keys
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+)
+
+// authenticator data flags
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+// WebAuthnCredential is a passkey registered to a user
+type WebAuthnCredential struct {
+	ID           uuid.UUID `json:"id"`
+	UserID       uuid.UUID `db:"user_id" json:"userId"`
+	CredentialID []byte    `db:"credential_id" json:"credentialId"`
+	// PublicKey is the credential's COSE_Key
+	PublicKey []byte `db:"public_key" json:"-"`
+	SignCount uint32 `db:"sign_count" json:"signCount"`
+	// Transports is a comma separated list of the transports the authenticator reported (i.e. "usb,nfc")
+	Transports string    `db:"transports" json:"transports"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+	LastUsedAt time.Time `db:"last_used_at" json:"lastUsedAt"`
+}
+
+// descriptor returns the credential as it is listed in ceremony options
+func (c WebAuthnCredential) descriptor() WebAuthnCredentialDescriptor {
+	d := WebAuthnCredentialDescriptor{
+		Type: "public-key",
+		ID:   b64url(c.CredentialID),
+	}
+	if len(c.Transports) > 0 {
+		d.Transports = strings.Split(c.Transports, ",")
+	}
+	return d
+}
+
+// WebAuthnCreationOptions is passed to navigator.credentials.create() (as publicKey) once the
+// base64url encoded fields are decoded to ArrayBuffers
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUserEntity             `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// WebAuthnRequestOptions is passed to navigator.credentials.get() (as publicKey) once the
+// base64url encoded fields are decoded to ArrayBuffers
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	Timeout          int64                          `json:"timeout"`
+	RPID             string                         `json:"rpId"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+// WebAuthnRelyingParty identifies the application to the authenticator
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebAuthnUserEntity identifies the user to the authenticator. ID is the base64url encoded user ID.
+type WebAuthnUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// WebAuthnCredentialParameter is a public key algorithm the application accepts
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// WebAuthnCredentialDescriptor refers to an existing credential. ID is base64url encoded.
+type WebAuthnCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// WebAuthnAuthenticatorSelection states the kind of authenticator the application wants
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnAttestationResponse is the PublicKeyCredential returned by navigator.credentials.create()
+// with every ArrayBuffer base64url encoded
+type WebAuthnAttestationResponse struct {
+	ID       string              `json:"id"`
+	RawID    string              `json:"rawId"`
+	Type     string              `json:"type"`
+	Response WebAuthnAttestation `json:"response"`
+}
+
+// WebAuthnAttestation is the AuthenticatorAttestationResponse of a registration
+type WebAuthnAttestation struct {
+	ClientDataJSON    string   `json:"clientDataJSON"`
+	AttestationObject string   `json:"attestationObject"`
+	Transports        []string `json:"transports"`
+}
+
+// WebAuthnAssertionResponse is the PublicKeyCredential returned by navigator.credentials.get()
+// with every ArrayBuffer base64url encoded
+type WebAuthnAssertionResponse struct {
+	ID       string            `json:"id"`
+	RawID    string            `json:"rawId"`
+	Type     string            `json:"type"`
+	Response WebAuthnAssertion `json:"response"`
+}
+
+// WebAuthnAssertion is the AuthenticatorAssertionResponse of a login
+type WebAuthnAssertion struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+func (s *authService) BeginWebAuthnRegistration(ctx context.Context, userID uuid.UUID) (WebAuthnCreationOptions, error) {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+
+	creds, err := s.ListWebAuthnCredentials(ctx, u.ID)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+	exclude := make([]WebAuthnCredentialDescriptor, len(creds))
+	for i, c := range creds {
+		exclude[i] = c.descriptor()
+	}
+
+	n, err := s.nonce.New("auth.WebAuthnRegistration", u.ID, WebAuthnTimeout)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+
+	return WebAuthnCreationOptions{
+		Challenge: b64url([]byte(n.Token)),
+		RP:        WebAuthnRelyingParty{ID: WebAuthnRPID, Name: AppName},
+		User: WebAuthnUserEntity{
+			ID:          b64url(u.ID.Bytes()),
+			Name:        u.Email,
+			DisplayName: strings.TrimSpace(u.FirstName + " " + u.LastName),
+		},
+		PubKeyCredParams: []WebAuthnCredentialParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            int64(WebAuthnTimeout / time.Millisecond),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: WebAuthnUserVerification,
+		},
+		Attestation: "none",
+	}, nil
+}
+
+func (s *authService) FinishWebAuthnRegistration(ctx context.Context, userID uuid.UUID, resp WebAuthnAttestationResponse) (WebAuthnCredential, error) {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	challenge, err := verifyClientData(ctx, resp.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	_, err = s.nonce.CheckThenConsume(challenge, "auth.WebAuthnRegistration", u.ID)
+	if err != nil {
+		return WebAuthnCredential{}, ErrInvalidToken
+	}
+
+	// attestation "none" is requested so the attestation statement is not verified
+	attObj, err := b64urlDecode(resp.Response.AttestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, ErrWebAuthnFailed
+	}
+	raw, _, err := decodeCBOR(attObj)
+	if err != nil {
+		return WebAuthnCredential{}, ErrWebAuthnFailed
+	}
+	att, _ := raw.(map[interface{}]interface{})
+	authDataRaw, _ := att["authData"].([]byte)
+	ad, err := parseAuthenticatorData(authDataRaw)
+	if err != nil || ad.flags&authDataAttested == 0 {
+		return WebAuthnCredential{}, ErrWebAuthnFailed
+	}
+	err = ad.verify()
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	_, err = parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	// a credential can only belong to one user
+	_, err = s.getWebAuthnCredential(ctx, ad.credentialID)
+	if err == nil {
+		return WebAuthnCredential{}, ErrAlreadyExists
+	} else if err != ErrCredentialNotFound {
+		return WebAuthnCredential{}, err
+	}
+
+	t := time.Now()
+	c := WebAuthnCredential{
+		ID:           uuid.NewV4(),
+		UserID:       u.ID,
+		CredentialID: ad.credentialID,
+		PublicKey:    ad.publicKey,
+		SignCount:    ad.signCount,
+		Transports:   strings.Join(resp.Response.Transports, ","),
+		CreatedAt:    t,
+		LastUsedAt:   t,
+	}
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, `INSERT INTO webauthn_credential
+		(id, user_id, credential_id, public_key, sign_count, transports, created_at, last_used_at)
+		VALUES (:id, :user_id, :credential_id, :public_key, :sign_count, :transports, :created_at, :last_used_at)`, &c)
+		return err
+	})
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	s.audit(ctx, AuditPasskeyAdded, u.ID, AuditDetails{"passkey": c.ID.String()})
+
+	return c, nil
+}
+
+func (s *authService) BeginWebAuthnLogin(ctx context.Context, email string) (WebAuthnRequestOptions, error) {
+	opts := WebAuthnRequestOptions{
+		Timeout:          int64(WebAuthnTimeout / time.Millisecond),
+		RPID:             WebAuthnRPID,
+		AllowCredentials: []WebAuthnCredentialDescriptor{},
+		UserVerification: WebAuthnUserVerification,
+	}
+
+	// without an email any discoverable credential may answer the challenge
+	uid := uuid.Nil
+	if len(strings.TrimSpace(email)) > 0 {
+		e, err := mail.ParseAddress(email)
+		if err != nil {
+			return WebAuthnRequestOptions{}, err
+		}
+		u, err := s.getUserByEmail(ctx, e.Address)
+		if err != nil {
+			return WebAuthnRequestOptions{}, err
+		}
+		err = u.checkUsable()
+		if err != nil {
+			return WebAuthnRequestOptions{}, err
+		}
+		creds, err := s.ListWebAuthnCredentials(ctx, u.ID)
+		if err != nil {
+			return WebAuthnRequestOptions{}, err
+		}
+		if len(creds) == 0 {
+			return WebAuthnRequestOptions{}, ErrCredentialNotFound
+		}
+		for _, c := range creds {
+			opts.AllowCredentials = append(opts.AllowCredentials, c.descriptor())
+		}
+		uid = u.ID
+	}
+
+	n, err := s.nonce.New("auth.WebAuthnLogin", uid, WebAuthnTimeout)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	opts.Challenge = b64url([]byte(n.Token))
+
+	return opts, nil
+}
+
+func (s *authService) FinishWebAuthnLogin(ctx context.Context, resp WebAuthnAssertionResponse) (User, error) {
+	u, err := s.finishWebAuthnLogin(ctx, resp)
+	if err != nil {
+		// name the passkey's owner when the passkey is known
+		target := uuid.Nil
+		if credID, decodeErr := b64urlDecode(resp.RawID); decodeErr == nil {
+			if c, credErr := s.getWebAuthnCredential(ctx, credID); credErr == nil {
+				target = c.UserID
+			}
+		}
+		s.loginFailed(ctx, "passkey", target, "", err)
+		return User{}, err
+	}
+	return s.loggedIn(ctx, u, "passkey")
+}
+
+// finishWebAuthnLogin verifies the assertion for FinishWebAuthnLogin
+func (s *authService) finishWebAuthnLogin(ctx context.Context, resp WebAuthnAssertionResponse) (User, error) {
+	credID, err := b64urlDecode(resp.RawID)
+	if err != nil || len(credID) == 0 {
+		return User{}, ErrCredentialNotFound
+	}
+	c, err := s.getWebAuthnCredential(ctx, credID)
+	if err != nil {
+		return User{}, err
+	}
+
+	challenge, err := verifyClientData(ctx, resp.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return User{}, err
+	}
+	// the challenge was issued either for this credential's user or for any user
+	_, err = s.nonce.CheckThenConsume(challenge, "auth.WebAuthnLogin", c.UserID)
+	if err != nil {
+		_, err = s.nonce.CheckThenConsume(challenge, "auth.WebAuthnLogin", uuid.Nil)
+		if err != nil {
+			return User{}, ErrInvalidToken
+		}
+	}
+
+	if len(resp.Response.UserHandle) > 0 {
+		handle, err := b64urlDecode(resp.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, c.UserID.Bytes()) {
+			return User{}, ErrWebAuthnFailed
+		}
+	}
+
+	authData, err := b64urlDecode(resp.Response.AuthenticatorData)
+	if err != nil {
+		return User{}, ErrWebAuthnFailed
+	}
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return User{}, ErrWebAuthnFailed
+	}
+	err = ad.verify()
+	if err != nil {
+		return User{}, err
+	}
+
+	// the signature covers the authenticator data and the hash of the client data
+	clientData, _ := b64urlDecode(resp.Response.ClientDataJSON)
+	sig, err := b64urlDecode(resp.Response.Signature)
+	if err != nil {
+		return User{}, ErrWebAuthnFailed
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	err = verifyCOSESignature(c.PublicKey, append(authData, clientDataHash[:]...), sig)
+	if err != nil {
+		return User{}, err
+	}
+
+	// a counter that doesn't increase means the authenticator may have been cloned
+	if (ad.signCount != 0 || c.SignCount != 0) && ad.signCount <= c.SignCount {
+		logCtx(ctx, LevelWarn, "Passkey sign count did not increase. The authenticator may be cloned.", Fields{"credential_id": c.ID, "target_id": c.UserID, "sign_count": ad.signCount, "expected_above": c.SignCount})
+		return User{}, ErrWebAuthnFailed
+	}
+
+	u, err := s.GetUser(ctx, c.UserID)
+	if err != nil {
+		return User{}, err
+	}
+	err = u.checkUsable()
+	if err != nil {
+		return User{}, err
+	}
+
+	c.SignCount = ad.signCount
+	c.LastUsedAt = time.Now()
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, "UPDATE webauthn_credential SET sign_count=:sign_count, last_used_at=:last_used_at WHERE id=:id", &c)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+func (s *authService) ListWebAuthnCredentials(ctx context.Context, userID uuid.UUID) ([]WebAuthnCredential, error) {
+	if userID == uuid.Nil {
+		return nil, ErrInvalidID
+	}
+
+	creds := []WebAuthnCredential{}
+	err := s.db.SelectContext(ctx, &creds, "SELECT * FROM webauthn_credential WHERE user_id=$1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (s *authService) DeleteWebAuthnCredential(ctx context.Context, userID, id uuid.UUID) error {
+	if userID == uuid.Nil || id == uuid.Nil {
+		return ErrInvalidID
+	}
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM webauthn_credential WHERE id=$1 AND user_id=$2", id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCredentialNotFound
+	}
+	s.audit(ctx, AuditPasskeyRemoved, userID, AuditDetails{"passkey": id.String()})
+	return nil
+}
+
+// getWebAuthnCredential gets a credential by the ID the authenticator assigned it
+func (s *authService) getWebAuthnCredential(ctx context.Context, credentialID []byte) (WebAuthnCredential, error) {
+	c := WebAuthnCredential{}
+	err := s.db.GetContext(ctx, &c, "SELECT * FROM webauthn_credential WHERE credential_id=$1", credentialID)
+	if err == sql.ErrNoRows {
+		return WebAuthnCredential{}, ErrCredentialNotFound
+	} else if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	return c, nil
+}
+
+// verifyClientData checks the type and origin of a ceremony's client data and returns its challenge
+func verifyClientData(ctx context.Context, encoded, typ string) (string, error) {
+	raw, err := b64urlDecode(encoded)
+	if err != nil {
+		return "", ErrWebAuthnFailed
+	}
+
+	cd := struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}{}
+	err = json.Unmarshal(raw, &cd)
+	if err != nil || cd.Type != typ {
+		return "", ErrWebAuthnFailed
+	}
+
+	allowed := false
+	for _, o := range WebAuthnOrigins {
+		if cd.Origin == o {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		logCtx(ctx, LevelWarn, "Rejected WebAuthn ceremony from unknown origin", Fields{"ceremony": typ, "origin": cd.Origin})
+		return "", ErrWebAuthnFailed
+	}
+
+	challenge, err := b64urlDecode(cd.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return "", ErrWebAuthnFailed
+	}
+	return string(challenge), nil
+}
+
+// authenticatorData is the parsed binary authenticator data of a ceremony
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// only present when the attested credential data flag is set
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData parses the authenticator data laid out as
+// rpIdHash (32) | flags (1) | signCount (4) | [aaguid (16) | credentialIdLength (2) | credentialId | COSE_Key] | [extensions]
+func parseAuthenticatorData(b []byte) (authenticatorData, error) {
+	if len(b) < 37 {
+		return authenticatorData{}, ErrWebAuthnFailed
+	}
+	ad := authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.flags&authDataAttested == 0 {
+		return ad, nil
+	}
+
+	rest := b[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, ErrWebAuthnFailed
+	}
+	l := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < l {
+		return authenticatorData{}, ErrWebAuthnFailed
+	}
+	ad.credentialID = append([]byte(nil), rest[:l]...)
+	rest = rest[l:]
+
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, ErrWebAuthnFailed
+	}
+	ad.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+	return ad, nil
+}
+
+// verify checks the authenticator data was made for this relying party with the user present
+func (ad authenticatorData) verify() error {
+	rpIDHash := sha256.Sum256([]byte(WebAuthnRPID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return ErrWebAuthnFailed
+	}
+	if ad.flags&authDataUserPresent == 0 {
+		return ErrWebAuthnFailed
+	}
+	if WebAuthnUserVerification == "required" && ad.flags&authDataUserVerified == 0 {
+		return ErrWebAuthnFailed
+	}
+	return nil
+}
+
+// parseCOSEKey parses an ES256 (P-256) or RS256 COSE_Key
+func parseCOSEKey(b []byte) (crypto.PublicKey, error) {
+	raw, _, err := decodeCBOR(b)
+	if err != nil {
+		return nil, ErrWebAuthnFailed
+	}
+	m, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnFailed
+	}
+
+	alg, _ := m[int64(3)].(int64)
+	switch alg {
+	case coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, ErrWebAuthnFailed
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, ErrWebAuthnFailed
+		}
+		return pub, nil
+	case coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrWebAuthnFailed
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, ErrWebAuthnFailed
+}
+
+// verifyCOSESignature checks sig is the signature of data by the COSE_Key coseKey
+func verifyCOSESignature(coseKey, data, sig []byte) error {
+	pub, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+	}
+	return ErrWebAuthnFailed
+}
+
+// b64url encodes b as unpadded base64url, the encoding WebAuthn uses for binary data in JSON
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// b64urlDecode decodes base64url with or without padding
+func b64urlDecode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
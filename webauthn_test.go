@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// softAuthenticator stands in for a platform authenticator. It holds a single ES256 credential.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	origin       string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected to generate a key. Instead got the error: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, credentialID: id, origin: WebAuthnOrigins[0]}
+}
+
+// create answers navigator.credentials.create()
+func (a *softAuthenticator) create(t *testing.T, opts WebAuthnCreationOptions) WebAuthnAttestationResponse {
+	a.userHandle, _ = b64urlDecode(opts.User.ID)
+
+	coseKey := encodeCBOR(cborMap{
+		{int64(1), int64(2)},                // kty: EC2
+		{int64(3), int64(coseAlgES256)},     // alg
+		{int64(-1), int64(1)},               // crv: P-256
+		{int64(-2), pad32(a.key.X.Bytes())}, // x
+		{int64(-3), pad32(a.key.Y.Bytes())}, // y
+	})
+	attested := make([]byte, 18)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(a.credentialID)))
+	attested = append(append(attested, a.credentialID...), coseKey...)
+	authData := append(a.authData(opts.RP.ID, authDataUserPresent|authDataUserVerified|authDataAttested), attested...)
+
+	resp := WebAuthnAttestationResponse{ID: b64url(a.credentialID), RawID: b64url(a.credentialID), Type: "public-key"}
+	resp.Response.ClientDataJSON = a.clientData(t, "webauthn.create", opts.Challenge)
+	resp.Response.AttestationObject = b64url(encodeCBOR(cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", authData},
+	}))
+	resp.Response.Transports = []string{"internal"}
+	return resp
+}
+
+// get answers navigator.credentials.get()
+func (a *softAuthenticator) get(t *testing.T, opts WebAuthnRequestOptions) WebAuthnAssertionResponse {
+	a.signCount++
+	authData := a.authData(opts.RPID, authDataUserPresent|authDataUserVerified)
+	clientData := a.clientData(t, "webauthn.get", opts.Challenge)
+
+	raw, _ := b64urlDecode(clientData)
+	clientDataHash := sha256.Sum256(raw)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("Expected to sign the assertion. Instead got the error: %v", err)
+	}
+
+	resp := WebAuthnAssertionResponse{ID: b64url(a.credentialID), RawID: b64url(a.credentialID), Type: "public-key"}
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AuthenticatorData = b64url(authData)
+	resp.Response.Signature = b64url(sig)
+	resp.Response.UserHandle = b64url(a.userHandle)
+	return resp
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte) []byte {
+	h := sha256.Sum256([]byte(rpID))
+	b := append(h[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	return b
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, typ, challenge string) string {
+	b, err := json.Marshal(map[string]interface{}{"type": typ, "challenge": challenge, "origin": a.origin, "crossOrigin": false})
+	if err != nil {
+		t.Fatalf("Expected to encode client data. Instead got the error: %v", err)
+	}
+	return b64url(b)
+}
+
+func pad32(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// cborMap is an ordered CBOR map for encodeCBOR
+type cborMap [][2]interface{}
+
+// encodeCBOR encodes the subset of CBOR decodeCBOR supports
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		}
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	}
+
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		b := head(4, uint64(len(v)))
+		for _, e := range v {
+			b = append(b, encodeCBOR(e)...)
+		}
+		return b
+	case cborMap:
+		b := head(5, uint64(len(v)))
+		for _, kv := range v {
+			b = append(b, encodeCBOR(kv[0])...)
+			b = append(b, encodeCBOR(kv[1])...)
+		}
+		return b
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	}
+	return []byte{0xf6}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	in := encodeCBOR(cborMap{
+		{int64(-257), "alg"},
+		{"bytes", []byte{1, 2, 3}},
+		{"list", []interface{}{int64(1), int64(1000), int64(70000), true, nil}},
+	})
+	v, rest, err := decodeCBOR(append(in, 0xff))
+	if err != nil {
+		t.Fatalf("Expected to decode CBOR. Instead got the error: %v", err)
+	}
+	if !bytes.Equal(rest, []byte{0xff}) {
+		t.Fatalf("Expected the trailing byte to be returned. Instead got: %v", rest)
+	}
+
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || m[int64(-257)] != "alg" || !bytes.Equal(m["bytes"].([]byte), []byte{1, 2, 3}) {
+		t.Fatalf("Expected the decoded map to match. Instead got: %#v", v)
+	}
+	list, _ := m["list"].([]interface{})
+	if len(list) != 5 || list[1] != int64(1000) || list[2] != int64(70000) || list[3] != true || list[4] != nil {
+		t.Fatalf("Expected the decoded list to match. Instead got: %#v", m["list"])
+	}
+
+	for _, bad := range [][]byte{{}, {0x5a, 0xff}, {0x9f}, {0xa1, 0x40, 0x01}, in[:len(in)-1]} {
+		_, _, err = decodeCBOR(bad)
+		if err != errCBOR {
+			t.Fatalf("Expected %x to be rejected. Instead got: %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+)
+
+// Webhook delivery statuses
+const (
+	WebhookPending = "pending"
+	WebhookSent    = "sent"
+	WebhookDead    = "dead"
+)
+
+// Headers sent with every webhook request
+const (
+	WebhookEventHeader     = "X-Auth-Event"
+	WebhookDeliveryHeader  = "X-Auth-Delivery"
+	WebhookTimestampHeader = "X-Auth-Timestamp"
+	WebhookSignatureHeader = "X-Auth-Signature"
+)
+
+// Errors returned by Webhooks
+var (
+	ErrWebhookNotFound  = errors.New("webhook endpoint not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidURL       = errors.New("webhook url must be an absolute http or https url")
+)
+
+// EventTypes is a list of event types, stored as a comma separated string
+type EventTypes []EventType
+
+// Value implements driver.Valuer
+func (t EventTypes) Value() (driver.Value, error) {
+	s := make([]string, len(t))
+	for i, v := range t {
+		s[i] = string(v)
+	}
+	return strings.Join(s, ","), nil
+}
+
+// Scan implements sql.Scanner
+func (t *EventTypes) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case nil:
+	default:
+		return errors.New("auth: cannot scan event types")
+	}
+	*t = EventTypes{}
+	for _, v := range strings.Split(s, ",") {
+		if len(v) > 0 {
+			*t = append(*t, EventType(v))
+		}
+	}
+	return nil
+}
+
+// has reports whether typ is in t. An empty list has every type.
+func (t EventTypes) has(typ EventType) bool {
+	if len(t) == 0 {
+		return true
+	}
+	for _, v := range t {
+		if v == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEndpoint is a URL that is sent the events it subscribes to
+type WebhookEndpoint struct {
+	ID  uuid.UUID `db:"id" json:"id"`
+	URL string    `db:"url" json:"url"`
+	// Secret signs every request. See WebhookSignature.
+	Secret string `db:"secret" json:"-"`
+	// Events lists the event types the endpoint is sent; when it is empty the endpoint is sent every event
+	Events    EventTypes `db:"events" json:"events"`
+	IsActive  bool       `db:"is_active" json:"is_active"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// WebhookDelivery is a request to a webhook endpoint. Together they form the delivery log.
+type WebhookDelivery struct {
+	ID         uuid.UUID `db:"id" json:"id"`
+	EndpointID uuid.UUID `db:"endpoint_id" json:"endpoint_id"`
+	// UserID is the user the event is about; the delivery is removed when the user is purged
+	UserID    uuid.UUID `db:"user_id" json:"user_id"`
+	EventType EventType `db:"event_type" json:"event_type"`
+	// Payload is the JSON encoded WebhookPayload that is POSTed
+	Payload  []byte `db:"payload" json:"payload"`
+	Status   string `db:"status" json:"status"`
+	Attempts int    `db:"attempts" json:"attempts"`
+	// LastError and ResponseStatus describe the latest attempt. ResponseStatus is 0 if no response was received.
+	LastError      string    `db:"last_error" json:"last_error"`
+	ResponseStatus int       `db:"response_status" json:"response_status"`
+	NextAttemptAt  time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at" json:"updated_at"`
+	DeliveredAt    time.Time `db:"delivered_at" json:"delivered_at"`
+}
+
+// WebhookPayload is the JSON body of a webhook request
+type WebhookPayload struct {
+	// ID is the same for every delivery of an event, including replays, so receivers can ignore duplicates
+	ID        uuid.UUID `json:"id"`
+	Type      EventType `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	User      User      `json:"user"`
+	// Method is how the user logged in. It is only set for EventUserLoggedIn.
+	Method  string    `json:"method,omitempty"`
+	ActorID uuid.UUID `json:"actor_id"`
+}
+
+// WebhookSignature returns the value of the signature header for a request with the given timestamp header and body:
+// "sha256=" followed by the hex encoded HMAC-SHA256 of timestamp + "." + body, keyed with the endpoint's secret.
+// Receivers should compute it themselves, compare it with hmac.Equal and reject old timestamps.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp)
+	io.WriteString(mac, ".")
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhooks stores webhook endpoints and delivers auth events to them in the background.
+// Like the Outbox, deliveries are written in the same transaction as the change that caused
+// them and are retried with backoff until they succeed or run out of attempts.
+type Webhooks struct {
+	db     timedDB
+	client *http.Client
+
+	// MaxAttempts is how many times delivery is tried before it is marked dead
+	MaxAttempts int
+	// BaseDelay is the wait after the first failure. It doubles after every failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// PollInterval is how often the dispatcher looks for due deliveries
+	PollInterval time.Duration
+	// BatchSize is the most deliveries sent per poll
+	BatchSize int
+	// Lease is how long a delivery is reserved while it is being sent. It should be longer than the client's timeout.
+	Lease time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWebhooks creates Webhooks that send requests with client, or a client with a 10 second timeout if it is nil
+func NewWebhooks(db *sqlx.DB, client *http.Client) *Webhooks {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Webhooks{
+		db:           timedDB{db},
+		client:       client,
+		MaxAttempts:  8,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     time.Hour,
+		PollInterval: 10 * time.Second,
+		BatchSize:    50,
+		Lease:        time.Minute,
+	}
+}
+
+// Attach adds a hook for every event type to bus that queues a delivery to each active endpoint subscribed to it.
+// Because the deliveries are queued by a hook, failing to store them rolls back the change.
+func (w *Webhooks) Attach(bus *EventBus) {
+	for _, typ := range eventTypes {
+		bus.Hook(typ, w.enqueue)
+	}
+}
+
+// enqueue is the Hook that stores the deliveries for e within tx
+func (w *Webhooks) enqueue(ctx context.Context, tx *sqlx.Tx, e Event) error {
+	endpoints := []WebhookEndpoint{}
+	err := tx.SelectContext(ctx, &endpoints, "SELECT * FROM webhook_endpoint WHERE is_active=$1", true)
+	if err != nil {
+		return err
+	}
+
+	var payload []byte
+	for _, ep := range endpoints {
+		if !ep.Events.has(e.Type) {
+			continue
+		}
+		if payload == nil {
+			payload, err = json.Marshal(WebhookPayload{
+				ID:        uuid.NewV4(),
+				Type:      e.Type,
+				CreatedAt: e.CreatedAt.UTC(),
+				User:      e.User,
+				Method:    e.Method,
+				ActorID:   e.Info.ActorID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		_, err = w.insertDelivery(ctx, tx, ep.ID, e.User.ID, e.Type, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertDelivery stores a new pending delivery
+func (w *Webhooks) insertDelivery(ctx context.Context, ext sqlx.ExtContext, endpointID, userID uuid.UUID, typ EventType, payload []byte) (WebhookDelivery, error) {
+	t := time.Now().UTC()
+	d := WebhookDelivery{
+		ID:            uuid.NewV4(),
+		EndpointID:    endpointID,
+		UserID:        userID,
+		EventType:     typ,
+		Payload:       payload,
+		Status:        WebhookPending,
+		NextAttemptAt: t,
+		CreatedAt:     t,
+		UpdatedAt:     t,
+	}
+	_, err := sqlx.NamedExecContext(ctx, ext, `INSERT INTO webhook_delivery
+	(id, endpoint_id, user_id, event_type, payload, status, attempts, last_error, response_status, next_attempt_at, created_at, updated_at, delivered_at)
+	VALUES (:id, :endpoint_id, :user_id, :event_type, :payload, :status, :attempts, :last_error, :response_status, :next_attempt_at, :created_at, :updated_at, :delivered_at)`, &d)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	return d, nil
+}
+
+// AddEndpoint stores a new active endpoint. A random secret is generated if secret is empty.
+func (w *Webhooks) AddEndpoint(ctx context.Context, rawURL, secret string, events ...EventType) (WebhookEndpoint, error) {
+	err := checkWebhookURL(rawURL)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	if len(secret) == 0 {
+		b := make([]byte, 32)
+		_, err = rand.Read(b)
+		if err != nil {
+			return WebhookEndpoint{}, err
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	t := time.Now().UTC()
+	ep := WebhookEndpoint{
+		ID:        uuid.NewV4(),
+		URL:       rawURL,
+		Secret:    secret,
+		Events:    EventTypes(events),
+		IsActive:  true,
+		CreatedAt: t,
+		UpdatedAt: t,
+	}
+	_, err = w.db.NamedExecContext(ctx, `INSERT INTO webhook_endpoint (id, url, secret, events, is_active, created_at, updated_at)
+	VALUES (:id, :url, :secret, :events, :is_active, :created_at, :updated_at)`, &ep)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	return ep, nil
+}
+
+// GetEndpoint gets an endpoint by its ID
+func (w *Webhooks) GetEndpoint(ctx context.Context, id uuid.UUID) (WebhookEndpoint, error) {
+	if id == uuid.Nil {
+		return WebhookEndpoint{}, ErrInvalidID
+	}
+	ep := WebhookEndpoint{}
+	err := w.db.GetContext(ctx, &ep, "SELECT * FROM webhook_endpoint WHERE id=$1", id)
+	if err == sql.ErrNoRows {
+		return WebhookEndpoint{}, ErrWebhookNotFound
+	} else if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	return ep, nil
+}
+
+// ListEndpoints lists every endpoint, oldest first
+func (w *Webhooks) ListEndpoints(ctx context.Context) ([]WebhookEndpoint, error) {
+	endpoints := []WebhookEndpoint{}
+	err := w.db.SelectContext(ctx, &endpoints, "SELECT * FROM webhook_endpoint ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// UpdateEndpoint saves the URL, secret, events and active flag of ep.
+// Deactivated endpoints are not sent new events; deliveries already queued are still attempted.
+func (w *Webhooks) UpdateEndpoint(ctx context.Context, ep WebhookEndpoint) (WebhookEndpoint, error) {
+	existing, err := w.GetEndpoint(ctx, ep.ID)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	err = checkWebhookURL(ep.URL)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	if len(ep.Secret) == 0 {
+		ep.Secret = existing.Secret
+	}
+	ep.CreatedAt = existing.CreatedAt
+	ep.UpdatedAt = time.Now().UTC()
+	_, err = w.db.NamedExecContext(ctx, "UPDATE webhook_endpoint SET url=:url, secret=:secret, events=:events, is_active=:is_active, updated_at=:updated_at WHERE id=:id", &ep)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	return ep, nil
+}
+
+// DeleteEndpoint removes an endpoint and its delivery log
+func (w *Webhooks) DeleteEndpoint(ctx context.Context, id uuid.UUID) error {
+	_, err := w.GetEndpoint(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer observeSince(MetricDBDuration, time.Now(), Labels{"operation": "transaction"})
+	tx, err := w.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM webhook_delivery WHERE endpoint_id=$1", id)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM webhook_endpoint WHERE id=$1", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkWebhookURL returns ErrInvalidURL unless rawURL is an absolute http or https URL
+func checkWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+// Deliveries lists the latest deliveries to an endpoint, newest first.
+// A limit of zero lists the latest 100.
+func (w *Webhooks) Deliveries(ctx context.Context, endpointID uuid.UUID, limit int) ([]WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	deliveries := []WebhookDelivery{}
+	err := w.db.SelectContext(ctx, &deliveries, "SELECT * FROM webhook_delivery WHERE endpoint_id=$1 ORDER BY created_at DESC LIMIT $2", endpointID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Failed lists dead deliveries, oldest first
+func (w *Webhooks) Failed(ctx context.Context) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := w.db.SelectContext(ctx, &deliveries, "SELECT * FROM webhook_delivery WHERE status=$1 ORDER BY created_at", WebhookDead)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Replay queues a new delivery of the same payload to the same endpoint, whatever the status of the original.
+// The original is kept in the log. The replay is sent even if the endpoint has since been deactivated.
+func (w *Webhooks) Replay(ctx context.Context, id uuid.UUID) (WebhookDelivery, error) {
+	if id == uuid.Nil {
+		return WebhookDelivery{}, ErrInvalidID
+	}
+	d := WebhookDelivery{}
+	err := w.db.GetContext(ctx, &d, "SELECT * FROM webhook_delivery WHERE id=$1", id)
+	if err == sql.ErrNoRows {
+		return WebhookDelivery{}, ErrDeliveryNotFound
+	} else if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return w.insertDelivery(ctx, w.db, d.EndpointID, d.UserID, d.EventType, d.Payload)
+}
+
+// Start runs the dispatcher in the background until Stop is called
+func (w *Webhooks) Start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop != nil {
+		return
+	}
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(w.PollInterval)
+		defer ticker.Stop()
+		for {
+			_, err := w.DispatchPending(context.Background())
+			if err != nil {
+				logCtx(context.Background(), LevelError, "Error dispatching webhooks", Fields{"error": err})
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(w.stop, w.done)
+}
+
+// Stop stops the dispatcher and waits for the current batch to finish
+func (w *Webhooks) Stop() {
+	w.mu.Lock()
+	stop, done := w.stop, w.done
+	w.stop, w.done = nil, nil
+	w.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// DispatchPending sends every delivery that is due and returns how many succeeded
+func (w *Webhooks) DispatchPending(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	deliveries := []WebhookDelivery{}
+	err := w.db.SelectContext(ctx, &deliveries, "SELECT * FROM webhook_delivery WHERE status=$1 AND next_attempt_at<=$2 ORDER BY next_attempt_at LIMIT $3", WebhookPending, now, w.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, d := range deliveries {
+		// leave the rest of the batch for the next run
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+		ok, err := w.claim(ctx, d, now)
+		if err != nil {
+			return sent, err
+		}
+		if !ok {
+			// another dispatcher has it
+			continue
+		}
+
+		err = w.deliver(ctx, &d)
+		if err != nil {
+			return sent, err
+		}
+		if d.Status == WebhookSent {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// claim reserves d for Lease so concurrent dispatchers don't send it twice
+func (w *Webhooks) claim(ctx context.Context, d WebhookDelivery, now time.Time) (bool, error) {
+	res, err := w.db.ExecContext(ctx, "UPDATE webhook_delivery SET next_attempt_at=$1 WHERE id=$2 AND status=$3 AND next_attempt_at=$4",
+		now.Add(w.Lease), d.ID, WebhookPending, d.NextAttemptAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// deliver sends d and records the outcome.
+// The outcome is recorded even if ctx is cancelled meanwhile so a delivered event isn't sent again.
+func (w *Webhooks) deliver(ctx context.Context, d *WebhookDelivery) error {
+	status, sendErr := w.send(ctx, d)
+
+	t := time.Now().UTC()
+	d.Attempts++
+	d.UpdatedAt = t
+	d.ResponseStatus = status
+	if sendErr == nil {
+		d.Status = WebhookSent
+		d.DeliveredAt = t
+		d.LastError = ""
+	} else {
+		d.LastError = sendErr.Error()
+		if d.Attempts >= w.MaxAttempts {
+			d.Status = WebhookDead
+			logCtx(ctx, LevelError, "Giving up delivering webhook", Fields{"delivery_id": d.ID, "endpoint_id": d.EndpointID, "attempts": d.Attempts, "error": sendErr})
+		} else {
+			d.NextAttemptAt = t.Add(w.backoff(d.Attempts))
+		}
+	}
+
+	_, err := w.db.NamedExecContext(detach(ctx), `UPDATE webhook_delivery SET status=:status, attempts=:attempts, last_error=:last_error, response_status=:response_status,
+	next_attempt_at=:next_attempt_at, updated_at=:updated_at, delivered_at=:delivered_at WHERE id=:id`, d)
+	return err
+}
+
+// send POSTs d to its endpoint and returns the response status. Any status other than 2xx is an error.
+func (w *Webhooks) send(ctx context.Context, d *WebhookDelivery) (int, error) {
+	ep, err := w.GetEndpoint(ctx, d.EndpointID)
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, "POST", ep.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(d.EventType))
+	req.Header.Set(WebhookDeliveryHeader, d.ID.String())
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(ep.Secret, timestamp, d.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay after the given number of failed attempts
+func (w *Webhooks) backoff(attempts int) time.Duration {
+	d := w.BaseDelay
+	for i := 1; i < attempts && d < w.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > w.MaxDelay {
+		d = w.MaxDelay
+	}
+	return d
+}